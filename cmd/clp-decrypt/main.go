@@ -0,0 +1,211 @@
+// Package implements clp-decrypt, which decrypts objects uploaded with client-side encryption so
+// they can be ingested by CLP.
+//
+// Usage:
+//
+//	clp-decrypt [-key-file path] [-metadata path] [-region region] [-o output] <input>
+//
+// The input is a local file, or an S3 URI ("s3://<bucket>/<key>") which is downloaded together
+// with its metadata. The metadata of a local file is read from -metadata, either a JSON object of
+// the object's metadata or the output of `aws s3api head-object`. Data keys wrapped by a key file
+// are unwrapped with -key-file; data keys wrapped by KMS are unwrapped with the AWS credentials of
+// the environment. The decrypted Zstd compressed IR is written to -o, or standard output.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/y-scope/fluent-bit-clp/internal/envelope"
+
+	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+)
+
+// Permission mode of the output file.
+const outputPermission = 0o600
+
+func main() {
+	keyFile := flag.String("key-file", "", "Key file which wrapped the data key")
+	metadataPath := flag.String("metadata", "", "JSON metadata of a local input file")
+	region := flag.String("region", "", "AWS region of the S3 bucket and KMS key")
+	outputPath := flag.String("o", "-", "Output file, - for standard output")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"Usage: %s [flags] <file or s3://bucket/key>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err := run(context.Background(), flag.Arg(0), *keyFile, *metadataPath, *region, *outputPath)
+	if err != nil {
+		log.Fatalf("clp-decrypt: %v", err)
+	}
+}
+
+// Decrypts the input and writes the plaintext to the output.
+func run(
+	ctx context.Context,
+	input string,
+	keyFile string,
+	metadataPath string,
+	region string,
+	outputPath string,
+) error {
+	ciphertext, metadata, err := openInput(ctx, input, metadataPath, region)
+	if err != nil {
+		return err
+	}
+	defer ciphertext.Close()
+
+	if !envelope.IsEncrypted(metadata) {
+		return fmt.Errorf("%s is not encrypted: metadata has no %s", input,
+			envelope.MetadataAlgorithm)
+	}
+	provider, err := keyProvider(ctx, metadata, keyFile, region)
+	if err != nil {
+		return err
+	}
+	plaintext, err := envelope.Decrypt(ctx, provider, ciphertext, metadata)
+	if err != nil {
+		return err
+	}
+
+	output := os.Stdout
+	if outputPath != "-" {
+		output, err = os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, outputPermission)
+		if err != nil {
+			return fmt.Errorf("failed to create output: %w", err)
+		}
+	}
+	_, err = io.Copy(output, plaintext)
+	if outputPath != "-" {
+		err = errors.Join(err, output.Close())
+		if err != nil {
+			// Do not leave a partially decrypted object behind.
+			_ = os.Remove(outputPath)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %s: %w", input, err)
+	}
+	return nil
+}
+
+// Opens the encrypted object and retrieves its metadata.
+func openInput(
+	ctx context.Context,
+	input string,
+	metadataPath string,
+	region string,
+) (io.ReadCloser, map[string]string, error) {
+	if location, ok := strings.CutPrefix(input, "s3://"); ok {
+		bucket, key, ok := strings.Cut(location, "/")
+		if !ok || bucket == "" || key == "" {
+			return nil, nil, fmt.Errorf("invalid S3 URI %q, expected s3://<bucket>/<key>", input)
+		}
+		return getS3Object(ctx, bucket, key, region)
+	}
+
+	if metadataPath == "" {
+		return nil, nil, errors.New("-metadata is required to decrypt a local file")
+	}
+	metadata, err := readMetadata(metadataPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	// #nosec G304 -- input is given by the user
+	file, err := os.Open(input)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open input: %w", err)
+	}
+	return file, metadata, nil
+}
+
+// Downloads an S3 object with its metadata.
+func getS3Object(
+	ctx context.Context,
+	bucket string,
+	key string,
+	region string,
+) (io.ReadCloser, map[string]string, error) {
+	var optFns []func(*awsConfig.LoadOptions) error
+	if region != "" {
+		optFns = append(optFns, awsConfig.WithRegion(region))
+	}
+	awsCfg, err := awsConfig.LoadDefaultConfig(ctx, optFns...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not load aws credentials: %w", err)
+	}
+	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		// Enable path-style addressing for S3-compatible services (MinIO, LocalStack, etc.)
+		if os.Getenv("AWS_ENDPOINT_URL") != "" {
+			o.UsePathStyle = true
+		}
+	})
+
+	result, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to download s3://%s/%s: %w", bucket, key, err)
+	}
+	return result.Body, result.Metadata, nil
+}
+
+// Reads object metadata from a JSON file holding either the metadata or the output of
+// `aws s3api head-object` (whose "Metadata" field holds the metadata).
+func readMetadata(path string) (map[string]string, error) {
+	// #nosec G304 -- path is given by the user
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+
+	var headObject struct {
+		Metadata map[string]string `json:"Metadata"`
+	}
+	if err := json.Unmarshal(contents, &headObject); err == nil && headObject.Metadata != nil {
+		return headObject.Metadata, nil
+	}
+	var metadata map[string]string
+	if err := json.Unmarshal(contents, &metadata); err != nil {
+		return nil, fmt.Errorf("metadata %s is not a JSON object of strings: %w", path, err)
+	}
+	return metadata, nil
+}
+
+// Creates the key provider which wrapped the object's data key.
+func keyProvider(
+	ctx context.Context,
+	metadata map[string]string,
+	keyFile string,
+	region string,
+) (envelope.KeyProvider, error) {
+	name, _ := envelope.KeyProviderName(metadata)
+	switch name {
+	case envelope.FileKeyProviderName:
+		if keyFile == "" {
+			return nil, errors.New("-key-file is required: the data key was wrapped by a key file")
+		}
+		return envelope.LoadFileKeyProvider(keyFile)
+	case envelope.KMSKeyProviderName:
+		return envelope.OpenKMSKeyProvider(ctx, "", region)
+	default:
+		return nil, fmt.Errorf("unsupported key provider %q", name)
+	}
+}
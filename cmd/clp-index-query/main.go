@@ -0,0 +1,123 @@
+// Package implements clp-index-query, which lists the objects that may hold matching events
+// according to their sidecar indexes, so only those need to be downloaded and searched.
+//
+// Usage:
+//
+//	clp-index-query [-value v]... [-key k]... [-start time] [-end time] <index file>...
+//
+// Index files are downloaded from the store, e.g. with
+// `aws s3 sync s3://<bucket>/<prefix> . --exclude "*" --include "*.objindex.json"`. An object is
+// listed if its index may hold every -value and -key, and its events may overlap [-start, -end].
+// Each listed object is printed as its key and the size its index was written for, separated by a
+// tab; an object of another size was replaced after its index was written and must be searched
+// regardless.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/y-scope/fluent-bit-clp/internal/objindex"
+)
+
+// Flag collecting repeated values.
+type repeatedFlag []string
+
+func (f *repeatedFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *repeatedFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// Conditions an object's events must be able to satisfy.
+type query struct {
+	values []string
+	keys   []string
+	start  time.Time
+	end    time.Time
+}
+
+func main() {
+	var q query
+	var values, keys repeatedFlag
+	flag.Var(&values, "value", "Value or dictionary variable events must hold (repeatable)")
+	flag.Var(&keys, "key", "Key path events must hold, nested keys joined with . (repeatable)")
+	start := flag.String("start", "", "Start of the time range as RFC 3339")
+	end := flag.String("end", "", "End of the time range as RFC 3339")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <index file>...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	q.values = values
+	q.keys = keys
+	if q.start, err = parseTime(*start); err != nil {
+		log.Fatalf("clp-index-query: invalid -start: %v", err)
+	}
+	if q.end, err = parseTime(*end); err != nil {
+		log.Fatalf("clp-index-query: invalid -end: %v", err)
+	}
+
+	for _, path := range flag.Args() {
+		index, err := readIndex(path)
+		if err != nil {
+			log.Fatalf("clp-index-query: %v", err)
+		}
+		if q.mayMatch(index) {
+			fmt.Printf("%s\t%d\n", index.Object, index.ObjectSize)
+		}
+	}
+}
+
+// Parses an RFC 3339 time, or returns the zero time for an empty flag.
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// Reads an index file.
+func readIndex(path string) (*objindex.Index, error) {
+	// #nosec G304 -- path is given by the user
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+	index, err := objindex.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return index, nil
+}
+
+// Tests whether an indexed object may hold events satisfying the query.
+func (q *query) mayMatch(index *objindex.Index) bool {
+	if !index.Overlaps(q.start, q.end) {
+		return false
+	}
+	for _, key := range q.keys {
+		if !index.HasKey(key) {
+			return false
+		}
+	}
+	for _, value := range q.values {
+		if !index.MayContain(value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,269 @@
+// Package serves the admin API of a plugin instance, for inspecting and flushing its streams while
+// debugging. The API has no authentication and should only listen on a loopback address.
+//
+// Endpoints:
+//   - GET /streams: Lists open streams with their buffer sizes and upload deadlines
+//   - POST /flush[?stream=<name>]: Uploads one stream, or every stream holding pending data
+//   - POST /pause, POST /resume: Pauses or resumes uploads
+//   - GET /config: Dumps the effective configuration, with secrets redacted
+
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/y-scope/fluent-bit-clp/internal/logging"
+)
+
+// Value replacing secret options in configuration dumps.
+const Redacted = "REDACTED"
+
+// Time allowed for requests in progress to finish when the server is closed.
+const shutdownTimeout = 5 * time.Second
+
+// Returned by [Target.Flush] for a stream which is not open.
+var ErrStreamNotFound = errors.New("stream not found")
+
+// Open stream of a plugin instance.
+type Stream struct {
+	// Fluent Bit tag or stream path
+	Name string `json:"name"`
+	// Key of the object being written. Empty if it is only named on upload.
+	Key string `json:"key,omitempty"`
+	// Bytes of Zstd output buffered for the stream
+	BufferBytes int64 `json:"buffer_bytes"`
+	// Bytes of the buffer already uploaded, for streams synced incrementally
+	SyncedBytes int64 `json:"synced_bytes,omitempty"`
+	// Buffer size at which the stream is uploaded. Zero if uploads are driven by timers.
+	UploadBytes int64 `json:"upload_bytes,omitempty"`
+	// Number of events written since the last upload (or since the object was opened)
+	Events int64 `json:"events"`
+	// Set if the stream holds data which was not uploaded
+	Pending bool `json:"pending"`
+	// Time the stream was last written to
+	LastWrite time.Time `json:"last_write,omitzero"`
+	// Time the hard flush timer fires. Zero if not scheduled.
+	HardDeadline time.Time `json:"hard_deadline,omitzero"`
+	// Time the soft flush timer fires. Zero if not scheduled.
+	SoftDeadline time.Time `json:"soft_deadline,omitzero"`
+	// Time a failed upload is retried. Zero if not scheduled.
+	RetryAt time.Time `json:"retry_at,omitzero"`
+}
+
+// Result of flushing a stream.
+type FlushResult struct {
+	Stream string `json:"stream"`
+	// Error uploading the stream. Empty if it succeeded.
+	Error string `json:"error,omitempty"`
+}
+
+// Plugin instance controlled by the admin API. Methods are called on the server's goroutines, so
+// implementations must synchronize with flushes.
+type Target interface {
+	// Lists open streams.
+	//
+	// Returns:
+	//   - streams: Open streams
+	Streams() []Stream
+
+	// Uploads the buffered data of streams now.
+	//
+	// Parameters:
+	//   - name: Stream to upload, or empty to upload every stream holding pending data
+	//
+	// Returns:
+	//   - results: Result of each uploaded stream
+	//   - err: ErrStreamNotFound
+	Flush(name string) ([]FlushResult, error)
+
+	// Pauses or resumes uploads. While paused, data is buffered but not uploaded, except when the
+	// plugin exits.
+	//
+	// Parameters:
+	//   - paused: Whether uploads are paused
+	SetPaused(paused bool)
+
+	// Getter for paused.
+	//
+	// Returns:
+	//   - paused: Whether uploads are paused
+	Paused() bool
+
+	// Gathers the effective configuration, with secret options replaced by [Redacted].
+	//
+	// Returns:
+	//   - config: Values by option name
+	EffectiveConfig() map[string]any
+}
+
+// HTTP server of the admin API.
+type Server struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+// Starts serving the admin API of a plugin instance.
+//
+// Parameters:
+//   - addr: Listen address, e.g. "127.0.0.1:2022"
+//   - target: Plugin instance
+//   - logger: Logger of the plugin instance
+//
+// Returns:
+//   - server: Server, to be closed when the plugin instance exits
+//   - err: Error listening
+func Serve(addr string, target Target, logger *logging.Logger) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening for admin API on %s: %w", addr, err)
+	}
+	s := &Server{
+		server: &http.Server{
+			Handler:           Handler(target, logger),
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+		listener: listener,
+	}
+
+	go func() {
+		err := s.server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorf("Admin API server on %s failed: %v", addr, err)
+		}
+	}()
+	if tcpAddr, ok := listener.Addr().(*net.TCPAddr); ok && !tcpAddr.IP.IsLoopback() {
+		logger.Warnf("Admin API on %s is reachable from other hosts and has no authentication",
+			listener.Addr())
+	}
+	logger.Infof("Serving admin API on http://%s", listener.Addr())
+	return s, nil
+}
+
+// Address the server listens on, with the port resolved if addr had port 0.
+//
+// Returns:
+//   - addr: Listen address
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Stops the server, waiting for requests in progress.
+//
+// Returns:
+//   - err: Error shutting down the server
+func (s *Server) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := s.server.Shutdown(ctx)
+	if err != nil {
+		return fmt.Errorf("error shutting down admin API server: %w", err)
+	}
+	return nil
+}
+
+// Creates the HTTP handler of the admin API.
+//
+// Parameters:
+//   - target: Plugin instance
+//   - logger: Logger of the plugin instance
+//
+// Returns:
+//   - handler: HTTP handler
+func Handler(target Target, logger *logging.Logger) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /streams", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{
+			"paused":  target.Paused(),
+			"streams": target.Streams(),
+		}, logger)
+	})
+	mux.HandleFunc("POST /flush", func(w http.ResponseWriter, r *http.Request) {
+		handleFlush(w, r, target, logger)
+	})
+	mux.HandleFunc("POST /pause", func(w http.ResponseWriter, _ *http.Request) {
+		target.SetPaused(true)
+		logger.Infof("Uploads paused through admin API")
+		writeJSON(w, http.StatusOK, map[string]any{"paused": true}, logger)
+	})
+	mux.HandleFunc("POST /resume", func(w http.ResponseWriter, _ *http.Request) {
+		target.SetPaused(false)
+		logger.Infof("Uploads resumed through admin API")
+		writeJSON(w, http.StatusOK, map[string]any{"paused": false}, logger)
+	})
+	mux.HandleFunc("GET /config", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, target.EffectiveConfig(), logger)
+	})
+	return mux
+}
+
+// Handles POST /flush. Responds with 409 while uploads are paused, 404 for a stream which is not
+// open, and 502 if any upload failed.
+//
+// Parameters:
+//   - w: Response
+//   - r: Request
+//   - target: Plugin instance
+//   - logger: Logger of the plugin instance
+func handleFlush(w http.ResponseWriter, r *http.Request, target Target, logger *logging.Logger) {
+	if target.Paused() {
+		writeError(w, http.StatusConflict, errors.New("uploads are paused"), logger)
+		return
+	}
+
+	name := r.URL.Query().Get("stream")
+	results, err := target.Flush(name)
+	if errors.Is(err, ErrStreamNotFound) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("stream %q: %w", name, err), logger)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err, logger)
+		return
+	}
+	if results == nil {
+		results = []FlushResult{}
+	}
+
+	status := http.StatusOK
+	for _, result := range results {
+		if result.Error != "" {
+			status = http.StatusBadGateway
+		}
+	}
+	logger.Infof("Flushed %d streams through admin API", len(results))
+	writeJSON(w, status, map[string]any{"results": results}, logger)
+}
+
+// Writes a JSON response.
+//
+// Parameters:
+//   - w: Response
+//   - status: HTTP status code
+//   - body: Value encoded as the response body
+//   - logger: Logger of the plugin instance
+func writeJSON(w http.ResponseWriter, status int, body any, logger *logging.Logger) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(body)
+	if err != nil {
+		logger.Warnf("Failed to write admin API response: %v", err)
+	}
+}
+
+// Writes an error response as a JSON object with an "error" field.
+//
+// Parameters:
+//   - w: Response
+//   - status: HTTP status code
+//   - err: Error
+//   - logger: Logger of the plugin instance
+func writeError(w http.ResponseWriter, status int, err error, logger *logging.Logger) {
+	writeJSON(w, status, map[string]string{"error": err.Error()}, logger)
+}
@@ -0,0 +1,113 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Target with two streams, the second of which fails to upload.
+type fakeTarget struct {
+	paused  bool
+	flushed []string
+}
+
+func (f *fakeTarget) Streams() []Stream {
+	return []Stream{{Name: "app", BufferBytes: 10, Pending: true}, {Name: "broken"}}
+}
+
+func (f *fakeTarget) Flush(name string) ([]FlushResult, error) {
+	names := []string{"app", "broken"}
+	if name != "" {
+		if name != "app" && name != "broken" {
+			return nil, ErrStreamNotFound
+		}
+		names = []string{name}
+	}
+	var results []FlushResult
+	for _, n := range names {
+		f.flushed = append(f.flushed, n)
+		result := FlushResult{Stream: n}
+		if n == "broken" {
+			result.Error = errors.New("upload failed").Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (f *fakeTarget) SetPaused(paused bool) { f.paused = paused }
+
+func (f *fakeTarget) Paused() bool { return f.paused }
+
+func (f *fakeTarget) EffectiveConfig() map[string]any {
+	return map[string]any{"id": "a", "secret": Redacted}
+}
+
+func TestHandler(t *testing.T) {
+	target := &fakeTarget{}
+	handler := Handler(target, nil)
+	do := func(method, target string) (int, map[string]any) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+		var body map[string]any
+		if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s %s returned invalid JSON %q: %v", method, target, recorder.Body, err)
+		}
+		return recorder.Code, body
+	}
+
+	code, body := do(http.MethodGet, "/streams")
+	streams, _ := body["streams"].([]any)
+	if code != http.StatusOK || len(streams) != 2 || body["paused"] != false {
+		t.Errorf("GET /streams = %d %v, want 200 with 2 streams", code, body)
+	}
+
+	code, _ = do(http.MethodPost, "/flush?stream=app")
+	if code != http.StatusOK || !reflect.DeepEqual(target.flushed, []string{"app"}) {
+		t.Errorf("POST /flush?stream=app = %d, flushed %v, want 200 and [app]",
+			code, target.flushed)
+	}
+	code, body = do(http.MethodPost, "/flush")
+	if code != http.StatusBadGateway || !strings.Contains(toJSON(body), "upload failed") {
+		t.Errorf("POST /flush = %d %v, want 502 with the upload error", code, body)
+	}
+	if code, _ = do(http.MethodPost, "/flush?stream=missing"); code != http.StatusNotFound {
+		t.Errorf("POST /flush?stream=missing = %d, want 404", code)
+	}
+
+	do(http.MethodPost, "/pause")
+	if !target.paused {
+		t.Error("POST /pause did not pause uploads")
+	}
+	target.flushed = nil
+	code, _ = do(http.MethodPost, "/flush")
+	if code != http.StatusConflict || target.flushed != nil {
+		t.Errorf("POST /flush while paused = %d, flushed %v, want 409", code, target.flushed)
+	}
+	do(http.MethodPost, "/resume")
+	if target.paused {
+		t.Error("POST /resume did not resume uploads")
+	}
+
+	code, body = do(http.MethodGet, "/config")
+	if code != http.StatusOK || body["secret"] != Redacted {
+		t.Errorf("GET /config = %d %v, want 200 with redacted secret", code, body)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/flush", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /flush = %d, want 405", recorder.Code)
+	}
+}
+
+func toJSON(value any) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
@@ -60,6 +60,11 @@ func New(data unsafe.Pointer, length int) *codec.Decoder {
 	mh.WriteExt = true
 	mh.ErrorIfNoArrayExpand = true
 
+	// Decode maps nested in records and metadata as map[string]any instead of
+	// map[interface{}]interface{}, which cannot be marshalled to JSON. Records with nested maps
+	// failed to marshal before, so no caller depends on the old type.
+	mh.MapType = reflect.TypeOf(map[string]any(nil))
+
 	// Set up custom extension for Fluent Bit timestamp format.
 	mh.SetBytesExt(reflect.TypeOf(FlbTime{}), 0, &FlbTime{})
 
@@ -114,19 +119,28 @@ const recordIndex = 1
 // minMetadataLen is the minimum length for V2 metadata format [[TIMESTAMP, METADATA], MESSAGE].
 const minMetadataLen = 2
 
+// metadataIndex is the index of the metadata in the V2 [TIMESTAMP, METADATA] array.
+const metadataIndex = 1
+
+// MetadataKey is the auto-generated kv-pair key under which plugins encode event metadata.
+const MetadataKey = "metadata"
+
 // errDecodingTimestamp is a format string for timestamp decoding errors.
 const errDecodingTimestamp = "error decoding timestamp %v from stream"
 
-// Retrieves data and timestamp from Msgpack object.
+// Retrieves data, timestamp and metadata from Msgpack object. Metadata is only present in the
+// Fluent Bit V2 event format. It holds fields attached outside the record body, such as
+// OpenTelemetry resource and scope attributes or fields added by processors.
 //
 // Parameters:
 //   - decoder: Msgpack decoder
 //
 // Returns:
 //   - timestamp: Timestamp retrieved from Fluent Bit
+//   - metadata: Event metadata, nil if absent or empty
 //   - record: JSON record from Fluent Bit with variable amount of keys
-//   - err: decode error, error retrieving timestamp, error marshalling record
-func GetRecord(decoder *codec.Decoder) (any, []byte, error) {
+//   - err: decode error, error retrieving timestamp or metadata, error marshalling record
+func GetRecord(decoder *codec.Decoder) (any, map[string]any, []byte, error) {
 	// Expect array of length 2 for timestamp and data. Also initialize expected types for
 	// timestamp and record
 	m := [msgpackArrayLen]any{nil, make(map[string]any)}
@@ -135,12 +149,13 @@ func GetRecord(decoder *codec.Decoder) (any, []byte, error) {
 	if err != nil {
 		// io.EOF errors signify chunk is empty. They should be caught and trigger end of decoding.
 		// Other decoding errors are not expected in normal operation of plugin.
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	// Timestamp is located in first index.
 	t := m[timestampIndex]
 	var timestamp any
+	var metadata map[string]any
 
 	// Fluent Bit can provide timestamp in multiple formats, so we use type switch to process
 	// correctly.
@@ -154,12 +169,21 @@ func GetRecord(decoder *codec.Decoder) (any, []byte, error) {
 	case []any:
 		if len(v) < minMetadataLen {
 			err = fmt.Errorf(errDecodingTimestamp, v)
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 		timestamp = v[0]
+		// Fluent Bit encodes an empty map when no metadata is attached.
+		md, ok := v[metadataIndex].(map[string]any)
+		if !ok && v[metadataIndex] != nil {
+			err = fmt.Errorf("error decoding metadata %v from stream", v[metadataIndex])
+			return nil, nil, nil, err
+		}
+		if len(md) > 0 {
+			metadata = md
+		}
 	default:
 		err = fmt.Errorf(errDecodingTimestamp, v)
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	// Record is located in second index.
@@ -169,8 +193,8 @@ func GetRecord(decoder *codec.Decoder) (any, []byte, error) {
 	jsonRecord, err := json.Marshal(record)
 	if err != nil {
 		err = fmt.Errorf("failed to marshal record %v: %w", record, err)
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
-	return timestamp, jsonRecord, nil
+	return timestamp, metadata, jsonRecord, nil
 }
@@ -0,0 +1,201 @@
+package decoder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/ugorji/go/codec"
+)
+
+var testTime = time.Unix(1700000000, 123456789)
+
+// eventWriter builds Msgpack chunks the way Fluent Bit encodes them.
+type eventWriter struct {
+	buf     bytes.Buffer
+	encoder *codec.Encoder
+}
+
+func newEventWriter() *eventWriter {
+	w := &eventWriter{}
+	var mh codec.MsgpackHandle
+	mh.WriteExt = true
+	w.encoder = codec.NewEncoder(&w.buf, &mh)
+	return w
+}
+
+// arrayHeader writes the header of a fixarray with n elements.
+func (w *eventWriter) arrayHeader(n int) {
+	w.buf.WriteByte(0x90 | byte(n))
+}
+
+// timestamp writes a Fluent Bit timestamp in fixext 8 format with extension type 0.
+func (w *eventWriter) timestamp(ts time.Time) {
+	w.buf.Write([]byte{0xd7, 0x00})
+	var b [8]byte
+	binary.BigEndian.PutUint32(b[:4], uint32(ts.Unix()))
+	binary.BigEndian.PutUint32(b[4:], uint32(ts.Nanosecond()))
+	w.buf.Write(b[:])
+}
+
+func (w *eventWriter) value(t *testing.T, v any) {
+	t.Helper()
+	if err := w.encoder.Encode(v); err != nil {
+		t.Fatalf("Failed to encode %v: %v", v, err)
+	}
+}
+
+// legacyEvent writes an event in the [TIMESTAMP, MESSAGE] format.
+func (w *eventWriter) legacyEvent(t *testing.T, record map[string]any) {
+	w.arrayHeader(2)
+	w.timestamp(testTime)
+	w.value(t, record)
+}
+
+// metadataEvent writes an event in the Fluent Bit V2 [[TIMESTAMP, METADATA], MESSAGE] format.
+func (w *eventWriter) metadataEvent(t *testing.T, metadata, record map[string]any) {
+	w.arrayHeader(2)
+	w.arrayHeader(2)
+	w.timestamp(testTime)
+	w.value(t, metadata)
+	w.value(t, record)
+}
+
+func (w *eventWriter) decoder() *codec.Decoder {
+	data := w.buf.Bytes()
+	return New(unsafe.Pointer(&data[0]), len(data))
+}
+
+func TestGetRecord_EventFormats(t *testing.T) {
+	record := map[string]any{
+		"log": "started",
+		"kubernetes": map[string]any{
+			"labels": map[string]any{"app": "server"},
+		},
+	}
+	wantRecord := `{"kubernetes":{"labels":{"app":"server"}},"log":"started"}`
+
+	tests := []struct {
+		name         string
+		write        func(*eventWriter)
+		wantMetadata map[string]any
+	}{
+		{
+			"legacy",
+			func(w *eventWriter) { w.legacyEvent(t, record) },
+			nil,
+		},
+		{
+			"metadata",
+			func(w *eventWriter) {
+				w.metadataEvent(t, map[string]any{
+					"otlp": map[string]any{
+						"resource": map[string]any{"service.name": "api"},
+					},
+				}, record)
+			},
+			map[string]any{
+				"otlp": map[string]any{
+					"resource": map[string]any{"service.name": "api"},
+				},
+			},
+		},
+		{
+			"empty metadata",
+			func(w *eventWriter) { w.metadataEvent(t, map[string]any{}, record) },
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newEventWriter()
+			tt.write(w)
+
+			timestamp, metadata, jsonRecord, err := GetRecord(w.decoder())
+			if err != nil {
+				t.Fatalf("GetRecord() error = %v", err)
+			}
+			ts, ok := timestamp.(FlbTime)
+			if !ok || !ts.Equal(testTime) {
+				t.Errorf("timestamp = %v, want %v", timestamp, testTime)
+			}
+			if !reflect.DeepEqual(metadata, tt.wantMetadata) {
+				t.Errorf("metadata = %#v, want %#v", metadata, tt.wantMetadata)
+			}
+			if string(jsonRecord) != wantRecord {
+				t.Errorf("record = %s, want %s", jsonRecord, wantRecord)
+			}
+		})
+	}
+}
+
+func TestGetRecord_MixedChunk(t *testing.T) {
+	w := newEventWriter()
+	w.legacyEvent(t, map[string]any{"n": 0})
+	w.metadataEvent(t, map[string]any{"k": "v"}, map[string]any{"n": 1})
+	decoder := w.decoder()
+
+	for i, want := range []string{`{"n":0}`, `{"n":1}`} {
+		_, _, jsonRecord, err := GetRecord(decoder)
+		if err != nil {
+			t.Fatalf("GetRecord() of event %d error = %v", i, err)
+		}
+		if string(jsonRecord) != want {
+			t.Errorf("record %d = %s, want %s", i, jsonRecord, want)
+		}
+	}
+	if _, _, _, err := GetRecord(decoder); !errors.Is(err, io.EOF) {
+		t.Errorf("GetRecord() at end of chunk error = %v, want io.EOF", err)
+	}
+}
+
+func TestGetRecord_InvalidHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(*eventWriter)
+	}{
+		{
+			"short header",
+			func(w *eventWriter) {
+				w.arrayHeader(2)
+				w.arrayHeader(1)
+				w.timestamp(testTime)
+				w.value(t, map[string]any{})
+			},
+		},
+		{
+			"metadata not a map",
+			func(w *eventWriter) {
+				w.arrayHeader(2)
+				w.arrayHeader(2)
+				w.timestamp(testTime)
+				w.value(t, "metadata")
+				w.value(t, map[string]any{})
+			},
+		},
+		{
+			"string timestamp",
+			func(w *eventWriter) {
+				w.arrayHeader(2)
+				w.value(t, "now")
+				w.value(t, map[string]any{})
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newEventWriter()
+			tt.write(w)
+			if _, _, _, err := GetRecord(w.decoder()); err == nil {
+				t.Error("GetRecord() error = nil, want error")
+			}
+		})
+	}
+}
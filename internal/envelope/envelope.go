@@ -0,0 +1,415 @@
+// Package implements client-side envelope encryption of objects. Each object is encrypted with its
+// own AES-256 data key. The data key is wrapped by a [KeyProvider] and stored, with the nonce, in
+// the object's metadata, so only holders of the provider's key can read the object.
+//
+// Objects are split into segments which are sealed with AES-256-GCM one at a time, so objects of
+// any size are encrypted and decrypted as streams. Each segment's nonce is derived from the
+// object's nonce and the segment's index, and the last segment is marked in its additional data.
+// Reordered, dropped or truncated segments therefore fail authentication.
+
+package envelope
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Name of the encryption scheme, stored in [MetadataAlgorithm].
+const Algorithm = "AES256-GCM-SEGMENTED-v1"
+
+// Object metadata written by [Encryptor.Encrypt]. Keys are matched case-insensitively when
+// decrypting since some stores (e.g. S3) lowercase metadata keys.
+const (
+	MetadataAlgorithm   = "clpEncryption"
+	MetadataKeyProvider = "clpKeyProvider"
+	MetadataKeyId       = "clpKeyId"
+	MetadataWrappedKey  = "clpWrappedKey"
+	MetadataNonce       = "clpNonce"
+	MetadataSegmentSize = "clpSegmentSize"
+)
+
+// Encryption parameters.
+const (
+	// Length in bytes of data keys (AES-256).
+	dataKeySize = 32
+	// Length in bytes of GCM nonces.
+	nonceSize = 12
+	// Length in bytes of the GCM tag appended to each segment.
+	tagSize = 16
+	// Plaintext bytes per segment.
+	defaultSegmentSize = 64 * 1024
+	// Largest segment size accepted when decrypting, bounding memory use.
+	maxSegmentSize = 16 * 1024 * 1024
+)
+
+// Additional data marking whether a segment is the last of an object.
+var (
+	segmentAdditionalData = []byte{0}
+	finalAdditionalData   = []byte{1}
+)
+
+// Encrypts objects with data keys from a [KeyProvider].
+type Encryptor struct {
+	provider    KeyProvider
+	segmentSize int
+}
+
+// Creates an encryptor wrapping data keys with provider.
+//
+// Parameters:
+//   - provider: Provider generating and wrapping data keys
+//
+// Returns:
+//   - encryptor: Encryptor
+func NewEncryptor(provider KeyProvider) *Encryptor {
+	return &Encryptor{provider: provider, segmentSize: defaultSegmentSize}
+}
+
+// Encrypts an object with a new data key. The object is encrypted as it is read from the returned
+// reader. If plaintext is an [io.Seeker], the reader can be rewound with Seek(0, io.SeekStart),
+// e.g. to compute a checksum of the ciphertext before uploading it. Rewinding reproduces the same
+// ciphertext. Other seeks fail.
+//
+// Parameters:
+//   - ctx: Context of requests to the key provider
+//   - plaintext: Object contents
+//   - size: Length of plaintext in bytes
+//
+// Returns:
+//   - ciphertext: Reader of the encrypted object
+//   - ciphertextSize: Length of ciphertext in bytes
+//   - metadata: Object metadata required to decrypt the object
+//   - err: Error generating data key, error creating cipher
+func (e *Encryptor) Encrypt(
+	ctx context.Context,
+	plaintext io.Reader,
+	size int64,
+) (io.ReadSeeker, int64, map[string]string, error) {
+	if size < 0 {
+		return nil, 0, nil, errors.New("size of the object must be known to encrypt it")
+	}
+
+	dataKey, err := e.provider.GenerateDataKey(ctx)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	aead, err := newGCM(dataKey.Plaintext)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, 0, nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	metadata := map[string]string{
+		MetadataAlgorithm:   Algorithm,
+		MetadataKeyProvider: e.provider.Name(),
+		MetadataKeyId:       dataKey.KeyId,
+		MetadataWrappedKey:  base64.StdEncoding.EncodeToString(dataKey.Wrapped),
+		MetadataNonce:       base64.StdEncoding.EncodeToString(nonce),
+		MetadataSegmentSize: strconv.Itoa(e.segmentSize),
+	}
+	ciphertext := &encryptReader{
+		aead:      aead,
+		nonce:     nonce,
+		source:    plaintext,
+		size:      size,
+		remaining: size,
+		plaintext: make([]byte, e.segmentSize),
+		sealed:    make([]byte, 0, e.segmentSize+tagSize),
+	}
+	return ciphertext, EncryptedSize(size, e.segmentSize), metadata, nil
+}
+
+// Computes the length of an encrypted object.
+//
+// Parameters:
+//   - size: Length of the plaintext in bytes
+//   - segmentSize: Plaintext bytes per segment
+//
+// Returns:
+//   - ciphertextSize: Length of the ciphertext in bytes
+func EncryptedSize(size int64, segmentSize int) int64 {
+	segments := max(1, (size+int64(segmentSize)-1)/int64(segmentSize))
+	return size + segments*tagSize
+}
+
+// Reports whether an object's metadata marks it as encrypted by [Encryptor.Encrypt].
+func IsEncrypted(metadata map[string]string) bool {
+	_, ok := lookup(metadata, MetadataAlgorithm)
+	return ok
+}
+
+// Returns the name of the key provider which wrapped an object's data key, e.g. "file" or "kms".
+// Returns false if the metadata does not name a key provider.
+func KeyProviderName(metadata map[string]string) (string, bool) {
+	return lookup(metadata, MetadataKeyProvider)
+}
+
+// Decrypts an object encrypted by [Encryptor.Encrypt]. The object is decrypted as it is read from
+// the returned reader, which fails if the object was modified or truncated. Data read before such
+// a failure is authentic.
+//
+// Parameters:
+//   - ctx: Context of requests to the key provider
+//   - provider: Provider which wrapped the object's data key
+//   - ciphertext: Encrypted object
+//   - metadata: Metadata of the encrypted object
+//
+// Returns:
+//   - plaintext: Reader of the decrypted object
+//   - err: Missing or invalid metadata, error unwrapping data key, error creating cipher
+func Decrypt(
+	ctx context.Context,
+	provider KeyProvider,
+	ciphertext io.Reader,
+	metadata map[string]string,
+) (io.Reader, error) {
+	values := make(map[string]string)
+	for _, key := range []string{
+		MetadataAlgorithm,
+		MetadataKeyProvider,
+		MetadataKeyId,
+		MetadataWrappedKey,
+		MetadataNonce,
+		MetadataSegmentSize,
+	} {
+		value, ok := lookup(metadata, key)
+		if !ok {
+			return nil, fmt.Errorf("object metadata is missing %s", key)
+		}
+		values[key] = value
+	}
+
+	if values[MetadataAlgorithm] != Algorithm {
+		return nil, fmt.Errorf("unsupported encryption %q", values[MetadataAlgorithm])
+	}
+	if values[MetadataKeyProvider] != provider.Name() {
+		return nil, fmt.Errorf("data key was wrapped by key provider %q, not %q",
+			values[MetadataKeyProvider], provider.Name())
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(values[MetadataWrappedKey])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", MetadataWrappedKey, err)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(values[MetadataNonce])
+	if err != nil || len(nonce) != nonceSize {
+		return nil, fmt.Errorf("invalid %s %q", MetadataNonce, values[MetadataNonce])
+	}
+	segmentSize, err := strconv.Atoi(values[MetadataSegmentSize])
+	if err != nil || segmentSize <= 0 || segmentSize > maxSegmentSize {
+		return nil, fmt.Errorf("invalid %s %q", MetadataSegmentSize, values[MetadataSegmentSize])
+	}
+
+	dataKey, err := provider.DecryptDataKey(ctx, wrapped, values[MetadataKeyId])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key: %w", err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := &decryptReader{
+		aead:   aead,
+		nonce:  nonce,
+		source: bufio.NewReader(ciphertext),
+		sealed: make([]byte, segmentSize+tagSize),
+	}
+	return plaintext, nil
+}
+
+// Reader sealing the segments of a plaintext as they are read.
+type encryptReader struct {
+	aead   cipher.AEAD
+	nonce  []byte
+	source io.Reader
+	// Length of the plaintext.
+	size      int64
+	remaining int64
+	index     uint64
+	// Buffer holding the plaintext of the current segment.
+	plaintext []byte
+	// Buffer holding the sealed current segment.
+	sealed []byte
+	// Sealed bytes not read yet.
+	pending []byte
+	done    bool
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.sealSegment(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// Rewinds the reader to the start of the ciphertext. Only seeking to the start is supported, and
+// only if the plaintext is an [io.Seeker].
+func (r *encryptReader) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := r.source.(io.Seeker)
+	if !ok {
+		return 0, errors.New("plaintext does not support seeking")
+	}
+	if offset != 0 || whence != io.SeekStart {
+		return 0, errors.New("ciphertext can only be rewound to its start")
+	}
+	if _, err := seeker.Seek(-(r.size - r.remaining), io.SeekCurrent); err != nil {
+		return 0, fmt.Errorf("failed to rewind plaintext: %w", err)
+	}
+	r.remaining = r.size
+	r.index = 0
+	r.pending = nil
+	r.done = false
+	return 0, nil
+}
+
+// Reads and seals the next segment. An empty plaintext is sealed as a single empty segment.
+func (r *encryptReader) sealSegment() error {
+	plaintext := r.plaintext[:min(r.remaining, int64(len(r.plaintext)))]
+	if _, err := io.ReadFull(r.source, plaintext); err != nil {
+		return fmt.Errorf("failed to read segment %d of plaintext: %w", r.index, err)
+	}
+	r.remaining -= int64(len(plaintext))
+	r.done = r.remaining == 0
+
+	r.pending = r.aead.Seal(
+		r.sealed[:0],
+		segmentNonce(r.nonce, r.index),
+		plaintext,
+		additionalData(r.done),
+	)
+	r.index++
+	return nil
+}
+
+// Reader opening the segments of a ciphertext as they are read.
+type decryptReader struct {
+	aead   cipher.AEAD
+	nonce  []byte
+	source *bufio.Reader
+	index  uint64
+	// Buffer holding the current segment, opened in place.
+	sealed []byte
+	// Opened bytes not read yet.
+	pending []byte
+	done    bool
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.openSegment(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// Reads and opens the next segment. A segment shorter than the segment size, or followed by the
+// end of the ciphertext, is the last one.
+func (r *decryptReader) openSegment() error {
+	n, err := io.ReadFull(r.source, r.sealed)
+	final := false
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		final = true
+	case err != nil:
+		return fmt.Errorf("failed to read segment %d of ciphertext: %w", r.index, err)
+	default:
+		_, err := r.source.Peek(1)
+		if errors.Is(err, io.EOF) {
+			final = true
+		} else if err != nil {
+			return fmt.Errorf("failed to read segment %d of ciphertext: %w", r.index+1, err)
+		}
+	}
+	if n < tagSize {
+		return fmt.Errorf("ciphertext is truncated at segment %d", r.index)
+	}
+
+	plaintext, err := r.aead.Open(
+		r.sealed[:0],
+		segmentNonce(r.nonce, r.index),
+		r.sealed[:n],
+		additionalData(final),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to authenticate segment %d: %w", r.index, err)
+	}
+	r.pending = plaintext
+	r.done = final
+	r.index++
+	return nil
+}
+
+// Creates an AES-256-GCM cipher.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != dataKeySize {
+		return nil, fmt.Errorf("data key has %d bytes, expected %d", len(key), dataKeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return aead, nil
+}
+
+// Derives the nonce of a segment by XORing its index into the last 8 bytes of the object's nonce.
+func segmentNonce(nonce []byte, index uint64) []byte {
+	segment := slices.Clone(nonce)
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], index)
+	for i, b := range counter {
+		segment[nonceSize-len(counter)+i] ^= b
+	}
+	return segment
+}
+
+// Returns the additional data of a segment.
+func additionalData(final bool) []byte {
+	if final {
+		return finalAdditionalData
+	}
+	return segmentAdditionalData
+}
+
+// Retrieves a metadata value, matching the key case-insensitively.
+func lookup(metadata map[string]string, key string) (string, bool) {
+	if value, ok := metadata[key]; ok {
+		return value, true
+	}
+	for k, v := range metadata {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,205 @@
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Segment size used by tests so objects span several segments without being large.
+const testSegmentSize = 16
+
+func newTestProvider(t *testing.T) *FileKeyProvider {
+	t.Helper()
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	provider, err := NewFileKeyProvider(key)
+	if err != nil {
+		t.Fatalf("NewFileKeyProvider() error = %v", err)
+	}
+	return provider
+}
+
+// encrypt encrypts plaintext with test segments, returning the ciphertext and its metadata.
+func encrypt(t *testing.T, provider KeyProvider, plaintext []byte) ([]byte, map[string]string) {
+	t.Helper()
+	encryptor := NewEncryptor(provider)
+	encryptor.segmentSize = testSegmentSize
+
+	reader, size, metadata, err := encryptor.Encrypt(
+		context.Background(),
+		bytes.NewReader(plaintext),
+		int64(len(plaintext)),
+	)
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+	ciphertext, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to read ciphertext: %v", err)
+	}
+	if int64(len(ciphertext)) != size {
+		t.Errorf("Encrypt() size = %d, want %d bytes read", size, len(ciphertext))
+	}
+	return ciphertext, metadata
+}
+
+func decrypt(provider KeyProvider, ciphertext []byte, metadata map[string]string) ([]byte, error) {
+	reader, err := Decrypt(context.Background(), provider, bytes.NewReader(ciphertext), metadata)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+func TestEncryptor_RoundTrip(t *testing.T) {
+	provider := newTestProvider(t)
+	sizes := []int{0, 1, testSegmentSize - 1, testSegmentSize, testSegmentSize + 1, 100}
+	for _, size := range sizes {
+		plaintext := bytes.Repeat([]byte{'x'}, size)
+		ciphertext, metadata := encrypt(t, provider, plaintext)
+
+		if !IsEncrypted(metadata) {
+			t.Errorf("size %d: IsEncrypted() = false, want true", size)
+		}
+		got, err := decrypt(provider, ciphertext, metadata)
+		if err != nil {
+			t.Errorf("size %d: Decrypt() error = %v", size, err)
+			continue
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("size %d: Decrypt() = %q, want %q", size, got, plaintext)
+		}
+	}
+}
+
+func TestEncryptor_Rewind(t *testing.T) {
+	encryptor := NewEncryptor(newTestProvider(t))
+	encryptor.segmentSize = testSegmentSize
+	plaintext := bytes.Repeat([]byte("0123456789"), 5)
+
+	reader, _, _, err := encryptor.Encrypt(
+		context.Background(),
+		bytes.NewReader(plaintext),
+		int64(len(plaintext)),
+	)
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+	first, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to read ciphertext: %v", err)
+	}
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek() error = %v", err)
+	}
+	second, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(first, second) {
+		t.Errorf("ReadAll() after Seek() = %x, %v, want %x", second, err, first)
+	}
+	if _, err := reader.Seek(1, io.SeekStart); err == nil {
+		t.Error("Seek(1) error = nil, want error")
+	}
+}
+
+func TestDecrypt_LowercaseMetadata(t *testing.T) {
+	provider := newTestProvider(t)
+	plaintext := []byte("hello world")
+	ciphertext, metadata := encrypt(t, provider, plaintext)
+
+	// S3 returns metadata keys lowercased
+	lowercase := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		lowercase[strings.ToLower(k)] = v
+	}
+	got, err := decrypt(provider, ciphertext, lowercase)
+	if err != nil || !bytes.Equal(got, plaintext) {
+		t.Errorf("Decrypt() = %q, %v, want %q", got, err, plaintext)
+	}
+}
+
+func TestDecrypt_Tampered(t *testing.T) {
+	provider := newTestProvider(t)
+	plaintext := bytes.Repeat([]byte("0123456789"), 5)
+	ciphertext, metadata := encrypt(t, provider, plaintext)
+	segment := testSegmentSize + tagSize
+
+	flipped := bytes.Clone(ciphertext)
+	flipped[3] ^= 1
+	swapped := bytes.Clone(ciphertext)
+	copy(swapped[:segment], ciphertext[segment:2*segment])
+	copy(swapped[segment:2*segment], ciphertext[:segment])
+	wrongNonce := maps.Clone(metadata)
+	wrongNonce[MetadataNonce] = "AAAAAAAAAAAAAAAA"
+
+	tests := []struct {
+		name       string
+		ciphertext []byte
+		metadata   map[string]string
+	}{
+		{"flipped bit", flipped, metadata},
+		{"swapped segments", swapped, metadata},
+		{"truncated at segment boundary", ciphertext[:2*segment], metadata},
+		{"truncated within segment", ciphertext[:len(ciphertext)-1], metadata},
+		{"empty", nil, metadata},
+		{"wrong nonce", ciphertext, wrongNonce},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decrypt(provider, tt.ciphertext, tt.metadata); err == nil {
+				t.Error("Decrypt() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestDecrypt_WrongKey(t *testing.T) {
+	ciphertext, metadata := encrypt(t, newTestProvider(t), []byte("secret"))
+	if _, err := decrypt(newTestProvider(t), ciphertext, metadata); err == nil {
+		t.Error("Decrypt() with another key error = nil, want error")
+	}
+
+	delete(metadata, MetadataWrappedKey)
+	if _, err := decrypt(newTestProvider(t), ciphertext, metadata); err == nil {
+		t.Error("Decrypt() without wrapped key error = nil, want error")
+	}
+}
+
+func TestLoadFileKeyProvider(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, dataKeySize)
+	dir := t.TempDir()
+
+	tests := []struct {
+		name     string
+		contents string
+		wantErr  bool
+	}{
+		{"raw", string(key), false},
+		{"base64", "BwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwcHBwc=\n", false},
+		{"short", "BwcHBw==", true},
+		{"not base64", "not a key", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(path, []byte(tt.contents), 0o600); err != nil {
+				t.Fatalf("Failed to write key file: %v", err)
+			}
+			provider, err := LoadFileKeyProvider(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadFileKeyProvider() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !bytes.Equal(provider.key, key) {
+				t.Errorf("LoadFileKeyProvider() key = %v, want %v", provider.key, key)
+			}
+		})
+	}
+}
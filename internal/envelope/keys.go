@@ -0,0 +1,165 @@
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// Name of [FileKeyProvider], stored in [MetadataKeyProvider].
+const FileKeyProviderName = "file"
+
+// Number of bytes of the key's SHA-256 digest identifying a [FileKeyProvider] key.
+const fileKeyIdSize = 8
+
+// Data key generated for a single object.
+type DataKey struct {
+	// Key encrypting the object. Must not be stored.
+	Plaintext []byte
+	// Key encrypted by the provider's key, stored in the object's metadata.
+	Wrapped []byte
+	// Identifies the provider's key which wrapped the data key.
+	KeyId string
+}
+
+// Generates data keys and wraps them with a key the provider holds, e.g. a local key file or a key
+// in a key management service.
+type KeyProvider interface {
+	// Returns the name of the provider, stored in object metadata.
+	Name() string
+
+	// Generates a new AES-256 data key.
+	//
+	// Parameters:
+	//   - ctx: Context of requests to the provider
+	//
+	// Returns:
+	//   - dataKey: Plaintext and wrapped data key
+	//   - err
+	GenerateDataKey(ctx context.Context) (DataKey, error)
+
+	// Unwraps a data key generated by GenerateDataKey.
+	//
+	// Parameters:
+	//   - ctx: Context of requests to the provider
+	//   - wrapped: Wrapped data key
+	//   - keyId: Identifier of the key which wrapped the data key
+	//
+	// Returns:
+	//   - plaintext: Data key
+	//   - err
+	DecryptDataKey(ctx context.Context, wrapped []byte, keyId string) ([]byte, error)
+}
+
+// [KeyProvider] wrapping data keys with AES-256-GCM under a local 256-bit key.
+type FileKeyProvider struct {
+	key   []byte
+	keyId string
+}
+
+// Loads the key of a [FileKeyProvider] from a file. The file holds the key either base64 encoded
+// (e.g. generated with `openssl rand -base64 32`) or as 32 raw bytes.
+//
+// Parameters:
+//   - path: Path to the key file
+//
+// Returns:
+//   - provider: File key provider
+//   - err: Error reading file, invalid key
+func LoadFileKeyProvider(path string) (*FileKeyProvider, error) {
+	// #nosec G304 -- path is configured by the user
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	key := contents
+	if len(contents) != dataKeySize {
+		key, err = base64.StdEncoding.DecodeString(string(bytes.TrimSpace(contents)))
+		if err != nil {
+			return nil, fmt.Errorf("key file %s is neither 32 bytes nor base64: %w", path, err)
+		}
+	}
+	return NewFileKeyProvider(key)
+}
+
+// Creates a [FileKeyProvider].
+//
+// Parameters:
+//   - key: 256-bit key wrapping data keys
+//
+// Returns:
+//   - provider: File key provider
+//   - err: Key is not 256 bits
+func NewFileKeyProvider(key []byte) (*FileKeyProvider, error) {
+	if len(key) != dataKeySize {
+		return nil, fmt.Errorf("key has %d bytes, expected %d", len(key), dataKeySize)
+	}
+	digest := sha256.Sum256(key)
+	return &FileKeyProvider{
+		key:   bytes.Clone(key),
+		keyId: hex.EncodeToString(digest[:fileKeyIdSize]),
+	}, nil
+}
+
+// Returns [FileKeyProviderName].
+func (*FileKeyProvider) Name() string {
+	return FileKeyProviderName
+}
+
+// Generates a random data key. The wrapped key is the nonce followed by the sealed data key. The
+// key id is a prefix of the SHA-256 digest of the provider's key, so a wrong key file is detected
+// before decryption is attempted.
+func (p *FileKeyProvider) GenerateDataKey(context.Context) (DataKey, error) {
+	aead, err := newGCM(p.key)
+	if err != nil {
+		return DataKey{}, err
+	}
+
+	plaintext := make([]byte, dataKeySize)
+	if _, err := rand.Read(plaintext); err != nil {
+		return DataKey{}, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return DataKey{}, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	wrapped := aead.Seal(nonce, nonce, plaintext, []byte(FileKeyProviderName))
+	return DataKey{Plaintext: plaintext, Wrapped: wrapped, KeyId: p.keyId}, nil
+}
+
+// Unwraps a data key generated by [FileKeyProvider.GenerateDataKey].
+func (p *FileKeyProvider) DecryptDataKey(
+	_ context.Context,
+	wrapped []byte,
+	keyId string,
+) ([]byte, error) {
+	if keyId != p.keyId {
+		return nil, fmt.Errorf("data key was wrapped by key %s, not %s", keyId, p.keyId)
+	}
+	if len(wrapped) < nonceSize {
+		return nil, fmt.Errorf("wrapped data key has %d bytes, expected at least %d",
+			len(wrapped), nonceSize)
+	}
+
+	aead, err := newGCM(p.key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(
+		nil,
+		wrapped[:nonceSize],
+		wrapped[nonceSize:],
+		[]byte(FileKeyProviderName),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,118 @@
+package envelope
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+
+	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+)
+
+// Name of [KMSKeyProvider], stored in [MetadataKeyProvider].
+const KMSKeyProviderName = "kms"
+
+// Subset of the AWS KMS API used by [KMSKeyProvider]. Satisfied by [kms.Client].
+type KMSClient interface {
+	GenerateDataKey(
+		ctx context.Context,
+		params *kms.GenerateDataKeyInput,
+		optFns ...func(*kms.Options),
+	) (*kms.GenerateDataKeyOutput, error)
+	Decrypt(
+		ctx context.Context,
+		params *kms.DecryptInput,
+		optFns ...func(*kms.Options),
+	) (*kms.DecryptOutput, error)
+}
+
+// [KeyProvider] generating data keys with a KMS key. Works with AWS KMS and with services
+// implementing its API (e.g. LocalStack) through AWS_ENDPOINT_URL.
+type KMSKeyProvider struct {
+	client KMSClient
+	keyId  string
+}
+
+// Creates a KMS client using the default AWS credential chain.
+//
+// Parameters:
+//   - ctx: Context of the requests
+//   - keyId: Key id, ARN or alias of the KMS key wrapping data keys. May be empty if the provider
+//     only decrypts.
+//   - region: AWS region of the KMS key. Empty uses the region of the default configuration.
+//
+// Returns:
+//   - provider: KMS key provider
+//   - err: Error loading AWS configuration
+func OpenKMSKeyProvider(ctx context.Context, keyId string, region string) (*KMSKeyProvider, error) {
+	var optFns []func(*awsConfig.LoadOptions) error
+	if region != "" {
+		optFns = append(optFns, awsConfig.WithRegion(region))
+	}
+	awsCfg, err := awsConfig.LoadDefaultConfig(ctx, optFns...)
+	if err != nil {
+		return nil, fmt.Errorf("could not load aws credentials: %w", err)
+	}
+	client := kms.NewFromConfig(awsCfg, func(o *kms.Options) {
+		if endpoint := os.Getenv("AWS_ENDPOINT_URL"); endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+	return NewKMSKeyProvider(client, keyId), nil
+}
+
+// Creates a [KMSKeyProvider].
+//
+// Parameters:
+//   - client: KMS client
+//   - keyId: Key id, ARN or alias of the KMS key wrapping data keys
+//
+// Returns:
+//   - provider: KMS key provider
+func NewKMSKeyProvider(client KMSClient, keyId string) *KMSKeyProvider {
+	return &KMSKeyProvider{client: client, keyId: keyId}
+}
+
+// Returns [KMSKeyProviderName].
+func (*KMSKeyProvider) Name() string {
+	return KMSKeyProviderName
+}
+
+// Generates a data key with the KMS key. The key id is the ARN of the KMS key.
+func (p *KMSKeyProvider) GenerateDataKey(ctx context.Context) (DataKey, error) {
+	if p.keyId == "" {
+		return DataKey{}, errors.New("a kms key id is required to generate data keys")
+	}
+	output, err := p.client.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+		KeyId:   aws.String(p.keyId),
+		KeySpec: types.DataKeySpecAes256,
+	})
+	if err != nil {
+		return DataKey{}, fmt.Errorf("kms failed to generate data key with %s: %w", p.keyId, err)
+	}
+	return DataKey{
+		Plaintext: output.Plaintext,
+		Wrapped:   output.CiphertextBlob,
+		KeyId:     aws.ToString(output.KeyId),
+	}, nil
+}
+
+// Decrypts a data key with the KMS key identified by keyId.
+func (p *KMSKeyProvider) DecryptDataKey(
+	ctx context.Context,
+	wrapped []byte,
+	keyId string,
+) ([]byte, error) {
+	output, err := p.client.Decrypt(ctx, &kms.DecryptInput{
+		CiphertextBlob: wrapped,
+		KeyId:          aws.String(keyId),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("kms failed to decrypt data key with %s: %w", keyId, err)
+	}
+	return output.Plaintext, nil
+}
@@ -0,0 +1,74 @@
+package envelope
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// fakeKMS wraps data keys by delegating to a file key provider, keeping the key id KMS reports.
+type fakeKMS struct {
+	wrapper *FileKeyProvider
+	keyArn  string
+}
+
+func (f *fakeKMS) GenerateDataKey(
+	ctx context.Context,
+	params *kms.GenerateDataKeyInput,
+	_ ...func(*kms.Options),
+) (*kms.GenerateDataKeyOutput, error) {
+	dataKey, err := f.wrapper.GenerateDataKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if aws.ToString(params.KeyId) != "alias/logs" {
+		return nil, errors.New("NotFoundException")
+	}
+	return &kms.GenerateDataKeyOutput{
+		Plaintext:      dataKey.Plaintext,
+		CiphertextBlob: dataKey.Wrapped,
+		KeyId:          aws.String(f.keyArn),
+	}, nil
+}
+
+func (f *fakeKMS) Decrypt(
+	ctx context.Context,
+	params *kms.DecryptInput,
+	_ ...func(*kms.Options),
+) (*kms.DecryptOutput, error) {
+	if aws.ToString(params.KeyId) != f.keyArn {
+		return nil, errors.New("IncorrectKeyException")
+	}
+	plaintext, err := f.wrapper.DecryptDataKey(ctx, params.CiphertextBlob, f.wrapper.keyId)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.DecryptOutput{Plaintext: plaintext, KeyId: params.KeyId}, nil
+}
+
+func TestKMSKeyProvider_RoundTrip(t *testing.T) {
+	client := &fakeKMS{
+		wrapper: newTestProvider(t),
+		keyArn:  "arn:aws:kms:us-east-1:123456789012:key/test",
+	}
+	plaintext := []byte("logs encrypted with a kms data key")
+	ciphertext, metadata := encrypt(t, NewKMSKeyProvider(client, "alias/logs"), plaintext)
+
+	if metadata[MetadataKeyId] != client.keyArn {
+		t.Errorf("metadata key id = %q, want %q", metadata[MetadataKeyId], client.keyArn)
+	}
+
+	// Decrypting only needs the key id stored in the metadata
+	got, err := decrypt(NewKMSKeyProvider(client, ""), ciphertext, metadata)
+	if err != nil || !bytes.Equal(got, plaintext) {
+		t.Errorf("Decrypt() = %q, %v, want %q", got, err, plaintext)
+	}
+
+	if _, err := decrypt(newTestProvider(t), ciphertext, metadata); err == nil {
+		t.Error("Decrypt() with a file key provider error = nil, want error")
+	}
+}
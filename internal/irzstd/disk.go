@@ -4,13 +4,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
 
 	"github.com/klauspost/compress/zstd"
 	"github.com/y-scope/clp-ffi-go/ffi"
 	"github.com/y-scope/clp-ffi-go/ir"
+
+	"github.com/y-scope/fluent-bit-clp/internal/logging"
 )
 
 // 2 MB threshold to buffer IR before compressing to Zstd.
@@ -60,7 +61,9 @@ type DiskWriter struct {
 	size         int
 	timezone     string
 	irTotalBytes int
-	zstdWriter   *zstd.Encoder
+	// IR bytes written since the writer was opened. Unlike irTotalBytes, never reset.
+	irBytesWritten int
+	zstdWriter     *zstd.Encoder
 }
 
 // Opens a new [DiskWriter] using files for IR and Zstd buffers. For use when use_disk_store
@@ -170,6 +173,7 @@ func RecoverWriter(
 //   - err: Error writing IR/Zstd, error flushing buffers
 func (w *DiskWriter) WriteIrZstd(logEvents []ffi.LogEvent) (int, error) {
 	numBytes, numEvents, err := writeIr(w.irWriter, logEvents)
+	w.irBytesWritten += numBytes
 	if err != nil {
 		return numEvents, err
 	}
@@ -254,7 +258,32 @@ func (w *DiskWriter) Reset() error {
 	return nil
 }
 
-// Closes [DiskWriter]. Currently used during recovery only, and advise caution using elsewhere.
+// Discards the log events in the IR and Zstd buffers and starts a new IR stream. Unlike
+// [DiskWriter.Reset], may be called while the IR stream is open. Zstd frames cannot be dropped
+// individually since the IR stream spans all of them, so the buffers are discarded as a whole.
+//
+// Returns:
+//   - err: Error closing irWriter, error truncating files, error opening IR writer
+func (w *DiskWriter) Discard() error {
+	if w.irWriter != nil {
+		err := w.irWriter.Serializer.Close()
+		if err != nil {
+			return fmt.Errorf("error could not close irWriter: %w", err)
+		}
+		w.irWriter = nil
+	}
+
+	err := w.truncateIrFile()
+	if err != nil {
+		return err
+	}
+	w.irTotalBytes = 0
+
+	return w.Reset()
+}
+
+// Closes [DiskWriter]. Currently used during recovery and eviction only, and advise caution using
+// elsewhere.
 // Using [ir.Writer.Serializer.Close] instead of [ir.Writer.Close] so EndofStream byte is not
 // added. It is preferable to add postamble on recovery so that IR is in the same state
 // (i.e. not terminated) for an abrupt crash and a graceful exit. Function does not call
@@ -299,6 +328,14 @@ func (w *DiskWriter) GetZstdOutput() io.Reader {
 	return w.zstdFile
 }
 
+// Get number of IR bytes written since the writer was opened, before Zstd compression.
+//
+// Returns:
+//   - irBytes: Bytes of IR written
+func (w *DiskWriter) GetIrBytesWritten() int {
+	return w.irBytesWritten
+}
+
 // Get size of Zstd output. [zstd] does not provide the amount of bytes written with each write.
 // Therefore, cannot keep track of size with variable as implemented for IR with [IrTotalBytes].
 // Instead, must always use stat.
@@ -331,7 +368,7 @@ func (w *DiskWriter) flushIrBuffer() error {
 		return nil
 	}
 
-	log.Printf("flushing IR buffer %s", filepath.Base(w.irPath))
+	logging.Default().Debugf("flushing IR buffer %s", filepath.Base(w.irPath))
 
 	if err := w.compressIrToZstd(); err != nil {
 		return err
@@ -398,13 +435,13 @@ func newFileBuffers(
 	if err != nil {
 		return nil, nil, fmt.Errorf(errCreatingFile, irPath, err)
 	}
-	log.Printf(logCreatedFile, irPath)
+	logging.Default().Debugf(logCreatedFile, irPath)
 
 	zstdFile, err = createFile(zstdPath)
 	if err != nil {
 		return nil, nil, fmt.Errorf(errCreatingFile, zstdPath, err)
 	}
-	log.Printf(logCreatedFile, zstdPath)
+	logging.Default().Debugf(logCreatedFile, zstdPath)
 
 	return irFile, zstdFile, nil
 }
@@ -0,0 +1,40 @@
+package irzstd
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/y-scope/fluent-bit-clp/internal/envelope"
+)
+
+// Encrypts the Zstd output of a writer for upload. Call after [Writer.CloseStreams] so the output
+// holds complete IR and Zstd streams. The output is encrypted as it is read from the returned
+// reader, which can be rewound to its start (see [envelope.Encryptor.Encrypt]).
+//
+// Parameters:
+//   - ctx: Context of requests to the key provider
+//   - w: Writer holding the Zstd output
+//   - encryptor: Encryptor with a new data key per call
+//
+// Returns:
+//   - ciphertext: Reader of the encrypted Zstd output
+//   - size: Length of ciphertext in bytes
+//   - metadata: Object metadata required to decrypt the output (see [envelope.Decrypt])
+//   - err: Error getting Zstd output, error encrypting
+func EncryptZstdOutput(
+	ctx context.Context,
+	w Writer,
+	encryptor *envelope.Encryptor,
+) (io.ReadSeeker, int64, map[string]string, error) {
+	plaintext, size, err := ZstdOutputSeeker(w)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	ciphertext, ciphertextSize, metadata, err := encryptor.Encrypt(ctx, plaintext, size)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("error encrypting Zstd output: %w", err)
+	}
+	return ciphertext, ciphertextSize, metadata, nil
+}
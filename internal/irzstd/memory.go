@@ -19,6 +19,8 @@ type memoryWriter struct {
 	size       int
 	timezone   string
 	zstdWriter *zstd.Encoder
+	// IR bytes written since the writer was opened
+	irBytesWritten int
 }
 
 // Opens a new [memoryWriter] with a memory buffer for Zstd output. For use when use_disk_store is
@@ -58,7 +60,8 @@ func NewMemoryWriter(timezone string, size int) (*memoryWriter, error) {
 //   - numEvents: Number of log events successfully written to IR writer buffer
 //   - err: Error writing IR/Zstd
 func (w *memoryWriter) WriteIrZstd(logEvents []ffi.LogEvent) (int, error) {
-	_, numEvents, err := writeIr(w.irWriter, logEvents)
+	numBytes, numEvents, err := writeIr(w.irWriter, logEvents)
+	w.irBytesWritten += numBytes
 	if err != nil {
 		return numEvents, err
 	}
@@ -96,6 +99,21 @@ func (w *memoryWriter) Reset() error {
 	return nil
 }
 
+// Discards the log events in the Zstd buffer and starts a new IR stream.
+//
+// Returns:
+//   - err: Error closing irWriter, error opening IR writer
+func (w *memoryWriter) Discard() error {
+	if w.irWriter != nil {
+		err := w.irWriter.Serializer.Close()
+		if err != nil {
+			return fmt.Errorf("error could not close irWriter: %w", err)
+		}
+		w.irWriter = nil
+	}
+	return w.Reset()
+}
+
 // Getter for useDiskBuffer.
 //
 // Returns:
@@ -112,6 +130,14 @@ func (w *memoryWriter) GetZstdOutput() io.Reader {
 	return w.zstdBuffer
 }
 
+// Get number of IR bytes written since the writer was opened, before Zstd compression.
+//
+// Returns:
+//   - irBytes: Bytes of IR written
+func (w *memoryWriter) GetIrBytesWritten() int {
+	return w.irBytesWritten
+}
+
 // Get size of Zstd output. [zstd] does not provide the amount of bytes written with each write.
 // Instead, calling Len() on buffer.
 //
@@ -122,7 +148,8 @@ func (w *memoryWriter) GetZstdOutputSize() (int, error) {
 	return w.zstdBuffer.Len(), nil
 }
 
-// Closes [memoryWriter]. Currently used during recovery only, and advise caution using elsewhere.
+// Closes [memoryWriter]. Currently used during recovery and eviction only, and advise caution
+// using elsewhere.
 // Using [ir.Writer.Serializer.Close] instead of [ir.Writer.Close] so EndofStream byte is not
 // added. It is preferable to add postamble on recovery so that IR is in the same state
 // (i.e. not terminated) for an abrupt crash and a graceful exit. Function does not call
@@ -0,0 +1,40 @@
+package irzstd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Returns the Zstd output of a writer as a reader which can be rewound, so the output can be read
+// more than once (e.g. to compute a checksum before uploading it). Call after
+// [Writer.CloseStreams]. Reading the returned reader does not consume a memory buffer, which is
+// only cleared by [Writer.Reset].
+//
+// Parameters:
+//   - w: Writer holding the Zstd output
+//
+// Returns:
+//   - output: Reader of the Zstd output, positioned at its start
+//   - size: Length of the Zstd output in bytes
+//   - err: Error getting Zstd output size, output cannot be rewound
+func ZstdOutputSeeker(w Writer) (io.ReadSeeker, int64, error) {
+	size, err := w.GetZstdOutputSize()
+	if err != nil {
+		return nil, 0, fmt.Errorf("error getting Zstd output size: %w", err)
+	}
+
+	switch output := w.GetZstdOutput().(type) {
+	case *bytes.Buffer:
+		return bytes.NewReader(output.Bytes()), int64(size), nil
+	case io.ReadSeeker:
+		// The output is a buffer file, whose offset is left wherever an earlier (e.g. failed)
+		// upload stopped reading it.
+		if _, err := output.Seek(0, io.SeekStart); err != nil {
+			return nil, 0, fmt.Errorf("error rewinding Zstd output: %w", err)
+		}
+		return output, int64(size), nil
+	default:
+		return nil, 0, fmt.Errorf("zstd output of type %T cannot be rewound", output)
+	}
+}
@@ -42,6 +42,12 @@ type Writer interface {
 	//   - err
 	Reset() error
 
+	// Discards buffered log events without closing streams, and starts a new IR stream.
+	//
+	// Returns:
+	//   - err
+	Discard() error
+
 	// Getter for useDiskBuffer.
 	//
 	// Returns:
@@ -60,6 +66,12 @@ type Writer interface {
 	//	 - size: Bytes written
 	//   - err
 	GetZstdOutputSize() (int, error)
+
+	// Get number of IR bytes written since the writer was opened, before Zstd compression.
+	//
+	// Returns:
+	//   - irBytes: Bytes of IR written
+	GetIrBytesWritten() int
 }
 
 // Writes log events to a IR Writer.
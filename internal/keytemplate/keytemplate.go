@@ -0,0 +1,495 @@
+// Package implements templates for the keys logs are stored under. A template mixes literal text
+// with placeholders, using syntax similar to Fluent Bit's record accessor:
+//   - $TAG: Fluent Bit tag
+//   - $TAG[n]: Part n (starting at 0) of the tag split on "."
+//   - $STREAM: Path of the stream the object belongs to
+//   - $ID: Id of the output plugin instance
+//   - $INDEX: Sequence number of the object within its tag or stream
+//   - $HOSTNAME: Hostname of the machine running Fluent Bit
+//   - $UPLOAD_TIME, $EVENT_START, $EVENT_END: Time of the upload and time range of the object's
+//     events, formatted as RFC 3339 or with a strftime format in brackets, e.g.
+//     $UPLOAD_TIME[%Y-%m-%d]
+//   - $field: Top-level record field
+//   - $field['key']['nested']: Nested record field
+//   - $$: Literal "$"
+//
+// A placeholder can be wrapped in braces, e.g. ${TAG}_${INDEX}, to separate it from text that
+// would otherwise be read as part of its name. Times are rendered in UTC.
+
+package keytemplate
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/y-scope/fluent-bit-clp/internal/timestamp"
+)
+
+// Reserved placeholder names. Record fields with these names cannot be referenced. Plugins pass
+// them to [Template.Reject] for placeholders whose values they cannot supply.
+const (
+	TagPlaceholder        = "TAG"
+	StreamPlaceholder     = "STREAM"
+	IDPlaceholder         = "ID"
+	IndexPlaceholder      = "INDEX"
+	HostnamePlaceholder   = "HOSTNAME"
+	UploadTimePlaceholder = "UPLOAD_TIME"
+	EventStartPlaceholder = "EVENT_START"
+	EventEndPlaceholder   = "EVENT_END"
+)
+
+// Separator of tag parts referenced with $TAG[n].
+const tagSeparator = "."
+
+// Characters allowed in sanitized keys besides ASCII letters, digits and "/". These are the
+// characters S3 documents as safe, plus "=" for Hive style partitions such as "dt=2024-01-15".
+const safePunctuation = "!-_.*'()="
+
+// Replaces characters of rendered keys which are not safe.
+const replacementChar = '_'
+
+// Type of a template segment.
+type segmentKind int
+
+const (
+	literalSegment segmentKind = iota
+	tagSegment
+	tagPartSegment
+	streamSegment
+	idSegment
+	indexSegment
+	hostnameSegment
+	uploadTimeSegment
+	eventStartSegment
+	eventEndSegment
+	fieldSegment
+)
+
+// Segment kinds of placeholders without subscripts.
+var namedSegments = map[string]segmentKind{
+	TagPlaceholder:      tagSegment,
+	StreamPlaceholder:   streamSegment,
+	IDPlaceholder:       idSegment,
+	IndexPlaceholder:    indexSegment,
+	HostnamePlaceholder: hostnameSegment,
+}
+
+// Segment kinds of time placeholders.
+var timeSegments = map[string]segmentKind{
+	UploadTimePlaceholder: uploadTimeSegment,
+	EventStartPlaceholder: eventStartSegment,
+	EventEndPlaceholder:   eventEndSegment,
+}
+
+// Piece of a parsed template.
+type segment struct {
+	kind segmentKind
+	// Text of a literal segment.
+	literal string
+	// Index of a tag part segment.
+	index int
+	// Go layout of a time segment.
+	layout string
+	// Path of a field segment, starting with the top-level key.
+	keys []string
+}
+
+// Parsed key template.
+type Template struct {
+	raw      string
+	segments []segment
+}
+
+// Values available to placeholders when rendering a template. Placeholders whose value is not set
+// render as empty text.
+type Values struct {
+	// Fluent Bit tag
+	Tag string
+	// Path of the stream the object belongs to
+	Stream string
+	// Decoded log record
+	Record map[string]any
+	// Id of the output plugin instance
+	ID string
+	// Sequence number of the object
+	Index int
+	// Hostname of the machine running Fluent Bit
+	Hostname string
+	// Time of the upload
+	UploadTime time.Time
+	// Timestamp of the object's earliest event
+	EventStart time.Time
+	// Timestamp of the object's latest event
+	EventEnd time.Time
+}
+
+// Parses a template.
+//
+// Parameters:
+//   - template: Template text
+//
+// Returns:
+//   - template: Parsed template
+//   - err: Malformed placeholder, unsupported strftime format
+func Parse(template string) (*Template, error) {
+	t := Template{raw: template}
+	var literal strings.Builder
+	flushLiteral := func() {
+		if literal.Len() == 0 {
+			return
+		}
+		t.segments = append(t.segments, segment{kind: literalSegment, literal: literal.String()})
+		literal.Reset()
+	}
+
+	for i := 0; i < len(template); {
+		if template[i] != '$' {
+			literal.WriteByte(template[i])
+			i++
+			continue
+		}
+		if strings.HasPrefix(template[i:], "$$") {
+			literal.WriteByte('$')
+			i += 2
+			continue
+		}
+
+		placeholder, n, err := parseDelimitedPlaceholder(template[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("error parsing template %q at offset %d: %w", template, i, err)
+		}
+		flushLiteral()
+		t.segments = append(t.segments, placeholder)
+		i += 1 + n
+	}
+	flushLiteral()
+
+	return &t, nil
+}
+
+// Parses a placeholder following a "$", which may be wrapped in braces.
+//
+// Parameters:
+//   - text: Template text after the "$"
+//
+// Returns:
+//   - segment: Placeholder segment
+//   - n: Number of bytes of text consumed
+//   - err: Malformed placeholder
+func parseDelimitedPlaceholder(text string) (segment, int, error) {
+	if !strings.HasPrefix(text, "{") {
+		return parsePlaceholder(text)
+	}
+
+	end := strings.IndexByte(text, '}')
+	if end < 0 {
+		return segment{}, 0, errors.New("error unterminated ${")
+	}
+	placeholder, n, err := parsePlaceholder(text[1:end])
+	if err != nil {
+		return segment{}, 0, err
+	}
+	if n != end-1 {
+		return segment{}, 0, fmt.Errorf("error unexpected %q in ${}", text[1+n:end])
+	}
+	return placeholder, end + 1, nil
+}
+
+// Parses a placeholder.
+//
+// Parameters:
+//   - text: Template text starting with the placeholder's name
+//
+// Returns:
+//   - segment: Placeholder segment
+//   - n: Number of bytes of text consumed
+//   - err: Missing name, malformed subscript, unsupported strftime format
+func parsePlaceholder(text string) (segment, int, error) {
+	n := 0
+	for n < len(text) && isNameByte(text[n]) {
+		n++
+	}
+	if n == 0 {
+		return segment{}, 0, errors.New("error placeholder without a name")
+	}
+	name := text[:n]
+	hasSubscript := strings.HasPrefix(text[n:], "[")
+
+	if kind, ok := timeSegments[name]; ok {
+		if !hasSubscript {
+			return segment{kind: kind, layout: time.RFC3339}, n, nil
+		}
+		format, length, err := parseBracket(text[n:])
+		if err != nil {
+			return segment{}, 0, err
+		}
+		layout, err := timestamp.StrftimeToLayout(format)
+		if err != nil {
+			return segment{}, 0, err
+		}
+		return segment{kind: kind, layout: layout}, n + length, nil
+	}
+
+	if name == TagPlaceholder && hasSubscript {
+		subscript, length, err := parseBracket(text[n:])
+		if err != nil {
+			return segment{}, 0, err
+		}
+		index, err := strconv.Atoi(subscript)
+		if err != nil || index < 0 {
+			return segment{}, 0, fmt.Errorf("error invalid $TAG index %q", subscript)
+		}
+		return segment{kind: tagPartSegment, index: index}, n + length, nil
+	}
+
+	if kind, ok := namedSegments[name]; ok {
+		return segment{kind: kind}, n, nil
+	}
+
+	keys := []string{name}
+	for strings.HasPrefix(text[n:], "[") {
+		key, length, err := parseSubscript(text[n:])
+		if err != nil {
+			return segment{}, 0, err
+		}
+		keys = append(keys, key)
+		n += length
+	}
+	return segment{kind: fieldSegment, keys: keys}, n, nil
+}
+
+// Parses an unquoted subscript such as [0] or [%Y-%m-%d].
+//
+// Parameters:
+//   - text: Template text starting with "["
+//
+// Returns:
+//   - subscript: Text between the brackets
+//   - n: Number of bytes of text consumed
+//   - err: Unterminated subscript
+func parseBracket(text string) (string, int, error) {
+	end := strings.IndexByte(text, ']')
+	if end < 0 {
+		return "", 0, errors.New("error unterminated subscript")
+	}
+	return text[1:end], end + 1, nil
+}
+
+// Parses a quoted subscript such as ['key'] or ["key"].
+//
+// Parameters:
+//   - text: Template text starting with "["
+//
+// Returns:
+//   - key: Subscript key
+//   - n: Number of bytes of text consumed
+//   - err: Unquoted or unterminated subscript
+func parseSubscript(text string) (string, int, error) {
+	if len(text) < 2 || (text[1] != '\'' && text[1] != '"') {
+		return "", 0, errors.New("error field subscript must be quoted")
+	}
+	quote := text[1]
+	end := strings.IndexByte(text[2:], quote)
+	if end < 0 || !strings.HasPrefix(text[2+end+1:], "]") {
+		return "", 0, errors.New("error unterminated field subscript")
+	}
+	return text[2 : 2+end], 2 + end + 2, nil
+}
+
+// Checks if a byte can be part of a placeholder name.
+func isNameByte(b byte) bool {
+	return b == '_' || ('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z') || ('0' <= b && b <= '9')
+}
+
+// Returns the template text the template was parsed from.
+func (t *Template) String() string {
+	return t.raw
+}
+
+// Checks if the template references record fields.
+func (t *Template) UsesRecord() bool {
+	return t.uses(fieldSegment)
+}
+
+// Checks if the template references the object's sequence number.
+func (t *Template) UsesIndex() bool {
+	return t.uses(indexSegment)
+}
+
+// Checks that the template references none of the given placeholders, e.g. because a plugin cannot
+// supply their values. Rejecting [TagPlaceholder] includes $TAG[n].
+//
+// Parameters:
+//   - names: Names of the rejected placeholders, e.g. [EventStartPlaceholder]
+//
+// Returns:
+//   - err: Error naming the first rejected placeholder the template references
+func (t *Template) Reject(names ...string) error {
+	for _, s := range t.segments {
+		name := placeholderName(s.kind)
+		if name != "" && slices.Contains(names, name) {
+			return fmt.Errorf("error $%s is not supported in %q", name, t.raw)
+		}
+	}
+	return nil
+}
+
+// Returns the name of the placeholder of a segment kind, or "" for literals and record fields.
+func placeholderName(kind segmentKind) string {
+	if kind == tagPartSegment {
+		return TagPlaceholder
+	}
+	for name, k := range namedSegments {
+		if k == kind {
+			return name
+		}
+	}
+	for name, k := range timeSegments {
+		if k == kind {
+			return name
+		}
+	}
+	return ""
+}
+
+// Checks if the template contains a segment of the given kind.
+func (t *Template) uses(kind segmentKind) bool {
+	for _, s := range t.segments {
+		if s.kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Renders the template. Tag parts and fields which do not exist render as empty text, as do
+// fields holding maps or arrays.
+//
+// Values which originate from log sources (tag, stream, hostname, id and record fields) are
+// sanitized (see [Sanitize]) so they cannot inject unsafe characters or escape the template's
+// prefix. Literal text and generated values are used as is.
+//
+// Parameters:
+//   - values: Values of placeholders
+//
+// Returns:
+//   - key: Rendered key
+func (t *Template) Render(values Values) string {
+	var key strings.Builder
+	for _, s := range t.segments {
+		switch s.kind {
+		case literalSegment:
+			key.WriteString(s.literal)
+		case tagSegment:
+			key.WriteString(Sanitize(values.Tag))
+		case tagPartSegment:
+			parts := strings.Split(values.Tag, tagSeparator)
+			if s.index < len(parts) {
+				key.WriteString(Sanitize(parts[s.index]))
+			}
+		case streamSegment:
+			key.WriteString(Sanitize(values.Stream))
+		case idSegment:
+			key.WriteString(Sanitize(values.ID))
+		case indexSegment:
+			key.WriteString(strconv.Itoa(values.Index))
+		case hostnameSegment:
+			key.WriteString(Sanitize(values.Hostname))
+		case uploadTimeSegment:
+			key.WriteString(formatTime(values.UploadTime, s.layout))
+		case eventStartSegment:
+			key.WriteString(formatTime(values.EventStart, s.layout))
+		case eventEndSegment:
+			key.WriteString(formatTime(values.EventEnd, s.layout))
+		case fieldSegment:
+			key.WriteString(Sanitize(formatField(lookup(values.Record, s.keys))))
+		}
+	}
+	return key.String()
+}
+
+// Formats a time in UTC. The zero time is formatted as empty text.
+func formatTime(t time.Time, layout string) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(layout)
+}
+
+// Retrieves a possibly nested record field.
+//
+// Parameters:
+//   - record: Decoded log record
+//   - keys: Path of the field
+//
+// Returns:
+//   - value: Field value, nil if it does not exist
+func lookup(record map[string]any, keys []string) any {
+	var value any = record
+	for _, key := range keys {
+		m, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return value
+}
+
+// Formats a scalar record value as text.
+func formatField(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case int64, uint64, int:
+		return fmt.Sprint(v)
+	default:
+		return ""
+	}
+}
+
+// Sanitizes a rendered key so it is safe to use as an object key and a file name. Unsafe
+// characters are replaced with "_". Empty and "." path segments are removed and ".." segments are
+// replaced so the key can neither start with "/" nor escape its prefix. For example,
+// "/logs/app/../server log" becomes "logs/app/_/server_log".
+//
+// Parameters:
+//   - key: Rendered key
+//
+// Returns:
+//   - key: Sanitized key, empty if nothing remains
+func Sanitize(key string) string {
+	segments := strings.Split(key, "/")
+	kept := segments[:0]
+	for _, s := range segments {
+		if s == "" || s == "." {
+			continue
+		}
+		if s == ".." {
+			kept = append(kept, string(replacementChar))
+			continue
+		}
+		kept = append(kept, strings.Map(sanitizeRune, s))
+	}
+	return strings.Join(kept, "/")
+}
+
+// Replaces a rune which is not safe in keys.
+func sanitizeRune(r rune) rune {
+	switch {
+	case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		return r
+	case strings.ContainsRune(safePunctuation, r):
+		return r
+	default:
+		return replacementChar
+	}
+}
@@ -0,0 +1,180 @@
+package keytemplate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTemplate_Render(t *testing.T) {
+	toronto, err := time.LoadLocation("America/Toronto")
+	if err != nil {
+		t.Fatalf("Failed to load location: %v", err)
+	}
+	values := Values{
+		Tag:        "kube.var.log.app",
+		Stream:     "/logs/app/server.log",
+		ID:         "abc123",
+		Index:      7,
+		Hostname:   "node-1",
+		UploadTime: time.Date(2024, 1, 15, 5, 30, 0, 0, toronto),
+		EventStart: time.Date(2024, 1, 15, 9, 0, 0, 0, time.UTC),
+		Record: map[string]any{
+			"file_path": "/logs/app/server.log",
+			"count":     float64(42),
+			"unsafe":    "../../etc/pass wd",
+			"kubernetes": map[string]any{
+				"namespace_name": "prod",
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{"tag", "$TAG", "kube.var.log.app"},
+		{"tag part", "$TAG[0]/$TAG[3]", "kube/app"},
+		{"missing tag part", "$TAG[9]", ""},
+		{"field", "$file_path", "logs/app/server.log"},
+		{"nested field", "$kubernetes['namespace_name']/x", "prod/x"},
+		{"double quoted subscript", `$kubernetes["namespace_name"]`, "prod"},
+		{"number field", "n=$count", "n=42"},
+		{"missing field", "$missing", ""},
+		{"map field", "$kubernetes", ""},
+		{"unsafe field", "$unsafe", "_/_/etc/pass_wd"},
+		{"combined", "$TAG/$file_path.$$", "kube.var.log.app/logs/app/server.log.$"},
+		{"literal only", "logs", "logs"},
+		{"stream", "$STREAM.clp.zst", "logs/app/server.log.clp.zst"},
+		{
+			"legacy out_clp_s3 key",
+			"${TAG}_${INDEX}_${UPLOAD_TIME}_${ID}.zst",
+			"kube.var.log.app_7_2024-01-15T10:30:00Z_abc123.zst",
+		},
+		{
+			"partitions",
+			"logs/$TAG[3]/dt=$UPLOAD_TIME[%Y-%m-%d]/hour=${UPLOAD_TIME[%H]}/$HOSTNAME",
+			"logs/app/dt=2024-01-15/hour=10/node-1",
+		},
+		{"event time range", "$EVENT_START[%H%M]-$EVENT_END[%H%M]", "0900-"},
+		{"braced field", "${kubernetes['namespace_name']}_x", "prod_x"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			template, err := Parse(tt.template)
+			if err != nil {
+				t.Fatalf("Parse(%q) error = %v", tt.template, err)
+			}
+			if got := template.Render(values); got != tt.want {
+				t.Errorf("Render() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse_Malformed(t *testing.T) {
+	for _, template := range []string{
+		"$",
+		"logs/$/x",
+		"$TAG[",
+		"$TAG[-1]",
+		"$TAG[x]",
+		"$field[key]",
+		"$field['key'",
+		"${TAG",
+		"${TAG x}",
+		"${TAG[1]x}",
+		"$UPLOAD_TIME[%Q]",
+		"$EVENT_END[%Y",
+	} {
+		if _, err := Parse(template); err == nil {
+			t.Errorf("Parse(%q) error = nil, want error", template)
+		}
+	}
+}
+
+func TestTemplate_UsesRecord(t *testing.T) {
+	tests := []struct {
+		template string
+		want     bool
+	}{
+		{"$TAG", false},
+		{"logs/$TAG[1]", false},
+		{"$TAG/$file_path", true},
+		{"${STREAM}_${HOSTNAME}", false},
+	}
+
+	for _, tt := range tests {
+		template, err := Parse(tt.template)
+		if err != nil {
+			t.Fatalf("Parse(%q) error = %v", tt.template, err)
+		}
+		if got := template.UsesRecord(); got != tt.want {
+			t.Errorf("UsesRecord(%q) = %v, want %v", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestTemplate_UsesIndex(t *testing.T) {
+	for template, want := range map[string]bool{
+		"$STREAM.clp.zst":           false,
+		"$STREAM.$INDEX.clp.zst":    true,
+		"${TAG}_${INDEX}_${ID}.zst": true,
+	} {
+		parsed, err := Parse(template)
+		if err != nil {
+			t.Fatalf("Parse(%q) error = %v", template, err)
+		}
+		if got := parsed.UsesIndex(); got != want {
+			t.Errorf("UsesIndex(%q) = %v, want %v", template, got, want)
+		}
+	}
+}
+
+func TestTemplate_Reject(t *testing.T) {
+	tests := []struct {
+		template string
+		rejected []string
+		wantErr  bool
+	}{
+		{"$STREAM/$EVENT_START[%Y]", []string{EventStartPlaceholder}, true},
+		{"${EVENT_END}.zst", []string{EventStartPlaceholder, EventEndPlaceholder}, true},
+		{"logs/$TAG[1]", []string{TagPlaceholder}, true},
+		{"$STREAM.$INDEX/$UPLOAD_TIME[%H]", []string{EventStartPlaceholder}, false},
+		{"$TAG/$EVENT_START/$$", nil, false},
+		{"$tag_name/$$EVENT_START", []string{TagPlaceholder, EventStartPlaceholder}, false},
+	}
+
+	for _, tt := range tests {
+		template, err := Parse(tt.template)
+		if err != nil {
+			t.Fatalf("Parse(%q) error = %v", tt.template, err)
+		}
+		if err := template.Reject(tt.rejected...); (err != nil) != tt.wantErr {
+			t.Errorf("Reject(%q, %v) error = %v, want error %v", tt.template, tt.rejected, err,
+				tt.wantErr)
+		}
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"/logs/app/server.log", "logs/app/server.log"},
+		{"logs//app/./server.log", "logs/app/server.log"},
+		{"logs/../../etc/passwd", "logs/_/_/etc/passwd"},
+		{"app server#1?.log", "app_server_1_.log"},
+		{"dt=2024-01-15/(a)!*'", "dt=2024-01-15/(a)!*'"},
+		{"日志.log", "__.log"},
+		{"/./", ""},
+	}
+
+	for _, tt := range tests {
+		if got := Sanitize(tt.key); got != tt.want {
+			t.Errorf("Sanitize(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+// Package provides the leveled logger of the output plugins. Each message is written to stderr as
+// one line, either as text in the format of the standard logger followed by its fields
+// ("2006/01/02 15:04:05 [info] message id=a tag=app") or as a JSON object. Repetitions of a message
+// are rate limited so a failing destination or a stream of malformed records does not flood the
+// output of Fluent Bit.
+
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level of a message. Messages below the level of a logger are discarded.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	// Discards all messages
+	LevelOff
+)
+
+// Output formats.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Interval in which a message is logged at most repeatBurst times, unless configured otherwise.
+const DefaultRepeatInterval = time.Minute
+
+// Times a message is logged per repeat interval before further repetitions are suppressed.
+const repeatBurst = 5
+
+// Number of tracked messages above which messages whose repeat interval elapsed are forgotten.
+const maxTrackedMessages = 1024
+
+var levelNames = []string{"debug", "info", "warn", "error", "off"}
+
+var defaultLogger atomic.Pointer[Logger]
+
+func init() {
+	defaultLogger.Store(New(os.Stderr, Config{
+		Level:          LevelInfo,
+		Format:         FormatText,
+		RepeatInterval: DefaultRepeatInterval,
+	}))
+}
+
+// Settings of a logger.
+type Config struct {
+	// Minimum level of logged messages
+	Level Level
+	// FormatText or FormatJSON
+	Format string
+	// Interval in which a message (a format string with the logger's fields) is logged at most
+	// repeatBurst times. Suppressed repetitions are counted in the next logged repetition. Zero
+	// disables rate limiting.
+	RepeatInterval time.Duration
+}
+
+// Leveled logger with fields added to each message. Loggers derived with [Logger.With] share their
+// output and rate limits. A nil logger logs through [Default].
+type Logger struct {
+	sink   *sink
+	fields []field
+}
+
+// Key-value pair added to messages.
+type field struct {
+	key   string
+	value any
+}
+
+// Output shared by a logger and the loggers derived from it.
+type sink struct {
+	mu             sync.Mutex
+	out            io.Writer
+	level          Level
+	json           bool
+	repeatInterval time.Duration
+	repeats        map[string]*repeat
+	now            func() time.Time
+}
+
+// Repetitions of a message in the current repeat interval.
+type repeat struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+// Parses a level. Accepts the values of the log_level option of Fluent Bit, where "trace" is
+// treated as "debug".
+//
+// Parameters:
+//   - name: Level name, case-insensitive
+//
+// Returns:
+//   - level: Parsed level
+//   - err: Unknown level
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "trace", "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	case "off":
+		return LevelOff, nil
+	}
+	return 0, fmt.Errorf("invalid log level %q: must be off, error, warn, info, debug or trace",
+		name)
+}
+
+// Returns the name of the level.
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// Validates an output format.
+//
+// Parameters:
+//   - format: Format name
+//
+// Returns:
+//   - err: Unknown format
+func ValidateFormat(format string) error {
+	if format != FormatText && format != FormatJSON {
+		return fmt.Errorf("invalid log format %q: must be %q or %q", format, FormatText, FormatJSON)
+	}
+	return nil
+}
+
+// Creates a logger.
+//
+// Parameters:
+//   - out: Destination of messages
+//   - config: Settings of the logger. An unknown format is treated as FormatText.
+//
+// Returns:
+//   - logger: Logger without fields
+func New(out io.Writer, config Config) *Logger {
+	return &Logger{sink: &sink{
+		out:            out,
+		level:          config.Level,
+		json:           config.Format == FormatJSON,
+		repeatInterval: config.RepeatInterval,
+		repeats:        make(map[string]*repeat),
+		now:            time.Now,
+	}}
+}
+
+// Returns the logger of messages not tied to a plugin instance, e.g. of the metrics server.
+func Default() *Logger {
+	return defaultLogger.Load()
+}
+
+// Replaces the default logger. Plugins set it to the logger of the instance initialized last,
+// without the instance's fields.
+//
+// Parameters:
+//   - logger: New default logger
+func SetDefault(logger *Logger) {
+	defaultLogger.Store(logger)
+}
+
+// Derives a logger adding a field to each message.
+//
+// Parameters:
+//   - key: Field name
+//   - value: Field value
+//
+// Returns:
+//   - logger: Logger sharing the output and rate limits of l
+func (l *Logger) With(key string, value any) *Logger {
+	l = l.orDefault()
+	fields := make([]field, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	return &Logger{sink: l.sink, fields: append(fields, field{key: key, value: value})}
+}
+
+// Checks if messages of a level are logged, to skip building expensive arguments.
+func (l *Logger) Enabled(level Level) bool {
+	l = l.orDefault()
+	return level >= l.sink.level && l.sink.level != LevelOff
+}
+
+// Logs a debug message. Arguments are handled as by [fmt.Printf].
+func (l *Logger) Debugf(format string, args ...any) {
+	l.orDefault().log(LevelDebug, format, args)
+}
+
+// Logs an info message. Arguments are handled as by [fmt.Printf].
+func (l *Logger) Infof(format string, args ...any) {
+	l.orDefault().log(LevelInfo, format, args)
+}
+
+// Logs a warning. Arguments are handled as by [fmt.Printf].
+func (l *Logger) Warnf(format string, args ...any) {
+	l.orDefault().log(LevelWarn, format, args)
+}
+
+// Logs an error. Arguments are handled as by [fmt.Printf].
+func (l *Logger) Errorf(format string, args ...any) {
+	l.orDefault().log(LevelError, format, args)
+}
+
+// Logs an error regardless of level and rate limits, then exits with status 1.
+func (l *Logger) Fatalf(format string, args ...any) {
+	l = l.orDefault()
+	l.sink.mu.Lock()
+	l.sink.write(LevelError, fmt.Sprintf(format, args...), l.fields, 0)
+	l.sink.mu.Unlock()
+	os.Exit(1)
+}
+
+// Returns [Default] if l is nil.
+func (l *Logger) orDefault() *Logger {
+	if l == nil {
+		return Default()
+	}
+	return l
+}
+
+// Logs a message unless its level is disabled or its repetitions are suppressed.
+//
+// Parameters:
+//   - level: Level of the message
+//   - format: Format string, which identifies the message for rate limiting
+//   - args: Arguments of the format string
+func (l *Logger) log(level Level, format string, args []any) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	s := l.sink
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	suppressed, ok := s.allow(l.repeatKey(level, format))
+	if !ok {
+		return
+	}
+	s.write(level, fmt.Sprintf(format, args...), l.fields, suppressed)
+}
+
+// Identifies repetitions of a message: the same level and format string logged with the same
+// fields.
+func (l *Logger) repeatKey(level Level, format string) string {
+	var key strings.Builder
+	key.WriteString(level.String())
+	key.WriteByte(0)
+	key.WriteString(format)
+	for _, f := range l.fields {
+		fmt.Fprintf(&key, "\x00%s=%v", f.key, f.value)
+	}
+	return key.String()
+}
+
+// Counts a repetition of a message. The caller must hold mu.
+//
+// Parameters:
+//   - key: Message identifier
+//
+// Returns:
+//   - suppressed: Repetitions suppressed in the previous interval, to report with this one
+//   - ok: Whether the repetition is logged
+func (s *sink) allow(key string) (int, bool) {
+	if s.repeatInterval <= 0 {
+		return 0, true
+	}
+
+	now := s.now()
+	r, exists := s.repeats[key]
+	if !exists {
+		if len(s.repeats) >= maxTrackedMessages {
+			s.forgetExpired(now)
+		}
+		r = &repeat{start: now}
+		s.repeats[key] = r
+	}
+
+	suppressed := 0
+	if now.Sub(r.start) >= s.repeatInterval {
+		suppressed = r.suppressed
+		*r = repeat{start: now}
+	}
+	r.count++
+	if r.count > repeatBurst {
+		r.suppressed++
+		return 0, false
+	}
+	return suppressed, true
+}
+
+// Forgets messages whose repeat interval elapsed without suppressed repetitions. The caller must
+// hold mu.
+func (s *sink) forgetExpired(now time.Time) {
+	for key, r := range s.repeats {
+		if now.Sub(r.start) >= s.repeatInterval && r.suppressed == 0 {
+			delete(s.repeats, key)
+		}
+	}
+}
+
+// Writes a message as one line. The caller must hold mu.
+//
+// Parameters:
+//   - level: Level of the message
+//   - message: Formatted message
+//   - fields: Fields of the logger
+//   - suppressed: Repetitions suppressed before this one, added as a field if non-zero
+func (s *sink) write(level Level, message string, fields []field, suppressed int) {
+	if suppressed > 0 {
+		fields = append(fields[:len(fields):len(fields)], field{"suppressed", suppressed})
+	}
+
+	var line []byte
+	if s.json {
+		line = formatJSON(s.now(), level, message, fields)
+	} else {
+		line = formatText(s.now(), level, message, fields)
+	}
+	// Nothing sensible can be done if stderr cannot be written to.
+	_, _ = s.out.Write(line)
+}
+
+// Formats a message like the standard logger, with the level in brackets and fields appended as
+// key=value pairs. Values containing spaces, quotes or equal signs are quoted.
+func formatText(now time.Time, level Level, message string, fields []field) []byte {
+	var line strings.Builder
+	line.WriteString(now.Format("2006/01/02 15:04:05"))
+	line.WriteString(" [")
+	line.WriteString(level.String())
+	line.WriteString("] ")
+	line.WriteString(strings.TrimSuffix(message, "\n"))
+	for _, f := range fields {
+		value := fmt.Sprint(f.value)
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = strconv.Quote(value)
+		}
+		line.WriteByte(' ')
+		line.WriteString(f.key)
+		line.WriteByte('=')
+		line.WriteString(value)
+	}
+	line.WriteByte('\n')
+	return []byte(line.String())
+}
+
+// Formats a message as a JSON object with "time", "level" and "msg" keys followed by the fields.
+// Field values which cannot be encoded are formatted as strings.
+func formatJSON(now time.Time, level Level, message string, fields []field) []byte {
+	line := []byte(`{"time":`)
+	line = appendJSON(line, now.Format(time.RFC3339Nano))
+	line = append(line, `,"level":`...)
+	line = appendJSON(line, level.String())
+	line = append(line, `,"msg":`...)
+	line = appendJSON(line, strings.TrimSuffix(message, "\n"))
+	for _, f := range fields {
+		line = append(line, ',')
+		line = appendJSON(line, f.key)
+		line = append(line, ':')
+		value := f.value
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		line = appendJSON(line, value)
+	}
+	return append(line, "}\n"...)
+}
+
+// Appends the JSON encoding of a value, or of its string form if it cannot be encoded.
+func appendJSON(line []byte, value any) []byte {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+	return append(line, encoded...)
+}
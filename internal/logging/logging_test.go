@@ -0,0 +1,118 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLevel(t *testing.T) {
+	tests := map[string]Level{
+		"trace":   LevelDebug,
+		"debug":   LevelDebug,
+		"Info":    LevelInfo,
+		"warn":    LevelWarn,
+		"warning": LevelWarn,
+		"error":   LevelError,
+		"off":     LevelOff,
+	}
+	for name, want := range tests {
+		got, err := ParseLevel(name)
+		if err != nil || got != want {
+			t.Errorf("ParseLevel(%q) = %v, %v; want %v", name, got, err, want)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("ParseLevel(\"verbose\") should fail")
+	}
+}
+
+func TestLevels(t *testing.T) {
+	var out bytes.Buffer
+	logger := New(&out, Config{Level: LevelWarn, Format: FormatText})
+	logger.Debugf("debug")
+	logger.Infof("info")
+	logger.Warnf("warn")
+	logger.Errorf("error")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "[warn] warn") ||
+		!strings.HasSuffix(lines[1], "[error] error") {
+		t.Errorf("output at warn level = %q, want the warning and the error", out.String())
+	}
+
+	out.Reset()
+	New(&out, Config{Level: LevelOff}).Errorf("error")
+	if out.Len() != 0 {
+		t.Errorf("output at off level = %q, want none", out.String())
+	}
+}
+
+func TestFields(t *testing.T) {
+	var out bytes.Buffer
+	logger := New(&out, Config{Level: LevelDebug, Format: FormatText}).With("id", "a")
+	logger.With("tag", "app log").Infof("uploaded %d bytes", 10)
+	logger.Infof("parent")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if !strings.HasSuffix(lines[0], `[info] uploaded 10 bytes id=a tag="app log"`) {
+		t.Errorf("text line = %q, want quoted tag field", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], "[info] parent id=a") {
+		t.Errorf("parent line = %q, want only the id field", lines[1])
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var out bytes.Buffer
+	logger := New(&out, Config{Level: LevelInfo, Format: FormatJSON})
+	logger.With("tag", "app").With("err", errors.New("denied")).Errorf("upload %q failed", "k")
+
+	var message map[string]any
+	if err := json.Unmarshal(out.Bytes(), &message); err != nil {
+		t.Fatalf("invalid JSON line %q: %v", out.String(), err)
+	}
+	if message["level"] != "error" || message["msg"] != `upload "k" failed` ||
+		message["tag"] != "app" || message["err"] != "denied" || message["time"] == nil {
+		t.Errorf("JSON message = %v", message)
+	}
+}
+
+func TestRepeatRateLimit(t *testing.T) {
+	var out bytes.Buffer
+	logger := New(&out, Config{Level: LevelInfo, RepeatInterval: time.Minute})
+	now := time.Now()
+	logger.sink.now = func() time.Time { return now }
+
+	for i := range repeatBurst + 3 {
+		logger.Warnf("attempt %d failed", i)
+	}
+	logger.With("tag", "other").Warnf("attempt %d failed", 0)
+	if lines := strings.Count(out.String(), "\n"); lines != repeatBurst+1 {
+		t.Errorf("logged %d lines, want %d repetitions and one for another tag:\n%s",
+			lines, repeatBurst, out.String())
+	}
+
+	out.Reset()
+	now = now.Add(time.Minute)
+	logger.Warnf("attempt %d failed", 9)
+	if !strings.HasSuffix(out.String(), "attempt 9 failed suppressed=3\n") {
+		t.Errorf("first repetition of the next interval = %q, want suppressed=3", out.String())
+	}
+}
+
+func TestNilLoggerUsesDefault(t *testing.T) {
+	previous := Default()
+	defer SetDefault(previous)
+
+	var out bytes.Buffer
+	SetDefault(New(&out, Config{Level: LevelInfo}))
+	var logger *Logger
+	logger.With("id", "a").Infof("hello")
+	if !strings.HasSuffix(out.String(), "[info] hello id=a\n") {
+		t.Errorf("nil logger output = %q, want the default logger's", out.String())
+	}
+}
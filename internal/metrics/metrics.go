@@ -0,0 +1,355 @@
+// Package collects metrics of the output plugins and exposes them in the Prometheus text format,
+// optionally on an embedded HTTP server (see [Serve]). Metrics are recorded whether or not they
+// are served, which only costs a map lookup per update.
+
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric types, as named in the Prometheus text format.
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// Separates label values in series keys. Not valid in UTF-8, so it never occurs in a value.
+const labelSeparator = "\xff"
+
+// Set of metrics exposed together.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+// Registry of the plugin's metrics, served by [Serve].
+var Default = NewRegistry()
+
+// Creates an empty registry.
+//
+// Returns:
+//   - registry: Empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Metric with a fixed set of labels, holding one series per combination of label values.
+type family struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// Values of one combination of label values.
+type series struct {
+	labelValues []string
+	// Value of a counter or gauge, sum of a histogram's observations
+	value float64
+	// Number of observations of a histogram per bucket, not cumulative
+	bucketCounts []uint64
+	// Number of observations of a histogram
+	count uint64
+}
+
+// Counter, which only increases (e.g. records decoded).
+type Counter struct {
+	family *family
+}
+
+// Gauge, which goes up and down (e.g. open streams).
+type Gauge struct {
+	family *family
+}
+
+// Histogram of observations (e.g. upload latency).
+type Histogram struct {
+	family *family
+}
+
+// Registers a counter.
+//
+// Parameters:
+//   - name: Metric name, ending with "_total" by convention
+//   - help: Description of the metric
+//   - labels: Label names, whose values are given in the order of labels on each update
+//
+// Returns:
+//   - counter: Registered counter
+func (r *Registry) NewCounter(name string, help string, labels ...string) *Counter {
+	return &Counter{family: r.register(name, help, typeCounter, nil, labels)}
+}
+
+// Registers a gauge.
+//
+// Parameters:
+//   - name: Metric name
+//   - help: Description of the metric
+//   - labels: Label names, whose values are given in the order of labels on each update
+//
+// Returns:
+//   - gauge: Registered gauge
+func (r *Registry) NewGauge(name string, help string, labels ...string) *Gauge {
+	return &Gauge{family: r.register(name, help, typeGauge, nil, labels)}
+}
+
+// Registers a histogram.
+//
+// Parameters:
+//   - name: Metric name
+//   - help: Description of the metric
+//   - buckets: Increasing upper bounds of the buckets, without +Inf
+//   - labels: Label names, whose values are given in the order of labels on each update
+//
+// Returns:
+//   - histogram: Registered histogram
+func (r *Registry) NewHistogram(
+	name string,
+	help string,
+	buckets []float64,
+	labels ...string,
+) *Histogram {
+	if !slices.IsSorted(buckets) {
+		panic(fmt.Sprintf("buckets of histogram %s are not sorted", name))
+	}
+	return &Histogram{family: r.register(name, help, typeHistogram, buckets, labels)}
+}
+
+// Adds a metric family to the registry.
+func (r *Registry) register(
+	name string,
+	help string,
+	typ string,
+	buckets []float64,
+	labels []string,
+) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, f := range r.families {
+		if f.name == name {
+			panic(fmt.Sprintf("metric %s is already registered", name))
+		}
+	}
+	f := &family{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	r.families = append(r.families, f)
+	return f
+}
+
+// Retrieves the series of the given label values, creating it if needed. The caller must hold the
+// family's mutex.
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s takes %d label values, got %d",
+			f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, labelSeparator)
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: slices.Clone(labelValues)}
+		if f.buckets != nil {
+			s.bucketCounts = make([]uint64, len(f.buckets)+1)
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Removes the series of the given label values, e.g. of a closed stream.
+func (f *family) delete(labelValues []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.series, strings.Join(labelValues, labelSeparator))
+}
+
+// Increments the counter by one.
+//
+// Parameters:
+//   - labelValues: Values of the counter's labels
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Increases the counter. Negative values are ignored since counters never decrease.
+//
+// Parameters:
+//   - value: Increase
+//   - labelValues: Values of the counter's labels
+func (c *Counter) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		return
+	}
+	c.family.mu.Lock()
+	defer c.family.mu.Unlock()
+	c.family.get(labelValues).value += value
+}
+
+// Sets the gauge.
+//
+// Parameters:
+//   - value: Value of the gauge
+//   - labelValues: Values of the gauge's labels
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.family.mu.Lock()
+	defer g.family.mu.Unlock()
+	g.family.get(labelValues).value = value
+}
+
+// Adds to the gauge.
+//
+// Parameters:
+//   - value: Change of the gauge, negative to decrease it
+//   - labelValues: Values of the gauge's labels
+func (g *Gauge) Add(value float64, labelValues ...string) {
+	g.family.mu.Lock()
+	defer g.family.mu.Unlock()
+	g.family.get(labelValues).value += value
+}
+
+// Removes the gauge's series for the given label values, e.g. once a stream is closed.
+//
+// Parameters:
+//   - labelValues: Values of the gauge's labels
+func (g *Gauge) Delete(labelValues ...string) {
+	g.family.delete(labelValues)
+}
+
+// Records an observation.
+//
+// Parameters:
+//   - value: Observed value
+//   - labelValues: Values of the histogram's labels
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.family.mu.Lock()
+	defer h.family.mu.Unlock()
+	s := h.family.get(labelValues)
+	bucket, _ := slices.BinarySearch(h.family.buckets, value)
+	s.bucketCounts[bucket]++
+	s.count++
+	s.value += value
+}
+
+// Writes all metrics in the Prometheus text format (version 0.0.4). Metrics without series are
+// omitted.
+//
+// Parameters:
+//   - w: Destination
+//
+// Returns:
+//   - err: Error writing
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	families := slices.Clone(r.families)
+	r.mu.Unlock()
+
+	out := bufio.NewWriter(w)
+	for _, f := range families {
+		f.writeText(out)
+	}
+	return out.Flush()
+}
+
+// Writes a family in the Prometheus text format.
+func (f *family) writeText(out *bufio.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.series) == 0 {
+		return
+	}
+
+	fmt.Fprintf(out, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(out, "# TYPE %s %s\n", f.name, f.typ)
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		if f.typ != typeHistogram {
+			writeSample(out, f.name, f.labels, s.labelValues, "", "", s.value)
+			continue
+		}
+		var cumulative uint64
+		for i, upperBound := range f.buckets {
+			cumulative += s.bucketCounts[i]
+			writeSample(out, f.name+"_bucket", f.labels, s.labelValues, "le",
+				formatFloat(upperBound), float64(cumulative))
+		}
+		writeSample(out, f.name+"_bucket", f.labels, s.labelValues, "le", "+Inf",
+			float64(s.count))
+		writeSample(out, f.name+"_sum", f.labels, s.labelValues, "", "", s.value)
+		writeSample(out, f.name+"_count", f.labels, s.labelValues, "", "", float64(s.count))
+	}
+}
+
+// Writes a sample line, e.g. `name{tag="app",le="0.5"} 3`.
+func writeSample(
+	out *bufio.Writer,
+	name string,
+	labels []string,
+	labelValues []string,
+	extraLabel string,
+	extraValue string,
+	value float64,
+) {
+	out.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		out.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			fmt.Fprintf(out, "%s=\"%s\"", label, escapeLabelValue(labelValues[i]))
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				out.WriteByte(',')
+			}
+			fmt.Fprintf(out, "%s=\"%s\"", extraLabel, extraValue)
+		}
+		out.WriteByte('}')
+	}
+	out.WriteByte(' ')
+	out.WriteString(formatFloat(value))
+	out.WriteByte('\n')
+}
+
+// Formats a sample value.
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+// Escapes the text of a HELP line.
+var escapeHelp = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace
+
+// Escapes a label value.
+var escapeLabelValue = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace
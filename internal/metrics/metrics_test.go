@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_WriteText(t *testing.T) {
+	registry := NewRegistry()
+	records := registry.NewCounter("records_total", "Records\nwritten.", "tag")
+	streams := registry.NewGauge("streams", "Open streams.")
+	latency := registry.NewHistogram("latency_seconds", "Latency.", []float64{0.5, 1}, "tag")
+	registry.NewCounter("unused_total", "Never updated.", "tag")
+
+	records.Inc("b")
+	records.Add(2.5, `a"\`)
+	records.Add(-1, "b")
+	streams.Set(3)
+	streams.Add(-1)
+	latency.Observe(0.25, "a")
+	latency.Observe(1, "a")
+	latency.Observe(7, "a")
+
+	var out strings.Builder
+	if err := registry.WriteText(&out); err != nil {
+		t.Fatalf("WriteText() error = %v", err)
+	}
+	want := `# HELP records_total Records\nwritten.
+# TYPE records_total counter
+records_total{tag="a\"\\"} 2.5
+records_total{tag="b"} 1
+# HELP streams Open streams.
+# TYPE streams gauge
+streams 2
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{tag="a",le="0.5"} 1
+latency_seconds_bucket{tag="a",le="1"} 2
+latency_seconds_bucket{tag="a",le="+Inf"} 3
+latency_seconds_sum{tag="a"} 8.25
+latency_seconds_count{tag="a"} 3
+`
+	if out.String() != want {
+		t.Errorf("WriteText() = %q, want %q", out.String(), want)
+	}
+
+	streams.Delete()
+	out.Reset()
+	if err := registry.WriteText(&out); err != nil {
+		t.Fatalf("WriteText() error = %v", err)
+	}
+	if strings.Contains(out.String(), "streams") {
+		t.Errorf("WriteText() after Delete() = %q, want no streams", out.String())
+	}
+}
+
+func TestServe(t *testing.T) {
+	RecordsDecoded.Add(3, "serve-test")
+
+	server, err := Serve("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Serve() error = %v", err)
+	}
+	defer server.Close()
+
+	resp, err := http.Get("http://" + server.Addr().String() + Path)
+	if err != nil {
+		t.Fatalf("GET %s error = %v", Path, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	want := `fluentbit_clp_records_decoded_total{tag="serve-test"} 3`
+	if !strings.Contains(string(body), want) {
+		t.Errorf("GET %s = %q, want it to contain %q", Path, body, want)
+	}
+
+	shared, err := Serve("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Serve() error = %v", err)
+	}
+	if shared != server {
+		t.Error("Serve() on the same address did not share the server")
+	}
+	if err := shared.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+}
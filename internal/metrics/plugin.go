@@ -0,0 +1,134 @@
+package metrics
+
+import (
+	"time"
+)
+
+// Values of the result label of [Uploads] and [RecoveredBuffers].
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+	// Recovered buffer which held no events and was deleted
+	ResultEmpty = "empty"
+)
+
+// Values of the timer label of [FlushTimerFires].
+const (
+	TimerHard  = "hard"
+	TimerSoft  = "soft"
+	TimerRetry = "retry"
+)
+
+// Upper bounds of the upload latency buckets in seconds.
+var uploadDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// Metrics of the output plugins. Series are labelled by the Fluent Bit tag, except that the v2
+// plugin labels the series of its streams (all but records decoded and decode failures) by the
+// stream's path, which is the tag unless stream_key is set.
+var (
+	RecordsDecoded = Default.NewCounter(
+		"fluentbit_clp_records_decoded_total",
+		"Records decoded from Fluent Bit chunks and written to IR.",
+		"tag",
+	)
+	DecodeFailures = Default.NewCounter(
+		"fluentbit_clp_decode_failures_total",
+		"Records or chunks which could not be decoded.",
+		"tag",
+	)
+	IrBytes = Default.NewCounter(
+		"fluentbit_clp_ir_bytes_total",
+		"Bytes of IR written, before Zstd compression.",
+		"tag",
+	)
+	ZstdBytes = Default.NewCounter(
+		"fluentbit_clp_zstd_bytes_total",
+		"Bytes of Zstd output uploaded, each counted once however often it is synced. The "+
+			"compression ratio is ir_bytes_total / zstd_bytes_total.",
+		"tag",
+	)
+	BufferBytes = Default.NewGauge(
+		"fluentbit_clp_buffer_bytes",
+		"Bytes of Zstd output in disk buffers, as of the last upload check.",
+		"tag",
+	)
+	OpenStreams = Default.NewGauge(
+		"fluentbit_clp_open_streams",
+		"Streams with open buffers.",
+	)
+	Uploads = Default.NewCounter(
+		"fluentbit_clp_uploads_total",
+		"Upload attempts by result.",
+		"tag",
+		"result",
+	)
+	UploadDuration = Default.NewHistogram(
+		"fluentbit_clp_upload_duration_seconds",
+		"Latency of upload attempts, including failed ones.",
+		uploadDurationBuckets,
+		"tag",
+	)
+	RecoveredBuffers = Default.NewCounter(
+		"fluentbit_clp_recovered_buffers_total",
+		"Disk buffers of a previous run recovered on start by result.",
+		"tag",
+		"result",
+	)
+	FlushTimerFires = Default.NewCounter(
+		"fluentbit_clp_flush_timer_fires_total",
+		"Flush timer fires of the v2 plugin by timer.",
+		"tag",
+		"timer",
+	)
+	DiskQuotaRetries = Default.NewCounter(
+		"fluentbit_clp_disk_quota_retries_total",
+		"Chunks of the v1 plugin retried because a disk quota was reached.",
+		"tag",
+	)
+	DroppedEvents = Default.NewCounter(
+		"fluentbit_clp_dropped_events_total",
+		"Events of the v1 plugin dropped or discarded from disk buffers to meet a disk quota.",
+		"tag",
+	)
+	DroppedBufferBytes = Default.NewCounter(
+		"fluentbit_clp_dropped_buffer_bytes_total",
+		"Bytes of Zstd output of the v1 plugin discarded from disk buffers to meet a disk quota.",
+		"tag",
+	)
+)
+
+// Records the result and latency of an upload attempt.
+//
+// Parameters:
+//   - tag: Tag or stream of the upload
+//   - start: Time the attempt started
+//   - err: Error of the attempt, nil if it succeeded
+func ObserveUpload(tag string, start time.Time, err error) {
+	UploadDuration.Observe(time.Since(start).Seconds(), tag)
+	Uploads.Inc(tag, result(err))
+}
+
+// Records the outcome of recovering a disk buffer.
+//
+// Parameters:
+//   - tag: Tag or stream of the buffer
+//   - err: Error recovering the buffer, nil if it succeeded
+func ObserveRecovery(tag string, err error) {
+	RecoveredBuffers.Inc(tag, result(err))
+}
+
+// Maps an error to the value of a result label.
+func result(err error) string {
+	if err != nil {
+		return ResultFailure
+	}
+	return ResultSuccess
+}
+
+// Removes the per-stream gauges of a closed stream, so closed streams do not accumulate.
+//
+// Parameters:
+//   - tag: Tag or stream
+func CloseStream(tag string) {
+	BufferBytes.Delete(tag)
+}
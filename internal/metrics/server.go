@@ -0,0 +1,137 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/y-scope/fluent-bit-clp/internal/logging"
+)
+
+// Path metrics are served at.
+const Path = "/metrics"
+
+// Content type of the Prometheus text format.
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Time allowed for requests in progress to finish when a server is closed.
+const shutdownTimeout = 5 * time.Second
+
+// HTTP server exposing [Default]. Plugin instances listening on the same address share a server,
+// which stops once every instance closed it.
+type Server struct {
+	addr     string
+	server   *http.Server
+	listener net.Listener
+	// Number of plugin instances using the server
+	refs int
+}
+
+// Servers by listen address.
+var (
+	serversMu sync.Mutex
+	servers   = make(map[string]*Server)
+)
+
+// Starts serving [Default] at [Path] on an address, or reuses the server already listening there.
+//
+// Parameters:
+//   - addr: Listen address, e.g. ":2021" or "127.0.0.1:2021"
+//
+// Returns:
+//   - server: Server, to be closed when the plugin instance exits
+//   - err: Error listening
+func Serve(addr string) (*Server, error) {
+	serversMu.Lock()
+	defer serversMu.Unlock()
+	if s, ok := servers[addr]; ok {
+		s.refs++
+		return s, nil
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening for metrics on %s: %w", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(Path, Handler(Default))
+	s := &Server{
+		addr: addr,
+		server: &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+		listener: listener,
+		refs:     1,
+	}
+	servers[addr] = s
+
+	go func() {
+		err := s.server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.Default().Errorf("Metrics server on %s failed: %v", addr, err)
+		}
+	}()
+	logging.Default().Infof("Serving metrics on http://%s%s", listener.Addr(), Path)
+	return s, nil
+}
+
+// Address the server listens on, with the port resolved if addr had port 0.
+//
+// Returns:
+//   - addr: Listen address
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Releases the server. The server stops once every plugin instance using it closed it.
+//
+// Returns:
+//   - err: Error shutting down the server
+func (s *Server) Close() error {
+	serversMu.Lock()
+	s.refs--
+	if s.refs > 0 {
+		serversMu.Unlock()
+		return nil
+	}
+	delete(servers, s.addr)
+	serversMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := s.server.Shutdown(ctx)
+	if err != nil {
+		return fmt.Errorf("error shutting down metrics server on %s: %w", s.addr, err)
+	}
+	return nil
+}
+
+// Creates an HTTP handler serving a registry in the Prometheus text format.
+//
+// Parameters:
+//   - registry: Metrics to serve
+//
+// Returns:
+//   - handler: HTTP handler
+func Handler(registry *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		if r.Method == http.MethodHead {
+			return
+		}
+		err := registry.WriteText(w)
+		if err != nil {
+			logging.Default().Warnf("Failed to write metrics: %v", err)
+		}
+	})
+}
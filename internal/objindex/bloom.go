@@ -0,0 +1,96 @@
+package objindex
+
+import (
+	"hash/fnv"
+)
+
+// Number of hash functions of Bloom filters. Optimal for about 10 bits per item, where the false
+// positive rate is about 1%.
+const bloomHashes = 7
+
+// Bloom filter over the values of an object's events. The zero value has no bits and may contain
+// anything.
+//
+// Bit i is bit i%8 of Bits[i/8]. An item sets the bits (h1 + n*h2) mod len(Bits)*8 for n in
+// [0, Hashes), where h1 is the low 32 bits of the FNV-1a 64-bit hash of the item's UTF-8 bytes and
+// h2 its high 32 bits with the lowest bit set.
+type Bloom struct {
+	// Bits of the filter, base64 encoded in JSON
+	Bits []byte `json:"bits"`
+	// Number of hash functions
+	Hashes int `json:"hashes"`
+	// Number of items which set at least one bit, an estimate of the distinct items added
+	Items int64 `json:"items"`
+}
+
+// Creates an empty Bloom filter.
+//
+// Parameters:
+//   - size: Size of the filter in bytes
+//
+// Returns:
+//   - bloom: Empty filter
+func newBloom(size int) *Bloom {
+	return &Bloom{Bits: make([]byte, size), Hashes: bloomHashes}
+}
+
+// Adds an item to the filter.
+//
+// Parameters:
+//   - item: Item to add
+func (b *Bloom) Add(item string) {
+	bits := uint64(len(b.Bits)) * 8
+	if bits == 0 {
+		return
+	}
+	h1, h2 := bloomHash(item)
+	added := false
+	for n := range uint64(b.Hashes) {
+		i := (h1 + n*h2) % bits
+		mask := byte(1) << (i % 8)
+		if b.Bits[i/8]&mask == 0 {
+			b.Bits[i/8] |= mask
+			added = true
+		}
+	}
+	if added {
+		b.Items++
+	}
+}
+
+// Tests whether an item may have been added to the filter. False positives are possible, false
+// negatives are not.
+//
+// Parameters:
+//   - item: Item to look up
+//
+// Returns:
+//   - mayContain: False if the item was definitely not added
+func (b *Bloom) MayContain(item string) bool {
+	bits := uint64(len(b.Bits)) * 8
+	if bits == 0 {
+		return true
+	}
+	h1, h2 := bloomHash(item)
+	for n := range uint64(b.Hashes) {
+		i := (h1 + n*h2) % bits
+		if b.Bits[i/8]&(byte(1)<<(i%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Clears the filter, keeping its size.
+func (b *Bloom) reset() {
+	clear(b.Bits)
+	b.Items = 0
+}
+
+// Hashes an item into the two hashes combined by the filter.
+func bloomHash(item string) (uint64, uint64) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(item))
+	sum := h.Sum64()
+	return sum & 0xffffffff, sum>>32 | 1
+}
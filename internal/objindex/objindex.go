@@ -0,0 +1,306 @@
+// Package writes sidecar indexes of uploaded objects, so a search tool or CLP ingestion can skip
+// objects which cannot match a query without downloading them. The index of an object records the
+// time range and number of its events, the keys seen in them, and a Bloom filter over their values
+// and CLP dictionary variables.
+
+package objindex
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/y-scope/fluent-bit-clp/internal/objmeta"
+)
+
+// Suffix appended to an object's key to name its index.
+const KeySuffix = ".objindex.json"
+
+// Content type of index objects.
+const ContentType = "application/json"
+
+// Version of the index format.
+const Version = 1
+
+// Default size of Bloom filters in bytes, enough for about 50,000 distinct values at a false
+// positive rate of 1%.
+const DefaultBloomSize = 64 * 1024
+
+// Maximum number of distinct keys recorded. Objects with more keys record none (see
+// [Index.KeysTruncated]), which bounds the size of indexes of schemaless records.
+const maxKeys = 1024
+
+// Maximum length of a string value added to the Bloom filter as a whole. Longer values (e.g. log
+// messages) only add their dictionary variables.
+const maxValueLength = 256
+
+// Index of an object. An index is only valid for the object it was written with: readers must
+// ignore an index whose ObjectSize differs from the object's size, e.g. because the object was
+// replaced after a crash.
+type Index struct {
+	// Version of the index format
+	Version int `json:"version"`
+	// Key of the indexed object
+	Object string `json:"object"`
+	// Size of the indexed object in bytes
+	ObjectSize int64 `json:"object_size"`
+	// Number of events in the object
+	EventCount int64 `json:"event_count"`
+	// Timestamp of the earliest event. Omitted if unknown.
+	EventStart time.Time `json:"event_start,omitzero"`
+	// Timestamp of the latest event. Omitted if unknown.
+	EventEnd time.Time `json:"event_end,omitzero"`
+	// Sorted paths of the keys seen in events, nested keys joined with "."
+	Keys []string `json:"keys"`
+	// Set if events had too many distinct keys to record; Keys is empty.
+	KeysTruncated bool `json:"keys_truncated,omitempty"`
+	// Filter over the values and dictionary variables of events
+	Bloom *Bloom `json:"bloom"`
+}
+
+// Parses an index.
+//
+// Parameters:
+//   - data: JSON encoded index
+//
+// Returns:
+//   - index: Parsed index
+//   - err: Malformed JSON, unsupported version
+func Parse(data []byte) (*Index, error) {
+	var index Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse index: %w", err)
+	}
+	if index.Version != Version {
+		return nil, fmt.Errorf("unsupported index version %d", index.Version)
+	}
+	return &index, nil
+}
+
+// Tests whether the object may hold events in a time range. Objects with an unknown time range
+// may hold events at any time.
+//
+// Parameters:
+//   - start: Start of the range, zero for no lower bound
+//   - end: End of the range, zero for no upper bound
+//
+// Returns:
+//   - overlaps: False if the object definitely holds no event in the range
+func (ix *Index) Overlaps(start time.Time, end time.Time) bool {
+	if !end.IsZero() && !ix.EventStart.IsZero() && ix.EventStart.After(end) {
+		return false
+	}
+	if !start.IsZero() && !ix.EventEnd.IsZero() && ix.EventEnd.Before(start) {
+		return false
+	}
+	return true
+}
+
+// Tests whether events of the object may hold a key.
+//
+// Parameters:
+//   - path: Key path, nested keys joined with "."
+//
+// Returns:
+//   - hasKey: False if no event definitely holds the key
+func (ix *Index) HasKey(path string) bool {
+	if ix.KeysTruncated {
+		return true
+	}
+	_, found := slices.BinarySearch(ix.Keys, path)
+	return found
+}
+
+// Tests whether events of the object may hold a value, either as the whole value of a key (up to
+// 256 bytes) or as a dictionary variable of a string value.
+//
+// Parameters:
+//   - value: Value to look up, numbers and booleans formatted as in JSON
+//
+// Returns:
+//   - mayContain: False if no event definitely holds the value
+func (ix *Index) MayContain(value string) bool {
+	if ix.Bloom == nil {
+		return true
+	}
+	return ix.Bloom.MayContain(value)
+}
+
+// Collects the index of an object as events are written to it. Not safe for concurrent use.
+type Builder struct {
+	keys          map[string]struct{}
+	keysTruncated bool
+	bloom         *Bloom
+}
+
+// Creates a builder for the index of an empty object.
+//
+// Parameters:
+//   - bloomSize: Size of the Bloom filter in bytes
+//
+// Returns:
+//   - builder: Index builder
+func NewBuilder(bloomSize int) *Builder {
+	return &Builder{keys: make(map[string]struct{}), bloom: newBloom(bloomSize)}
+}
+
+// Adds the kv-pairs of an event to the index.
+//
+// Parameters:
+//   - kvPairs: User kv-pairs of the event
+func (b *Builder) Add(kvPairs map[string]any) {
+	b.addValue("", kvPairs)
+}
+
+// Adds a value and the values nested in it.
+//
+// Parameters:
+//   - path: Key path of the value, empty for the event's root
+//   - value: Value decoded from JSON
+func (b *Builder) addValue(path string, value any) {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, nested := range v {
+			nestedPath := key
+			if path != "" {
+				nestedPath = path + "." + key
+			}
+			b.addKey(nestedPath)
+			b.addValue(nestedPath, nested)
+		}
+	case []any:
+		for _, element := range v {
+			b.addValue(path, element)
+		}
+	case string:
+		if len(v) <= maxValueLength {
+			b.bloom.Add(v)
+		}
+		dictionaryVariables(v, b.bloom.Add)
+	case float64:
+		b.bloom.Add(strconv.FormatFloat(v, 'f', -1, 64))
+	case int:
+		b.bloom.Add(strconv.Itoa(v))
+	case int64:
+		b.bloom.Add(strconv.FormatInt(v, 10))
+	case uint64:
+		b.bloom.Add(strconv.FormatUint(v, 10))
+	case bool:
+		b.bloom.Add(strconv.FormatBool(v))
+	}
+}
+
+// Records a key path, unless too many keys were seen.
+func (b *Builder) addKey(path string) {
+	if b.keysTruncated {
+		return
+	}
+	if _, ok := b.keys[path]; ok {
+		return
+	}
+	if len(b.keys) >= maxKeys {
+		b.keysTruncated = true
+		clear(b.keys)
+		return
+	}
+	b.keys[path] = struct{}{}
+}
+
+// Builds the index of the object. The builder keeps collecting, so the index of a growing object
+// can be built again.
+//
+// Parameters:
+//   - object: Key of the object
+//   - objectSize: Size of the object in bytes
+//   - stats: Statistics of the object's events
+//
+// Returns:
+//   - index: Index of the object
+func (b *Builder) Build(object string, objectSize int64, stats *objmeta.Stats) *Index {
+	bloom := *b.bloom
+	bloom.Bits = slices.Clone(b.bloom.Bits)
+	keys := slices.Sorted(maps.Keys(b.keys))
+	if keys == nil {
+		keys = []string{}
+	}
+	return &Index{
+		Version:       Version,
+		Object:        object,
+		ObjectSize:    objectSize,
+		EventCount:    stats.Events,
+		EventStart:    stats.Start.UTC(),
+		EventEnd:      stats.End.UTC(),
+		Keys:          keys,
+		KeysTruncated: b.keysTruncated,
+		Bloom:         &bloom,
+	}
+}
+
+// Clears the builder for the next object.
+func (b *Builder) Reset() {
+	clear(b.keys)
+	b.keysTruncated = false
+	b.bloom.reset()
+}
+
+// Encodes the index of an object.
+//
+// Parameters:
+//   - object: Key of the object
+//   - objectSize: Size of the object in bytes
+//   - stats: Statistics of the object's events
+//
+// Returns:
+//   - data: JSON encoded index
+//   - err: Error encoding
+func (b *Builder) Marshal(object string, objectSize int64, stats *objmeta.Stats) ([]byte, error) {
+	data, err := json.Marshal(b.Build(object, objectSize, stats))
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal index of %s: %w", object, err)
+	}
+	return data, nil
+}
+
+// Finds the dictionary variables of text as CLP does: tokens delimited by characters other than
+// letters, digits and "+-./_\", which contain a digit or follow "=", and are not integers or
+// floating point numbers (CLP encodes those instead).
+//
+// Parameters:
+//   - text: Text to tokenize
+//   - yield: Called with each dictionary variable
+func dictionaryVariables(text string, yield func(string)) {
+	start := -1
+	for i, r := range text + " " {
+		if isTokenRune(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start < 0 {
+			continue
+		}
+		token := text[start:i]
+		afterEquals := start > 0 && text[start-1] == '='
+		if (afterEquals || strings.ContainsFunc(token, unicode.IsDigit)) && !isNumber(token) {
+			yield(token)
+		}
+		start = -1
+	}
+}
+
+// Tests whether a rune belongs to a token (see dictionaryVariables).
+func isTokenRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune(`+-./_\`, r)
+}
+
+// Tests whether a token is an integer or floating point number.
+func isNumber(token string) bool {
+	_, err := strconv.ParseFloat(token, 64)
+	return err == nil
+}
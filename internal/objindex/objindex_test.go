@@ -0,0 +1,124 @@
+package objindex
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/y-scope/fluent-bit-clp/internal/objmeta"
+)
+
+func TestBuilder(t *testing.T) {
+	builder := NewBuilder(DefaultBloomSize)
+	builder.Add(map[string]any{
+		"message": "request req-4f2a failed after 250 ms with code=E42 user id=alice",
+		"status":  float64(503),
+		"ok":      false,
+		"http":    map[string]any{"method": "GET", "path": "/api/v1/items"},
+		"tags":    []any{"blue", float64(7)},
+	})
+
+	start := time.Date(2024, 1, 15, 9, 0, 0, 0, time.UTC)
+	stats := objmeta.Stats{Events: 1, Start: start, End: start}
+	data, err := builder.Marshal("logs/app.clp.zst", 1234, &stats)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	index, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	wantKeys := []string{"http", "http.method", "http.path", "message", "ok", "status", "tags"}
+	if !reflect.DeepEqual(index.Keys, wantKeys) {
+		t.Errorf("Keys = %v, want %v", index.Keys, wantKeys)
+	}
+	if index.Object != "logs/app.clp.zst" || index.ObjectSize != 1234 || index.EventCount != 1 ||
+		!index.EventStart.Equal(start) {
+		t.Errorf("Parse() = %+v, want object, size, count and start of the builder", index)
+	}
+
+	present := []string{"req-4f2a", "E42", "alice", "503", "false", "GET", "/api/v1/items", "7"}
+	for _, value := range present {
+		if !index.MayContain(value) {
+			t.Errorf("MayContain(%q) = false, want true", value)
+		}
+	}
+	absent := []string{"req-0000", "250", "failed", "E43", "504"}
+	for _, value := range absent {
+		if index.MayContain(value) {
+			t.Errorf("MayContain(%q) = true, want false", value)
+		}
+	}
+	if !index.HasKey("http.method") || index.HasKey("method") {
+		t.Errorf("HasKey() does not match keys %v", index.Keys)
+	}
+
+	builder.Reset()
+	empty := builder.Build("k", 0, &objmeta.Stats{})
+	if len(empty.Keys) != 0 || empty.Bloom.Items != 0 || empty.MayContain("req-4f2a") {
+		t.Errorf("Build() after Reset() = %+v, want empty index", empty)
+	}
+	if !index.MayContain("req-4f2a") {
+		t.Error("Reset() cleared a previously built index")
+	}
+}
+
+func TestBuilder_KeyLimit(t *testing.T) {
+	builder := NewBuilder(DefaultBloomSize)
+	for i := range maxKeys + 1 {
+		builder.Add(map[string]any{fmt.Sprintf("key%d", i): "v"})
+	}
+	index := builder.Build("k", 0, &objmeta.Stats{})
+	if !index.KeysTruncated || len(index.Keys) != 0 || !index.HasKey("anything") {
+		t.Errorf("Build() = %d keys, truncated %v, want no keys and truncated",
+			len(index.Keys), index.KeysTruncated)
+	}
+}
+
+func TestIndex_Overlaps(t *testing.T) {
+	hour := func(h int) time.Time { return time.Date(2024, 1, 15, h, 0, 0, 0, time.UTC) }
+	index := Index{EventStart: hour(9), EventEnd: hour(10)}
+	tests := []struct {
+		start time.Time
+		end   time.Time
+		want  bool
+	}{
+		{hour(8), hour(9), true},
+		{hour(10), hour(11), true},
+		{hour(6), hour(8), false},
+		{hour(11), hour(12), false},
+		{hour(11), time.Time{}, false},
+		{time.Time{}, hour(8), false},
+		{time.Time{}, time.Time{}, true},
+	}
+	for _, tt := range tests {
+		if got := index.Overlaps(tt.start, tt.end); got != tt.want {
+			t.Errorf("Overlaps(%v, %v) = %v, want %v", tt.start, tt.end, got, tt.want)
+		}
+	}
+	if !(&Index{}).Overlaps(hour(11), hour(12)) {
+		t.Error("Overlaps() of an unknown time range = false, want true")
+	}
+}
+
+func TestDictionaryVariables(t *testing.T) {
+	var got []string
+	dictionaryVariables("user=bob took 1.5s, node-7 at 10.0.0.1 ids 42 -3", func(v string) {
+		got = append(got, v)
+	})
+	want := []string{"bob", "1.5s", "node-7", "10.0.0.1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("dictionaryVariables() = %v, want %v", got, want)
+	}
+}
+
+func TestParse_Version(t *testing.T) {
+	if _, err := Parse([]byte(`{"version": 2}`)); err == nil {
+		t.Error("Parse() of version 2 error = nil, want error")
+	}
+	if _, err := Parse([]byte(`{`)); err == nil {
+		t.Error("Parse() of malformed JSON error = nil, want error")
+	}
+}
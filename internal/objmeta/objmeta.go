@@ -0,0 +1,245 @@
+// Package describes uploaded objects with user metadata and tags, so the right object can be found
+// without downloading it. Statistics of the events written to an object are collected as they are
+// written, and stored with each upload of the object alongside its source.
+
+package objmeta
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/y-scope/fluent-bit-clp/internal/keytemplate"
+)
+
+// Metadata keys of uploaded objects. Keys are camel case so they are valid on every destination
+// (Azure requires C# identifiers); S3 returns them lowercased.
+const (
+	// Number of events in the object
+	MetadataEventCount = "clpEventCount"
+	// Timestamp of the earliest event, in RFC 3339 with nanoseconds
+	MetadataEventStart = "clpEventStart"
+	// Timestamp of the latest event, in RFC 3339 with nanoseconds
+	MetadataEventEnd = "clpEventEnd"
+	// Number of events per log level, e.g. "error=2,info=40"
+	MetadataLevelCounts = "clpLevelCounts"
+	// Fluent Bit tag (or stream path) of the object's events
+	MetadataFluentBitTag = "clpFluentBitTag"
+	// Id of the output plugin instance
+	MetadataInstanceId = "clpInstanceId"
+	// Hostname of the machine running Fluent Bit
+	MetadataHostname = "clpHostname"
+	// Name and version of the plugin which uploaded the object
+	MetadataPlugin = "clpPlugin"
+	// Encoding of the object's contents
+	MetadataIrEncoding = "clpIrEncoding"
+)
+
+// Encoding of objects written by the plugins: CLP key-value pair IR with four-byte encoded
+// variables, compressed with Zstd.
+const IrEncoding = "clp-kv-ir/four-byte+zstd"
+
+// Maximum number of tags S3 accepts on an object.
+const MaxTags = 10
+
+// Maximum number of distinct levels counted. Further levels are counted as [OtherLevel], which
+// bounds the size of [MetadataLevelCounts] if levels are not normalized.
+const maxLevels = 16
+
+// Level counting events whose level is beyond the first maxLevels distinct levels.
+const OtherLevel = "other"
+
+// Level counting events without a level.
+const UnknownLevel = "unknown"
+
+// Statistics of the events written to an object. The zero value is ready to use. Not safe for
+// concurrent use.
+type Stats struct {
+	// Number of events
+	Events int64
+	// Timestamp of the earliest event. Zero if unknown.
+	Start time.Time
+	// Timestamp of the latest event. Zero if unknown.
+	End time.Time
+	// Number of events per level. Nil until an event is counted.
+	Levels map[string]int64
+}
+
+// Counts an event.
+//
+// Parameters:
+//   - level: Log level of the event, empty if unknown
+func (s *Stats) Count(level string) {
+	if level == "" {
+		level = UnknownLevel
+	}
+	if s.Levels == nil {
+		s.Levels = make(map[string]int64)
+	}
+	if _, ok := s.Levels[level]; !ok && len(s.Levels) >= maxLevels {
+		level = OtherLevel
+	}
+	s.Events++
+	s.Levels[level]++
+}
+
+// Extends the time range of the events. Zero times are ignored.
+//
+// Parameters:
+//   - start: Timestamp of the earliest event added
+//   - end: Timestamp of the latest event added
+func (s *Stats) ExtendTimeRange(start time.Time, end time.Time) {
+	if !start.IsZero() && (s.Start.IsZero() || start.Before(s.Start)) {
+		s.Start = start
+	}
+	if !end.IsZero() && (s.End.IsZero() || end.After(s.End)) {
+		s.End = end
+	}
+}
+
+// Clears the statistics for the next object.
+func (s *Stats) Reset() {
+	*s = Stats{}
+}
+
+// Where an object's events came from.
+type Source struct {
+	// Fluent Bit tag or stream path
+	Tag string
+	// Id of the output plugin instance. Omitted if empty.
+	InstanceId string
+	// Hostname of the machine running Fluent Bit. Omitted if empty.
+	Hostname string
+	// Name of the plugin, e.g. "out_clp_s3"
+	Plugin string
+}
+
+// Builds the metadata describing an object.
+//
+// Parameters:
+//   - source: Where the object's events came from
+//   - stats: Statistics of the object's events, nil if unknown (e.g. for recovered buffers)
+//
+// Returns:
+//   - metadata: User metadata of the object
+func Metadata(source Source, stats *Stats) map[string]string {
+	metadata := map[string]string{
+		MetadataFluentBitTag: source.Tag,
+		MetadataPlugin:       source.Plugin + "/" + PluginVersion(),
+		MetadataIrEncoding:   IrEncoding,
+	}
+	if source.InstanceId != "" {
+		metadata[MetadataInstanceId] = source.InstanceId
+	}
+	if source.Hostname != "" {
+		metadata[MetadataHostname] = source.Hostname
+	}
+	if stats == nil {
+		return metadata
+	}
+
+	metadata[MetadataEventCount] = strconv.FormatInt(stats.Events, 10)
+	if !stats.Start.IsZero() {
+		metadata[MetadataEventStart] = stats.Start.UTC().Format(time.RFC3339Nano)
+	}
+	if !stats.End.IsZero() {
+		metadata[MetadataEventEnd] = stats.End.UTC().Format(time.RFC3339Nano)
+	}
+	if len(stats.Levels) > 0 {
+		counts := make([]string, 0, len(stats.Levels))
+		for _, level := range slices.Sorted(maps.Keys(stats.Levels)) {
+			counts = append(counts, level+"="+strconv.FormatInt(stats.Levels[level], 10))
+		}
+		metadata[MetadataLevelCounts] = strings.Join(counts, ",")
+	}
+	return metadata
+}
+
+// Normalizes a log level read from a record: strings are trimmed and lowercased, anything else is
+// unknown.
+//
+// Parameters:
+//   - value: Value of the record's level field, nil if missing
+//
+// Returns:
+//   - level: Normalized level, empty if unknown
+func NormalizeLevel(value any) string {
+	level, ok := value.(string)
+	if !ok {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(level))
+}
+
+// Tags of uploaded objects, parsed from an "object_tags" option.
+type Tags map[string]*keytemplate.Template
+
+// Parses tags from a comma separated list of key=value pairs. Values are key templates (see
+// [keytemplate]), e.g. "team=logs,host=$HOSTNAME,day=$UPLOAD_TIME[%Y-%m-%d]".
+//
+// Parameters:
+//   - option: Comma separated tags, empty for none
+//
+// Returns:
+//   - tags: Parsed tags
+//   - err: Malformed pair, duplicate key, invalid template, too many tags
+func ParseTags(option string) (Tags, error) {
+	tags := make(Tags)
+	if strings.TrimSpace(option) == "" {
+		return tags, nil
+	}
+	for _, pair := range strings.Split(option, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid tag %q, expected key=value", pair)
+		}
+		if _, exists := tags[key]; exists {
+			return nil, fmt.Errorf("duplicate tag %q", key)
+		}
+		template, err := keytemplate.Parse(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of tag %q: %w", key, err)
+		}
+		tags[key] = template
+	}
+	if len(tags) > MaxTags {
+		return nil, fmt.Errorf("%d tags exceed the limit of %d", len(tags), MaxTags)
+	}
+	return tags, nil
+}
+
+// Checks if any tag references record fields.
+func (t Tags) UsesRecord() bool {
+	for _, template := range t {
+		if template.UsesRecord() {
+			return true
+		}
+	}
+	return false
+}
+
+// Renders the tags of an object. Tags rendering as empty text are omitted.
+//
+// Parameters:
+//   - values: Values of the templates' placeholders
+//
+// Returns:
+//   - tags: Tags of the object, nil if there are none
+func (t Tags) Render(values keytemplate.Values) map[string]string {
+	var rendered map[string]string
+	for key, template := range t {
+		value := template.Render(values)
+		if value == "" {
+			continue
+		}
+		if rendered == nil {
+			rendered = make(map[string]string, len(t))
+		}
+		rendered[key] = value
+	}
+	return rendered
+}
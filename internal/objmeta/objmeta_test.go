@@ -0,0 +1,120 @@
+package objmeta
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/y-scope/fluent-bit-clp/internal/keytemplate"
+)
+
+func TestStats(t *testing.T) {
+	early := time.Date(2024, 1, 15, 9, 0, 0, 0, time.UTC)
+	late := time.Date(2024, 1, 15, 9, 59, 0, 500, time.UTC)
+
+	var stats Stats
+	stats.Count("info")
+	stats.Count("error")
+	stats.Count("info")
+	stats.Count("")
+	stats.ExtendTimeRange(late, late)
+	stats.ExtendTimeRange(early, early)
+	stats.ExtendTimeRange(time.Time{}, time.Time{})
+
+	got := Metadata(Source{Tag: "app", Plugin: "out_clp_s3"}, &stats)
+	want := map[string]string{
+		MetadataFluentBitTag: "app",
+		MetadataPlugin:       "out_clp_s3/" + PluginVersion(),
+		MetadataIrEncoding:   IrEncoding,
+		MetadataEventCount:   "4",
+		MetadataEventStart:   "2024-01-15T09:00:00Z",
+		MetadataEventEnd:     "2024-01-15T09:59:00.0000005Z",
+		MetadataLevelCounts:  "error=1,info=2,unknown=1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Metadata() = %v, want %v", got, want)
+	}
+
+	stats.Reset()
+	if !reflect.DeepEqual(stats, Stats{}) {
+		t.Errorf("Reset() left %+v, want zero stats", stats)
+	}
+}
+
+func TestStats_LevelLimit(t *testing.T) {
+	var stats Stats
+	for i := range maxLevels + 2 {
+		stats.Count(fmt.Sprintf("level%d", i))
+	}
+	if len(stats.Levels) != maxLevels+1 || stats.Levels[OtherLevel] != 2 {
+		t.Errorf("Count() levels = %v, want %d levels and 2 %s", stats.Levels, maxLevels,
+			OtherLevel)
+	}
+}
+
+func TestMetadata_WithoutStats(t *testing.T) {
+	source := Source{Tag: "app", InstanceId: "abc123", Hostname: "node-1", Plugin: "p"}
+	got := Metadata(source, nil)
+	if got[MetadataInstanceId] != "abc123" || got[MetadataHostname] != "node-1" {
+		t.Errorf("Metadata() = %v, want instance id and hostname", got)
+	}
+	if _, ok := got[MetadataEventCount]; ok {
+		t.Errorf("Metadata() without stats = %v, want no event count", got)
+	}
+}
+
+func TestNormalizeLevel(t *testing.T) {
+	tests := []struct {
+		value any
+		want  string
+	}{
+		{" WARN ", "warn"},
+		{"info", "info"},
+		{42, ""},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		if got := NormalizeLevel(tt.value); got != tt.want {
+			t.Errorf("NormalizeLevel(%v) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tags, err := ParseTags("team=logs, host=$HOSTNAME ,day=$UPLOAD_TIME[%Y-%m-%d],empty=$ID")
+	if err != nil {
+		t.Fatalf("ParseTags() error = %v", err)
+	}
+	got := tags.Render(keytemplate.Values{
+		Hostname:   "node-1",
+		UploadTime: time.Date(2024, 1, 15, 9, 0, 0, 0, time.UTC),
+	})
+	want := map[string]string{"team": "logs", "host": "node-1", "day": "2024-01-15"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Render() = %v, want %v", got, want)
+	}
+	if tags.UsesRecord() {
+		t.Error("UsesRecord() = true for tags without record fields")
+	}
+	if tags, _ := ParseTags("team=logs,app=$kubernetes['app']"); !tags.UsesRecord() {
+		t.Error("UsesRecord() = false for a tag referencing a record field")
+	}
+
+	var pairs []string
+	for i := range MaxTags + 1 {
+		pairs = append(pairs, fmt.Sprintf("k%d=v", i))
+	}
+	tooMany := strings.Join(pairs, ",")
+	invalid := []string{"novalue", "=v", "a=1,a=2", "a=$TAG[x]", tooMany}
+	for _, option := range invalid {
+		if _, err := ParseTags(option); err == nil {
+			t.Errorf("ParseTags(%q) error = nil, want error", option)
+		}
+	}
+
+	if tags, err := ParseTags(""); err != nil || tags.Render(keytemplate.Values{}) != nil {
+		t.Errorf("ParseTags(\"\") = %v, %v, want no tags", tags, err)
+	}
+}
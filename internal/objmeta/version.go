@@ -0,0 +1,57 @@
+package objmeta
+
+import (
+	"runtime/debug"
+	"sync"
+)
+
+// Length of VCS revisions reported by [PluginVersion].
+const shortRevisionLength = 12
+
+// Version of the plugins. Set at build time with:
+//
+//	go build -ldflags "-X github.com/y-scope/fluent-bit-clp/internal/objmeta.Version=v1.2.3"
+//
+// If not set, the version is derived from the build information.
+var Version string
+
+// Version derived from the build information, computed once.
+var buildVersion = sync.OnceValue(func() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+
+	var revision string
+	var modified bool
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if revision == "" {
+		return "devel"
+	}
+	if len(revision) > shortRevisionLength {
+		revision = revision[:shortRevisionLength]
+	}
+	if modified {
+		revision += "-dirty"
+	}
+	return revision
+})
+
+// Returns [Version] if set, otherwise the module version or VCS revision the plugin was built
+// from.
+func PluginVersion() string {
+	if Version != "" {
+		return Version
+	}
+	return buildVersion()
+}
@@ -0,0 +1,302 @@
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/appendblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+)
+
+// Environment variable holding a connection string, used if none is configured.
+const azureConnectionStringEnv = "AZURE_STORAGE_CONNECTION_STRING"
+
+// Azure upload sizing.
+const (
+	// Size of the blocks staged for block blobs. Objects larger than one block are uploaded as
+	// several staged blocks committed together, so a failed block is retried on its own.
+	azureBlockSize = 8 * 1024 * 1024
+	// Number of blocks staged in parallel.
+	azureBlockConcurrency = 4
+	// Maximum size of a single append to an append blob.
+	azureAppendBlockSize = 4 * 1024 * 1024
+)
+
+// Settings to connect to an Azure storage account.
+type AzureOptions struct {
+	// Connection string of the storage account, e.g. "UseDevelopmentStorage=true" for Azurite.
+	// Falls back to AZURE_STORAGE_CONNECTION_STRING if empty.
+	ConnectionString string
+	// Blob service URL, e.g. "https://<account>.blob.core.windows.net". Used with Azure AD
+	// credentials (managed identity, workload identity, environment, Azure CLI) if no connection
+	// string is set.
+	AccountURL string
+	// Target container.
+	Container string
+}
+
+// [ObjectStore] backed by an Azure Blob Storage container. Objects are stored as block blobs.
+// The store also implements [Appender] with append blobs.
+type AzureStore struct {
+	container *container.Client
+}
+
+// Creates an Azure Blob client and verifies the container is accessible.
+//
+// Parameters:
+//   - ctx: Context of the requests
+//   - opts: Connection settings
+//
+// Returns:
+//   - store: Azure store
+//   - err: Missing settings, error creating credentials or client, container not found, error
+//     accessing container
+func OpenAzureStore(ctx context.Context, opts AzureOptions) (*AzureStore, error) {
+	connectionString := opts.ConnectionString
+	if connectionString == "" {
+		connectionString = os.Getenv(azureConnectionStringEnv)
+	}
+
+	var client *azblob.Client
+	var err error
+	switch {
+	case connectionString != "":
+		client, err = azblob.NewClientFromConnectionString(connectionString, nil)
+	case opts.AccountURL != "":
+		var credential *azidentity.DefaultAzureCredential
+		credential, err = azidentity.NewDefaultAzureCredential(nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load azure credentials: %w", err)
+		}
+		client, err = azblob.NewClient(opts.AccountURL, credential, nil)
+	default:
+		return nil, fmt.Errorf("an account url or a connection string (or %s) is required",
+			azureConnectionStringEnv)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create azure blob client: %w", err)
+	}
+
+	store := NewAzureStore(client, opts.Container)
+	_, err = store.container.GetProperties(ctx, nil)
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.ContainerNotFound) {
+			return nil, fmt.Errorf("container %s could not be found: %w", store.URI(""), err)
+		}
+		return nil, fmt.Errorf("failed to access container %s: %w", store.URI(""), err)
+	}
+	return store, nil
+}
+
+// Creates a store uploading to a container.
+//
+// Parameters:
+//   - client: Configured Azure Blob client
+//   - containerName: Target container
+//
+// Returns:
+//   - store: Azure store
+func NewAzureStore(client *azblob.Client, containerName string) *AzureStore {
+	return &AzureStore{container: client.ServiceClient().NewContainerClient(containerName)}
+}
+
+// Uploads an object as a block blob, staging blocks for large objects.
+//
+// A blob of another type (e.g. an append blob left by [AzureStore.Append]) cannot be overwritten
+// with blocks, so it is deleted and the upload is retried if body can be rewound.
+func (s *AzureStore) Put(
+	ctx context.Context,
+	key string,
+	body io.Reader,
+	size int64,
+	opts PutOptions,
+) error {
+	err := s.put(ctx, key, body, size, opts)
+	seeker, ok := body.(io.Seeker)
+	if ok && bloberror.HasCode(err, bloberror.InvalidBlobType) {
+		if _, err := s.container.NewBlobClient(key).Delete(ctx, nil); err != nil {
+			return fmt.Errorf("failed to replace %s: %w", s.URI(key), err)
+		}
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind body of %s: %w", s.URI(key), err)
+		}
+		err = s.put(ctx, key, body, size, opts)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", s.URI(key), err)
+	}
+	return nil
+}
+
+// Uploads an object as a block blob.
+func (s *AzureStore) put(
+	ctx context.Context,
+	key string,
+	body io.Reader,
+	size int64,
+	opts PutOptions,
+) error {
+	counter := &countingReader{reader: body}
+	_, err := s.container.NewBlockBlobClient(key).UploadStream(ctx, counter,
+		&blockblob.UploadStreamOptions{
+			BlockSize:   azureBlockSize,
+			Concurrency: azureBlockConcurrency,
+			HTTPHeaders: azureHTTPHeaders(opts),
+			Metadata:    azureMetadata(opts.Metadata),
+			Tags:        opts.Tags,
+		})
+	if err != nil {
+		return err
+	}
+	if size >= 0 && counter.count != size {
+		return fmt.Errorf("body has %d bytes, expected %d", counter.count, size)
+	}
+	return nil
+}
+
+// Appends to an append blob. See [Appender].
+//
+// An append interrupted by a failure may have been partially applied, since large bodies are
+// appended in several blocks. On retry, the bytes already present are skipped.
+func (s *AzureStore) Append(
+	ctx context.Context,
+	key string,
+	body io.Reader,
+	size int64,
+	offset int64,
+	opts PutOptions,
+) error {
+	client := s.container.NewAppendBlobClient(key)
+
+	position := offset
+	if offset == 0 {
+		// Creating the blob clears any previous content, e.g. of an earlier object with the same
+		// key or an attempt which failed midway.
+		_, err := client.Create(ctx, &appendblob.CreateOptions{
+			HTTPHeaders: azureHTTPHeaders(opts),
+			Metadata:    azureMetadata(opts.Metadata),
+			Tags:        opts.Tags,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", s.URI(key), err)
+		}
+	} else {
+		properties, err := client.GetProperties(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to get properties of %s: %w", s.URI(key), err)
+		}
+		if properties.ContentLength != nil {
+			position = *properties.ContentLength
+		}
+		if position < offset || position > offset+size {
+			return fmt.Errorf("%s has %d bytes, cannot append bytes [%d, %d)",
+				s.URI(key), position, offset, offset+size)
+		}
+		if _, err := io.CopyN(io.Discard, body, position-offset); err != nil {
+			return fmt.Errorf("failed to skip appended bytes of %s: %w", s.URI(key), err)
+		}
+	}
+
+	block := make([]byte, azureAppendBlockSize)
+	for position < offset+size {
+		n, err := io.ReadFull(body, block[:min(int64(len(block)), offset+size-position)])
+		if err != nil {
+			return fmt.Errorf("failed to read body of %s: %w", s.URI(key), err)
+		}
+		blockPosition := position
+		_, err = client.AppendBlock(ctx, streaming.NopCloser(bytes.NewReader(block[:n])),
+			&appendblob.AppendBlockOptions{
+				AppendPositionAccessConditions: &appendblob.AppendPositionAccessConditions{
+					AppendPosition: &blockPosition,
+				},
+			})
+		if err != nil {
+			return fmt.Errorf("failed to append to %s: %w", s.URI(key), err)
+		}
+		position += int64(n)
+	}
+	return nil
+}
+
+// Deletes blobs one at a time.
+func (s *AzureStore) Delete(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		_, err := s.container.NewBlobClient(key).Delete(ctx, nil)
+		if err != nil && !bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return fmt.Errorf("failed to delete %s: %w", s.URI(key), err)
+		}
+	}
+	return nil
+}
+
+// Retrieves the size and metadata of a blob.
+func (s *AzureStore) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	properties, err := s.container.NewBlobClient(key).GetProperties(ctx, nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return ObjectInfo{}, fmt.Errorf("%w: %s", ErrNotFound, s.URI(key))
+	}
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to head %s: %w", s.URI(key), err)
+	}
+
+	info := ObjectInfo{Metadata: make(map[string]string, len(properties.Metadata))}
+	if properties.ContentLength != nil {
+		info.Size = *properties.ContentLength
+	}
+	for k, v := range properties.Metadata {
+		if v != nil {
+			info.Metadata[k] = *v
+		}
+	}
+	return info, nil
+}
+
+// Returns the URL of the blob, e.g. "https://<account>.blob.core.windows.net/<container>/<key>".
+func (s *AzureStore) URI(key string) string {
+	if key == "" {
+		return s.container.URL()
+	}
+	return s.container.NewBlobClient(key).URL()
+}
+
+// Converts [PutOptions] to blob HTTP headers. Returns nil if there are no headers to set.
+func azureHTTPHeaders(opts PutOptions) *blob.HTTPHeaders {
+	if opts.ContentType == "" {
+		return nil
+	}
+	contentType := opts.ContentType
+	return &blob.HTTPHeaders{BlobContentType: &contentType}
+}
+
+// Converts metadata to the form expected by the Azure SDK.
+func azureMetadata(metadata map[string]string) map[string]*string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	converted := make(map[string]*string, len(metadata))
+	for k, v := range metadata {
+		converted[k] = &v
+	}
+	return converted
+}
+
+// Reader counting the bytes read through it.
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
@@ -0,0 +1,138 @@
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Runs against Azurite when AZURE_STORAGE_CONNECTION_STRING is set (e.g. to
+// "UseDevelopmentStorage=true"). The container named by AZURE_TEST_CONTAINER (default
+// "test-container") must exist.
+func TestAzureStore_Azurite(t *testing.T) {
+	if os.Getenv(azureConnectionStringEnv) == "" {
+		t.Skipf("%s is not set", azureConnectionStringEnv)
+	}
+	containerName := os.Getenv("AZURE_TEST_CONTAINER")
+	if containerName == "" {
+		containerName = "test-container"
+	}
+
+	ctx := context.Background()
+	store, err := OpenAzureStore(ctx, AzureOptions{Container: containerName})
+	if err != nil {
+		t.Fatalf("OpenAzureStore() error = %v", err)
+	}
+
+	t.Run("put head delete", func(t *testing.T) {
+		key := "objstore-test/put.clp.zst"
+		opts := PutOptions{Metadata: map[string]string{"level": "info"}}
+		if err := store.Put(ctx, key, strings.NewReader("hello"), 5, opts); err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+
+		info, err := store.Head(ctx, key)
+		if err != nil || info.Size != 5 || info.Metadata["level"] != "info" {
+			t.Errorf("Head() = %+v, %v, want size 5 with metadata", info, err)
+		}
+
+		if err := store.Delete(ctx, []string{key, "objstore-test/missing"}); err != nil {
+			t.Fatalf("Delete() error = %v", err)
+		}
+		if _, err := store.Head(ctx, key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Head() after Delete() error = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("append", func(t *testing.T) {
+		key := "objstore-test/append.clp.zst"
+		t.Cleanup(func() { _ = store.Delete(ctx, []string{key}) })
+
+		// Two append blocks, so a failure while reading the second leaves the first applied
+		data := bytes.Repeat([]byte("0123456789abcdef"), (azureAppendBlockSize+16)/16)
+		head, tail := data[:5], data[5:]
+		if err := store.Append(ctx, key, bytes.NewReader(head), 5, 0, PutOptions{}); err != nil {
+			t.Fatalf("Append() at offset 0 error = %v", err)
+		}
+
+		// Appending past the end of the blob would leave a gap
+		err := store.Append(ctx, key, bytes.NewReader(tail), int64(len(tail)), 6, PutOptions{})
+		if err == nil {
+			t.Error("Append() past the end of the blob error = nil, want error")
+		}
+
+		failing := io.MultiReader(
+			bytes.NewReader(tail[:azureAppendBlockSize]),
+			&errorReader{err: errors.New("disk read failed")},
+		)
+		err = store.Append(ctx, key, failing, int64(len(tail)), 5, PutOptions{})
+		if err == nil {
+			t.Fatal("Append() with a failing body error = nil, want error")
+		}
+		if info, err := store.Head(ctx, key); err != nil || info.Size != 5+azureAppendBlockSize {
+			t.Fatalf("Head() after partial Append() = %+v, %v, want size %d", info, err,
+				5+azureAppendBlockSize)
+		}
+
+		// The retry skips the block appended before the failure
+		err = store.Append(ctx, key, bytes.NewReader(tail), int64(len(tail)), 5, PutOptions{})
+		if err != nil {
+			t.Fatalf("Append() retry error = %v", err)
+		}
+		if got := downloadBlob(t, store, key); !bytes.Equal(got, data) {
+			t.Errorf("blob has %d bytes after retry, want the %d appended bytes", len(got),
+				len(data))
+		}
+	})
+
+	t.Run("put replaces append blob", func(t *testing.T) {
+		key := "objstore-test/replace.clp.zst"
+		t.Cleanup(func() { _ = store.Delete(ctx, []string{key}) })
+
+		err := store.Append(ctx, key, strings.NewReader("appended"), 8, 0, PutOptions{})
+		if err != nil {
+			t.Fatalf("Append() error = %v", err)
+		}
+
+		// A body that cannot be rewound cannot be uploaded again after deleting the blob
+		body := io.MultiReader(strings.NewReader("hello"))
+		if err := store.Put(ctx, key, body, 5, PutOptions{}); err == nil {
+			t.Error("Put() of an unseekable body over an append blob error = nil, want error")
+		}
+
+		if err := store.Put(ctx, key, strings.NewReader("hello"), 5, PutOptions{}); err != nil {
+			t.Fatalf("Put() over an append blob error = %v", err)
+		}
+		if got := downloadBlob(t, store, key); string(got) != "hello" {
+			t.Errorf("blob = %q, want %q", got, "hello")
+		}
+	})
+}
+
+// Reader failing with err.
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// Downloads the contents of a blob.
+func downloadBlob(t *testing.T, store *AzureStore, key string) []byte {
+	t.Helper()
+	response, err := store.container.NewBlobClient(key).DownloadStream(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("DownloadStream(%q) error = %v", key, err)
+	}
+	defer response.Body.Close()
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("Failed to read %q: %v", key, err)
+	}
+	return data
+}
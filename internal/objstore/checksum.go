@@ -0,0 +1,250 @@
+package objstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"maps"
+	"strings"
+)
+
+// Checksum algorithms, named as in the S3 API.
+const (
+	ChecksumCRC32C = "CRC32C"
+	ChecksumSHA256 = "SHA256"
+)
+
+// Object metadata recording the checksum computed before upload. Keys are matched
+// case-insensitively since some stores (e.g. S3) lowercase metadata keys.
+const (
+	MetadataChecksumAlgorithm = "clpChecksumAlgorithm"
+	MetadataChecksum          = "clpChecksum"
+)
+
+// Returned by [Verify] if the store does not hold the uploaded bytes.
+var ErrVerification = errors.New("object verification failed")
+
+// Castagnoli table used by CRC32C.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksum of an object's contents.
+type Checksum struct {
+	// ChecksumCRC32C or ChecksumSHA256. Empty if there is no checksum.
+	Algorithm string
+	// Base64 encoded big-endian digest, as used by the S3 API. Empty if not computed yet.
+	Value string
+}
+
+// Parses a checksum algorithm option case-insensitively.
+//
+// Parameters:
+//   - option: "crc32c", "sha256", or "none" or "" to disable checksums
+//
+// Returns:
+//   - algorithm: ChecksumCRC32C, ChecksumSHA256, or "" if disabled
+//   - err: Unknown algorithm
+func ParseChecksumAlgorithm(option string) (string, error) {
+	switch strings.ToUpper(option) {
+	case "", "NONE":
+		return "", nil
+	case ChecksumCRC32C:
+		return ChecksumCRC32C, nil
+	case ChecksumSHA256:
+		return ChecksumSHA256, nil
+	default:
+		return "", fmt.Errorf("unknown checksum algorithm %q, expected crc32c, sha256 or none",
+			option)
+	}
+}
+
+// Creates the hash computing a checksum.
+func newChecksumHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case ChecksumCRC32C:
+		return crc32.New(crc32cTable), nil
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	default:
+		return nil, fmt.Errorf("unknown checksum algorithm %q", algorithm)
+	}
+}
+
+// Computes the checksum of a reader's contents.
+//
+// Parameters:
+//   - algorithm: ChecksumCRC32C or ChecksumSHA256
+//   - body: Contents to checksum
+//
+// Returns:
+//   - checksum: Checksum of the contents
+//   - err: Unknown algorithm, error reading body
+func ComputeChecksum(algorithm string, body io.Reader) (Checksum, error) {
+	h, err := newChecksumHash(algorithm)
+	if err != nil {
+		return Checksum{}, err
+	}
+	if _, err := io.Copy(h, body); err != nil {
+		return Checksum{}, fmt.Errorf("failed to compute checksum: %w", err)
+	}
+	return Checksum{Algorithm: algorithm, Value: encodeDigest(h.Sum(nil))}, nil
+}
+
+// Encodes a digest as a checksum value.
+func encodeDigest(digest []byte) string {
+	return base64.StdEncoding.EncodeToString(digest)
+}
+
+// Uploads a rewindable body. If opts.Checksum names an algorithm without a value, the checksum is
+// computed first and recorded in the object's metadata, so stores supporting checksums reject a
+// corrupted upload. If opts.Verify is set, the upload is confirmed with [Verify].
+//
+// Parameters:
+//   - ctx: Context of the requests
+//   - store: Destination
+//   - key: Object key
+//   - body: Object contents, positioned at their start
+//   - size: Number of bytes in body
+//   - opts: Object options
+//
+// Returns:
+//   - err: Error computing checksum, error uploading, verification error
+func PutSeeker(
+	ctx context.Context,
+	store ObjectStore,
+	key string,
+	body io.ReadSeeker,
+	size int64,
+	opts PutOptions,
+) error {
+	if opts.Checksum.Algorithm != "" && opts.Checksum.Value == "" {
+		checksum, err := ComputeChecksum(opts.Checksum.Algorithm, body)
+		if err != nil {
+			return err
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind body: %w", err)
+		}
+		opts.Checksum = checksum
+		opts.Metadata = maps.Clone(opts.Metadata)
+		if opts.Metadata == nil {
+			opts.Metadata = make(map[string]string, 2)
+		}
+		opts.Metadata[MetadataChecksumAlgorithm] = checksum.Algorithm
+		opts.Metadata[MetadataChecksum] = checksum.Value
+	}
+
+	if err := store.Put(ctx, key, body, size, opts); err != nil {
+		return err
+	}
+	if opts.Verify {
+		return Verify(ctx, store, key, size, opts.Checksum)
+	}
+	return nil
+}
+
+// Confirms the store holds an object of the expected size and checksum. The checksum is compared
+// with the one the store computed if it reports one (S3 single part uploads, GCS), and otherwise
+// with the one recorded in the object's metadata, which detects an object replaced by another
+// upload. Stores which keep neither (file) verified the checksum while writing the object, so
+// only its size is compared.
+//
+// S3 multipart uploads (objects of at least one part, 5 MiB) only report a checksum of their
+// parts' checksums, which is discarded (see headChecksum). The contents of such objects are
+// therefore not verified against checksum: S3 verified each part while it was uploaded, and only
+// the size and the recorded checksum are compared here.
+//
+// Parameters:
+//   - ctx: Context of the request
+//   - store: Destination
+//   - key: Object key
+//   - size: Expected size in bytes
+//   - checksum: Expected checksum, or the zero value to only compare sizes
+//
+// Returns:
+//   - err: [ErrVerification], error retrieving object properties
+func Verify(
+	ctx context.Context,
+	store ObjectStore,
+	key string,
+	size int64,
+	checksum Checksum,
+) error {
+	info, err := store.Head(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to verify %s: %w", store.URI(key), err)
+	}
+	if info.Size != size {
+		return fmt.Errorf("%w: %s has %d bytes, expected %d",
+			ErrVerification, store.URI(key), info.Size, size)
+	}
+	if checksum.Value == "" {
+		return nil
+	}
+
+	stored := info.Checksum
+	if stored.Algorithm != checksum.Algorithm || stored.Value == "" {
+		stored.Algorithm, _ = metadataValue(info.Metadata, MetadataChecksumAlgorithm)
+		stored.Value, _ = metadataValue(info.Metadata, MetadataChecksum)
+	}
+	if stored == (Checksum{}) {
+		return nil
+	}
+	if stored != checksum {
+		return fmt.Errorf("%w: %s has %s checksum %q, expected %q", ErrVerification,
+			store.URI(key), checksum.Algorithm, stored.Value, checksum.Value)
+	}
+	return nil
+}
+
+// Creates a hash for checking a body against an expected checksum while it is written.
+//
+// Parameters:
+//   - checksum: Expected checksum
+//
+// Returns:
+//   - h: Hash of the checksum's algorithm, or nil if there is no expected value
+//   - err: Unknown algorithm
+func expectedChecksumHash(checksum Checksum) (hash.Hash, error) {
+	if checksum.Value == "" {
+		return nil, nil
+	}
+	return newChecksumHash(checksum.Algorithm)
+}
+
+// Compares the digest of a written body with its expected checksum.
+//
+// Parameters:
+//   - uri: URI of the object for the error message
+//   - checksum: Expected checksum
+//   - h: Hash returned by expectedChecksumHash, which may be nil
+//
+// Returns:
+//   - err: Digest does not match the checksum
+func checkDigest(uri string, checksum Checksum, h hash.Hash) error {
+	if h == nil {
+		return nil
+	}
+	if value := encodeDigest(h.Sum(nil)); value != checksum.Value {
+		return fmt.Errorf("%s checksum of body of %s is %q, expected %q",
+			checksum.Algorithm, uri, value, checksum.Value)
+	}
+	return nil
+}
+
+// Retrieves a metadata value, matching the key case-insensitively.
+func metadataValue(metadata map[string]string, key string) (string, bool) {
+	if value, ok := metadata[key]; ok {
+		return value, true
+	}
+	for k, v := range metadata {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
+}
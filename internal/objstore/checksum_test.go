@@ -0,0 +1,150 @@
+package objstore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Checksums of "hello".
+var (
+	helloCRC32C = Checksum{Algorithm: ChecksumCRC32C, Value: "mnG7TA=="}
+	helloSHA256 = Checksum{
+		Algorithm: ChecksumSHA256,
+		Value:     "LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=",
+	}
+)
+
+func TestParseChecksumAlgorithm(t *testing.T) {
+	tests := []struct {
+		option  string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"none", "", false},
+		{"crc32c", ChecksumCRC32C, false},
+		{"SHA256", ChecksumSHA256, false},
+		{"md5", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseChecksumAlgorithm(tt.option)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParseChecksumAlgorithm(%q) = %q, %v, want %q, wantErr %v",
+				tt.option, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestComputeChecksum(t *testing.T) {
+	for _, want := range []Checksum{helloCRC32C, helloSHA256} {
+		got, err := ComputeChecksum(want.Algorithm, strings.NewReader("hello"))
+		if err != nil || got != want {
+			t.Errorf("ComputeChecksum(%s) = %+v, %v, want %+v", want.Algorithm, got, err, want)
+		}
+	}
+	if _, err := ComputeChecksum("MD5", strings.NewReader("hello")); err == nil {
+		t.Error("ComputeChecksum(MD5) error = nil, want error")
+	}
+}
+
+func TestPutSeeker_Checksum(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	metadata := map[string]string{"tag": "app"}
+	opts := PutOptions{
+		Metadata: metadata,
+		Checksum: Checksum{Algorithm: ChecksumSHA256},
+		Verify:   true,
+	}
+
+	if err := PutSeeker(ctx, store, "k", strings.NewReader("hello"), 5, opts); err != nil {
+		t.Fatalf("PutSeeker() error = %v", err)
+	}
+	object, _ := store.Get("k")
+	if string(object.Data) != "hello" || object.Opts.Checksum != helloSHA256 {
+		t.Errorf("Get() = %q with checksum %+v, want %q with %+v",
+			object.Data, object.Opts.Checksum, "hello", helloSHA256)
+	}
+	if object.Opts.Metadata[MetadataChecksum] != helloSHA256.Value ||
+		object.Opts.Metadata[MetadataChecksumAlgorithm] != ChecksumSHA256 ||
+		object.Opts.Metadata["tag"] != "app" {
+		t.Errorf("Get() metadata = %v, want checksum and tag", object.Opts.Metadata)
+	}
+	if len(metadata) != 1 {
+		t.Errorf("PutSeeker() modified the caller's metadata: %v", metadata)
+	}
+}
+
+func TestPutSeeker_ChecksumMismatch(t *testing.T) {
+	store := NewMemoryStore()
+	opts := PutOptions{Checksum: helloCRC32C}
+	err := PutSeeker(context.Background(), store, "k", strings.NewReader("world"), 5, opts)
+	if err == nil {
+		t.Error("PutSeeker() error = nil, want checksum mismatch error")
+	}
+	if _, ok := store.Get("k"); ok {
+		t.Error("Get() found an object whose checksum does not match")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	opts := PutOptions{Checksum: Checksum{Algorithm: ChecksumCRC32C}}
+	if err := PutSeeker(ctx, store, "k", strings.NewReader("hello"), 5, opts); err != nil {
+		t.Fatalf("PutSeeker() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		key      string
+		size     int64
+		checksum Checksum
+		wantErr  error
+	}{
+		{"match", "k", 5, helloCRC32C, nil},
+		{"size only", "k", 5, Checksum{}, nil},
+		{"metadata", "k", 5, helloSHA256, ErrVerification},
+		{"wrong size", "k", 4, helloCRC32C, ErrVerification},
+		{"wrong checksum", "k", 5, Checksum{Algorithm: ChecksumCRC32C, Value: "AAAAAA=="},
+			ErrVerification},
+		{"missing", "missing", 5, helloCRC32C, ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(ctx, store, tt.key, tt.size, tt.checksum)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFileStore_PutFile_Checksum(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+	localPath := filepath.Join(t.TempDir(), "buffer")
+	if err := os.WriteFile(localPath, []byte("hello"), 0o600); err != nil {
+		t.Fatalf("Failed to write buffer: %v", err)
+	}
+
+	opts := PutOptions{Checksum: Checksum{Algorithm: ChecksumCRC32C}, Verify: true}
+	if err := PutFile(ctx, store, localPath, "a/b", opts); err != nil {
+		t.Errorf("PutFile() error = %v", err)
+	}
+
+	opts = PutOptions{Checksum: helloSHA256}
+	if err := PutFileRange(ctx, store, localPath, 1, 4, "a/c", opts); err == nil {
+		t.Error("PutFileRange() with checksum of another body error = nil, want error")
+	}
+	if _, err := store.Head(ctx, "a/c"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Head() error = %v, want ErrNotFound for rejected object", err)
+	}
+}
@@ -0,0 +1,177 @@
+package objstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Permissions of directories created by [FileStore].
+const fileStoreDirPerm = 0o750
+
+// Permissions of objects written by [FileStore]. Objects are readable by the group so downstream
+// consumers (e.g. CLP ingestion) do not need to run as the plugin's user.
+const fileStoreObjectPerm = 0o640
+
+// [ObjectStore] writing objects to a local (or network mounted) directory tree. Keys are paths
+// relative to the root directory, so objects are laid out exactly as they would be in a bucket.
+//
+// Objects are written to a temporary file in the target directory and renamed into place once
+// complete. Readers never observe a partially written object, and an object replaced by a later
+// sync is swapped atomically. Metadata and tags are not stored. An object whose contents do not
+// match the checksum of its options is never renamed into place.
+type FileStore struct {
+	root string
+}
+
+// Creates a store writing below a root directory. The directory is created if it does not exist.
+//
+// Parameters:
+//   - root: Root directory of the store
+//
+// Returns:
+//   - store: File store
+//   - err: Error resolving root, error creating root
+func NewFileStore(root string) (*FileStore, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve directory %q: %w", root, err)
+	}
+	err = os.MkdirAll(absRoot, fileStoreDirPerm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create directory %q: %w", absRoot, err)
+	}
+	return &FileStore{root: absRoot}, nil
+}
+
+// Writes an object to a temporary file and renames it into place.
+func (s *FileStore) Put(
+	_ context.Context,
+	key string,
+	body io.Reader,
+	size int64,
+	opts PutOptions,
+) error {
+	objectPath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	h, err := expectedChecksumHash(opts.Checksum)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(objectPath)
+	if err := os.MkdirAll(dir, fileStoreDirPerm); err != nil {
+		return fmt.Errorf("failed to create directory %q: %w", dir, err)
+	}
+
+	// The temporary file is hidden and lives in the target directory, so the rename below stays on
+	// one file system.
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(objectPath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file in %q: %w", dir, err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	var w io.Writer = tmp
+	if h != nil {
+		w = io.MultiWriter(tmp, h)
+	}
+	written, err := io.Copy(w, body)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", s.URI(key), err)
+	}
+	if size >= 0 && written != size {
+		return fmt.Errorf("body of %s has %d bytes, expected %d", s.URI(key), written, size)
+	}
+	if err := checkDigest(s.URI(key), opts.Checksum, h); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(fileStoreObjectPerm); err != nil {
+		return fmt.Errorf("failed to set permissions of %s: %w", s.URI(key), err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", s.URI(key), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", s.URI(key), err)
+	}
+	if err := os.Rename(tmp.Name(), objectPath); err != nil {
+		return fmt.Errorf("failed to rename %s into place: %w", s.URI(key), err)
+	}
+	committed = true
+	return nil
+}
+
+// Removes objects, along with directories left empty by their removal.
+func (s *FileStore) Delete(_ context.Context, keys []string) error {
+	for _, key := range keys {
+		objectPath, err := s.path(key)
+		if err != nil {
+			return err
+		}
+		err = os.Remove(objectPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to delete %s: %w", s.URI(key), err)
+		}
+		s.removeEmptyParents(objectPath)
+	}
+	return nil
+}
+
+// Retrieves the size of an object.
+func (s *FileStore) Head(_ context.Context, key string) (ObjectInfo, error) {
+	objectPath, err := s.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := os.Stat(objectPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return ObjectInfo{}, fmt.Errorf("%w: %s", ErrNotFound, s.URI(key))
+	}
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to stat %s: %w", s.URI(key), err)
+	}
+	return ObjectInfo{Size: info.Size()}, nil
+}
+
+// Returns "file://<root>/<key>".
+func (s *FileStore) URI(key string) string {
+	return "file://" + filepath.ToSlash(filepath.Join(s.root, filepath.FromSlash(key)))
+}
+
+// Maps a key to its path below the root directory.
+//
+// Parameters:
+//   - key: Object key
+//
+// Returns:
+//   - path: Path of the object
+//   - err: Key is absolute or escapes the root directory
+func (s *FileStore) path(key string) (string, error) {
+	localKey := filepath.FromSlash(key)
+	if !filepath.IsLocal(localKey) {
+		return "", fmt.Errorf("key %q is not a relative path within %s", key, s.root)
+	}
+	return filepath.Join(s.root, localKey), nil
+}
+
+// Removes the empty directories between an object and the root directory, e.g. the directory of
+// an object's segments once they are deleted. Stops at the first directory that is not empty.
+func (s *FileStore) removeEmptyParents(objectPath string) {
+	for dir := filepath.Dir(objectPath); dir != s.root; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
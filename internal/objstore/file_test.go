@@ -0,0 +1,78 @@
+package objstore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileStore_PutHeadDelete(t *testing.T) {
+	ctx := context.Background()
+	root := filepath.Join(t.TempDir(), "objects")
+	store, err := NewFileStore(root)
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+
+	key := "logs/app/server.clp.zst"
+	for _, body := range []string{"first", "replaced"} {
+		err := store.Put(ctx, key, strings.NewReader(body), int64(len(body)), PutOptions{})
+		if err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(root, "logs", "app", "server.clp.zst"))
+	if err != nil || string(data) != "replaced" {
+		t.Errorf("object = %q, %v, want %q", data, err, "replaced")
+	}
+	entries, _ := os.ReadDir(filepath.Join(root, "logs", "app"))
+	if len(entries) != 1 {
+		t.Errorf("directory has %d entries, want only the object", len(entries))
+	}
+	if info, err := store.Head(ctx, key); err != nil || info.Size != int64(len("replaced")) {
+		t.Errorf("Head() = %+v, %v, want size %d", info, err, len("replaced"))
+	}
+	if got, want := store.URI(key), "file://"+filepath.ToSlash(root)+"/"+key; got != want {
+		t.Errorf("URI() = %q, want %q", got, want)
+	}
+
+	if err := store.Delete(ctx, []string{key, "logs/missing"}); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := store.Head(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Head() after Delete() error = %v, want ErrNotFound", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "logs")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("empty directories should be removed, got stat error %v", err)
+	}
+	if _, err := os.Stat(root); err != nil {
+		t.Errorf("root directory should be kept, got stat error %v", err)
+	}
+}
+
+func TestFileStore_Put_Failures(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	store, err := NewFileStore(root)
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+
+	for _, key := range []string{"../escape", "/abs/key", "a/../../escape", ""} {
+		if err := store.Put(ctx, key, strings.NewReader("x"), 1, PutOptions{}); err == nil {
+			t.Errorf("Put(%q) error = nil, want invalid key error", key)
+		}
+	}
+
+	if err := store.Put(ctx, "short", strings.NewReader("hello"), 3, PutOptions{}); err == nil {
+		t.Error("Put() error = nil, want size mismatch error")
+	}
+	entries, _ := os.ReadDir(root)
+	if len(entries) != 0 {
+		t.Errorf("failed puts left %d entries behind", len(entries))
+	}
+}
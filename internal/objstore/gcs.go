@@ -0,0 +1,175 @@
+package objstore
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	storage "google.golang.org/api/storage/v1"
+)
+
+// Size of the chunks of resumable uploads. Objects larger than one chunk are uploaded with a
+// resumable upload session, so a failed chunk is retried without restarting the whole upload.
+const gcsChunkSize = 16 * 1024 * 1024
+
+// [ObjectStore] backed by a Google Cloud Storage bucket.
+type GCSStore struct {
+	service *storage.Service
+	bucket  string
+}
+
+// Creates a GCS client and verifies the bucket is accessible.
+//
+// Credentials are loaded with Application Default Credentials: GOOGLE_APPLICATION_CREDENTIALS,
+// gcloud user credentials, or the metadata server (including GKE workload identity). If
+// STORAGE_EMULATOR_HOST is set, requests are sent unauthenticated to that emulator instead (e.g.
+// fake-gcs-server).
+//
+// Parameters:
+//   - ctx: Context of the requests
+//   - bucket: Target bucket
+//
+// Returns:
+//   - store: GCS store
+//   - err: Error creating client, bucket not found, error accessing bucket
+func OpenGCSStore(ctx context.Context, bucket string) (*GCSStore, error) {
+	var opts []option.ClientOption
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		opts = append(
+			opts,
+			option.WithEndpoint(strings.TrimSuffix(host, "/")+"/storage/v1/"),
+			option.WithoutAuthentication(),
+		)
+	}
+	service, err := storage.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gcs client: %w", err)
+	}
+
+	_, err = service.Buckets.Get(bucket).Context(ctx).Do()
+	if isGCSNotFound(err) {
+		return nil, fmt.Errorf("bucket gs://%s could not be found: %w", bucket, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to access bucket gs://%s: %w", bucket, err)
+	}
+	return NewGCSStore(service, bucket), nil
+}
+
+// Creates a store uploading to a bucket.
+//
+// Parameters:
+//   - service: Configured GCS JSON API client
+//   - bucket: Target bucket
+//
+// Returns:
+//   - store: GCS store
+func NewGCSStore(service *storage.Service, bucket string) *GCSStore {
+	return &GCSStore{service: service, bucket: bucket}
+}
+
+// Uploads an object. GCS has no object tags, so tags are stored as metadata.
+func (s *GCSStore) Put(
+	ctx context.Context,
+	key string,
+	body io.Reader,
+	size int64,
+	opts PutOptions,
+) error {
+	object := &storage.Object{Name: key, ContentType: opts.ContentType}
+	if len(opts.Metadata) > 0 || len(opts.Tags) > 0 {
+		object.Metadata = make(map[string]string, len(opts.Metadata)+len(opts.Tags))
+		maps.Copy(object.Metadata, opts.Tags)
+		maps.Copy(object.Metadata, opts.Metadata)
+	}
+	// GCS only verifies CRC32C checksums; SHA-256 checksums are only recorded in the metadata.
+	if opts.Checksum.Algorithm == ChecksumCRC32C && opts.Checksum.Value != "" {
+		digest, err := base64.StdEncoding.DecodeString(opts.Checksum.Value)
+		if err != nil || len(digest) != crc32.Size {
+			return fmt.Errorf("invalid CRC32C checksum %q", opts.Checksum.Value)
+		}
+		object.Crc32c = opts.Checksum.Value
+	}
+
+	mediaOptions := []googleapi.MediaOption{googleapi.ChunkSize(gcsChunkSize)}
+	if opts.ContentType != "" {
+		mediaOptions = append(mediaOptions, googleapi.ContentType(opts.ContentType))
+	}
+	// A body of the wrong size fails the upload before the object is committed.
+	_, err := s.service.Objects.Insert(s.bucket, object).
+		Media(&sizedReader{reader: body, size: size}, mediaOptions...).
+		Context(ctx).
+		Do()
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", s.URI(key), err)
+	}
+	return nil
+}
+
+// Deletes objects. GCS has no batch delete in its JSON API client, so objects are deleted one at a
+// time.
+func (s *GCSStore) Delete(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		err := s.service.Objects.Delete(s.bucket, key).Context(ctx).Do()
+		if err != nil && !isGCSNotFound(err) {
+			return fmt.Errorf("failed to delete %s: %w", s.URI(key), err)
+		}
+	}
+	return nil
+}
+
+// Retrieves the size and metadata of an object.
+func (s *GCSStore) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	object, err := s.service.Objects.Get(s.bucket, key).Context(ctx).Do()
+	if isGCSNotFound(err) {
+		return ObjectInfo{}, fmt.Errorf("%w: %s", ErrNotFound, s.URI(key))
+	}
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("failed to head %s: %w", s.URI(key), err)
+	}
+	return ObjectInfo{
+		Size:     int64(object.Size),
+		Metadata: object.Metadata,
+		Checksum: Checksum{Algorithm: ChecksumCRC32C, Value: object.Crc32c},
+	}, nil
+}
+
+// Returns "gs://<bucket>/<key>".
+func (s *GCSStore) URI(key string) string {
+	return fmt.Sprintf("gs://%s/%s", s.bucket, key)
+}
+
+// Checks if a GCS request failed because the bucket or object does not exist.
+func isGCSNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+// Reader failing at EOF if the body does not have the expected size.
+type sizedReader struct {
+	reader io.Reader
+	// Expected size, or -1 if unknown
+	size int64
+	read int64
+}
+
+func (r *sizedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+	if errors.Is(err, io.EOF) && r.size >= 0 && r.read != r.size {
+		return n, fmt.Errorf("body has %d bytes, expected %d", r.read, r.size)
+	}
+	return n, err
+}
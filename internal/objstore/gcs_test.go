@@ -0,0 +1,47 @@
+package objstore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Runs against fake-gcs-server (see the plugin READMEs) when STORAGE_EMULATOR_HOST is set. The
+// bucket named by GCS_TEST_BUCKET (default "test-bucket") must exist.
+func TestGCSStore_Emulator(t *testing.T) {
+	if os.Getenv("STORAGE_EMULATOR_HOST") == "" {
+		t.Skip("STORAGE_EMULATOR_HOST is not set")
+	}
+	bucket := os.Getenv("GCS_TEST_BUCKET")
+	if bucket == "" {
+		bucket = "test-bucket"
+	}
+
+	ctx := context.Background()
+	store, err := OpenGCSStore(ctx, bucket)
+	if err != nil {
+		t.Fatalf("OpenGCSStore() error = %v", err)
+	}
+
+	key := "objstore-test/app.clp.zst"
+	opts := PutOptions{Metadata: map[string]string{"level": "info"}, Tags: map[string]string{
+		"fluentBitTag": "app",
+	}}
+	if err := store.Put(ctx, key, strings.NewReader("hello"), 5, opts); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	info, err := store.Head(ctx, key)
+	if err != nil || info.Size != 5 || info.Metadata["fluentBitTag"] != "app" {
+		t.Errorf("Head() = %+v, %v, want size 5 with tags as metadata", info, err)
+	}
+
+	if err := store.Delete(ctx, []string{key, "objstore-test/missing"}); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := store.Head(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Head() after Delete() error = %v, want ErrNotFound", err)
+	}
+}
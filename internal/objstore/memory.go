@@ -0,0 +1,202 @@
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// Object held by [MemoryStore].
+type MemoryObject struct {
+	Data []byte
+	Opts PutOptions
+}
+
+// In-memory [ObjectStore] for tests. Failures can be injected to exercise retry logic.
+type MemoryStore struct {
+	mu      sync.Mutex
+	objects map[string]MemoryObject
+	puts    int
+	putErr  error
+	// Number of uploads still to be interrupted.
+	interrupts int
+}
+
+// Creates an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{objects: make(map[string]MemoryObject)}
+}
+
+// Stores the contents of body under key. Fails with the error set by [MemoryStore.FailPuts], after
+// reading body if interrupted by [MemoryStore.InterruptPuts], or if body does not match
+// opts.Checksum.
+func (s *MemoryStore) Put(
+	_ context.Context,
+	key string,
+	body io.Reader,
+	size int64,
+	opts PutOptions,
+) error {
+	s.mu.Lock()
+	putErr := s.putErr
+	interrupted := putErr == nil && s.interrupts > 0
+	if interrupted {
+		s.interrupts--
+	}
+	s.mu.Unlock()
+	if putErr != nil {
+		return putErr
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("failed to read body of %q: %w", key, err)
+	}
+	if interrupted {
+		return fmt.Errorf("upload of %q interrupted after %d bytes", key, len(data))
+	}
+	if size >= 0 && int64(len(data)) != size {
+		return fmt.Errorf("body of %q has %d bytes, expected %d", key, len(data), size)
+	}
+	h, err := expectedChecksumHash(opts.Checksum)
+	if err != nil {
+		return err
+	}
+	if h != nil {
+		_, _ = h.Write(data)
+	}
+	if err := checkDigest(s.URI(key), opts.Checksum, h); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = MemoryObject{Data: data, Opts: opts}
+	s.puts++
+	return nil
+}
+
+// Appends the contents of body to an object. See [Appender].
+func (s *MemoryStore) Append(
+	_ context.Context,
+	key string,
+	body io.Reader,
+	size int64,
+	offset int64,
+	opts PutOptions,
+) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("failed to read body of %q: %w", key, err)
+	}
+	if int64(len(data)) != size {
+		return fmt.Errorf("body of %q has %d bytes, expected %d", key, len(data), size)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.putErr != nil {
+		return s.putErr
+	}
+	object := MemoryObject{Opts: opts}
+	if offset != 0 {
+		object = s.objects[key]
+		if int64(len(object.Data)) != offset {
+			return fmt.Errorf("%q has %d bytes, cannot append at %d", key, len(object.Data), offset)
+		}
+	}
+	object.Data = append(object.Data, data...)
+	s.objects[key] = object
+	s.puts++
+	return nil
+}
+
+// Removes objects.
+func (s *MemoryStore) Delete(_ context.Context, keys []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		delete(s.objects, key)
+	}
+	return nil
+}
+
+// Retrieves the properties of an object. Like S3, the checksum is computed with the algorithm the
+// object was uploaded with.
+func (s *MemoryStore) Head(_ context.Context, key string) (ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	object, ok := s.objects[key]
+	if !ok {
+		return ObjectInfo{}, fmt.Errorf("%w: %s", ErrNotFound, s.URI(key))
+	}
+	info := ObjectInfo{Size: int64(len(object.Data)), Metadata: object.Opts.Metadata}
+	if algorithm := object.Opts.Checksum.Algorithm; algorithm != "" {
+		checksum, err := ComputeChecksum(algorithm, bytes.NewReader(object.Data))
+		if err != nil {
+			return ObjectInfo{}, err
+		}
+		info.Checksum = checksum
+	}
+	return info, nil
+}
+
+// Returns "memory://<key>".
+func (*MemoryStore) URI(key string) string {
+	return "memory://" + key
+}
+
+// Retrieves a stored object.
+//
+// Parameters:
+//   - key: Object key
+//
+// Returns:
+//   - object: Stored object
+//   - ok: Whether the object exists
+func (s *MemoryStore) Get(key string) (MemoryObject, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	object, ok := s.objects[key]
+	return object, ok
+}
+
+// Returns the keys of all stored objects in sorted order.
+func (s *MemoryStore) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Sorted(maps.Keys(s.objects))
+}
+
+// Returns the number of successful uploads and appends.
+func (s *MemoryStore) Puts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.puts
+}
+
+// Makes subsequent uploads and appends fail with err until called again with nil.
+func (s *MemoryStore) FailPuts(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.putErr = err
+}
+
+// Makes the next n uploads fail after reading their body, like uploads interrupted by a network
+// failure, so a retry must rewind the body.
+func (s *MemoryStore) InterruptPuts(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.interrupts = n
+}
@@ -0,0 +1,153 @@
+package objstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMemoryStore_PutHeadDelete(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	opts := PutOptions{ContentType: "text/plain", Metadata: map[string]string{"tag": "app"}}
+
+	if err := store.Put(ctx, "a/b", strings.NewReader("hello"), 5, opts); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if err := store.Put(ctx, "a/c", strings.NewReader("hi"), -1, PutOptions{}); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	object, ok := store.Get("a/b")
+	if !ok || string(object.Data) != "hello" || !reflect.DeepEqual(object.Opts, opts) {
+		t.Errorf("Get() = %+v, %v, want stored object", object, ok)
+	}
+	info, err := store.Head(ctx, "a/b")
+	if err != nil || info.Size != 5 || info.Metadata["tag"] != "app" {
+		t.Errorf("Head() = %+v, %v, want size 5 with metadata", info, err)
+	}
+	if got, want := store.Keys(), []string{"a/b", "a/c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Keys() = %v, want %v", got, want)
+	}
+
+	if err := store.Delete(ctx, []string{"a/b", "missing"}); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := store.Head(ctx, "a/b"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Head() after Delete() error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMemoryStore_Put_SizeMismatch(t *testing.T) {
+	store := NewMemoryStore()
+	err := store.Put(context.Background(), "k", strings.NewReader("hello"), 3, PutOptions{})
+	if err == nil {
+		t.Error("Put() error = nil, want size mismatch error")
+	}
+}
+
+func TestMemoryStore_FailPuts(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	errUnavailable := errors.New("unavailable")
+
+	store.FailPuts(errUnavailable)
+	err := store.Put(ctx, "k", strings.NewReader("x"), 1, PutOptions{})
+	if !errors.Is(err, errUnavailable) {
+		t.Errorf("Put() error = %v, want %v", err, errUnavailable)
+	}
+
+	store.FailPuts(nil)
+	if err := store.Put(ctx, "k", strings.NewReader("x"), 1, PutOptions{}); err != nil {
+		t.Errorf("Put() error = %v, want nil", err)
+	}
+	if got := store.Puts(); got != 1 {
+		t.Errorf("Puts() = %d, want 1", got)
+	}
+}
+
+func TestMemoryStore_InterruptPuts(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	store.InterruptPuts(1)
+
+	body := strings.NewReader("hello")
+	if err := store.Put(ctx, "k", body, 5, PutOptions{}); err == nil {
+		t.Fatal("Put() error = nil, want interrupted upload")
+	}
+	if body.Len() != 0 {
+		t.Errorf("interrupted Put() left %d bytes unread, want the body consumed", body.Len())
+	}
+
+	// A retry without rewinding the body uploads nothing
+	if err := store.Put(ctx, "k", body, 5, PutOptions{}); err == nil {
+		t.Error("Put() of a consumed body error = nil, want size mismatch")
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Seek() error = %v", err)
+	}
+	if err := store.Put(ctx, "k", body, 5, PutOptions{}); err != nil {
+		t.Fatalf("Put() of a rewound body error = %v", err)
+	}
+	if object, _ := store.Get("k"); string(object.Data) != "hello" {
+		t.Errorf("Get() = %q, want %q", object.Data, "hello")
+	}
+}
+
+func TestPutFileRange(t *testing.T) {
+	localPath := filepath.Join(t.TempDir(), "buffer")
+	if err := os.WriteFile(localPath, []byte("0123456789"), 0o600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	ctx := context.Background()
+	store := NewMemoryStore()
+	if err := PutFile(ctx, store, localPath, "whole", PutOptions{}); err != nil {
+		t.Fatalf("PutFile() error = %v", err)
+	}
+	if err := PutFileRange(ctx, store, localPath, 3, 4, "range", PutOptions{}); err != nil {
+		t.Fatalf("PutFileRange() error = %v", err)
+	}
+
+	for key, want := range map[string]string{"whole": "0123456789", "range": "3456"} {
+		if object, _ := store.Get(key); string(object.Data) != want {
+			t.Errorf("object %q = %q, want %q", key, object.Data, want)
+		}
+	}
+}
+
+func TestMemoryStore_Append(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	appends := []struct {
+		body    string
+		offset  int64
+		wantErr bool
+	}{
+		{"abc", 0, false},
+		{"de", 3, false},
+		{"xx", 3, true},
+		{"new", 0, false},
+	}
+	for _, a := range appends {
+		err := store.Append(ctx, "k", strings.NewReader(a.body), int64(len(a.body)), a.offset,
+			PutOptions{})
+		if (err != nil) != a.wantErr {
+			t.Errorf("Append(%q, %d) error = %v, wantErr %v", a.body, a.offset, err, a.wantErr)
+		}
+		if a.body == "de" {
+			if object, _ := store.Get("k"); string(object.Data) != "abcde" {
+				t.Errorf("object = %q, want %q", object.Data, "abcde")
+			}
+		}
+	}
+	if object, _ := store.Get("k"); string(object.Data) != "new" {
+		t.Errorf("object after append at 0 = %q, want %q", object.Data, "new")
+	}
+}
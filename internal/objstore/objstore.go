@@ -0,0 +1,227 @@
+// Package defines the storage backends output plugins upload objects to. Plugins only depend on
+// the [ObjectStore] interface, so upload, naming and retry logic is independent of the
+// destination and can be tested against [MemoryStore].
+
+package objstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Destination types selectable with the plugins' "destination" option.
+const (
+	// Objects are uploaded to an S3 (or S3 compatible) bucket with [S3Store].
+	DestinationS3 = "s3"
+	// Objects are written to a local or network mounted directory with [FileStore].
+	DestinationFile = "file"
+	// Objects are uploaded to a Google Cloud Storage bucket with [GCSStore].
+	DestinationGCS = "gcs"
+	// Objects are uploaded to an Azure Blob Storage container with [AzureStore].
+	DestinationAzure = "azure"
+)
+
+// Returned by [ObjectStore.Head] if the object does not exist.
+var ErrNotFound = errors.New("object not found")
+
+// Options of an uploaded object. Backends which do not support an option ignore it.
+type PutOptions struct {
+	// MIME type of the object. Backends pick a default if empty.
+	ContentType string
+	// User-defined metadata stored with the object.
+	Metadata map[string]string
+	// Tags of the object, e.g. for lifecycle rules.
+	Tags map[string]string
+	// Storage class of the object, overriding the store's default. Only supported by S3.
+	StorageClass string
+	// Checksum of the object. Stores supporting checksums (S3, GCS, file) reject an upload whose
+	// contents do not match it. [PutSeeker] computes the value if only the algorithm is set.
+	Checksum Checksum
+	// Whether [PutSeeker] confirms the store holds the object with [Verify] after uploading.
+	Verify bool
+}
+
+// Properties of a stored object.
+type ObjectInfo struct {
+	// Size in bytes
+	Size int64
+	// User-defined metadata stored with the object
+	Metadata map[string]string
+	// Checksum computed by the store, if it computes one
+	Checksum Checksum
+}
+
+// Destination objects are uploaded to. Implementations must be safe for concurrent use.
+type ObjectStore interface {
+	// Stores the contents of body under key, replacing any existing object.
+	//
+	// Parameters:
+	//   - ctx: Context of the request
+	//   - key: Object key
+	//   - body: Object contents
+	//   - size: Number of bytes in body, or -1 if unknown
+	//   - opts: Object options
+	//
+	// Returns:
+	//   - err: Error uploading
+	Put(ctx context.Context, key string, body io.Reader, size int64, opts PutOptions) error
+
+	// Removes objects. Keys which do not exist are not an error.
+	//
+	// Parameters:
+	//   - ctx: Context of the request
+	//   - keys: Object keys
+	//
+	// Returns:
+	//   - err: Error deleting any of the objects
+	Delete(ctx context.Context, keys []string) error
+
+	// Retrieves the properties of an object.
+	//
+	// Parameters:
+	//   - ctx: Context of the request
+	//   - key: Object key
+	//
+	// Returns:
+	//   - info: Object properties
+	//   - err: [ErrNotFound], error retrieving properties
+	Head(ctx context.Context, key string) (ObjectInfo, error)
+
+	// Returns a URI identifying an object for log messages, e.g. "s3://bucket/key".
+	URI(key string) string
+}
+
+// Implemented by stores which can extend an object in place, so a growing file is shipped by
+// uploading only its new bytes.
+type Appender interface {
+	// Appends the contents of body to the object at key. If offset is 0, the object is created,
+	// replacing any existing object. Otherwise the object must hold offset bytes, so appends are
+	// never duplicated or lost.
+	//
+	// Parameters:
+	//   - ctx: Context of the request
+	//   - key: Object key
+	//   - body: Bytes to append
+	//   - size: Number of bytes in body
+	//   - offset: Size of the object before the append
+	//   - opts: Object options, applied when the object is created
+	//
+	// Returns:
+	//   - err: Object size does not match offset, error appending
+	Append(
+		ctx context.Context,
+		key string,
+		body io.Reader,
+		size int64,
+		offset int64,
+		opts PutOptions,
+	) error
+}
+
+// Uploads a local file with [PutSeeker].
+//
+// Parameters:
+//   - ctx: Context of the request
+//   - store: Destination
+//   - localPath: Path of the file to upload
+//   - key: Object key
+//   - opts: Object options
+//
+// Returns:
+//   - err: Error opening file, error uploading, verification error
+func PutFile(
+	ctx context.Context,
+	store ObjectStore,
+	localPath string,
+	key string,
+	opts PutOptions,
+) error {
+	// #nosec G304 -- localPath is a buffer file created by the plugin
+	file, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q: %w", localPath, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file %q: %w", localPath, err)
+	}
+	return PutSeeker(ctx, store, key, file, info.Size(), opts)
+}
+
+// Uploads a byte range of a local file as its own object with [PutSeeker].
+//
+// Parameters:
+//   - ctx: Context of the request
+//   - store: Destination
+//   - localPath: Path of the file to upload from
+//   - offset: Offset of the first byte to upload
+//   - length: Number of bytes to upload
+//   - key: Object key
+//   - opts: Object options
+//
+// Returns:
+//   - err: Error opening file, error uploading, verification error
+func PutFileRange(
+	ctx context.Context,
+	store ObjectStore,
+	localPath string,
+	offset int64,
+	length int64,
+	key string,
+	opts PutOptions,
+) error {
+	// #nosec G304 -- localPath is a buffer file created by the plugin
+	file, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q: %w", localPath, err)
+	}
+	defer file.Close()
+
+	return PutSeeker(ctx, store, key, io.NewSectionReader(file, offset, length), length, opts)
+}
+
+// Appends a byte range of a local file to an object. The range starts at offset, so the object
+// mirrors the file's prefix. Checksums are not supported by appends; if opts.Verify is set, only
+// the size of the object is verified.
+//
+// Parameters:
+//   - ctx: Context of the request
+//   - store: Destination
+//   - localPath: Path of the file to append from
+//   - offset: Offset of the first byte to append, which is also the object's current size
+//   - length: Number of bytes to append
+//   - key: Object key
+//   - opts: Object options
+//
+// Returns:
+//   - err: Error opening file, error appending, verification error
+func AppendFileRange(
+	ctx context.Context,
+	store Appender,
+	localPath string,
+	offset int64,
+	length int64,
+	key string,
+	opts PutOptions,
+) error {
+	// #nosec G304 -- localPath is a buffer file created by the plugin
+	file, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open file %q: %w", localPath, err)
+	}
+	defer file.Close()
+
+	body := io.NewSectionReader(file, offset, length)
+	if err := store.Append(ctx, key, body, length, offset, opts); err != nil {
+		return err
+	}
+	if objectStore, ok := store.(ObjectStore); ok && opts.Verify {
+		return Verify(ctx, objectStore, key, offset+length, Checksum{})
+	}
+	return nil
+}
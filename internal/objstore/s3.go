@@ -0,0 +1,301 @@
+package objstore
+
+import (
+	"cmp"
+	"context"
+	"crypto/md5" // #nosec G501 -- MD5 is the digest S3 requires for SSE-C keys
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Maximum number of keys accepted by a single DeleteObjects request.
+const maxDeleteObjects = 1000
+
+// Length in bytes of SSE-C keys.
+const sseCustomerKeySize = 32
+
+// Encryption and storage settings of objects uploaded by [S3Store].
+type S3Options struct {
+	// Server-side encryption with keys managed by S3 ("AES256") or KMS ("aws:kms"). Empty uses the
+	// bucket's default encryption.
+	ServerSideEncryption string
+	// KMS key of "aws:kms" encryption. Empty uses the AWS managed key.
+	KMSKeyID string
+	// Whether "aws:kms" encryption uses an S3 Bucket Key, reducing KMS requests.
+	BucketKeyEnabled bool
+	// Encryption context of "aws:kms" encryption.
+	EncryptionContext map[string]string
+	// Base64 encoded 256-bit key for encryption with a customer-provided key (SSE-C). Cannot be
+	// combined with ServerSideEncryption.
+	CustomerKey string
+	// Storage class of objects, unless overridden by [PutOptions.StorageClass]. Empty uses the
+	// bucket's default (usually STANDARD).
+	StorageClass string
+}
+
+// Checks the options for invalid values and combinations.
+//
+// Returns:
+//   - err: All invalid options joined
+func (o *S3Options) Validate() error {
+	var errs []error
+
+	sse := types.ServerSideEncryption(o.ServerSideEncryption)
+	switch sse {
+	case "", types.ServerSideEncryptionAes256, types.ServerSideEncryptionAwsKms:
+	default:
+		errs = append(errs, fmt.Errorf("server-side encryption %q is not one of %q or %q",
+			o.ServerSideEncryption,
+			types.ServerSideEncryptionAes256,
+			types.ServerSideEncryptionAwsKms,
+		))
+	}
+
+	usesKMSOptions := o.KMSKeyID != "" || o.BucketKeyEnabled || len(o.EncryptionContext) > 0
+	if usesKMSOptions && sse != types.ServerSideEncryptionAwsKms {
+		errs = append(errs, fmt.Errorf(
+			"kms key id, bucket key and encryption context require %q server-side encryption",
+			types.ServerSideEncryptionAwsKms,
+		))
+	}
+
+	if o.CustomerKey != "" {
+		if o.ServerSideEncryption != "" {
+			errs = append(errs, errors.New(
+				"customer-provided keys (SSE-C) cannot be combined with server-side encryption"))
+		}
+		key, err := base64.StdEncoding.DecodeString(o.CustomerKey)
+		if err != nil || len(key) != sseCustomerKeySize {
+			errs = append(errs, errors.New("customer-provided key must be a base64 encoded "+
+				"256-bit key"))
+		}
+	}
+
+	if o.StorageClass != "" && !IsS3StorageClass(o.StorageClass) {
+		errs = append(errs, fmt.Errorf("unknown storage class %q", o.StorageClass))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Reports whether class is an S3 storage class, e.g. "STANDARD_IA".
+func IsS3StorageClass(class string) bool {
+	return slices.Contains(types.StorageClass("").Values(), types.StorageClass(class))
+}
+
+// [ObjectStore] backed by an S3 (or S3 compatible) bucket.
+type S3Store struct {
+	client   *s3.Client
+	uploader *manager.Uploader
+	bucket   string
+	opts     S3Options
+	// Base64 encoded JSON of opts.EncryptionContext. Empty if there is no encryption context.
+	encryptionContext string
+	// Base64 encoded MD5 digest of opts.CustomerKey. Empty if SSE-C is not used.
+	customerKeyMD5 string
+}
+
+// Creates a store uploading to a bucket. Objects larger than the uploader's part size are uploaded
+// with multipart uploads.
+//
+// Parameters:
+//   - client: Configured S3 client
+//   - bucket: Target bucket
+//   - opts: Encryption and storage settings of uploaded objects
+//
+// Returns:
+//   - store: S3 store
+//   - err: Invalid options
+func NewS3Store(client *s3.Client, bucket string, opts S3Options) (*S3Store, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	store := S3Store{
+		client:   client,
+		uploader: manager.NewUploader(client),
+		bucket:   bucket,
+		opts:     opts,
+	}
+	if len(opts.EncryptionContext) > 0 {
+		encryptionContext, err := json.Marshal(opts.EncryptionContext)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode encryption context: %w", err)
+		}
+		store.encryptionContext = base64.StdEncoding.EncodeToString(encryptionContext)
+	}
+	if opts.CustomerKey != "" {
+		// Validate ensured the key decodes.
+		key, _ := base64.StdEncoding.DecodeString(opts.CustomerKey)
+		// #nosec G401 -- MD5 is the digest S3 requires for SSE-C keys, not a security control
+		digest := md5.Sum(key)
+		store.customerKeyMD5 = base64.StdEncoding.EncodeToString(digest[:])
+	}
+	return &store, nil
+}
+
+// Uploads an object.
+func (s *S3Store) Put(
+	ctx context.Context,
+	key string,
+	body io.Reader,
+	size int64,
+	opts PutOptions,
+) error {
+	input := s3.PutObjectInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		Body:     body,
+		Metadata: opts.Metadata,
+	}
+	if size >= 0 {
+		input.ContentLength = aws.Int64(size)
+	}
+	if opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+	if len(opts.Tags) > 0 {
+		tags := make(url.Values, len(opts.Tags))
+		for k, v := range opts.Tags {
+			tags.Set(k, v)
+		}
+		input.Tagging = aws.String(tags.Encode())
+	}
+
+	if storageClass := cmp.Or(opts.StorageClass, s.opts.StorageClass); storageClass != "" {
+		input.StorageClass = types.StorageClass(storageClass)
+	}
+	if s.opts.ServerSideEncryption != "" {
+		input.ServerSideEncryption = types.ServerSideEncryption(s.opts.ServerSideEncryption)
+	}
+	if s.opts.KMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(s.opts.KMSKeyID)
+	}
+	if s.opts.BucketKeyEnabled {
+		input.BucketKeyEnabled = aws.Bool(true)
+	}
+	if s.encryptionContext != "" {
+		input.SSEKMSEncryptionContext = aws.String(s.encryptionContext)
+	}
+	if s.customerKeyMD5 != "" {
+		input.SSECustomerAlgorithm = aws.String(string(types.ServerSideEncryptionAes256))
+		input.SSECustomerKey = aws.String(s.opts.CustomerKey)
+		input.SSECustomerKeyMD5 = aws.String(s.customerKeyMD5)
+	}
+	setChecksum(&input, opts.Checksum, size < 0 || size >= s.uploader.PartSize)
+
+	if _, err := s.uploader.Upload(ctx, &input); err != nil {
+		return fmt.Errorf("failed to upload %s: %w", s.URI(key), err)
+	}
+	return nil
+}
+
+// Deletes objects, batching requests to respect the DeleteObjects limit.
+func (s *S3Store) Delete(ctx context.Context, keys []string) error {
+	for start := 0; start < len(keys); start += maxDeleteObjects {
+		end := min(start+maxDeleteObjects, len(keys))
+
+		objects := make([]types.ObjectIdentifier, 0, end-start)
+		for _, key := range keys[start:end] {
+			objects = append(objects, types.ObjectIdentifier{Key: aws.String(key)})
+		}
+
+		result, err := s.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &types.Delete{Objects: objects},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete objects from s3://%s: %w", s.bucket, err)
+		}
+		if len(result.Errors) > 0 {
+			first := result.Errors[0]
+			return fmt.Errorf("failed to delete %s: %s",
+				s.URI(aws.ToString(first.Key)), aws.ToString(first.Message))
+		}
+	}
+	return nil
+}
+
+// Retrieves the size and metadata of an object.
+func (s *S3Store) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	input := s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	// Objects encrypted with SSE-C can only be inspected with their key.
+	if s.customerKeyMD5 != "" {
+		input.SSECustomerAlgorithm = aws.String(string(types.ServerSideEncryptionAes256))
+		input.SSECustomerKey = aws.String(s.opts.CustomerKey)
+		input.SSECustomerKeyMD5 = aws.String(s.customerKeyMD5)
+	}
+	input.ChecksumMode = types.ChecksumModeEnabled
+	result, err := s.client.HeadObject(ctx, &input)
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return ObjectInfo{}, fmt.Errorf("%w: %s", ErrNotFound, s.URI(key))
+		}
+		return ObjectInfo{}, fmt.Errorf("failed to head %s: %w", s.URI(key), err)
+	}
+	return ObjectInfo{
+		Size:     aws.ToInt64(result.ContentLength),
+		Metadata: result.Metadata,
+		Checksum: headChecksum(result),
+	}, nil
+}
+
+// Sets the checksum S3 verifies an upload against.
+//
+// Parameters:
+//   - input: Upload request
+//   - checksum: Checksum of the object
+//   - multipart: Whether the object is uploaded in parts. S3 computes the checksums of parts
+//     itself, so only the algorithm is set.
+func setChecksum(input *s3.PutObjectInput, checksum Checksum, multipart bool) {
+	if checksum.Algorithm == "" {
+		return
+	}
+	input.ChecksumAlgorithm = types.ChecksumAlgorithm(checksum.Algorithm)
+	if multipart || checksum.Value == "" {
+		return
+	}
+	switch checksum.Algorithm {
+	case ChecksumCRC32C:
+		input.ChecksumCRC32C = aws.String(checksum.Value)
+	case ChecksumSHA256:
+		input.ChecksumSHA256 = aws.String(checksum.Value)
+	}
+}
+
+// Retrieves the checksum S3 stored with an object. Checksums of multipart uploads are checksums
+// of the parts' checksums (suffixed with "-<parts>"), which cannot be compared to the checksum of
+// the contents, so they are ignored.
+func headChecksum(result *s3.HeadObjectOutput) Checksum {
+	var checksum Checksum
+	switch {
+	case result.ChecksumCRC32C != nil:
+		checksum = Checksum{Algorithm: ChecksumCRC32C, Value: *result.ChecksumCRC32C}
+	case result.ChecksumSHA256 != nil:
+		checksum = Checksum{Algorithm: ChecksumSHA256, Value: *result.ChecksumSHA256}
+	}
+	if strings.Contains(checksum.Value, "-") {
+		return Checksum{}
+	}
+	return checksum
+}
+
+// Returns "s3://<bucket>/<key>".
+func (s *S3Store) URI(key string) string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, key)
+}
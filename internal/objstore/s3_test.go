@@ -0,0 +1,105 @@
+package objstore
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestS3Options_Validate(t *testing.T) {
+	customerKey := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32)))
+	shortKey := base64.StdEncoding.EncodeToString([]byte("short"))
+
+	tests := []struct {
+		name    string
+		opts    S3Options
+		wantErr bool
+	}{
+		{"empty", S3Options{}, false},
+		{"aes256", S3Options{ServerSideEncryption: "AES256"}, false},
+		{
+			"kms with options",
+			S3Options{
+				ServerSideEncryption: "aws:kms",
+				KMSKeyID:             "alias/logs",
+				BucketKeyEnabled:     true,
+				EncryptionContext:    map[string]string{"team": "logs"},
+			},
+			false,
+		},
+		{"unknown sse", S3Options{ServerSideEncryption: "aws:kms:dsse:x"}, true},
+		{"kms key without kms", S3Options{ServerSideEncryption: "AES256", KMSKeyID: "k"}, true},
+		{"bucket key without sse", S3Options{BucketKeyEnabled: true}, true},
+		{"sse-c", S3Options{CustomerKey: customerKey}, false},
+		{
+			"sse-c with sse",
+			S3Options{ServerSideEncryption: "AES256", CustomerKey: customerKey},
+			true,
+		},
+		{"sse-c short key", S3Options{CustomerKey: shortKey}, true},
+		{"sse-c not base64", S3Options{CustomerKey: "not base64!"}, true},
+		{"storage class", S3Options{StorageClass: "GLACIER_IR"}, false},
+		{"unknown storage class", S3Options{StorageClass: "COLD"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewS3Store_Options(t *testing.T) {
+	customerKey := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32)))
+	store, err := NewS3Store(nil, "bucket", S3Options{
+		CustomerKey: customerKey,
+	})
+	if err != nil {
+		t.Fatalf("NewS3Store() error = %v", err)
+	}
+	// echo -n kkkkkkkkkkkkkkkkkkkkkkkkkkkkkkkk | openssl md5 -binary | base64
+	if want := "mT2HRsMGJ5IX5C+0rreZ8Q=="; store.customerKeyMD5 != want {
+		t.Errorf("customerKeyMD5 = %q, want %q", store.customerKeyMD5, want)
+	}
+
+	_, err = NewS3Store(nil, "bucket", S3Options{StorageClass: "COLD"})
+	if err == nil {
+		t.Error("NewS3Store() with unknown storage class error = nil, want error")
+	}
+}
+
+func TestHeadChecksum(t *testing.T) {
+	tests := []struct {
+		name   string
+		result s3.HeadObjectOutput
+		want   Checksum
+	}{
+		{"none", s3.HeadObjectOutput{}, Checksum{}},
+		{
+			"single part",
+			s3.HeadObjectOutput{ChecksumCRC32C: aws.String("yZRlqg==")},
+			Checksum{Algorithm: ChecksumCRC32C, Value: "yZRlqg=="},
+		},
+		{
+			"single part sha256",
+			s3.HeadObjectOutput{ChecksumSHA256: aws.String("LPJNul+wow4m6Dsq")},
+			Checksum{Algorithm: ChecksumSHA256, Value: "LPJNul+wow4m6Dsq"},
+		},
+		// Checksum of the parts' checksums, which Verify cannot compare
+		{"multipart", s3.HeadObjectOutput{ChecksumCRC32C: aws.String("Zm9vYg==-3")}, Checksum{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := headChecksum(&tt.result); got != tt.want {
+				t.Errorf("headChecksum() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
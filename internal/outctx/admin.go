@@ -0,0 +1,159 @@
+package outctx
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/y-scope/fluent-bit-clp/internal/admin"
+)
+
+// Options whose values are replaced with [admin.Redacted] in configuration dumps.
+var secretOptions = []string{"azure_connection_string", "sse_customer_key"}
+
+// Starts serving the admin API if admin_listen is set. Called once recovery is complete, so admin
+// requests only see event managers of this run.
+//
+// Returns:
+//   - err: Error listening
+func (ctx *S3Context) ServeAdmin() error {
+	if ctx.Config.AdminListen == "" {
+		return nil
+	}
+	server, err := admin.Serve(ctx.Config.AdminListen, ctx, ctx.Log)
+	if err != nil {
+		return err
+	}
+	ctx.Admin = server
+	return nil
+}
+
+// Getter for paused.
+//
+// Returns:
+//   - paused: Whether uploads are paused through the admin API
+func (ctx *S3Context) UploadsPaused() bool {
+	return ctx.paused.Load()
+}
+
+// Lists the event managers for the admin API.
+//
+// Returns:
+//   - streams: Event manager of each tag
+func (ctx *S3Context) Streams() []admin.Stream {
+	ctx.Mutex.Lock()
+	defer ctx.Mutex.Unlock()
+
+	var uploadBytes int64
+	if ctx.Config.UseDiskBuffer {
+		uploadBytes = int64(ctx.Config.UploadSizeMb) << 20
+	}
+	streams := make([]admin.Stream, 0, len(ctx.EventManagers))
+	for tag, eventManager := range ctx.EventManagers {
+		if eventManager.Writer == nil {
+			// Evicted, but its buffer files could not be removed yet
+			continue
+		}
+		// The size is only used for display, so a failed stat shows an empty buffer.
+		bufferSize, _ := eventManager.Writer.GetZstdOutputSize()
+		streams = append(streams, admin.Stream{
+			Name:        tag,
+			BufferBytes: int64(bufferSize),
+			UploadBytes: uploadBytes,
+			Events:      eventManager.stats.Events,
+			Pending:     eventManager.pending,
+			LastWrite:   eventManager.lastUsed,
+		})
+	}
+	slices.SortFunc(streams, func(a, b admin.Stream) int { return strings.Compare(a.Name, b.Name) })
+	return streams
+}
+
+// Uploads event managers for the admin API, regardless of upload_size_mb.
+//
+// Parameters:
+//   - tag: Tag of the event manager to upload, or empty to upload every event manager holding
+//     pending events
+//
+// Returns:
+//   - results: Result of each upload
+//   - err: [admin.ErrStreamNotFound]
+func (ctx *S3Context) Flush(tag string) ([]admin.FlushResult, error) {
+	ctx.Mutex.Lock()
+	defer ctx.Mutex.Unlock()
+
+	var eventManagers []*EventManager
+	if tag != "" {
+		eventManager, ok := ctx.EventManagers[tag]
+		if !ok || eventManager.Writer == nil {
+			return nil, admin.ErrStreamNotFound
+		}
+		eventManagers = append(eventManagers, eventManager)
+	} else {
+		for _, eventManager := range ctx.EventManagers {
+			if eventManager.pending {
+				eventManagers = append(eventManagers, eventManager)
+			}
+		}
+	}
+
+	var results []admin.FlushResult
+	for _, eventManager := range eventManagers {
+		result := admin.FlushResult{Stream: eventManager.Tag}
+		err := eventManager.ToS3(ctx)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// Pauses or resumes uploads. While paused, chunks are buffered regardless of upload_size_mb
+// (in memory if use_disk_buffer is off) and event managers are not evicted.
+//
+// Parameters:
+//   - paused: Whether uploads are paused
+func (ctx *S3Context) SetPaused(paused bool) {
+	ctx.paused.Store(paused)
+}
+
+// Getter for paused, for the admin API.
+//
+// Returns:
+//   - paused: Whether uploads are paused
+func (ctx *S3Context) Paused() bool {
+	return ctx.UploadsPaused()
+}
+
+// Gathers the effective configuration for the admin API.
+//
+// Returns:
+//   - config: Values by option name, secrets redacted
+func (ctx *S3Context) EffectiveConfig() map[string]any {
+	return ctx.Config.options()
+}
+
+// Gathers the values of all options, including defaults. Durations are formatted as in
+// fluent-bit.conf and secret options which are set are redacted.
+//
+// Returns:
+//   - options: Values by option name
+func (config *S3Config) options() map[string]any {
+	options := make(map[string]any)
+	value := reflect.ValueOf(*config)
+	for i := range value.NumField() {
+		name := value.Type().Field(i).Tag.Get("conf")
+		field := value.Field(i).Interface()
+		switch {
+		case slices.Contains(secretOptions, name) && !value.Field(i).IsZero():
+			options[name] = admin.Redacted
+		case value.Field(i).Type() == reflect.TypeFor[time.Duration]():
+			options[name] = field.(time.Duration).String()
+		default:
+			options[name] = field
+		}
+	}
+	return options
+}
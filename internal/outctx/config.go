@@ -1,18 +1,29 @@
 package outctx
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 	"unsafe"
 
 	"github.com/fluent/fluent-bit-go/output"
 	"github.com/go-playground/validator/v10"
 	"github.com/google/uuid"
+
+	"github.com/y-scope/fluent-bit-clp/internal/logging"
+	"github.com/y-scope/fluent-bit-clp/internal/objindex"
+	"github.com/y-scope/fluent-bit-clp/internal/objstore"
+	"github.com/y-scope/fluent-bit-clp/internal/timestamp"
 )
 
+// Default s3_key_format. Reproduces the key used before s3_key_format was configurable, e.g.
+// "myapp_0_2024-01-15T10:30:00Z_abc123.zst".
+const DefaultS3KeyFormat = "${TAG}_${INDEX}_${UPLOAD_TIME}_${ID}.zst"
+
 // Holds settings for S3 CLP plugin from user-defined Fluent Bit configuration file.
 // The "conf" struct tags are the plugin options described to user in README, and allow user to see
 // snake case "use_single_key" vs. camel case "SingleKey" in validation error messages. The
@@ -21,18 +32,53 @@ import (
 //
 //nolint:revive
 type S3Config struct {
-	S3Region        string `conf:"s3_region"         validate:"required"`
-	S3Bucket        string `conf:"s3_bucket"         validate:"required"`
-	S3BucketPrefix  string `conf:"s3_bucket_prefix"  validate:"dirpath"`
-	RoleArn         string `conf:"role_arn"          validate:"omitempty,startswith=arn:aws:iam"`
-	Id              string `conf:"id"                validate:"required"`
-	UseSingleKey    bool   `conf:"use_single_key"    validate:"-"`
-	AllowMissingKey bool   `conf:"allow_missing_key" validate:"-"`
-	SingleKey       string `conf:"single_key"        validate:"required_if=use_single_key true"`
-	UseDiskBuffer   bool   `conf:"use_disk_buffer"   validate:"-"`
-	DiskBufferPath  string `conf:"disk_buffer_path"  validate:"omitempty,dirpath"`
-	UploadSizeMb    int    `conf:"upload_size_mb"    validate:"omitempty,gte=2,lt=1000"`
-	TimeZone        string `conf:"time_zone"         validate:"timezone"`
+	S3Region          string        `conf:"s3_region"               validate:"required"`
+	Destination       string        `conf:"destination"             validate:"oneof=s3 file gcs azure"`
+	DestinationPath   string        `conf:"destination_path"        validate:"required_if=Destination file"`
+	S3Bucket          string        `conf:"s3_bucket"               validate:"required_if=Destination s3"`
+	GcsBucket         string        `conf:"gcs_bucket"              validate:"required_if=Destination gcs"`
+	AzureContainer    string        `conf:"azure_container"         validate:"required_if=Destination azure"`
+	AzureAccountUrl   string        `conf:"azure_account_url"       validate:"omitempty,url"`
+	AzureConnString   string        `conf:"azure_connection_string" validate:"-"`
+	S3BucketPrefix    string        `conf:"s3_bucket_prefix"        validate:"dirpath"`
+	RoleArn           string        `conf:"role_arn"                validate:"omitempty,startswith=arn:aws:iam"`
+	Sse               string        `conf:"sse"                     validate:"omitempty,oneof=AES256 aws:kms"`
+	SseKmsKeyId       string        `conf:"sse_kms_key_id"          validate:"-"`
+	SseBucketKey      bool          `conf:"sse_bucket_key"          validate:"-"`
+	SseContext        string        `conf:"sse_encryption_context"  validate:"omitempty,json"`
+	SseCustomerKey    string        `conf:"sse_customer_key"        validate:"-"`
+	StorageClass      string        `conf:"storage_class"           validate:"-"`
+	EncryptionKeyFile string        `conf:"encryption_key_file"     validate:"omitempty,file,excluded_with=EncryptionKmsKey"`
+	EncryptionKmsKey  string        `conf:"encryption_kms_key_id"   validate:"-"`
+	Checksum          string        `conf:"checksum"                validate:"oneof=crc32c sha256 none"`
+	VerifyUploads     bool          `conf:"verify_uploads"          validate:"-"`
+	ObjectTags        string        `conf:"object_tags"             validate:"-"`
+	LogLevelKey       string        `conf:"log_level_key"           validate:"-"`
+	WriteIndex        bool          `conf:"write_index"             validate:"-"`
+	IndexBloomSizeKb  int           `conf:"index_bloom_size_kb"     validate:"gte=1,lte=16384"`
+	Id                string        `conf:"id"                      validate:"required"`
+	UseSingleKey      bool          `conf:"use_single_key"          validate:"-"`
+	AllowMissingKey   bool          `conf:"allow_missing_key"       validate:"-"`
+	SingleKey         string        `conf:"single_key"              validate:"required_if=use_single_key true"`
+	KeepAuxiliaryKeys bool          `conf:"keep_auxiliary_keys"     validate:"-"`
+	UseDiskBuffer     bool          `conf:"use_disk_buffer"         validate:"-"`
+	DiskBufferPath    string        `conf:"disk_buffer_path"        validate:"omitempty,dirpath"`
+	UploadSizeMb      int           `conf:"upload_size_mb"          validate:"omitempty,gte=2,lt=1000"`
+	DiskQuotaMb       int           `conf:"disk_quota_mb"           validate:"omitempty,gtfield=UploadSizeMb"`
+	DiskQuotaPerTagMb int           `conf:"disk_quota_per_tag_mb"   validate:"omitempty,gtfield=UploadSizeMb"`
+	DiskQuotaOverflow string        `conf:"disk_quota_overflow"     validate:"oneof=retry drop_oldest drop_low_severity"`
+	DiskQuotaKeepLvl  string        `conf:"disk_quota_keep_level"   validate:"oneof=debug info warn error fatal"`
+	TimeZone          string        `conf:"time_zone"               validate:"timezone"`
+	TimeKey           string        `conf:"time_key"                validate:"-"`
+	TimeFormat        string        `conf:"time_format"             validate:"required"`
+	IdleTimeout       time.Duration `conf:"idle_timeout"            validate:"gte=0"`
+	MaxOpenStreams    int           `conf:"max_open_streams"        validate:"gte=0"`
+	S3KeyFormat       string        `conf:"s3_key_format"           validate:"required"`
+	MetricsListen     string        `conf:"metrics_listen"          validate:"-"`
+	AdminListen       string        `conf:"admin_listen"            validate:"-"`
+	LogLevel          string        `conf:"log_level"               validate:"oneof=off error warn warning info debug trace"`
+	LogFormat         string        `conf:"log_format"              validate:"oneof=text json"`
+	LogRepeatInterval time.Duration `conf:"log_repeat_interval"     validate:"gte=0"`
 }
 
 // Generates configuration struct containing user-defined settings. In addition, sets default values
@@ -50,33 +96,80 @@ func NewS3Config(plugin unsafe.Pointer) (*S3Config, error) {
 	config := S3Config{
 		// Default Id is uuid to safeguard against s3 filename namespace collision. User may use
 		// multiple collectors to send logs to same s3 path. Id is appended to s3 filename.
-		S3Region:        "us-east-1",
-		S3BucketPrefix:  "logs/",
-		Id:              uuid.New().String(),
-		UseSingleKey:    true,
-		AllowMissingKey: true,
-		SingleKey:       "log",
-		UseDiskBuffer:   true,
-		DiskBufferPath:  "tmp/out_clp_s3/",
-		UploadSizeMb:    16,
-		TimeZone:        "America/Toronto",
+		Destination:       objstore.DestinationS3,
+		S3Region:          "us-east-1",
+		S3BucketPrefix:    "logs/",
+		Id:                uuid.New().String(),
+		UseSingleKey:      true,
+		AllowMissingKey:   true,
+		SingleKey:         "log",
+		KeepAuxiliaryKeys: true,
+		UseDiskBuffer:     true,
+		DiskBufferPath:    "tmp/out_clp_s3/",
+		UploadSizeMb:      16,
+		DiskQuotaOverflow: OverflowRetry,
+		DiskQuotaKeepLvl:  "error",
+		Checksum:          "crc32c",
+		LogLevelKey:       "level",
+		IndexBloomSizeKb:  objindex.DefaultBloomSize / 1024,
+		TimeZone:          "America/Toronto",
+		TimeFormat:        timestamp.FormatRfc3339,
+		S3KeyFormat:       DefaultS3KeyFormat,
+		LogLevel:          "info",
+		LogFormat:         logging.FormatText,
+		LogRepeatInterval: logging.DefaultRepeatInterval,
 	}
 
 	// Map used to loop over user inputs saving a [output.FLBPluginConfigKey] call for each key.
 	// Potential to iterate over struct using reflect; however, better to avoid reflect package.
 	pluginSettings := map[string]interface{}{
-		"s3_region":         &config.S3Region,
-		"s3_bucket":         &config.S3Bucket,
-		"s3_bucket_prefix":  &config.S3BucketPrefix,
-		"role_arn":          &config.RoleArn,
-		"id":                &config.Id,
-		"use_single_key":    &config.UseSingleKey,
-		"allow_missing_key": &config.AllowMissingKey,
-		"single_key":        &config.SingleKey,
-		"use_disk_buffer":   &config.UseDiskBuffer,
-		"disk_buffer_path":  &config.DiskBufferPath,
-		"upload_size_mb":    &config.UploadSizeMb,
-		"time_zone":         &config.TimeZone,
+		"s3_region":               &config.S3Region,
+		"destination":             &config.Destination,
+		"destination_path":        &config.DestinationPath,
+		"s3_bucket":               &config.S3Bucket,
+		"gcs_bucket":              &config.GcsBucket,
+		"azure_container":         &config.AzureContainer,
+		"azure_account_url":       &config.AzureAccountUrl,
+		"azure_connection_string": &config.AzureConnString,
+		"s3_bucket_prefix":        &config.S3BucketPrefix,
+		"role_arn":                &config.RoleArn,
+		"sse":                     &config.Sse,
+		"sse_kms_key_id":          &config.SseKmsKeyId,
+		"sse_bucket_key":          &config.SseBucketKey,
+		"sse_encryption_context":  &config.SseContext,
+		"sse_customer_key":        &config.SseCustomerKey,
+		"storage_class":           &config.StorageClass,
+		"encryption_key_file":     &config.EncryptionKeyFile,
+		"encryption_kms_key_id":   &config.EncryptionKmsKey,
+		"checksum":                &config.Checksum,
+		"verify_uploads":          &config.VerifyUploads,
+		"object_tags":             &config.ObjectTags,
+		"log_level_key":           &config.LogLevelKey,
+		"write_index":             &config.WriteIndex,
+		"index_bloom_size_kb":     &config.IndexBloomSizeKb,
+		"id":                      &config.Id,
+		"use_single_key":          &config.UseSingleKey,
+		"allow_missing_key":       &config.AllowMissingKey,
+		"single_key":              &config.SingleKey,
+		"keep_auxiliary_keys":     &config.KeepAuxiliaryKeys,
+		"use_disk_buffer":         &config.UseDiskBuffer,
+		"disk_buffer_path":        &config.DiskBufferPath,
+		"upload_size_mb":          &config.UploadSizeMb,
+		"disk_quota_mb":           &config.DiskQuotaMb,
+		"disk_quota_per_tag_mb":   &config.DiskQuotaPerTagMb,
+		"disk_quota_overflow":     &config.DiskQuotaOverflow,
+		"disk_quota_keep_level":   &config.DiskQuotaKeepLvl,
+		"time_zone":               &config.TimeZone,
+		"time_key":                &config.TimeKey,
+		"time_format":             &config.TimeFormat,
+		"idle_timeout":            &config.IdleTimeout,
+		"max_open_streams":        &config.MaxOpenStreams,
+		"s3_key_format":           &config.S3KeyFormat,
+		"metrics_listen":          &config.MetricsListen,
+		"admin_listen":            &config.AdminListen,
+		"log_level":               &config.LogLevel,
+		"log_format":              &config.LogFormat,
+		"log_repeat_interval":     &config.LogRepeatInterval,
 	}
 
 	for settingName, untypedField := range pluginSettings {
@@ -107,6 +200,12 @@ func NewS3Config(plugin unsafe.Pointer) (*S3Config, error) {
 				return nil, fmt.Errorf("error could not parse input %v into int", userInput)
 			}
 			*configField = intInput
+		case *time.Duration:
+			durationInput, err := time.ParseDuration(userInput)
+			if err != nil {
+				return nil, fmt.Errorf("error could not parse input %v into duration", userInput)
+			}
+			*configField = durationInput
 		default:
 			return nil, fmt.Errorf("unable to parse type %T", untypedField)
 		}
@@ -140,10 +239,85 @@ func NewS3Config(plugin unsafe.Pointer) (*S3Config, error) {
 				err.Field(), err.Value(), err.Tag())
 			configErrors = append(configErrors, err)
 		}
+	}
+
+	// Encryption and storage class options have rules spanning several options, which cannot be
+	// expressed with [validator] tags.
+	err = config.validateS3Options()
+	if err != nil {
+		configErrors = append(configErrors, err)
+	}
+
+	if len(configErrors) > 0 {
 		// Wrap all errors into one error before returning.
-		err = errors.Join(configErrors...)
-		return nil, err
+		return nil, errors.Join(configErrors...)
 	}
 
 	return &config, nil
 }
+
+// Gathers the encryption and storage class options of uploaded S3 objects.
+//
+// Returns:
+//   - opts: Options of uploaded S3 objects
+//   - err: Error parsing sse_encryption_context
+func (config *S3Config) s3Options() (objstore.S3Options, error) {
+	opts := objstore.S3Options{
+		ServerSideEncryption: config.Sse,
+		KMSKeyID:             config.SseKmsKeyId,
+		BucketKeyEnabled:     config.SseBucketKey,
+		CustomerKey:          config.SseCustomerKey,
+		StorageClass:         config.StorageClass,
+	}
+	if config.SseContext != "" {
+		err := json.Unmarshal([]byte(config.SseContext), &opts.EncryptionContext)
+		if err != nil {
+			return objstore.S3Options{}, fmt.Errorf(
+				"error validating option sse_encryption_context, expected JSON string map: %w",
+				err,
+			)
+		}
+	}
+	return opts, nil
+}
+
+// Gathers the options common to all uploaded objects.
+//
+// Returns:
+//   - opts: Checksum algorithm and verification of uploaded objects
+func (config *S3Config) putOptions() objstore.PutOptions {
+	// checksum is validated to be a known algorithm.
+	algorithm, _ := objstore.ParseChecksumAlgorithm(config.Checksum)
+	return objstore.PutOptions{
+		Checksum: objstore.Checksum{Algorithm: algorithm},
+		Verify:   config.VerifyUploads,
+	}
+}
+
+// Validates encryption and storage class options. The options are only supported by the s3
+// destination.
+//
+// Returns:
+//   - err: Invalid options, options set for another destination
+func (config *S3Config) validateS3Options() error {
+	opts, err := config.s3Options()
+	if err != nil {
+		return err
+	}
+
+	if config.Destination != objstore.DestinationS3 {
+		if reflect.ValueOf(opts).IsZero() {
+			return nil
+		}
+		return fmt.Errorf(
+			"error validating encryption and storage class options, only supported by %s",
+			objstore.DestinationS3,
+		)
+	}
+
+	err = opts.Validate()
+	if err != nil {
+		return fmt.Errorf("error validating encryption and storage class options: %w", err)
+	}
+	return nil
+}
@@ -6,22 +6,24 @@ package outctx
 // using outctx to prevent namespace collision with [context].
 import (
 	"context"
-	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/sts"
-	"github.com/aws/smithy-go"
-
+	"github.com/y-scope/fluent-bit-clp/internal/admin"
+	"github.com/y-scope/fluent-bit-clp/internal/envelope"
 	"github.com/y-scope/fluent-bit-clp/internal/irzstd"
-
-	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/y-scope/fluent-bit-clp/internal/keytemplate"
+	"github.com/y-scope/fluent-bit-clp/internal/logging"
+	"github.com/y-scope/fluent-bit-clp/internal/metrics"
+	"github.com/y-scope/fluent-bit-clp/internal/objindex"
+	"github.com/y-scope/fluent-bit-clp/internal/objmeta"
+	"github.com/y-scope/fluent-bit-clp/internal/objstore"
+	"github.com/y-scope/fluent-bit-clp/internal/timestamp"
 )
 
 // Names of disk buffering directories.
@@ -30,118 +32,206 @@ const (
 	ZstdDir = "zstd"
 )
 
-// AWS error codes.
-const (
-	invalidCredsCode  = "InvalidClientTokenId"
-	bucketMissingCode = "NotFound"
-)
-
 // Holds objects accessible to plugin during flush. Fluent Bit uses a single thread for Go output
-// plugin instance so no need to consider synchronization issues. C plugins use "coroutines" which
-// could cause synchronization issues for C plugins according to [docs] but "coroutines" are not
-// used in Go plugins.
+// plugin instance so flushes need no synchronization among themselves. C plugins use "coroutines"
+// which could cause synchronization issues for C plugins according to [docs] but "coroutines" are
+// not used in Go plugins. Requests of the admin API are served on other goroutines, so flushes and
+// admin requests hold Mutex.
 // [docs]: https://github.com/fluent/fluent-bit/blob/master/DEVELOPER_GUIDE.md#concurrency
 type S3Context struct {
-	Config        S3Config
-	Uploader      *manager.Uploader
+	Config S3Config
+	// Destination of uploads.
+	Store objstore.ObjectStore
+	// Client-side encryption of objects. Nil if objects are uploaded unencrypted.
+	Encryptor *envelope.Encryptor
+	// Parser for timestamps in the record's time_key. Nil if time_key is not set.
+	TimeParser *timestamp.Parser
+	// Parsed s3_key_format.
+	KeyFormat *keytemplate.Template
+	// Parsed object_tags, applied to objects besides the Fluent Bit tag.
+	Tags objmeta.Tags
+	// Hostname available to s3_key_format. Empty if it could not be retrieved.
+	Hostname string
+	// Server exposing metrics. Nil if metrics_listen is not set.
+	Metrics *metrics.Server
+	// Server of the admin API. Nil if admin_listen is not set.
+	Admin *admin.Server
+	// Logger of the plugin instance, adding its id to messages.
+	Log           *logging.Logger
 	EventManagers map[string]*EventManager
+	// Serializes flushes with requests of the admin API.
+	Mutex sync.Mutex
+	// Set while uploads are paused through the admin API.
+	paused atomic.Bool
 }
 
-// Creates a new context. Loads configuration from user. Loads and tests aws credentials.
+// Creates a new context. Loads configuration from user. Creates the object store for the
+// configured destination and the key provider of client-side encryption. If metrics_listen is set,
+// starts serving metrics.
 //
 // Parameters:
 //   - plugin: Fluent Bit plugin reference
 //
 // Returns:
 //   - S3Context: Plugin context
-//   - err: User configuration load failed, aws errors
+//   - err: User configuration load failed, destination errors, error listening for metrics
 func NewS3Context(plugin unsafe.Pointer) (*S3Context, error) {
 	config, err := NewS3Config(plugin)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load configuration: %w", err)
 	}
 
-	// Load the aws credentials. [awsConfig.LoadDefaultConfig] will look for credentials in a
-	// specific hierarchy.
-	// https://aws.github.io/aws-sdk-go-v2/docs/configuring-sdk/
-	awsCfg, err := awsConfig.LoadDefaultConfig(context.TODO(),
-		awsConfig.WithRegion(config.S3Region),
-	)
+	var timeParser *timestamp.Parser
+	if config.TimeKey != "" {
+		timeParser, err = newTimeParser(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load configuration: %w", err)
+		}
+	}
+
+	keyFormat, err := keytemplate.Parse(config.S3KeyFormat)
 	if err != nil {
-		return nil, fmt.Errorf("could not load aws credentials %w", err)
+		return nil, fmt.Errorf(
+			"error validating option s3_key_format=%s: %w",
+			config.S3KeyFormat,
+			err,
+		)
 	}
 
-	// Allows user to assume a provided role. Fluent Bit s3 plugin provides this feature.
-	// In many cases, the EC2 instance will already have permission for the s3 bucket;
-	// however, if it doesn't, this option allows the plugin to assume role with bucket access.
-	if config.RoleArn != "" {
-		stsClient := sts.NewFromConfig(awsCfg)
-		creds := stscreds.NewAssumeRoleProvider(stsClient, config.RoleArn)
-		awsCfg.Credentials = aws.NewCredentialsCache(creds)
+	tags, err := newObjectTags(config)
+	if err != nil {
+		return nil, err
 	}
 
-	s3Client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
-		// Enable path-style addressing for S3-compatible services (MinIO, LocalStack, etc.)
-		// AWS S3 supports both styles, but custom endpoints typically require path-style.
-		if os.Getenv("AWS_ENDPOINT_URL") != "" {
-			o.UsePathStyle = true
-		}
-	})
+	logger, err := newLogger(config)
+	if err != nil {
+		return nil, err
+	}
 
-	// Confirm bucket exists and test aws credentials.
-	_, err = s3Client.HeadBucket(context.TODO(), &s3.HeadBucketInput{
-		Bucket: aws.String(config.S3Bucket),
-	})
+	hostname, err := os.Hostname()
+	if err != nil {
+		logger.Warnf("Could not retrieve hostname for s3_key_format: %v", err)
+	}
+
+	store, err := newObjectStore(config, logger)
 	if err != nil {
-		// AWS does have some error types that can be checked with [error.As] such as
-		// [s3.NotFound]. However, it can be difficult to always find the appropriate type. As a
-		// result, using aws [smithy-go] to handle error codes.
-		// https://aws.github.io/aws-sdk-go-v2/docs/handling-errors/#api-error-responses
-		var ae smithy.APIError
-		if errors.As(err, &ae) {
-			switch code := ae.ErrorCode(); code {
-			case invalidCredsCode:
-				err = fmt.Errorf("error aws credentials are invalid: %w", err)
-			case bucketMissingCode:
-				err = fmt.Errorf("error bucket %s could not be found: %w", config.S3Bucket, err)
-			default:
-				err = fmt.Errorf("error aws %s: %w", code, err)
-			}
-		}
 		return nil, err
 	}
 
-	uploader := manager.NewUploader(s3Client)
+	encryptor, err := newEncryptor(config, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	var metricsServer *metrics.Server
+	if config.MetricsListen != "" {
+		metricsServer, err = metrics.Serve(config.MetricsListen)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	ctx := S3Context{
 		Config:        *config,
-		Uploader:      uploader,
+		Store:         store,
+		Encryptor:     encryptor,
+		TimeParser:    timeParser,
+		KeyFormat:     keyFormat,
+		Tags:          tags,
+		Hostname:      hostname,
+		Metrics:       metricsServer,
+		Log:           logger,
 		EventManagers: make(map[string]*EventManager),
 	}
 
 	return &ctx, nil
 }
 
+// Parses object_tags. Objects are always tagged with the Fluent Bit tag, which counts towards the
+// tag limit of S3.
+//
+// Parameters:
+//   - config: Plugin configuration
+//
+// Returns:
+//   - tags: Parsed tags
+//   - err: Invalid object_tags, tag conflicts with the Fluent Bit tag
+func newObjectTags(config *S3Config) (objmeta.Tags, error) {
+	tags, err := objmeta.ParseTags(config.ObjectTags)
+	if err != nil {
+		return nil, fmt.Errorf("error validating option object_tags: %w", err)
+	}
+	if _, ok := tags[s3TagKey]; ok {
+		return nil, fmt.Errorf("error validating option object_tags: tag %s is reserved", s3TagKey)
+	}
+	if len(tags) >= objmeta.MaxTags {
+		return nil, fmt.Errorf(
+			"error validating option object_tags: at most %d tags are allowed besides %s",
+			objmeta.MaxTags-1,
+			s3TagKey,
+		)
+	}
+	return tags, nil
+}
+
+// Creates a parser for timestamps in the record's time_key. Timestamps without a time zone are
+// interpreted in time_zone.
+//
+// Parameters:
+//   - config: Plugin configuration
+//
+// Returns:
+//   - timeParser: Timestamp parser
+//   - err: Error loading time zone, invalid time_format
+func newTimeParser(config *S3Config) (*timestamp.Parser, error) {
+	location, err := time.LoadLocation(config.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("error loading time_zone %s: %w", config.TimeZone, err)
+	}
+
+	timeParser, err := timestamp.NewParser(config.TimeFormat, location)
+	if err != nil {
+		return nil, fmt.Errorf("error validating option time_format=%s: %w", config.TimeFormat, err)
+	}
+	return timeParser, nil
+}
+
 // If the event manager for the tag has been initialized, get the corresponding event manager. If
-// not, create new one.
+// not, create new one. If max_open_streams is reached, the least recently used event manager is
+// evicted first. An earlier eviction of the tag's event manager which failed after closing its
+// writer is completed before a new one is created.
 //
 // Parameters:
 //   - tag: Fluent Bit tag
 //   - size: Byte length
 //
 // Returns:
-//   - err: Could not create buffers or tag
+//   - err: Could not create buffers or tag, could not complete an earlier eviction
 func (ctx *S3Context) GetEventManager(tag string, size int) (*EventManager, error) {
 	var err error
 	eventManager, ok := ctx.EventManagers[tag]
+	if ok && eventManager.Writer == nil {
+		err = ctx.evictEventManager(eventManager)
+		if err != nil {
+			return nil, fmt.Errorf("error completing eviction of tag %s: %w", tag, err)
+		}
+		ok = false
+	}
 
 	if !ok {
+		ctx.evictLeastRecentlyUsed()
 		eventManager, err = ctx.newEventManager(tag, size)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	now := time.Now()
+	if !eventManager.pending {
+		eventManager.bufferedSince = now
+	}
+	eventManager.lastUsed = now
+	eventManager.pending = true
 	return eventManager, nil
 }
 
@@ -170,11 +260,16 @@ func (ctx *S3Context) RecoverEventManager(
 	}
 
 	eventManager := EventManager{
-		Tag:    tag,
-		Writer: writer,
+		Tag:       tag,
+		Writer:    writer,
+		index:     ctx.newIndexBuilder(),
+		lastUsed:  time.Now(),
+		pending:   true,
+		uncounted: true,
 	}
 
 	ctx.EventManagers[tag] = &eventManager
+	metrics.OpenStreams.Add(1)
 
 	return &eventManager, nil
 }
@@ -216,13 +311,26 @@ func (ctx *S3Context) newEventManager(
 	eventManager := EventManager{
 		Tag:    tag,
 		Writer: writer,
+		index:  ctx.newIndexBuilder(),
 	}
 
 	ctx.EventManagers[tag] = &eventManager
+	metrics.OpenStreams.Add(1)
 
 	return &eventManager, nil
 }
 
+// Creates the builder of an event manager's object indexes.
+//
+// Returns:
+//   - builder: Index builder, nil if write_index is not set
+func (ctx *S3Context) newIndexBuilder() *objindex.Builder {
+	if !ctx.Config.WriteIndex {
+		return nil
+	}
+	return objindex.NewBuilder(ctx.Config.IndexBloomSizeKb * 1024)
+}
+
 // Retrieves paths for IR and Zstd disk buffer directories.
 //
 // Returns:
@@ -253,3 +361,71 @@ func (ctx *S3Context) GetBufferFilePaths(
 
 	return irPath, zstdPath
 }
+
+// Creates the logger of the plugin instance from log_level, log_format and log_repeat_interval.
+// The logger, without the instance's id, also becomes the default logger of messages not tied to
+// an instance.
+//
+// Parameters:
+//   - config: Plugin configuration
+//
+// Returns:
+//   - logger: Logger adding the instance's id to messages
+//   - err: Invalid log_level
+func newLogger(config *S3Config) (*logging.Logger, error) {
+	level, err := logging.ParseLevel(config.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	logger := logging.New(os.Stderr, logging.Config{
+		Level:          level,
+		Format:         config.LogFormat,
+		RepeatInterval: config.LogRepeatInterval,
+	})
+	logging.SetDefault(logger)
+	return logger.With("id", config.Id), nil
+}
+
+// Creates the encryptor of objects from the configured key provider.
+//
+// Parameters:
+//   - config: Plugin configuration
+//   - logger: Logger of the plugin instance
+//
+// Returns:
+//   - encryptor: Client-side encryption of objects, nil if no key provider is configured
+//   - err: Destination cannot store metadata, error loading key file, aws errors
+func newEncryptor(config *S3Config, logger *logging.Logger) (*envelope.Encryptor, error) {
+	if config.EncryptionKeyFile == "" && config.EncryptionKmsKey == "" {
+		return nil, nil
+	}
+	// The wrapped data key and nonce are stored in object metadata, which files do not have.
+	if config.Destination == objstore.DestinationFile {
+		return nil, fmt.Errorf(
+			"error validating encryption options, not supported by destination %s",
+			objstore.DestinationFile,
+		)
+	}
+
+	var provider envelope.KeyProvider
+	if config.EncryptionKeyFile != "" {
+		fileProvider, err := envelope.LoadFileKeyProvider(config.EncryptionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading encryption_key_file: %w", err)
+		}
+		provider = fileProvider
+	} else {
+		kmsProvider, err := envelope.OpenKMSKeyProvider(
+			context.TODO(),
+			config.EncryptionKmsKey,
+			config.S3Region,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("error creating kms key provider: %w", err)
+		}
+		provider = kmsProvider
+	}
+
+	logger.Infof("Objects are encrypted with data keys from the %s key provider", provider.Name())
+	return envelope.NewEncryptor(provider), nil
+}
@@ -0,0 +1,130 @@
+package outctx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+
+	"github.com/y-scope/fluent-bit-clp/internal/logging"
+	"github.com/y-scope/fluent-bit-clp/internal/objstore"
+
+	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+)
+
+// AWS error codes.
+const (
+	invalidCredsCode  = "InvalidClientTokenId"
+	bucketMissingCode = "NotFound"
+)
+
+// Creates the object store for the configured destination.
+//
+// Parameters:
+//   - config: Plugin configuration
+//   - logger: Logger of the plugin instance
+//
+// Returns:
+//   - store: Destination of uploads
+//   - err: Error creating file store, gcs errors, azure errors, aws errors
+func newObjectStore(config *S3Config, logger *logging.Logger) (objstore.ObjectStore, error) {
+	switch config.Destination {
+	case objstore.DestinationFile:
+		store, err := objstore.NewFileStore(config.DestinationPath)
+		if err != nil {
+			return nil, fmt.Errorf("error creating file destination: %w", err)
+		}
+		logger.Infof("Objects are configured to be written to %s", store.URI(""))
+		return store, nil
+	case objstore.DestinationGCS:
+		store, err := objstore.OpenGCSStore(context.TODO(), config.GcsBucket)
+		if err != nil {
+			return nil, fmt.Errorf("error creating gcs destination: %w", err)
+		}
+		return store, nil
+	case objstore.DestinationAzure:
+		store, err := objstore.OpenAzureStore(context.TODO(), objstore.AzureOptions{
+			ConnectionString: config.AzureConnString,
+			AccountURL:       config.AzureAccountUrl,
+			Container:        config.AzureContainer,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error creating azure destination: %w", err)
+		}
+		return store, nil
+	default:
+		return newS3Store(config)
+	}
+}
+
+// Creates an S3 object store. Loads and tests aws credentials.
+//
+// Parameters:
+//   - config: Plugin configuration
+//
+// Returns:
+//   - store: S3 object store
+//   - err: aws errors
+func newS3Store(config *S3Config) (*objstore.S3Store, error) {
+	// Load the aws credentials. [awsConfig.LoadDefaultConfig] will look for credentials in a
+	// specific hierarchy.
+	// https://aws.github.io/aws-sdk-go-v2/docs/configuring-sdk/
+	awsCfg, err := awsConfig.LoadDefaultConfig(context.TODO(),
+		awsConfig.WithRegion(config.S3Region),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not load aws credentials %w", err)
+	}
+
+	// Allows user to assume a provided role. Fluent Bit s3 plugin provides this feature.
+	// In many cases, the EC2 instance will already have permission for the s3 bucket;
+	// however, if it doesn't, this option allows the plugin to assume role with bucket access.
+	if config.RoleArn != "" {
+		stsClient := sts.NewFromConfig(awsCfg)
+		creds := stscreds.NewAssumeRoleProvider(stsClient, config.RoleArn)
+		awsCfg.Credentials = aws.NewCredentialsCache(creds)
+	}
+
+	s3Client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		// Enable path-style addressing for S3-compatible services (MinIO, LocalStack, etc.)
+		// AWS S3 supports both styles, but custom endpoints typically require path-style.
+		if os.Getenv("AWS_ENDPOINT_URL") != "" {
+			o.UsePathStyle = true
+		}
+	})
+
+	// Confirm bucket exists and test aws credentials.
+	_, err = s3Client.HeadBucket(context.TODO(), &s3.HeadBucketInput{
+		Bucket: aws.String(config.S3Bucket),
+	})
+	if err != nil {
+		// AWS does have some error types that can be checked with [error.As] such as
+		// [s3.NotFound]. However, it can be difficult to always find the appropriate type. As a
+		// result, using aws [smithy-go] to handle error codes.
+		// https://aws.github.io/aws-sdk-go-v2/docs/handling-errors/#api-error-responses
+		var ae smithy.APIError
+		if errors.As(err, &ae) {
+			switch code := ae.ErrorCode(); code {
+			case invalidCredsCode:
+				err = fmt.Errorf("error aws credentials are invalid: %w", err)
+			case bucketMissingCode:
+				err = fmt.Errorf("error bucket %s could not be found: %w", config.S3Bucket, err)
+			default:
+				err = fmt.Errorf("error aws %s: %w", code, err)
+			}
+		}
+		return nil, err
+	}
+
+	opts, err := config.s3Options()
+	if err != nil {
+		return nil, err
+	}
+	return objstore.NewS3Store(s3Client, config.S3Bucket, opts)
+}
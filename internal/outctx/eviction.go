@@ -0,0 +1,105 @@
+package outctx
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/y-scope/fluent-bit-clp/internal/metrics"
+)
+
+// Evicts event managers which have not been used for longer than idle_timeout. Does nothing if
+// idle_timeout is not set or uploads are paused. Fluent Bit only calls the plugin when there is
+// data to flush, so idle event managers are swept during the flush of any tag. Failures are logged
+// and the event manager is kept so eviction is retried on the next sweep.
+//
+// Parameters:
+//   - now: Current time
+func (ctx *S3Context) EvictIdleEventManagers(now time.Time) {
+	if ctx.Config.IdleTimeout <= 0 || ctx.UploadsPaused() {
+		return
+	}
+
+	for tag, eventManager := range ctx.EventManagers {
+		if now.Sub(eventManager.lastUsed) < ctx.Config.IdleTimeout {
+			continue
+		}
+		err := ctx.evictEventManager(eventManager)
+		if err != nil {
+			ctx.Log.With("tag", tag).Errorf("Failed to evict idle event manager: %v", err)
+			continue
+		}
+		ctx.Log.With("tag", tag).Infof("Evicted idle event manager")
+	}
+}
+
+// Evicts the least recently used event manager if max_open_streams is reached. Does nothing if
+// max_open_streams is not set or uploads are paused. The limit is soft; if eviction fails the
+// failure is logged and a new event manager is still created.
+func (ctx *S3Context) evictLeastRecentlyUsed() {
+	maxOpenStreams := ctx.Config.MaxOpenStreams
+	if maxOpenStreams <= 0 || len(ctx.EventManagers) < maxOpenStreams || ctx.UploadsPaused() {
+		return
+	}
+
+	var leastRecentlyUsed *EventManager
+	for _, eventManager := range ctx.EventManagers {
+		if leastRecentlyUsed == nil || eventManager.lastUsed.Before(leastRecentlyUsed.lastUsed) {
+			leastRecentlyUsed = eventManager
+		}
+	}
+
+	err := ctx.evictEventManager(leastRecentlyUsed)
+	if err != nil {
+		ctx.Log.With("tag", leastRecentlyUsed.Tag).Errorf(
+			"Failed to evict event manager at max_open_streams=%d: %v",
+			maxOpenStreams,
+			err,
+		)
+		return
+	}
+	ctx.Log.With("tag", leastRecentlyUsed.Tag).Infof("Evicted least recently used event manager")
+}
+
+// Sends remaining events to s3, closes writer, removes disk buffer files and removes event manager
+// from context. The event manager is only removed once every step succeeded, so a failed eviction
+// is retried. If the upload fails, the event manager is left untouched. If a later step fails, the
+// writer stays closed (nil) and the event manager is not used again until it is evicted.
+//
+// Parameters:
+//   - eventManager: Manager to evict
+//
+// Returns:
+//   - err: Error uploading to s3, error closing writer, error removing disk buffer files
+func (ctx *S3Context) evictEventManager(eventManager *EventManager) error {
+	if eventManager.pending {
+		err := eventManager.ToS3(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if eventManager.Writer != nil {
+		err := eventManager.Writer.Close()
+		if err != nil {
+			return fmt.Errorf("error closing writer: %w", err)
+		}
+		eventManager.Writer = nil
+	}
+
+	if ctx.Config.UseDiskBuffer {
+		irPath, zstdPath := ctx.GetBufferFilePaths(eventManager.Tag)
+		for _, path := range []string{irPath, zstdPath} {
+			err := os.Remove(path)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("error deleting file '%s': %w", path, err)
+			}
+		}
+	}
+
+	delete(ctx.EventManagers, eventManager.Tag)
+	metrics.OpenStreams.Add(-1)
+	metrics.CloseStream(eventManager.Tag)
+	return nil
+}
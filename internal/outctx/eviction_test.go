@@ -0,0 +1,49 @@
+package outctx
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEvictIdleEventManagers_KeepsManagerUntilCleanedUp(t *testing.T) {
+	config := S3Config{
+		UseDiskBuffer:  true,
+		DiskBufferPath: t.TempDir(),
+		IdleTimeout:    time.Minute,
+	}
+	ctx := &S3Context{Config: config, EventManagers: make(map[string]*EventManager)}
+	writer := &fakeWriter{closeErr: errors.New("close failed")}
+	m := &EventManager{Tag: "app", Writer: writer}
+	ctx.EventManagers[m.Tag] = m
+	now := time.Now()
+
+	ctx.EvictIdleEventManagers(now)
+	if ctx.EventManagers[m.Tag] != m || m.Writer == nil {
+		t.Fatal("event manager should be kept with its writer when closing the writer fails")
+	}
+
+	// A buffer file that cannot be removed keeps the closed event manager
+	_, zstdPath := ctx.GetBufferFilePaths(m.Tag)
+	if err := os.MkdirAll(filepath.Join(zstdPath, "blocker"), 0o700); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	writer.closeErr = nil
+	ctx.EvictIdleEventManagers(now)
+	if ctx.EventManagers[m.Tag] != m || m.Writer != nil {
+		t.Fatal("event manager should be kept with a closed writer when removing buffers fails")
+	}
+	if _, err := ctx.GetEventManager(m.Tag, 0); err == nil {
+		t.Error("GetEventManager() error = nil, want error completing the eviction")
+	}
+
+	if err := os.RemoveAll(zstdPath); err != nil {
+		t.Fatalf("Failed to remove directory: %v", err)
+	}
+	ctx.EvictIdleEventManagers(now)
+	if _, ok := ctx.EventManagers[m.Tag]; ok {
+		t.Error("event manager should be removed once its eviction succeeds")
+	}
+}
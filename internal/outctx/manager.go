@@ -1,28 +1,113 @@
 package outctx
 
 import (
+	"bytes"
 	"context"
 	"fmt"
-	"log"
-	"net/url"
+	"io"
+	"maps"
 	"path/filepath"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/y-scope/clp-ffi-go/ffi"
 
+	"github.com/y-scope/fluent-bit-clp/internal/envelope"
 	"github.com/y-scope/fluent-bit-clp/internal/irzstd"
+	"github.com/y-scope/fluent-bit-clp/internal/keytemplate"
+	"github.com/y-scope/fluent-bit-clp/internal/metrics"
+	"github.com/y-scope/fluent-bit-clp/internal/objindex"
+	"github.com/y-scope/fluent-bit-clp/internal/objmeta"
+	"github.com/y-scope/fluent-bit-clp/internal/objstore"
 )
 
 // Tag key when tagging s3 objects with Fluent Bit tag.
 const s3TagKey = "fluentBitTag"
 
+// Name of the plugin, recorded in the metadata of uploaded objects.
+const pluginName = "out_clp_s3"
+
 // Resources and metadata to process Fluent Bit events with the same tag.
 type EventManager struct {
-	Tag    string
-	Index  int
+	Tag   string
+	Index int
+	// Nil once closed by an eviction whose cleanup failed. The eviction is retried before the tag
+	// is used again.
 	Writer irzstd.Writer
+	// Time the manager was last retrieved for a chunk. Used to evict idle managers.
+	lastUsed time.Time
+	// Set if events may have been written since the last upload.
+	pending bool
+	// Set if the writer's streams were closed for an upload which failed. No events can be
+	// written until the buffer is uploaded.
+	closed bool
+	// Time the first chunk since the last upload was retrieved for. Zero if the buffer was
+	// recovered from disk. Used to discard the oldest buffers to meet disk_quota_mb.
+	bufferedSince time.Time
+	// Statistics of events written since the last upload, stored as the object's metadata.
+	stats objmeta.Stats
+	// Set if the buffer holds events which were not counted in stats, i.e. it was recovered from
+	// disk.
+	uncounted bool
+	// Index of events written since the last upload. Nil if write_index is not set.
+	index *objindex.Builder
+	// Decoded record of the first event written since the last upload, whose fields are available
+	// to s3_key_format and object_tags. Nil if no event was written or the buffer holds uncounted
+	// events.
+	record map[string]any
+}
+
+// Extends the time range of events written since the last upload. The range is available to
+// s3_key_format as $EVENT_START and $EVENT_END.
+//
+// Parameters:
+//   - start: Timestamp of the earliest written event
+//   - end: Timestamp of the latest written event
+func (m *EventManager) ExtendEventTimeRange(start time.Time, end time.Time) {
+	m.stats.ExtendTimeRange(start, end)
+}
+
+// Keeps the record of the first event written since the last upload for s3_key_format and
+// object_tags. The first event of a buffer recovered from disk is unknown, so records are only
+// kept once it has been uploaded.
+//
+// Parameters:
+//   - record: Decoded record of a written event
+func (m *EventManager) KeepFirstRecord(record map[string]any) {
+	if m.record == nil && !m.uncounted {
+		m.record = record
+	}
+}
+
+// Adds events written since the last upload to the object's index, if write_index is set.
+//
+// Parameters:
+//   - logEvents: Written log events
+func (m *EventManager) IndexEvents(logEvents []ffi.LogEvent) {
+	if m.index == nil {
+		return
+	}
+	for _, event := range logEvents {
+		m.index.Add(event.UserKvPairs)
+	}
+}
+
+// Counts events written since the last upload, stored in the object's metadata.
+//
+// Parameters:
+//   - levels: Normalized log level of each written event, empty if unknown
+func (m *EventManager) CountEvents(levels []string) {
+	for _, level := range levels {
+		m.stats.Count(level)
+	}
+}
+
+// Reports whether the writer's streams were closed for an upload which failed. No events can be
+// written to the buffer until it is uploaded with [EventManager.ToS3].
+//
+// Returns:
+//   - closed: Whether the streams are closed
+func (m *EventManager) StreamsClosed() bool {
+	return m.closed
 }
 
 // Sends Zstd buffer to s3 and reset writer and buffers for future uploads. Prior to upload,
@@ -30,81 +115,194 @@ type EventManager struct {
 // on successful upload.
 //
 // Parameters:
-//   - config: Plugin configuration
-//   - uploader: S3 uploader manager
+//   - ctx: Plugin context
 //
 // Returns:
 //   - err: Error creating closing streams, error uploading to s3, error resetting writer
-func (m *EventManager) ToS3(config S3Config, uploader *manager.Uploader) error {
-	err := m.Writer.CloseStreams()
-	if err != nil {
-		return fmt.Errorf("error closing irzstd stream: %w", err)
+func (m *EventManager) ToS3(ctx *S3Context) error {
+	// The streams of a buffer whose upload failed are already closed, so it is uploaded as is.
+	// Reading the buffer rewinds it first (see [irzstd.ZstdOutputSeeker]), wherever the failed
+	// upload stopped reading.
+	if !m.closed {
+		err := m.Writer.CloseStreams()
+		if err != nil {
+			return fmt.Errorf("error closing irzstd stream: %w", err)
+		}
+		m.closed = true
 	}
 
-	outputLocation, err := uploadToS3(
-		config.S3Bucket,
-		config.S3BucketPrefix,
-		m,
-		config.Id,
-		uploader,
-	)
+	// Events of buffers recovered from disk were not counted, so their statistics are omitted.
+	stats := &m.stats
+	if m.uncounted {
+		stats = nil
+	}
+
+	uploadTime := time.Now()
+	opts := ctx.Config.putOptions()
+	opts.Metadata = objmeta.Metadata(objmeta.Source{
+		Tag:        m.Tag,
+		InstanceId: ctx.Config.Id,
+		Hostname:   ctx.Hostname,
+		Plugin:     pluginName,
+	}, stats)
+	opts.Tags = ctx.Tags.Render(m.templateValues(ctx, uploadTime))
+	if opts.Tags == nil {
+		opts.Tags = make(map[string]string, 1)
+	}
+	opts.Tags[s3TagKey] = m.Tag
+
+	key := filepath.Join(ctx.Config.S3BucketPrefix, m.objectKey(ctx, uploadTime))
+	size, err := upload(ctx.Store, ctx.Encryptor, opts, key, m)
+	metrics.ObserveUpload(m.Tag, uploadTime, err)
 	if err != nil {
 		err = fmt.Errorf("failed to upload chunk to s3, %w", err)
 		return err
 	}
+	metrics.ZstdBytes.Add(float64(size), m.Tag)
+
+	// An index claims to list every event of its object, so it is only written if all were
+	// counted.
+	if m.index != nil && stats != nil {
+		m.uploadIndex(ctx, key, size)
+	}
 
 	m.Index += 1
+	m.pending = false
+	m.uncounted = false
+	m.record = nil
+	m.stats.Reset()
+	if m.index != nil {
+		m.index.Reset()
+	}
 
-	log.Printf("chunk uploaded to %s", outputLocation)
+	ctx.Log.With("tag", m.Tag).Infof("Chunk uploaded to %s", ctx.Store.URI(key))
 
 	err = m.Writer.Reset()
 	if err != nil {
 		return err
 	}
+	m.closed = false
+	if m.Writer.GetUseDiskBuffer() {
+		metrics.BufferBytes.Set(0, m.Tag)
+	}
 
 	return nil
 }
 
-// Uploads log events to s3.
+// Renders s3_key_format for the next upload.
 //
 // Parameters:
-//   - bucket: S3 bucket
-//   - bucketPrefix: Directory prefix in s3
+//   - ctx: Plugin context
+//   - uploadTime: Time of the upload
+//
+// Returns:
+//   - key: Object key relative to s3_bucket_prefix
+func (m *EventManager) objectKey(ctx *S3Context, uploadTime time.Time) string {
+	return ctx.KeyFormat.Render(m.templateValues(ctx, uploadTime))
+}
+
+// Gathers the values of s3_key_format and object_tags placeholders for the next upload.
+//
+// Parameters:
+//   - ctx: Plugin context
+//   - uploadTime: Time of the upload
+//
+// Returns:
+//   - values: Values of placeholders
+func (m *EventManager) templateValues(ctx *S3Context, uploadTime time.Time) keytemplate.Values {
+	return keytemplate.Values{
+		Tag:        m.Tag,
+		Stream:     m.Tag,
+		Record:     m.record,
+		ID:         ctx.Config.Id,
+		Index:      m.Index,
+		Hostname:   ctx.Hostname,
+		UploadTime: uploadTime,
+		EventStart: m.stats.Start,
+		EventEnd:   m.stats.End,
+	}
+}
+
+// Uploads the index of an uploaded object next to it. An object without an index is searched
+// rather than skipped, so failures are logged rather than returned.
+//
+// Parameters:
+//   - ctx: Plugin context
+//   - key: Key of the uploaded object
+//   - size: Size of the uploaded object in bytes
+func (m *EventManager) uploadIndex(ctx *S3Context, key string, size int64) {
+	logger := ctx.Log.With("tag", m.Tag)
+	data, err := m.index.Marshal(key, size, &m.stats)
+	if err != nil {
+		logger.Warnf("Failed to write index of %s: %v", ctx.Store.URI(key), err)
+		return
+	}
+	opts := ctx.Config.putOptions()
+	opts.ContentType = objindex.ContentType
+	indexKey := key + objindex.KeySuffix
+	err = objstore.PutSeeker(
+		context.TODO(),
+		ctx.Store,
+		indexKey,
+		bytes.NewReader(data),
+		int64(len(data)),
+		opts,
+	)
+	if err != nil {
+		logger.Warnf("Failed to upload index %s: %v", ctx.Store.URI(indexKey), err)
+	}
+}
+
+// Uploads log events to the object store. If an encryptor is set, the Zstd output is encrypted
+// and the metadata required to decrypt it is added to the object's metadata. The upload is
+// checksummed and optionally verified (see [objstore.PutSeeker]) before it returns, so the writer
+// is only reset once the store holds the object.
+//
+// Parameters:
+//   - store: Destination of uploads
+//   - encryptor: Client-side encryption of objects, nil to upload them unencrypted
+//   - opts: Metadata, tags, checksum and verification options of the object
+//   - key: Object key, including s3_bucket_prefix
 //   - eventManager: Manager for Fluent Bit events with the same tag
-//   - id: Id of output plugin
-//   - uploader: AWS s3 upload manager
 //
 // Returns:
-//   - err: Error uploading, error unescaping string
-func uploadToS3(
-	bucket string,
-	bucketPrefix string,
+//   - size: Size of the uploaded object in bytes
+//   - err: Error retrieving Zstd output, error encrypting, error uploading, verification error
+func upload(
+	store objstore.ObjectStore,
+	encryptor *envelope.Encryptor,
+	opts objstore.PutOptions,
+	key string,
 	eventManager *EventManager,
-	id string,
-	uploader *manager.Uploader,
-) (string, error) {
-	currentTime := time.Now()
-	timeString := currentTime.Format(time.RFC3339)
-
-	fileName := fmt.Sprintf("%s_%d_%s_%s.zst", eventManager.Tag, eventManager.Index, timeString, id)
-	fullFilePath := filepath.Join(bucketPrefix, fileName)
-
-	tag := fmt.Sprintf("%s=%s", s3TagKey, eventManager.Tag)
-	result, err := uploader.Upload(context.TODO(), &s3.PutObjectInput{
-		Bucket:  aws.String(bucket),
-		Key:     aws.String(fullFilePath),
-		Body:    eventManager.Writer.GetZstdOutput(),
-		Tagging: &tag,
-	})
-	if err != nil {
-		return "", err
+) (int64, error) {
+	var body io.ReadSeeker
+	var size int64
+	var err error
+	if encryptor != nil {
+		var encryptionMetadata map[string]string
+		body, size, encryptionMetadata, err = irzstd.EncryptZstdOutput(
+			context.TODO(),
+			eventManager.Writer,
+			encryptor,
+		)
+		if err != nil {
+			return 0, err
+		}
+		if opts.Metadata == nil {
+			opts.Metadata = make(map[string]string, len(encryptionMetadata))
+		}
+		maps.Copy(opts.Metadata, encryptionMetadata)
+	} else {
+		body, size, err = irzstd.ZstdOutputSeeker(eventManager.Writer)
+		if err != nil {
+			return 0, err
+		}
 	}
 
-	// Result location is less readable when escaped.
-	uploadLocation, err := url.QueryUnescape(result.Location)
+	// The checksum is computed and the upload verified before the writer is reset.
+	err = objstore.PutSeeker(context.TODO(), store, key, body, size, opts)
 	if err != nil {
-		return "", err
+		return 0, err
 	}
-
-	return uploadLocation, nil
+	return size, nil
 }
@@ -0,0 +1,154 @@
+package outctx
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/y-scope/clp-ffi-go/ffi"
+
+	"github.com/y-scope/fluent-bit-clp/internal/irzstd"
+	"github.com/y-scope/fluent-bit-clp/internal/keytemplate"
+	"github.com/y-scope/fluent-bit-clp/internal/objstore"
+)
+
+func TestEventManager_ObjectKey(t *testing.T) {
+	uploadTime := time.Date(2024, 1, 15, 10, 30, 0, 0, time.UTC)
+	eventStart := time.Date(2024, 1, 15, 9, 0, 0, 0, time.UTC)
+	eventEnd := time.Date(2024, 1, 15, 9, 59, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		keyFormat string
+		want      string
+	}{
+		{"default", DefaultS3KeyFormat, "myapp_3_2024-01-15T10:30:00Z_abc123.zst"},
+		{
+			"partitions",
+			"dt=$EVENT_START[%Y-%m-%d]/hour=$EVENT_START[%H]/$HOSTNAME/${TAG}_$INDEX.zst",
+			"dt=2024-01-15/hour=09/node-1/myapp_3.zst",
+		},
+		{
+			"event time range",
+			"$EVENT_START[%H%M]-$EVENT_END[%H%M].zst",
+			"0900-0959.zst",
+		},
+		{
+			"first record",
+			"$kubernetes['namespace_name']/$TAG[0]/${STREAM}_$INDEX.zst",
+			"prod/myapp/myapp_3.zst",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyFormat, err := keytemplate.Parse(tt.keyFormat)
+			if err != nil {
+				t.Fatalf("Parse(%q) error = %v", tt.keyFormat, err)
+			}
+			ctx := &S3Context{
+				Config:    S3Config{Id: "abc123"},
+				KeyFormat: keyFormat,
+				Hostname:  "node-1",
+			}
+			m := EventManager{Tag: "myapp", Index: 3}
+			m.ExtendEventTimeRange(eventEnd, eventEnd)
+			m.ExtendEventTimeRange(eventStart, eventStart)
+			m.ExtendEventTimeRange(time.Time{}, time.Time{})
+			m.KeepFirstRecord(map[string]any{
+				"kubernetes": map[string]any{"namespace_name": "prod"},
+			})
+			m.KeepFirstRecord(map[string]any{
+				"kubernetes": map[string]any{"namespace_name": "staging"},
+			})
+
+			if got := m.objectKey(ctx, uploadTime); got != tt.want {
+				t.Errorf("objectKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEventManager_KeepFirstRecord(t *testing.T) {
+	keyFormat, err := keytemplate.Parse("$app/$TAG.zst")
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	ctx := &S3Context{KeyFormat: keyFormat}
+
+	// The first event of a recovered buffer is unknown, so its record field renders empty
+	m := EventManager{Tag: "myapp", uncounted: true}
+	m.KeepFirstRecord(map[string]any{"app": "api"})
+	if got := m.objectKey(ctx, time.Now()); got != "/myapp.zst" {
+		t.Errorf("objectKey() of recovered buffer = %q, want %q", got, "/myapp.zst")
+	}
+
+	m.uncounted = false
+	m.KeepFirstRecord(map[string]any{"app": "api"})
+	if got := m.objectKey(ctx, time.Now()); got != "api/myapp.zst" {
+		t.Errorf("objectKey() = %q, want %q", got, "api/myapp.zst")
+	}
+}
+
+func TestEventManager_ToS3_RetriesInterruptedUpload(t *testing.T) {
+	for _, checksum := range []string{"crc32c", "none"} {
+		t.Run(checksum, func(t *testing.T) {
+			keyFormat, err := keytemplate.Parse("${TAG}_${INDEX}.zst")
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			store := objstore.NewMemoryStore()
+			ctx := &S3Context{
+				Config: S3Config{
+					UseDiskBuffer:  true,
+					DiskBufferPath: t.TempDir(),
+					TimeZone:       "UTC",
+					Checksum:       checksum,
+				},
+				Store:         store,
+				KeyFormat:     keyFormat,
+				EventManagers: make(map[string]*EventManager),
+			}
+			irPath, zstdPath := ctx.GetBufferFilePaths("app")
+			writer, err := irzstd.NewDiskWriter("UTC", 0, irPath, zstdPath)
+			if err != nil {
+				t.Fatalf("NewDiskWriter() error = %v", err)
+			}
+			var logEvents []ffi.LogEvent
+			for i := range 100 {
+				event := ffi.NewLogEvent()
+				event.AutoKvPairs["timestamp"] = int64(i)
+				event.UserKvPairs = map[string]any{"message": fmt.Sprintf("event %d", i)}
+				logEvents = append(logEvents, *event)
+			}
+			if _, err := writer.WriteIrZstd(logEvents); err != nil {
+				t.Fatalf("WriteIrZstd() error = %v", err)
+			}
+			m := &EventManager{Tag: "app", Writer: writer, pending: true}
+
+			// The interrupted upload reads the buffer file to its end
+			store.InterruptPuts(1)
+			if err := m.ToS3(ctx); err == nil {
+				t.Fatal("ToS3() error = nil, want interrupted upload")
+			}
+			want, err := os.ReadFile(zstdPath)
+			if err != nil || len(want) == 0 {
+				t.Fatalf("Failed to read buffer file: %d bytes, %v", len(want), err)
+			}
+
+			if err := m.ToS3(ctx); err != nil {
+				t.Fatalf("ToS3() retry error = %v", err)
+			}
+			object, ok := store.Get("app_0.zst")
+			if !ok {
+				t.Fatalf("retried upload not stored, got keys %v", store.Keys())
+			}
+			if !bytes.Equal(object.Data, want) {
+				t.Errorf("retried object has %d bytes, want the %d bytes of the buffer file",
+					len(object.Data), len(want))
+			}
+		})
+	}
+}
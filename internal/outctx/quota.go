@@ -0,0 +1,197 @@
+package outctx
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/y-scope/fluent-bit-clp/internal/metrics"
+)
+
+// Values of disk_quota_overflow, the behavior once a disk quota is reached.
+const (
+	// Uploads the oldest disk buffers, and retries chunks if uploads fail so Fluent Bit applies
+	// backpressure
+	OverflowRetry = "retry"
+	// Discards the oldest disk buffers
+	OverflowDropOldest = "drop_oldest"
+	// Like retry, but drops chunks whose events are all below disk_quota_keep_level
+	OverflowDropLowSeverity = "drop_low_severity"
+)
+
+// Returned if a disk buffer quota is reached and the quota was not met by discarding buffers.
+var ErrDiskQuotaExceeded = errors.New("disk quota exceeded")
+
+// Checks the disk buffers against disk_quota_mb, and the buffer of an event manager against
+// disk_quota_per_tag_mb, before a chunk is written to it. Buffers are measured by their Zstd
+// output, so a quota may be exceeded by the size of the last written chunk. Once a quota is
+// reached, buffers are freed until it is met: with drop_oldest, they are discarded; otherwise they
+// are uploaded, stopping at the first failed upload. For the per-tag quota, the buffer of the
+// event manager is freed; for the total quota, the buffers holding the oldest events are freed
+// first and the buffer of the event manager last. Buffers are not uploaded while uploads are
+// paused through the admin API, but quotas still apply. Does nothing without use_disk_buffer.
+//
+// Parameters:
+//   - eventManager: Manager the chunk is written to
+//
+// Returns:
+//   - err: [ErrDiskQuotaExceeded] wrapped with the reached quota, error getting buffer sizes,
+//     error discarding buffers
+func (ctx *S3Context) CheckDiskQuota(eventManager *EventManager) error {
+	if !ctx.Config.UseDiskBuffer {
+		return nil
+	}
+	// The chunk is written to the event manager even if its buffer is freed.
+	defer func() { eventManager.pending = true }()
+
+	perTagQuota := int64(ctx.Config.DiskQuotaPerTagMb) << 20
+	if perTagQuota > 0 {
+		size, err := eventManager.bufferSize()
+		if err != nil {
+			return err
+		}
+		if size >= perTagQuota {
+			freed, err := ctx.freeBuffer(eventManager, size)
+			if err != nil {
+				return err
+			}
+			if !freed {
+				return fmt.Errorf("%w: buffer of %d bytes reached disk_quota_per_tag_mb=%d",
+					ErrDiskQuotaExceeded, size, ctx.Config.DiskQuotaPerTagMb)
+			}
+		}
+	}
+
+	quota := int64(ctx.Config.DiskQuotaMb) << 20
+	if quota <= 0 {
+		return nil
+	}
+	sizes := make(map[*EventManager]int64, len(ctx.EventManagers))
+	var total int64
+	for _, m := range ctx.EventManagers {
+		if m.Writer == nil {
+			continue
+		}
+		size, err := m.bufferSize()
+		if err != nil {
+			return err
+		}
+		sizes[m] = size
+		total += size
+	}
+	if total < quota {
+		return nil
+	}
+
+	oldestFirst := slices.SortedFunc(maps.Keys(sizes), func(a, b *EventManager) int {
+		return a.bufferedSince.Compare(b.bufferedSince)
+	})
+	// The buffer of the chunk's event manager is freed last, so older buffers of other tags are
+	// freed instead of the events the tag is receiving.
+	if i := slices.Index(oldestFirst, eventManager); i >= 0 {
+		oldestFirst = append(slices.Delete(oldestFirst, i, i+1), eventManager)
+	}
+	for _, m := range oldestFirst {
+		if total < quota {
+			break
+		}
+		if sizes[m] == 0 {
+			continue
+		}
+		freed, err := ctx.freeBuffer(m, sizes[m])
+		if err != nil {
+			return err
+		}
+		if !freed {
+			break
+		}
+		total -= sizes[m]
+	}
+	if total >= quota {
+		return fmt.Errorf("%w: buffers of %d bytes reached disk_quota_mb=%d",
+			ErrDiskQuotaExceeded, total, ctx.Config.DiskQuotaMb)
+	}
+	return nil
+}
+
+// Frees the buffer of an event manager to meet a disk quota, by discarding it with drop_oldest and
+// by uploading it otherwise. A failed upload is logged, and the buffer is kept for the next upload
+// attempt.
+//
+// Parameters:
+//   - eventManager: Manager whose buffer is freed
+//   - size: Size of the buffer in bytes
+//
+// Returns:
+//   - freed: Whether the buffer was freed
+//   - err: Error discarding the buffer
+func (ctx *S3Context) freeBuffer(eventManager *EventManager, size int64) (bool, error) {
+	if ctx.Config.DiskQuotaOverflow == OverflowDropOldest {
+		return true, ctx.discardBuffer(eventManager, size)
+	}
+	if ctx.UploadsPaused() {
+		return false, nil
+	}
+
+	logger := ctx.Log.With("tag", eventManager.Tag)
+	err := eventManager.ToS3(ctx)
+	if err != nil {
+		logger.Warnf("Failed to upload buffer of %d bytes to meet the disk quota: %v", size, err)
+		return false, nil
+	}
+	logger.Infof("Uploaded buffer of %d bytes to meet the disk quota", size)
+	return true, nil
+}
+
+// Discards the events buffered by an event manager to meet a disk quota. The Zstd frames of a
+// buffer hold a single IR stream, whose preamble is in the first frame, so a buffer cannot be
+// shortened by dropping its oldest frames and is discarded as a whole.
+//
+// Parameters:
+//   - eventManager: Manager whose buffer is discarded
+//   - size: Size of the buffer in bytes
+//
+// Returns:
+//   - err: Error discarding the buffer
+func (ctx *S3Context) discardBuffer(eventManager *EventManager, size int64) error {
+	err := eventManager.Writer.Discard()
+	if err != nil {
+		return fmt.Errorf("error discarding buffer of tag %s: %w", eventManager.Tag, err)
+	}
+
+	logger := ctx.Log.With("tag", eventManager.Tag)
+	if eventManager.uncounted {
+		logger.Warnf("Discarded buffer of %d bytes to meet the disk quota", size)
+	} else {
+		logger.Warnf("Discarded buffer of %d bytes with %d events to meet the disk quota",
+			size, eventManager.stats.Events)
+		metrics.DroppedEvents.Add(float64(eventManager.stats.Events), eventManager.Tag)
+	}
+	metrics.DroppedBufferBytes.Add(float64(size), eventManager.Tag)
+	metrics.BufferBytes.Set(0, eventManager.Tag)
+
+	eventManager.pending = false
+	eventManager.closed = false
+	eventManager.bufferedSince = time.Now()
+	eventManager.uncounted = false
+	eventManager.stats.Reset()
+	if eventManager.index != nil {
+		eventManager.index.Reset()
+	}
+	return nil
+}
+
+// Gets the size of the Zstd output in the buffer of an event manager.
+//
+// Returns:
+//   - size: Size in bytes
+//   - err: Error getting the size
+func (m *EventManager) bufferSize() (int64, error) {
+	size, err := m.Writer.GetZstdOutputSize()
+	if err != nil {
+		return 0, fmt.Errorf("error could not get size of buffer of tag %s: %w", m.Tag, err)
+	}
+	return int64(size), nil
+}
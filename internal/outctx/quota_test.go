@@ -0,0 +1,169 @@
+package outctx
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/y-scope/clp-ffi-go/ffi"
+
+	"github.com/y-scope/fluent-bit-clp/internal/keytemplate"
+	"github.com/y-scope/fluent-bit-clp/internal/objstore"
+)
+
+// Writer reporting a fixed Zstd output size, which is cleared when uploaded or discarded.
+type fakeWriter struct {
+	size      int
+	discarded bool
+	closeErr  error
+}
+
+func (w *fakeWriter) WriteIrZstd(logEvents []ffi.LogEvent) (int, error) {
+	return len(logEvents), nil
+}
+func (w *fakeWriter) CloseStreams() error             { return nil }
+func (w *fakeWriter) Close() error                    { return w.closeErr }
+func (w *fakeWriter) GetUseDiskBuffer() bool          { return true }
+func (w *fakeWriter) GetZstdOutputSize() (int, error) { return w.size, nil }
+func (w *fakeWriter) GetIrBytesWritten() int          { return 0 }
+
+func (w *fakeWriter) GetZstdOutput() io.Reader {
+	return bytes.NewReader(make([]byte, w.size))
+}
+
+func (w *fakeWriter) Reset() error {
+	w.size = 0
+	return nil
+}
+
+func (w *fakeWriter) Discard() error {
+	w.size = 0
+	w.discarded = true
+	return nil
+}
+
+// Creates a context uploading to a [objstore.MemoryStore] with an event manager per buffer size in
+// MB, buffered in the given order.
+func newQuotaContext(config S3Config, sizesMb ...int) (*S3Context, []*EventManager) {
+	config.UseDiskBuffer = true
+	keyFormat, _ := keytemplate.Parse(DefaultS3KeyFormat)
+	ctx := &S3Context{
+		Config:        config,
+		Store:         objstore.NewMemoryStore(),
+		KeyFormat:     keyFormat,
+		EventManagers: make(map[string]*EventManager),
+	}
+	start := time.Date(2024, 1, 15, 9, 0, 0, 0, time.UTC)
+	managers := make([]*EventManager, 0, len(sizesMb))
+	for i, sizeMb := range sizesMb {
+		m := &EventManager{
+			Tag:           string(rune('a' + i)),
+			Writer:        &fakeWriter{size: sizeMb << 20},
+			bufferedSince: start.Add(time.Duration(i) * time.Minute),
+		}
+		ctx.EventManagers[m.Tag] = m
+		managers = append(managers, m)
+	}
+	return ctx, managers
+}
+
+func TestCheckDiskQuota_Retry(t *testing.T) {
+	ctx, managers := newQuotaContext(
+		S3Config{DiskQuotaMb: 10, DiskQuotaPerTagMb: 4, DiskQuotaOverflow: OverflowRetry},
+		3, 4, 2,
+	)
+	store := ctx.Store.(*objstore.MemoryStore)
+	store.FailPuts(errors.New("unavailable"))
+	if err := ctx.CheckDiskQuota(managers[0]); err != nil {
+		t.Errorf("CheckDiskQuota() within quotas error = %v", err)
+	}
+	if err := ctx.CheckDiskQuota(managers[1]); !errors.Is(err, ErrDiskQuotaExceeded) {
+		t.Errorf("CheckDiskQuota() at per-tag quota error = %v, want ErrDiskQuotaExceeded", err)
+	}
+
+	managers[2].Writer.(*fakeWriter).size = 3 << 20
+	if err := ctx.CheckDiskQuota(managers[0]); !errors.Is(err, ErrDiskQuotaExceeded) {
+		t.Errorf("CheckDiskQuota() at total quota error = %v, want ErrDiskQuotaExceeded", err)
+	}
+	for _, m := range managers {
+		if m.Writer.(*fakeWriter).discarded {
+			t.Errorf("buffer of tag %s discarded with overflow retry", m.Tag)
+		}
+	}
+	if keys := store.Keys(); len(keys) != 0 {
+		t.Errorf("Keys() while the store fails = %v, want none", keys)
+	}
+}
+
+func TestCheckDiskQuota_RetryUploads(t *testing.T) {
+	ctx, managers := newQuotaContext(
+		S3Config{DiskQuotaMb: 10, DiskQuotaPerTagMb: 4, DiskQuotaOverflow: OverflowRetry},
+		3, 4, 2,
+	)
+	store := ctx.Store.(*objstore.MemoryStore)
+
+	ctx.paused.Store(true)
+	if err := ctx.CheckDiskQuota(managers[1]); !errors.Is(err, ErrDiskQuotaExceeded) {
+		t.Errorf("CheckDiskQuota() while paused error = %v, want ErrDiskQuotaExceeded", err)
+	}
+	ctx.paused.Store(false)
+
+	// The buffer at the per-tag quota is uploaded instead of retrying the chunk
+	if err := ctx.CheckDiskQuota(managers[1]); err != nil {
+		t.Fatalf("CheckDiskQuota() at per-tag quota error = %v", err)
+	}
+	if managers[1].Writer.(*fakeWriter).size != 0 || len(store.Keys()) != 1 {
+		t.Errorf("buffer at per-tag quota not uploaded, got keys %v", store.Keys())
+	}
+
+	// The oldest buffers of other tags are uploaded first to meet the total quota
+	managers[2].Writer.(*fakeWriter).size = 8 << 20
+	if err := ctx.CheckDiskQuota(managers[2]); err != nil {
+		t.Fatalf("CheckDiskQuota() at total quota error = %v", err)
+	}
+	for i, want := range []int{0, 0, 8 << 20} {
+		if got := managers[i].Writer.(*fakeWriter).size; got != want {
+			t.Errorf("buffer of tag %s has %d bytes, want %d", managers[i].Tag, got, want)
+		}
+	}
+	if !managers[2].pending {
+		t.Error("event manager of the chunk should stay pending")
+	}
+}
+
+func TestCheckDiskQuota_DropOldest(t *testing.T) {
+	ctx, managers := newQuotaContext(
+		S3Config{DiskQuotaMb: 10, DiskQuotaPerTagMb: 5, DiskQuotaOverflow: OverflowDropOldest},
+		1, 2, 5, 4,
+	)
+	if err := ctx.CheckDiskQuota(managers[3]); err != nil {
+		t.Fatalf("CheckDiskQuota() error = %v", err)
+	}
+
+	// 12 MB are buffered, so the two oldest buffers are discarded to get below 10 MB.
+	for i, want := range []bool{true, true, false, false} {
+		if got := managers[i].Writer.(*fakeWriter).discarded; got != want {
+			t.Errorf("buffer of tag %s discarded = %v, want %v", managers[i].Tag, got, want)
+		}
+	}
+	if !managers[3].pending {
+		t.Error("event manager of the chunk should stay pending")
+	}
+
+	if err := ctx.CheckDiskQuota(managers[2]); err != nil {
+		t.Fatalf("CheckDiskQuota() error = %v", err)
+	}
+	if !managers[2].Writer.(*fakeWriter).discarded {
+		t.Error("buffer at per-tag quota should be discarded")
+	}
+}
+
+func TestCheckDiskQuota_MemoryBuffer(t *testing.T) {
+	ctx, managers := newQuotaContext(S3Config{DiskQuotaMb: 1, DiskQuotaOverflow: OverflowRetry}, 2)
+	ctx.Config.UseDiskBuffer = false
+	if err := ctx.CheckDiskQuota(managers[0]); err != nil {
+		t.Errorf("CheckDiskQuota() without use_disk_buffer error = %v", err)
+	}
+}
@@ -0,0 +1,256 @@
+// Package implements parsing of timestamps embedded in log records. Fluent Bit provides the time
+// a record was ingested; however, the time an event actually happened is usually a field of the
+// record itself, stored in an application specific format.
+
+package timestamp
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Names of non-layout formats accepted by [NewParser].
+const (
+	FormatRfc3339 = "rfc3339"
+	FormatEpoch   = "epoch"
+	FormatEpochMs = "epoch_ms"
+	FormatEpochUs = "epoch_us"
+	FormatEpochNs = "epoch_ns"
+)
+
+// strftimeDirective marks a format as a strftime format rather than a Go layout.
+const strftimeDirective = '%'
+
+// Go layout equivalents of supported strftime conversion specifiers. %L and %f (fractional
+// seconds) must follow a "." or "," and accept any number of digits.
+var strftimeLayouts = map[byte]string{
+	'Y': "2006",
+	'y': "06",
+	'm': "01",
+	'd': "02",
+	'e': "_2",
+	'j': "002",
+	'H': "15",
+	'I': "03",
+	'M': "04",
+	'S': "05",
+	'L': "999999999",
+	'f': "999999999",
+	'p': "PM",
+	'b': "Jan",
+	'h': "Jan",
+	'B': "January",
+	'a': "Mon",
+	'A': "Monday",
+	'z': "-0700",
+	'Z': "MST",
+	'F': "2006-01-02",
+	'T': "15:04:05",
+	'%': "%",
+}
+
+// Reference times differing in every layout element (including the weekday, AM/PM and time zone),
+// used to detect literal text that Go would read as a layout element.
+var layoutProbes = []time.Time{
+	time.Date(2001, time.February, 3, 4, 5, 6, 123456789, time.UTC),
+	time.Date(2012, time.November, 25, 15, 48, 57, 987654321, time.FixedZone("XYZ", -5*60*60)),
+}
+
+// errUnsupportedType is returned when a record value cannot hold a timestamp.
+var errUnsupportedType = errors.New("unsupported timestamp type")
+
+// Parses timestamps from record values according to a fixed format.
+type Parser struct {
+	// Go layout used for textual formats. Empty for epoch formats.
+	layout string
+	// Duration of one unit for epoch formats.
+	unit     time.Duration
+	location *time.Location
+}
+
+// Creates a new parser. The format can be one of:
+//   - [FormatRfc3339]: RFC 3339 with optional fractional seconds
+//   - [FormatEpoch], [FormatEpochMs], [FormatEpochUs], [FormatEpochNs]: Numeric time since the
+//     Unix epoch in seconds, milliseconds, microseconds or nanoseconds
+//   - A strftime format such as "%Y-%m-%d %H:%M:%S.%L" if the format contains "%"
+//   - Otherwise, a Go [time.Layout] such as "2006-01-02 15:04:05"
+//
+// Timestamps without a time zone are interpreted in the provided location.
+//
+// Parameters:
+//   - format: Timestamp format
+//   - location: Location of timestamps without a time zone
+//
+// Returns:
+//   - parser: Timestamp parser
+//   - err: Unsupported strftime conversion specifier
+func NewParser(format string, location *time.Location) (*Parser, error) {
+	parser := Parser{location: location}
+
+	switch format {
+	case FormatRfc3339:
+		parser.layout = time.RFC3339Nano
+	case FormatEpoch:
+		parser.unit = time.Second
+	case FormatEpochMs:
+		parser.unit = time.Millisecond
+	case FormatEpochUs:
+		parser.unit = time.Microsecond
+	case FormatEpochNs:
+		parser.unit = time.Nanosecond
+	default:
+		if !strings.ContainsRune(format, strftimeDirective) {
+			parser.layout = format
+			break
+		}
+		layout, err := StrftimeToLayout(format)
+		if err != nil {
+			return nil, err
+		}
+		parser.layout = layout
+	}
+
+	return &parser, nil
+}
+
+// Parses a timestamp from a record value. Textual formats expect a string. Epoch formats accept
+// numbers as well as numeric strings.
+//
+// Parameters:
+//   - value: Record value holding the timestamp
+//
+// Returns:
+//   - timestamp: Parsed timestamp
+//   - err: Value does not match the format
+func (p *Parser) Parse(value any) (time.Time, error) {
+	if p.layout != "" {
+		s, ok := value.(string)
+		if !ok {
+			return time.Time{}, fmt.Errorf("%w %T, expected string", errUnsupportedType, value)
+		}
+		return time.ParseInLocation(p.layout, s, p.location)
+	}
+
+	switch v := value.(type) {
+	case string:
+		// Parse integers exactly since float64 cannot represent nanosecond epochs.
+		if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return p.fromEpoch(i, 0), nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("error parsing epoch %q: %w", v, err)
+		}
+		return p.fromFloat(f), nil
+	case float64:
+		return p.fromFloat(v), nil
+	case int64:
+		return p.fromEpoch(v, 0), nil
+	case uint64:
+		return p.fromEpoch(int64(v), 0), nil
+	default:
+		return time.Time{}, fmt.Errorf("%w %T, expected number", errUnsupportedType, value)
+	}
+}
+
+// Converts a fractional epoch value into a timestamp.
+//
+// Parameters:
+//   - epoch: Number of units since the Unix epoch
+//
+// Returns:
+//   - timestamp: Timestamp
+func (p *Parser) fromFloat(epoch float64) time.Time {
+	whole, frac := math.Modf(epoch)
+	return p.fromEpoch(int64(whole), time.Duration(frac*float64(p.unit)))
+}
+
+// Converts an epoch value into a timestamp.
+//
+// Parameters:
+//   - epoch: Number of whole units since the Unix epoch
+//   - remainder: Fraction of a unit
+//
+// Returns:
+//   - timestamp: Timestamp
+func (p *Parser) fromEpoch(epoch int64, remainder time.Duration) time.Time {
+	unitsPerSecond := int64(time.Second / p.unit)
+	sec := epoch / unitsPerSecond
+	nsec := (epoch%unitsPerSecond)*int64(p.unit) + int64(remainder)
+	return time.Unix(sec, nsec)
+}
+
+// Converts a strftime format into a Go layout.
+//
+// Literal text is copied into the layout as is, so it is rejected if Go would read any of it as a
+// layout element (e.g. "Jan", "Mon", "PM", "MST" or a digit from 1 to 6), including together with
+// the elements of adjacent conversion specifiers.
+//
+// Parameters:
+//   - format: Strftime format
+//
+// Returns:
+//   - layout: Go layout
+//   - err: Unsupported or incomplete conversion specifier, or literal text read as a layout element
+func StrftimeToLayout(format string) (string, error) {
+	var layout strings.Builder
+	// How each probe renders if literal text stays literal
+	expected := make([]strings.Builder, len(layoutProbes))
+	for i := 0; i < len(format); i++ {
+		if format[i] != strftimeDirective {
+			layout.WriteByte(format[i])
+			for j := range expected {
+				expected[j].WriteByte(format[i])
+			}
+			continue
+		}
+		i++
+		if i == len(format) {
+			return "", fmt.Errorf("error incomplete conversion specifier in format %q", format)
+		}
+		goLayout, ok := strftimeLayouts[format[i]]
+		if !ok {
+			return "", fmt.Errorf(
+				"error unsupported conversion specifier %%%c in format %q",
+				format[i],
+				format,
+			)
+		}
+		layout.WriteString(goLayout)
+		afterSeparator := i >= 2 && (format[i-2] == '.' || format[i-2] == ',')
+		for j, probe := range layoutProbes {
+			expected[j].WriteString(formatElement(probe, goLayout, afterSeparator))
+		}
+	}
+
+	for j, probe := range layoutProbes {
+		if probe.Format(layout.String()) != expected[j].String() {
+			return "", fmt.Errorf(
+				"error literal text in format %q would be read as a Go layout element",
+				format,
+			)
+		}
+	}
+	return layout.String(), nil
+}
+
+// Formats a timestamp according to the Go layout of a single conversion specifier.
+//
+// Parameters:
+//   - t: Timestamp
+//   - goLayout: Go layout of the conversion specifier
+//   - afterSeparator: Whether the specifier follows a "." or ",", which makes the digits of %L and
+//     %f fractional seconds
+//
+// Returns:
+//   - text: Formatted timestamp
+func formatElement(t time.Time, goLayout string, afterSeparator bool) string {
+	if !afterSeparator || strings.Trim(goLayout, "9") != "" {
+		return t.Format(goLayout)
+	}
+	return t.Format("." + goLayout)[1:]
+}
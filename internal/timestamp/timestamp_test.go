@@ -0,0 +1,112 @@
+package timestamp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParser_Parse(t *testing.T) {
+	toronto, err := time.LoadLocation("America/Toronto")
+	if err != nil {
+		t.Fatalf("Failed to load location: %v", err)
+	}
+	want := time.Date(2024, 1, 15, 10, 30, 45, 123000000, time.UTC)
+	wantSec := want.Truncate(time.Second)
+
+	tests := []struct {
+		name    string
+		format  string
+		value   any
+		want    time.Time
+		wantErr bool
+	}{
+		{"rfc3339", FormatRfc3339, "2024-01-15T10:30:45.123Z", want, false},
+		{"rfc3339 with offset", FormatRfc3339, "2024-01-15T05:30:45.123-05:00", want, false},
+		{"epoch float", FormatEpoch, float64(1705314645.123), want, false},
+		{"epoch ms", FormatEpochMs, float64(1705314645123), want, false},
+		{"epoch us string", FormatEpochUs, "1705314645123000", want, false},
+		{"epoch ns string", FormatEpochNs, "1705314645123000000", want, false},
+		{"strftime in time zone", "%Y-%m-%d %H:%M:%S.%L", "2024-01-15 05:30:45.123", want, false},
+		{"strftime offset", "%d/%b/%Y:%H:%M:%S %z", "15/Jan/2024:10:30:45 +0000", wantSec, false},
+		{"go layout", "2006-01-02 15:04:05.000", "2024-01-15 05:30:45.123", want, false},
+		{"mismatched layout", FormatRfc3339, "15/Jan/2024", time.Time{}, true},
+		{"number for layout", FormatRfc3339, float64(1705314645), time.Time{}, true},
+		{"string for epoch", FormatEpochMs, "yesterday", time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser, err := NewParser(tt.format, toronto)
+			if err != nil {
+				t.Fatalf("NewParser(%q) error = %v", tt.format, err)
+			}
+			got, err := parser.Parse(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse(%v) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			// Float epochs are only accurate to about a microsecond.
+			if diff := got.Sub(tt.want).Abs(); diff > time.Microsecond {
+				t.Errorf("Parse(%v) = %v, want %v", tt.value, got.UTC(), tt.want)
+			}
+		})
+	}
+}
+
+func TestNewParser_UnsupportedStrftime(t *testing.T) {
+	for _, format := range []string{"%Y-%m-%d %Q", "%Y-%m-%d %"} {
+		if _, err := NewParser(format, time.UTC); err == nil {
+			t.Errorf("NewParser(%q) error = nil, want error", format)
+		}
+	}
+}
+
+func TestStrftimeToLayout_Literals(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		want   string
+	}{
+		{"plain text", "day %Y-%m-%d", "day 2006-01-02"},
+		{"fractional seconds", "at %H:%M:%S.%L", "at 15:04:05.999999999"},
+		{"percent", "%Y%%", "2006%"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := StrftimeToLayout(tt.format)
+			if err != nil || got != tt.want {
+				t.Errorf("StrftimeToLayout(%q) = %q, %v, want %q", tt.format, got, err, tt.want)
+			}
+		})
+	}
+
+	for _, format := range []string{
+		"day1 %Y-%m-%d",
+		"%Y-%m-%d Mon",
+		"%b Jan",
+		"%H:%M PM",
+		"%H:%M MST",
+		"%H:%M Z07",
+		"v06 %Y",
+		// Literal text forming an element with a specifier ("002" is the day of the year)
+		"v0%d",
+	} {
+		if _, err := StrftimeToLayout(format); err == nil {
+			t.Errorf("StrftimeToLayout(%q) error = nil, want error", format)
+		}
+	}
+}
+
+func TestParser_ParseLiteralFormat(t *testing.T) {
+	parser, err := NewParser("day %d/%m/%Y", time.UTC)
+	if err != nil {
+		t.Fatalf("NewParser() error = %v", err)
+	}
+	got, err := parser.Parse("day 15/01/2024")
+	want := time.Date(2024, time.January, 15, 0, 0, 0, 0, time.UTC)
+	if err != nil || !got.Equal(want) {
+		t.Errorf("Parse() = %v, %v, want %v", got, err, want)
+	}
+}
@@ -10,7 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"slices"
 	"time"
 	"unsafe"
 
@@ -19,11 +19,23 @@ import (
 	"github.com/y-scope/clp-ffi-go/ffi"
 
 	"github.com/y-scope/fluent-bit-clp/internal/decoder"
+	"github.com/y-scope/fluent-bit-clp/internal/logging"
+	"github.com/y-scope/fluent-bit-clp/internal/metrics"
+	"github.com/y-scope/fluent-bit-clp/internal/objmeta"
 	"github.com/y-scope/fluent-bit-clp/internal/outctx"
+	"github.com/y-scope/fluent-bit-clp/internal/timestamp"
+)
+
+// Keys of the user kv-pairs encoded when use_single_key is true.
+const (
+	messageKey   = "message"
+	auxiliaryKey = "auxiliary"
 )
 
 // Ingests Fluent Bit chunk, then sends to s3 in IR format. Data may be buffered on disk or in
-// memory depending on plugin configuration.
+// memory depending on plugin configuration. Event managers of other tags which have been idle for
+// longer than idle_timeout are evicted. If a disk quota is reached, the chunk is handled according
+// to disk_quota_overflow (see [outctx.S3Context.CheckDiskQuota]).
 //
 // Parameters:
 //   - data: Msgpack data
@@ -35,9 +47,11 @@ import (
 //   - code: Fluent Bit success code (OK, RETRY, ERROR)
 //   - err: Error if flush fails
 func Ingest(data unsafe.Pointer, size int, tag string, ctx *outctx.S3Context) (int, error) {
+	logger := ctx.Log.With("tag", tag)
 	dec := decoder.New(data, size)
-	logEvents, err := decodeMsgpack(dec, ctx.Config)
+	logEvents, levels, records, err := decodeMsgpack(dec, ctx.Config, ctx.TimeParser, logger)
 	if !errors.Is(err, io.EOF) {
+		metrics.DecodeFailures.Inc(tag)
 		return output.FLB_ERROR, err
 	}
 
@@ -46,30 +60,58 @@ func Ingest(data unsafe.Pointer, size int, tag string, ctx *outctx.S3Context) (i
 		return output.FLB_RETRY, fmt.Errorf("error getting event manager: %w", err)
 	}
 
+	// Retrieving the event manager marks it as used, so it is never evicted here.
+	ctx.EvictIdleEventManagers(time.Now())
+
+	drop, err := applyDiskQuota(ctx, eventManager, levels, logger)
+	if err != nil {
+		return output.FLB_RETRY, err
+	}
+	if drop {
+		return output.FLB_OK, nil
+	}
+
+	// Events cannot be written to a buffer whose streams were closed for an upload which failed.
+	if eventManager.StreamsClosed() {
+		if ctx.UploadsPaused() {
+			return output.FLB_RETRY, fmt.Errorf("buffer awaits upload while uploads are paused")
+		}
+		err = eventManager.ToS3(ctx)
+		if err != nil {
+			return output.FLB_RETRY, fmt.Errorf("error uploading buffer of failed upload: %w", err)
+		}
+	}
+
+	irBytes := eventManager.Writer.GetIrBytesWritten()
 	numEvents, err := eventManager.Writer.WriteIrZstd(logEvents)
+	metrics.RecordsDecoded.Add(float64(numEvents), tag)
+	metrics.IrBytes.Add(float64(eventManager.Writer.GetIrBytesWritten()-irBytes), tag)
 	if err != nil {
-		log.Printf(
-			"Wrote %d out of %d total log events for tag %s",
-			numEvents,
-			len(logEvents),
-			eventManager.Tag,
-		)
+		logger.Errorf("Wrote %d out of %d total log events", numEvents, len(logEvents))
 		return output.FLB_ERROR, err
 	}
+	eventManager.ExtendEventTimeRange(getEventTimeRange(logEvents))
+	if len(records) > 0 {
+		eventManager.KeepFirstRecord(records[0])
+	}
+	eventManager.CountEvents(levels)
+	eventManager.IndexEvents(logEvents)
 
 	uploadCriteriaMet, err := checkUploadCriteriaMet(
 		eventManager,
 		ctx.Config.UploadSizeMb,
+		logger,
 	)
 	if err != nil {
 		return output.FLB_ERROR, fmt.Errorf("error checking upload criteria: %w", err)
 	}
 
-	if !uploadCriteriaMet {
+	// While uploads are paused through the admin API, chunks keep accumulating in the buffer.
+	if !uploadCriteriaMet || ctx.UploadsPaused() {
 		return output.FLB_OK, nil
 	}
 
-	err = eventManager.ToS3(ctx.Config, ctx.Uploader)
+	err = eventManager.ToS3(ctx)
 	if err != nil {
 		return output.FLB_ERROR, fmt.Errorf("error flushing Zstd buffer to s3: %w", err)
 	}
@@ -77,38 +119,207 @@ func Ingest(data unsafe.Pointer, size int, tag string, ctx *outctx.S3Context) (i
 	return output.FLB_OK, nil
 }
 
+// Checks the disk quotas before a chunk is written (see [outctx.S3Context.CheckDiskQuota]). If a
+// quota is still reached after uploading buffers, the chunk must be retried. With
+// drop_low_severity, a chunk holding only events below disk_quota_keep_level is dropped instead;
+// the other events would grow the buffers past the quota, so a chunk holding any of them is
+// retried as a whole.
+//
+// Parameters:
+//   - ctx: Plugin context
+//   - eventManager: Manager the chunk is written to
+//   - levels: Normalized log level of each event of the chunk
+//   - logger: Logger of the flushed tag
+//
+// Returns:
+//   - drop: Whether the chunk is dropped
+//   - err: Error wrapping [outctx.ErrDiskQuotaExceeded] if the chunk must be retried, error
+//     checking quotas
+func applyDiskQuota(
+	ctx *outctx.S3Context,
+	eventManager *outctx.EventManager,
+	levels []string,
+	logger *logging.Logger,
+) (bool, error) {
+	err := ctx.CheckDiskQuota(eventManager)
+	if !errors.Is(err, outctx.ErrDiskQuotaExceeded) {
+		return false, err
+	}
+
+	keepLevel := ctx.Config.DiskQuotaKeepLvl
+	if ctx.Config.DiskQuotaOverflow != outctx.OverflowDropLowSeverity ||
+		!isLowSeverity(levels, keepLevel) {
+		metrics.DiskQuotaRetries.Inc(eventManager.Tag)
+		return false, err
+	}
+	metrics.DroppedEvents.Add(float64(len(levels)), eventManager.Tag)
+	logger.Warnf("Dropped %d events below %s: %v", len(levels), keepLevel, err)
+	return true, nil
+}
+
+// Checks if all log events are less severe than a level. Events with an unknown level are treated
+// as info.
+//
+// Parameters:
+//   - levels: Normalized log level of each event
+//   - keepLevel: Least severe level kept
+//
+// Returns:
+//   - low: Whether every event is below keepLevel
+func isLowSeverity(levels []string, keepLevel string) bool {
+	minSeverity := severity(keepLevel)
+	return !slices.ContainsFunc(levels, func(level string) bool {
+		return severity(level) >= minSeverity
+	})
+}
+
+// Ranks a normalized log level by severity, from 0 for trace to 5 for fatal. Common aliases (e.g.
+// "warning", "critical") rank as their level; unknown levels rank as info.
+//
+// Parameters:
+//   - level: Normalized log level
+//
+// Returns:
+//   - rank: Severity of the level
+func severity(level string) int {
+	switch level {
+	case "trace":
+		return 0
+	case "debug":
+		return 1
+	case "warn", "warning":
+		return 3
+	case "error", "err":
+		return 4
+	case "fatal", "critical", "crit", "panic", "alert", "emergency", "emerg":
+		return 5
+	default:
+		return 2
+	}
+}
+
 // Decodes Msgpack Fluent Bit chunk into slice of log events. Decode of Msgpack based on
 // [Fluent Bit reference].
 //
 // Parameters:
 //   - decoder: Msgpack decoder
 //   - config: Plugin configuration
+//   - timeParser: Parser for timestamps in the record's time_key, nil if time_key is not set
+//   - logger: Logger of the flushed tag
 //
 // Returns:
 //   - logEvents: Slice of log events
+//   - levels: Normalized log level of each event (from log_level_key), empty if unknown
+//   - records: Decoded record of each event, available to s3_key_format and object_tags
 //   - err: Error decoding Msgpack, error retrieving log message from decoded object
 //
 // [Fluent Bit reference]:
 // https://github.com/fluent/fluent-bit-go/blob/a7a013e2473cdf62d7320822658d5816b3063758/examples/out_multiinstance/out.go#L41
-func decodeMsgpack(dec *codec.Decoder, config outctx.S3Config) ([]ffi.LogEvent, error) {
+func decodeMsgpack(
+	dec *codec.Decoder,
+	config outctx.S3Config,
+	timeParser *timestamp.Parser,
+	logger *logging.Logger,
+) ([]ffi.LogEvent, []string, []map[string]any, error) {
 	var logEvents []ffi.LogEvent
+	var levels []string
+	var records []map[string]any
 	for {
-		flbTimestamp, jsonRecord, err := decoder.GetRecord(dec)
+		flbTimestamp, metadata, jsonRecord, err := decoder.GetRecord(dec)
 		if err != nil {
-			return logEvents, err
+			return logEvents, levels, records, err
 		}
 
-		var userKvPairs map[string]any
-		err = json.Unmarshal(jsonRecord, &userKvPairs)
+		var record map[string]any
+		err = json.Unmarshal(jsonRecord, &record)
 		if err != nil {
-			return nil, fmt.Errorf("failed to unmarshal json record %v: %w", jsonRecord, err)
+			return nil, nil, nil, fmt.Errorf(
+				"failed to unmarshal json record %v: %w",
+				jsonRecord,
+				err,
+			)
+		}
+
+		// Timestamp and level are retrieved before their keys may be removed from the record.
+		ts := getTimestamp(flbTimestamp, record, config.TimeKey, timeParser, logger)
+		levels = append(levels, objmeta.NormalizeLevel(record[config.LogLevelKey]))
+
+		userKvPairs, err := getUserKvPairs(record, config)
+		if err != nil {
+			return nil, nil, nil, err
 		}
 
 		event := ffi.NewLogEvent()
-		event.AutoKvPairs["timestamp"] = decodeTs(flbTimestamp)
+		event.AutoKvPairs["timestamp"] = ts
+		if metadata != nil {
+			event.AutoKvPairs[decoder.MetadataKey] = metadata
+		}
 		event.UserKvPairs = userKvPairs
 		logEvents = append(logEvents, (*event))
+		records = append(records, record)
+	}
+}
+
+// Retrieves the earliest and latest timestamps of log events.
+//
+// Parameters:
+//   - logEvents: Slice of log events
+//
+// Returns:
+//   - start: Earliest timestamp, zero if there are no events
+//   - end: Latest timestamp, zero if there are no events
+func getEventTimeRange(logEvents []ffi.LogEvent) (time.Time, time.Time) {
+	var start, end time.Time
+	for _, event := range logEvents {
+		ts, ok := event.AutoKvPairs["timestamp"].(time.Time)
+		if !ok {
+			continue
+		}
+		if start.IsZero() || ts.Before(start) {
+			start = ts
+		}
+		if end.IsZero() || ts.After(end) {
+			end = ts
+		}
+	}
+	return start, end
+}
+
+// Retrieves the timestamp of a record. If time_key is set and present in the record, the event's
+// timestamp is parsed from the record. If time_key is not set, is missing, or cannot be parsed,
+// falls back to the timestamp provided by Fluent Bit engine.
+//
+// Parameters:
+//   - flbTimestamp: Timestamp provided by Fluent Bit
+//   - record: JSON record from Fluent Bit with variable amount of keys
+//   - timeKey: Key of the record holding the timestamp
+//   - timeParser: Parser for timestamps in timeKey, nil if time_key is not set
+//   - logger: Logger of the flushed tag
+//
+// Returns:
+//   - timestamp: time.Time timestamp
+func getTimestamp(
+	flbTimestamp any,
+	record map[string]any,
+	timeKey string,
+	timeParser *timestamp.Parser,
+	logger *logging.Logger,
+) time.Time {
+	if timeParser == nil {
+		return decodeTs(flbTimestamp, logger)
 	}
+
+	value, ok := record[timeKey]
+	if !ok {
+		return decodeTs(flbTimestamp, logger)
+	}
+
+	ts, err := timeParser.Parse(value)
+	if err != nil {
+		logger.Warnf("Failed to parse %s, defaulting to Fluent Bit timestamp: %v", timeKey, err)
+		return decodeTs(flbTimestamp, logger)
+	}
+	return ts
 }
 
 // Decodes timestamp provided by Fluent Bit engine into time.Time. If timestamp cannot be
@@ -116,10 +327,11 @@ func decodeMsgpack(dec *codec.Decoder, config outctx.S3Config) ([]ffi.LogEvent,
 //
 // Parameters:
 //   - ts: Timestamp provided by Fluent Bit
+//   - logger: Logger of the flushed tag
 //
 // Returns:
 //   - timestamp: time.Time timestamp
-func decodeTs(ts any) time.Time {
+func decodeTs(ts any, logger *logging.Logger) time.Time {
 	var timestamp time.Time
 	switch t := ts.(type) {
 	case decoder.FlbTime:
@@ -127,34 +339,31 @@ func decodeTs(ts any) time.Time {
 	case uint64:
 		timestamp = time.Unix(int64(t), 0)
 	default:
-		log.Printf("time provided invalid, defaulting to now. Invalid type is %T", t)
+		logger.Warnf("Time provided invalid, defaulting to now. Invalid type is %T", t)
 		timestamp = time.Now()
 	}
 	return timestamp
 }
 
-// Retrieves message from a record object. The message can consist of the entire object or
-// just a single key. For a single key, user should set use_single_key to true in fluent-bit.conf.
+// Builds the user kv-pairs encoded for a record. By default, the entire record is encoded. To
+// encode a single key as the message, user should set use_single_key to true in fluent-bit.conf.
 // In addition user, should set single_key to "log" which is default Fluent Bit key for unparsed
-// messages; however, single_key can be set to another value. To prevent failure if the key is
-// missing, user can specify allow_missing_key, and behaviour will fallback to the entire object.
+// messages; however, single_key can be set to another value. The message is encoded under
+// [messageKey]. If keep_auxiliary_keys is true, the remaining keys of the record are nested under
+// [auxiliaryKey]; otherwise, they are dropped. To prevent failure if the key is missing, user can
+// specify allow_missing_key, and behaviour will fallback to the entire record.
 //
 // Parameters:
-//   - record: JSON record from Fluent Bit with variable amount of keys
+//   - record: Unmarshalled JSON record from Fluent Bit with variable amount of keys, which is not
+//     modified
 //   - config: Plugin configuration
 //
 // Returns:
-//   - stringMsg: Retrieved message
-//   - err: Key not found, json.Unmarshal error, string type assertion error
-func getMessage(jsonRecord []byte, config outctx.S3Config) (string, error) {
+//   - userKvPairs: Kv-pairs to encode
+//   - err: Key not found, string type assertion error
+func getUserKvPairs(record map[string]any, config outctx.S3Config) (map[string]any, error) {
 	if !config.UseSingleKey {
-		return string(jsonRecord), nil
-	}
-
-	var record map[string]any
-	err := json.Unmarshal(jsonRecord, &record)
-	if err != nil {
-		return "", fmt.Errorf("failed to unmarshal json record %v: %w", jsonRecord, err)
+		return record, nil
 	}
 
 	singleKeyMsg, ok := record[config.SingleKey]
@@ -162,17 +371,32 @@ func getMessage(jsonRecord []byte, config outctx.S3Config) (string, error) {
 		// If key not found in record, see if allow_missing_key=true. If missing key is
 		// allowed, then return entire record.
 		if config.AllowMissingKey {
-			return string(jsonRecord), nil
+			return record, nil
 		}
-		return "", fmt.Errorf("key %s not found in record %v", config.SingleKey, record)
+		return nil, fmt.Errorf("key %s not found in record %v", config.SingleKey, record)
 	}
 
 	stringMsg, ok := singleKeyMsg.(string)
 	if !ok {
-		return "", fmt.Errorf("string type assertion for message failed %v", singleKeyMsg)
+		return nil, fmt.Errorf("string type assertion for message failed %v", singleKeyMsg)
 	}
 
-	return stringMsg, nil
+	userKvPairs := map[string]any{messageKey: stringMsg}
+	if !config.KeepAuxiliaryKeys {
+		return userKvPairs, nil
+	}
+
+	// The record is left intact since it remains available to s3_key_format and object_tags.
+	if len(record) > 1 {
+		auxiliary := make(map[string]any, len(record)-1)
+		for key, value := range record {
+			if key != config.SingleKey {
+				auxiliary[key] = value
+			}
+		}
+		userKvPairs[auxiliaryKey] = auxiliary
+	}
+	return userKvPairs, nil
 }
 
 // Checks if criteria are met to upload to s3. If useDiskBuffer is false, then the chunk is always
@@ -182,11 +406,16 @@ func getMessage(jsonRecord []byte, config outctx.S3Config) (string, error) {
 // Parameters:
 //   - eventManager: Manager for Fluent Bit events with the same tag
 //   - uploadSizeMb: S3 upload size in MB
+//   - logger: Logger of the flushed tag
 //
 // Returns:
 //   - readyToUpload: Boolean if upload criteria met or not
 //   - err: Error getting Zstd buffer size
-func checkUploadCriteriaMet(eventManager *outctx.EventManager, uploadSizeMb int) (bool, error) {
+func checkUploadCriteriaMet(
+	eventManager *outctx.EventManager,
+	uploadSizeMb int,
+	logger *logging.Logger,
+) (bool, error) {
 	if !eventManager.Writer.GetUseDiskBuffer() {
 		return true, nil
 	}
@@ -195,16 +424,12 @@ func checkUploadCriteriaMet(eventManager *outctx.EventManager, uploadSizeMb int)
 	if err != nil {
 		return false, fmt.Errorf("error could not get size of buffer: %w", err)
 	}
+	metrics.BufferBytes.Set(float64(bufferSize), eventManager.Tag)
 
 	uploadSize := uploadSizeMb << 20
 
 	if bufferSize >= uploadSize {
-		log.Printf(
-			"Zstd buffer size of %d for tag %s exceeded upload size %d",
-			bufferSize,
-			eventManager.Tag,
-			uploadSize,
-		)
+		logger.Debugf("Zstd buffer size of %d exceeded upload size %d", bufferSize, uploadSize)
 		return true, nil
 	}
 
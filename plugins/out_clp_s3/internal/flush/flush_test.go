@@ -0,0 +1,306 @@
+package flush
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"maps"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/ugorji/go/codec"
+	"github.com/y-scope/clp-ffi-go/ffi"
+
+	"github.com/y-scope/fluent-bit-clp/internal/keytemplate"
+	"github.com/y-scope/fluent-bit-clp/internal/objstore"
+	"github.com/y-scope/fluent-bit-clp/internal/outctx"
+)
+
+func TestGetUserKvPairs(t *testing.T) {
+	singleKey := outctx.S3Config{UseSingleKey: true, SingleKey: "log", KeepAuxiliaryKeys: true}
+	dropAuxiliary := singleKey
+	dropAuxiliary.KeepAuxiliaryKeys = false
+	allowMissing := singleKey
+	allowMissing.AllowMissingKey = true
+
+	tests := []struct {
+		name    string
+		config  outctx.S3Config
+		record  map[string]any
+		want    map[string]any
+		wantErr bool
+	}{
+		{
+			name:   "full record",
+			config: outctx.S3Config{UseSingleKey: false, SingleKey: "log"},
+			record: map[string]any{"log": "hello", "stream": "stdout"},
+			want:   map[string]any{"log": "hello", "stream": "stdout"},
+		},
+		{
+			name:   "single key with auxiliary keys",
+			config: singleKey,
+			record: map[string]any{"log": "hello", "stream": "stdout"},
+			want: map[string]any{
+				messageKey:   "hello",
+				auxiliaryKey: map[string]any{"stream": "stdout"},
+			},
+		},
+		{
+			name:   "single key without other keys",
+			config: singleKey,
+			record: map[string]any{"log": "hello"},
+			want:   map[string]any{messageKey: "hello"},
+		},
+		{
+			name:   "single key dropping auxiliary keys",
+			config: dropAuxiliary,
+			record: map[string]any{"log": "hello", "stream": "stdout"},
+			want:   map[string]any{messageKey: "hello"},
+		},
+		{
+			name:   "missing key allowed",
+			config: allowMissing,
+			record: map[string]any{"message": "hello"},
+			want:   map[string]any{"message": "hello"},
+		},
+		{
+			name:    "missing key not allowed",
+			config:  singleKey,
+			record:  map[string]any{"message": "hello"},
+			wantErr: true,
+		},
+		{
+			name:    "non-string value",
+			config:  allowMissing,
+			record:  map[string]any{"log": float64(42)},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := maps.Clone(tt.record)
+			got, err := getUserKvPairs(tt.record, tt.config)
+			if !reflect.DeepEqual(tt.record, record) {
+				t.Errorf("getUserKvPairs() modified the record to %v", tt.record)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getUserKvPairs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getUserKvPairs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetEventTimeRange(t *testing.T) {
+	early := time.Date(2024, 1, 15, 9, 0, 0, 0, time.UTC)
+	late := early.Add(time.Hour)
+
+	var logEvents []ffi.LogEvent
+	for _, ts := range []any{late, early, "not a time", late.Add(-time.Minute)} {
+		event := ffi.NewLogEvent()
+		event.AutoKvPairs["timestamp"] = ts
+		logEvents = append(logEvents, *event)
+	}
+
+	start, end := getEventTimeRange(logEvents)
+	if !start.Equal(early) || !end.Equal(late) {
+		t.Errorf("getEventTimeRange() = (%v, %v), want (%v, %v)", start, end, early, late)
+	}
+
+	start, end = getEventTimeRange(nil)
+	if !start.IsZero() || !end.IsZero() {
+		t.Errorf("getEventTimeRange(nil) = (%v, %v), want zero times", start, end)
+	}
+}
+
+func TestIsLowSeverity(t *testing.T) {
+	tests := []struct {
+		name      string
+		levels    []string
+		keepLevel string
+		want      bool
+	}{
+		{"below", []string{"debug", "trace", "info"}, "warn", true},
+		{"unknown counts as info", []string{"", "debug"}, "warn", true},
+		{"unknown kept at info", []string{"", "debug"}, "info", false},
+		{"alias", []string{"debug", "warning"}, "warn", false},
+		{"one severe event", []string{"debug", "critical", "info"}, "error", false},
+		{"fatal", []string{"error", "critical"}, "fatal", false},
+		{"empty", nil, "error", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isLowSeverity(tt.levels, tt.keepLevel); got != tt.want {
+				t.Errorf("isLowSeverity(%v, %q) = %v, want %v", tt.levels, tt.keepLevel, got,
+					tt.want)
+			}
+		})
+	}
+}
+
+// Encodes a chunk of log events the way Fluent Bit does, with a random message of messageSize
+// bytes per event so the chunk barely compresses.
+func newTestChunk(t *testing.T, numEvents int, messageSize int, level string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var mh codec.MsgpackHandle
+	encoder := codec.NewEncoder(&buf, &mh)
+	message := make([]byte, messageSize*3/4)
+	for range numEvents {
+		if _, err := rand.Read(message); err != nil {
+			t.Fatalf("Failed to generate message: %v", err)
+		}
+		event := []any{uint64(1700000000), map[string]any{
+			"log":   base64.StdEncoding.EncodeToString(message),
+			"level": level,
+		}}
+		if err := encoder.Encode(event); err != nil {
+			t.Fatalf("Failed to encode event: %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func ingestTestChunk(t *testing.T, ctx *outctx.S3Context, chunk []byte) (int, error) {
+	t.Helper()
+	return Ingest(unsafe.Pointer(&chunk[0]), len(chunk), "app", ctx)
+}
+
+// Creates a context buffering on disk with a per-tag quota of 1 MB. Buffers are only uploaded to
+// meet the quota since upload_size_mb is larger.
+func newQuotaTestContext(t *testing.T, overflow string) (*outctx.S3Context, *objstore.MemoryStore) {
+	t.Helper()
+	keyFormat, err := keytemplate.Parse(outctx.DefaultS3KeyFormat)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	store := objstore.NewMemoryStore()
+	ctx := &outctx.S3Context{
+		Config: outctx.S3Config{
+			Id:                "test",
+			UseSingleKey:      true,
+			AllowMissingKey:   true,
+			SingleKey:         "log",
+			UseDiskBuffer:     true,
+			DiskBufferPath:    t.TempDir(),
+			UploadSizeMb:      16,
+			DiskQuotaPerTagMb: 1,
+			DiskQuotaOverflow: overflow,
+			DiskQuotaKeepLvl:  "error",
+			LogLevelKey:       "level",
+			TimeZone:          "UTC",
+		},
+		Store:         store,
+		KeyFormat:     keyFormat,
+		EventManagers: make(map[string]*outctx.EventManager),
+	}
+	return ctx, store
+}
+
+func TestIngest_DiskQuotaRetry(t *testing.T) {
+	ctx, store := newQuotaTestContext(t, outctx.OverflowRetry)
+	// Over 2 MB of IR, so the chunk is compressed into the Zstd buffer once written
+	chunk := newTestChunk(t, 250, 10_000, "info")
+
+	store.FailPuts(errors.New("unavailable"))
+	if code, err := ingestTestChunk(t, ctx, chunk); code != output.FLB_OK {
+		t.Fatalf("Ingest() below quota = %d, %v, want FLB_OK", code, err)
+	}
+
+	// The buffer cannot be uploaded to meet the quota, so the chunk is retried, also on retry
+	for range 2 {
+		code, err := ingestTestChunk(t, ctx, chunk)
+		if code != output.FLB_RETRY || !errors.Is(err, outctx.ErrDiskQuotaExceeded) {
+			t.Fatalf("Ingest() at quota = %d, %v, want FLB_RETRY with ErrDiskQuotaExceeded",
+				code, err)
+		}
+	}
+	if keys := store.Keys(); len(keys) != 0 {
+		t.Fatalf("Keys() while the store fails = %v, want none", keys)
+	}
+
+	// Once the store recovers, the retried chunk uploads the buffer and is written to a new one
+	store.FailPuts(nil)
+	if code, err := ingestTestChunk(t, ctx, chunk); code != output.FLB_OK {
+		t.Fatalf("Ingest() after the store recovered = %d, %v, want FLB_OK", code, err)
+	}
+	keys := store.Keys()
+	if len(keys) != 1 {
+		t.Fatalf("Keys() after the store recovered = %v, want the uploaded buffer", keys)
+	}
+	eventManager := ctx.EventManagers["app"]
+	if eventManager.StreamsClosed() {
+		t.Error("buffer should accept events after its upload")
+	}
+	size, err := eventManager.Writer.GetZstdOutputSize()
+	if err != nil || size == 0 {
+		t.Fatalf("GetZstdOutputSize() = %d, %v, want the retried chunk", size, err)
+	}
+	// Retried chunks were not written, so the object holds the first chunk only
+	object, _ := store.Get(keys[0])
+	if len(object.Data) >= 2*size {
+		t.Errorf("uploaded buffer has %d bytes, want about one chunk of %d bytes",
+			len(object.Data), size)
+	}
+}
+
+func TestIngest_DiskQuotaDropLowSeverity(t *testing.T) {
+	ctx, store := newQuotaTestContext(t, outctx.OverflowDropLowSeverity)
+	store.FailPuts(errors.New("unavailable"))
+	chunk := newTestChunk(t, 250, 10_000, "info")
+	if code, err := ingestTestChunk(t, ctx, chunk); code != output.FLB_OK {
+		t.Fatalf("Ingest() below quota = %d, %v, want FLB_OK", code, err)
+	}
+
+	// Low severity chunks are dropped, while chunks holding kept events are retried
+	chunk = newTestChunk(t, 2, 100, "debug")
+	if code, err := ingestTestChunk(t, ctx, chunk); code != output.FLB_OK {
+		t.Errorf("Ingest() of debug chunk at quota = %d, %v, want FLB_OK", code, err)
+	}
+	chunk = newTestChunk(t, 2, 100, "error")
+	code, err := ingestTestChunk(t, ctx, chunk)
+	if code != output.FLB_RETRY || !errors.Is(err, outctx.ErrDiskQuotaExceeded) {
+		t.Errorf("Ingest() of error chunk at quota = %d, %v, want FLB_RETRY", code, err)
+	}
+}
+
+func TestIngest_RetriesInterruptedUpload(t *testing.T) {
+	ctx, store := newQuotaTestContext(t, outctx.OverflowRetry)
+	ctx.Config.DiskQuotaPerTagMb = 0
+	ctx.Config.UploadSizeMb = 1
+	ctx.Config.Checksum = "crc32c"
+	chunk := newTestChunk(t, 250, 10_000, "info")
+
+	// The upload reads the buffer file to its end before failing
+	store.InterruptPuts(1)
+	if code, err := ingestTestChunk(t, ctx, chunk); code != output.FLB_ERROR {
+		t.Fatalf("Ingest() with interrupted upload = %d, %v, want FLB_ERROR", code, err)
+	}
+	_, zstdPath := ctx.GetBufferFilePaths("app")
+	want, err := os.ReadFile(zstdPath)
+	if err != nil || len(want) == 0 {
+		t.Fatalf("Failed to read buffer file: %d bytes, %v", len(want), err)
+	}
+
+	// The next chunk uploads the whole buffer before it is written
+	if code, err := ingestTestChunk(t, ctx, chunk); code != output.FLB_OK {
+		t.Fatalf("Ingest() after interrupted upload = %d, %v, want FLB_OK", code, err)
+	}
+	keys := store.Keys()
+	if len(keys) == 0 {
+		t.Fatal("Keys() = [], want the buffer of the interrupted upload")
+	}
+	if object, _ := store.Get(keys[0]); !bytes.Equal(object.Data, want) {
+		t.Errorf("object %s has %d bytes, want the %d bytes of the buffer file", keys[0],
+			len(object.Data), len(want))
+	}
+}
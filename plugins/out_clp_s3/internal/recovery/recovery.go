@@ -5,31 +5,56 @@ package recovery
 import (
 	"fmt"
 	"io/fs"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/y-scope/fluent-bit-clp/internal/logging"
+	"github.com/y-scope/fluent-bit-clp/internal/metrics"
 	"github.com/y-scope/fluent-bit-clp/internal/outctx"
 )
 
 // If useDiskBuffer is set, close all files prior to exit. Graceful exit will only be called
 // if Fluent Bit receives a kill signal and not during an abrupt crash. Plugin is only
 // given a limited time to clean up resources, so output is not sent to s3. Instead
-// they are sent during startup.
+// they are sent during startup. The admin API server is shut down first and the metrics server is
+// released last.
 //
 // Parameters:
 //   - ctx: Plugin context
 //
 // Returns:
-//   - err: Error closing file
+//   - err: Error shutting down admin API server, error closing file, error shutting down metrics
+//     server
 func GracefulExit(ctx *outctx.S3Context) error {
+	// Closed before taking the lock, since requests in progress wait for it.
+	if ctx.Admin != nil {
+		err := ctx.Admin.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx.Mutex.Lock()
+	defer ctx.Mutex.Unlock()
+
 	for _, eventManager := range ctx.EventManagers {
-		err := eventManager.Writer.Close()
+		if eventManager.Writer != nil {
+			err := eventManager.Writer.Close()
+			if err != nil {
+				return err
+			}
+			eventManager.Writer = nil
+		}
+		metrics.OpenStreams.Add(-1)
+		metrics.CloseStream(eventManager.Tag)
+	}
+
+	if ctx.Metrics != nil {
+		err := ctx.Metrics.Close()
 		if err != nil {
 			return err
 		}
-		eventManager.Writer = nil
 	}
 
 	return nil
@@ -58,6 +83,7 @@ func RecoverBufferFiles(ctx *outctx.S3Context) error {
 		zstdFileInfo := zstdFiles[tag]
 		err := flushExistingBuffer(tag, irFileInfo, zstdFileInfo, ctx)
 		if err != nil {
+			metrics.ObserveRecovery(tag, err)
 			return fmt.Errorf("error flushing existing buffer '%s': %w", tag, err)
 		}
 	}
@@ -105,7 +131,7 @@ func readDirectory(dir string) (map[string]os.FileInfo, error) {
 
 	dirEntries, err := os.ReadDir(dir)
 	if os.IsNotExist(err) {
-		log.Printf("Recovered storage directory %s not found during startup", dir)
+		logging.Default().Infof("Recovered storage directory %s not found during startup", dir)
 		return files, nil
 	} else if err != nil {
 		return nil, fmt.Errorf("error reading directory '%s': %w", dir, err)
@@ -200,6 +226,9 @@ func flushExistingBuffer(
 		// If both files are empty, and there is no error, it will skip tag. Creating unnecessary
 		// event manager is wasteful. Also prevents accumulation of event mangers with tags no
 		// longer being sent by Fluent Bit.
+		if err == nil {
+			metrics.RecoveredBuffers.Inc(tag, metrics.ResultEmpty)
+		}
 		return err
 	}
 
@@ -211,12 +240,13 @@ func flushExistingBuffer(
 		return fmt.Errorf("error recovering event manager with tag: %w", err)
 	}
 
-	log.Printf("Recovered disk buffers with tag %s", tag)
+	ctx.Log.With("tag", tag).Infof("Recovered disk buffers")
 
-	err = eventManager.ToS3(ctx.Config, ctx.Uploader)
+	err = eventManager.ToS3(ctx)
 	if err != nil {
 		return fmt.Errorf("error flushing Zstd to s3: %w", err)
 	}
+	metrics.ObserveRecovery(tag, nil)
 
 	return nil
 }
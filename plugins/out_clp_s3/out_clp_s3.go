@@ -11,11 +11,11 @@ package main
 import "C"
 
 import (
-	"log"
 	"unsafe"
 
 	"github.com/fluent/fluent-bit-go/output"
 
+	"github.com/y-scope/fluent-bit-clp/internal/logging"
 	"github.com/y-scope/fluent-bit-clp/internal/outctx"
 	"github.com/y-scope/fluent-bit-clp/plugins/out_clp_s3/internal/flush"
 	"github.com/y-scope/fluent-bit-clp/plugins/out_clp_s3/internal/recovery"
@@ -33,7 +33,7 @@ const s3PluginName = "out_clp_s3"
 //
 //export FLBPluginRegister
 func FLBPluginRegister(def unsafe.Pointer) int {
-	log.Printf("[%s] Register called", s3PluginName)
+	logging.Default().Debugf("[%s] Register called", s3PluginName)
 	return output.FLBPluginRegister(def, s3PluginName, "CLP s3 plugin")
 }
 
@@ -49,18 +49,23 @@ func FLBPluginRegister(def unsafe.Pointer) int {
 func FLBPluginInit(plugin unsafe.Pointer) int {
 	outCtx, err := outctx.NewS3Context(plugin)
 	if err != nil {
-		log.Fatalf("Failed to initialize plugin: %s", err)
+		logging.Default().Fatalf("Failed to initialize plugin: %s", err)
 	}
 
-	log.Printf("[%s] Init called for id: %s", s3PluginName, outCtx.Config.Id)
+	outCtx.Log.Infof("[%s] Init called", s3PluginName)
 
 	if outCtx.Config.UseDiskBuffer {
 		err = recovery.RecoverBufferFiles(outCtx)
 		if err != nil {
-			log.Fatalf("Failed to recover logs stored on disk: %s", err)
+			outCtx.Log.Fatalf("Failed to recover logs stored on disk: %s", err)
 		}
 	}
 
+	err = outCtx.ServeAdmin()
+	if err != nil {
+		outCtx.Log.Fatalf("Failed to start admin API: %s", err)
+	}
+
 	// Set the context for this instance so that params can be retrieved during flush.
 	output.FLBPluginSetContext(plugin, outCtx)
 	return output.FLB_OK
@@ -83,23 +88,20 @@ func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int
 	// Type assert context back into the original type for the Go variable.
 	outCtx, ok := p.(*outctx.S3Context)
 	if !ok {
-		log.Fatal("Could not read context during flush")
+		logging.Default().Fatalf("Could not read context during flush")
 	}
 
 	size := int(length)
 	stringTag := C.GoString(tag)
 
-	log.Printf(
-		"[%s] Flush called for id %s with tag %s and size %d",
-		s3PluginName,
-		outCtx.Config.Id,
-		stringTag,
-		size,
-	)
+	logger := outCtx.Log.With("tag", stringTag)
+	logger.Debugf("[%s] Flush called with size %d", s3PluginName, size)
 
+	outCtx.Mutex.Lock()
 	code, err := flush.Ingest(data, size, stringTag, outCtx)
+	outCtx.Mutex.Unlock()
 	if err != nil {
-		log.Printf("error flushing data: %s", err)
+		logger.Errorf("Error flushing data: %s", err)
 		// RETRY or ERROR
 		return code
 	}
@@ -109,7 +111,7 @@ func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int
 
 //export FLBPluginExit
 func FLBPluginExit() int {
-	log.Printf("[%s] Exit called for unknown instance", s3PluginName)
+	logging.Default().Infof("[%s] Exit called for unknown instance", s3PluginName)
 	return output.FLB_OK
 }
 
@@ -128,14 +130,14 @@ func FLBPluginExitCtx(ctx unsafe.Pointer) int {
 
 	outCtx, ok := p.(*outctx.S3Context)
 	if !ok {
-		log.Fatal("Could not read context during flush")
+		logging.Default().Fatalf("Could not read context during flush")
 	}
 
-	log.Printf("[%s] Exit called for id: %s", s3PluginName, outCtx.Config.Id)
+	outCtx.Log.Infof("[%s] Exit called", s3PluginName)
 
 	err := recovery.GracefulExit(outCtx)
 	if err != nil {
-		log.Printf("Failed to exit gracefully")
+		outCtx.Log.Errorf("Failed to exit gracefully: %s", err)
 	}
 
 	return output.FLB_OK
@@ -143,7 +145,7 @@ func FLBPluginExitCtx(ctx unsafe.Pointer) int {
 
 //export FLBPluginUnregister
 func FLBPluginUnregister(def unsafe.Pointer) {
-	log.Printf("[%s] Unregister called", s3PluginName)
+	logging.Default().Debugf("[%s] Unregister called", s3PluginName)
 	output.FLBPluginUnregister(def)
 }
 
@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/y-scope/fluent-bit-clp/internal/admin"
+)
+
+// flushDeltaLevels names the log levels of the flush_hard_delta_* and flush_soft_delta_* options,
+// indexed like FlushConfigContext.hardDeltas.
+var flushDeltaLevels = []string{"debug", "info", "warn", "error", "fatal"}
+
+// UploadsPaused reports whether uploads are paused through the admin API.
+func (ctx *PluginContext) UploadsPaused() bool {
+	return ctx.uploadsPaused.Load()
+}
+
+// Streams lists the open streams for the admin API, sorted by path.
+func (ctx *PluginContext) Streams() []admin.Stream {
+	streams := make([]admin.Stream, 0)
+	for path, ingestionCtx := range ctx.Ingestion.Snapshot() {
+		// Read before acquiring the stream's mutex to respect the lock order
+		pending := ingestionCtx.Flush.Dirty()
+		hard, soft, retry := ingestionCtx.Flush.Deadlines()
+
+		stream, ok := ingestionCtx.describe()
+		if !ok {
+			continue
+		}
+		stream.Name = path
+		stream.Pending = pending
+		stream.HardDeadline = hard
+		stream.SoftDeadline = soft
+		stream.RetryAt = retry
+		streams = append(streams, stream)
+	}
+	slices.SortFunc(streams, func(a, b admin.Stream) int { return strings.Compare(a.Name, b.Name) })
+	return streams
+}
+
+// describe returns the buffer and object of the stream for the admin API, or false if the stream
+// is closed.
+func (ctx *IngestionContext) describe() (admin.Stream, bool) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if ctx.closed {
+		return admin.Stream{}, false
+	}
+	// The size is only used for display, so a failed stat shows an empty buffer.
+	var bufferBytes int64
+	if info, err := ctx.Compression.File.Stat(); err == nil {
+		bufferBytes = info.Size()
+	}
+	return admin.Stream{
+		Key:         ctx.manifest.RemoteKey,
+		BufferBytes: bufferBytes,
+		SyncedBytes: ctx.manifest.SyncedBytes,
+		Events:      ctx.stats.Events,
+		LastWrite:   ctx.LastWrite(),
+	}, true
+}
+
+// Flush uploads streams for the admin API, without waiting for their timers. An empty path
+// uploads every stream holding unsynced data. Failed uploads are retried like timer-driven ones.
+func (ctx *PluginContext) Flush(path string) ([]admin.FlushResult, error) {
+	var streams []*IngestionContext
+	if path != "" {
+		ingestionCtx, exists := ctx.Ingestion.get(path)
+		if !exists {
+			return nil, admin.ErrStreamNotFound
+		}
+		streams = append(streams, ingestionCtx)
+	} else {
+		for _, ingestionCtx := range ctx.Ingestion.Snapshot() {
+			if ingestionCtx.Flush.Dirty() {
+				streams = append(streams, ingestionCtx)
+			}
+		}
+	}
+
+	results := make([]admin.FlushResult, 0, len(streams))
+	for _, ingestionCtx := range streams {
+		result := admin.FlushResult{Stream: ingestionCtx.path}
+		if err := ingestionCtx.Flush.UploadNow(); err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// SetPaused pauses or resumes uploads for the admin API. While paused, timers that fire leave
+// their stream dirty, and streams are neither rotated nor evicted; records are still written to
+// the buffer files. Resuming uploads every dirty stream. Streams are still finalized and uploaded
+// when the plugin exits.
+func (ctx *PluginContext) SetPaused(paused bool) {
+	if ctx.uploadsPaused.Swap(paused) == paused || paused {
+		return
+	}
+	for _, ingestionCtx := range ctx.Ingestion.Snapshot() {
+		if ingestionCtx.Flush.Dirty() {
+			go ingestionCtx.Flush.Callback()
+		}
+	}
+}
+
+// Paused reports whether uploads are paused, for the admin API.
+func (ctx *PluginContext) Paused() bool {
+	return ctx.UploadsPaused()
+}
+
+// EffectiveConfig returns the configuration of the plugin instance for the admin API, including
+// defaults. Credentials are not kept by the plugin context, so the dump holds no secrets.
+func (ctx *PluginContext) EffectiveConfig() map[string]any {
+	config := map[string]any{
+		"destination":        ctx.Store.URI(""),
+		"log_level_key":      ctx.FlushConfig.LogLevelKey,
+		"stream_key":         ctx.StreamKey.String(),
+		"id":                 ctx.ID,
+		"disk_buffer_path":   ctx.BufferDir,
+		"rotate_max_size":    ctx.Rotation.MaxSize,
+		"rotate_max_age":     ctx.Rotation.MaxAge.String(),
+		"rotate_interval":    ctx.Rotation.Interval.String(),
+		"sync_mode":          ctx.SyncMode,
+		"dead_letter_prefix": ctx.DeadLetterPrefix,
+		"idle_timeout":       ctx.Eviction.IdleTimeout.String(),
+		"max_open_streams":   ctx.Eviction.MaxOpenStreams,
+		"checksum":           ctx.ChecksumAlgorithm,
+		"verify_uploads":     ctx.VerifyUploads,
+		"write_index":        ctx.WriteIndex,
+		"index_bloom_size":   ctx.IndexBloomSize,
+	}
+	if ctx.KeyFormat != nil {
+		config["s3_key_format"] = ctx.KeyFormat.String()
+	}
+	if len(ctx.Tags) > 0 {
+		tags := make(map[string]string, len(ctx.Tags))
+		for key, template := range ctx.Tags {
+			tags[key] = template.String()
+		}
+		config["object_tags"] = tags
+	}
+	if ctx.StorageClasses != nil {
+		for level, class := range ctx.StorageClasses.ByLevel {
+			if class != "" {
+				config["storage_class_"+logLevelName(level)] = class
+			}
+		}
+	}
+	for level, name := range flushDeltaLevels {
+		config["flush_hard_delta_"+name] = ctx.FlushConfig.hardDeltas[level].String()
+		config["flush_soft_delta_"+name] = ctx.FlushConfig.softDeltas[level].String()
+	}
+	if retry := ctx.FlushConfig.retry; retry != nil {
+		config["retry_initial_backoff"] = retry.InitialBackoff.String()
+		config["retry_max_backoff"] = retry.MaxBackoff.String()
+		config["retry_max_attempts"] = retry.MaxAttempts
+		config["retry_max_age"] = retry.MaxAge.String()
+	}
+	if ctx.Metrics != nil {
+		config["metrics_listen"] = ctx.Metrics.Addr().String()
+	}
+	if ctx.Admin != nil {
+		config["admin_listen"] = ctx.Admin.Addr().String()
+	}
+	return config
+}
+
+// CloseAdmin stops serving the admin API, if it is served, waiting for requests in progress.
+// Called first on exit, so no admin request uploads a stream while it is finalized.
+func (ctx *PluginContext) CloseAdmin() {
+	if ctx.Admin == nil {
+		return
+	}
+	if err := ctx.Admin.Close(); err != nil {
+		ctx.Log.Warnf("%v", err)
+	}
+	ctx.Admin = nil
+}
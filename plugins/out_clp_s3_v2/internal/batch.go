@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"time"
+
+	"github.com/y-scope/clp-ffi-go/ffi"
+)
+
+// Batch writes the records of one Fluent Bit chunk to their streams.
+//
+// Add resolves (and creates) the stream of each record, and Write writes all records afterwards.
+// A stream that cannot be created therefore fails the chunk before any of its records is written,
+// so retrying the chunk does not duplicate them.
+//
+// The streams resolved by Add are pinned until Release, so that resolving a later record never
+// evicts the stream of an earlier one to stay within max_open_streams.
+type Batch struct {
+	pluginCtx *PluginContext
+	records   []batchRecord
+}
+
+// batchRecord is a log event of a [Batch] with the stream it is written to.
+type batchRecord struct {
+	stream    *IngestionContext
+	event     *ffi.LogEvent
+	timestamp time.Time
+	level     int
+	// first names the stream's object if the record is the object's first.
+	first firstRecord
+}
+
+// NewBatch creates an empty batch writing to the streams of pluginCtx.
+func NewBatch(pluginCtx *PluginContext) *Batch {
+	return &Batch{pluginCtx: pluginCtx}
+}
+
+// Add queues a log event for Write, creating the stream at path if it does not exist yet. The tag
+// and fields of the event's record name the stream's object if the event is the object's first
+// (see objectKey); fields may be nil unless [PluginContext.UsesRecordFields].
+//
+// The stream is pinned until Release. Returns an error marked with [ErrTransient] if the stream
+// cannot be created. Nothing has been written at that point, so the chunk can be retried as a
+// whole.
+func (b *Batch) Add(
+	path string,
+	tag string,
+	fields map[string]any,
+	event *ffi.LogEvent,
+	timestamp time.Time,
+	level int,
+) error {
+	ingestionCtx, err := getOrCreateIngestionContext(b.pluginCtx, path, true)
+	if err != nil {
+		return err
+	}
+	b.records = append(b.records, batchRecord{
+		stream:    ingestionCtx,
+		event:     event,
+		timestamp: timestamp,
+		level:     level,
+		first:     firstRecord{tag: tag, fields: fields},
+	})
+	return nil
+}
+
+// Write writes the queued log events in order and updates their streams' flush timers. The
+// buffer files of the streams written to are then flushed, so the records survive a crash, and
+// streams due for rotation start new objects.
+//
+// Writing stops at the first failure. A transient failure while writing (e.g. the disk filled up)
+// cannot be detected in advance: records written before it are written again when the chunk is
+// retried.
+//
+// Returns the number of log events written and the first failure.
+func (b *Batch) Write(now time.Time) (int, error) {
+	touched := make(map[*IngestionContext]struct{})
+	var written int
+	var writeErr error
+	for _, record := range b.records {
+		// Record the severity before writing so the object's storage class never undercounts it
+		record.stream.ObserveLevel(record.level)
+		if err := record.stream.writeRecord(b.pluginCtx, record); err != nil {
+			writeErr = err
+			break
+		}
+		written++
+		touched[record.stream] = struct{}{}
+
+		// Update flush timers based on log severity (after the stream's lock is released)
+		record.stream.Flush.Update(record.level, record.timestamp, b.pluginCtx.FlushConfig)
+	}
+
+	for ingestionCtx := range touched {
+		if err := ingestionCtx.FlushBuffer(); err != nil {
+			ingestionCtx.log.Errorf("Failed to flush buffer file: %v", err)
+			if writeErr == nil && IsTransient(err) {
+				writeErr = err
+			}
+			continue
+		}
+		if err := ingestionCtx.RotateIfNeeded(b.pluginCtx, now); err != nil {
+			ingestionCtx.log.Errorf("Failed to rotate stream: %v", err)
+		}
+	}
+	return written, writeErr
+}
+
+// Release unpins the streams of the batch once it is written or abandoned, then evicts the least
+// recently written streams if the batch left more than max_open_streams open. Safe to call more
+// than once.
+func (b *Batch) Release() {
+	for _, record := range b.records {
+		record.stream.release()
+	}
+	b.records = nil
+	if err := b.pluginCtx.evictLeastRecentlyUsed(0); err != nil {
+		b.pluginCtx.Log.Warnf("Failed to restore max_open_streams: %v", err)
+	}
+}
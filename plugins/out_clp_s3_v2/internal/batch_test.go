@@ -0,0 +1,194 @@
+package internal
+
+import (
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/y-scope/fluent-bit-clp/internal/objmeta"
+)
+
+func TestBatch_StreamCreationFailureWritesNothing(t *testing.T) {
+	pluginCtx, _ := newTestPluginContext(t)
+
+	// A directory in place of the buffer file makes creating the "blocked" stream fail
+	blockedPath, _ := bufferFilePaths(pluginCtx.BufferDir, "blocked", 0)
+	if err := os.Mkdir(blockedPath, 0o700); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	batch := NewBatch(pluginCtx)
+	event := newTestLogEvent(0, 0)
+	if err := batch.Add(testPath, "app", nil, &event, time.Time{}, 0); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	err := batch.Add("blocked", "app", nil, &event, time.Time{}, 0)
+	if !IsTransient(err) {
+		t.Fatalf("Add() error = %v, want transient error", err)
+	}
+
+	ingestionCtx, ok := pluginCtx.Ingestion.get(testPath)
+	if !ok {
+		t.Fatalf("stream %q should have been created", testPath)
+	}
+	defer ingestionCtx.Flush.Stop()
+	if ingestionCtx.stats.Events != 0 || ingestionCtx.Flush.Dirty() {
+		t.Errorf("records were written before the batch failed: %d events",
+			ingestionCtx.stats.Events)
+	}
+}
+
+func TestBatch_Write(t *testing.T) {
+	pluginCtx, _ := newTestPluginContext(t)
+
+	batch := NewBatch(pluginCtx)
+	for i, path := range []string{testPath, "other", testPath} {
+		event := newTestLogEvent(0, i)
+		if err := batch.Add(path, "app", nil, &event, time.Time{}, 0); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	written, err := batch.Write(time.Now())
+	if err != nil || written != 3 {
+		t.Fatalf("Write() = %d, %v, want 3, nil", written, err)
+	}
+
+	for path, want := range map[string]int64{testPath: 2, "other": 1} {
+		ingestionCtx, _ := pluginCtx.Ingestion.get(path)
+		ingestionCtx.Flush.Stop()
+		if ingestionCtx.stats.Events != want {
+			t.Errorf("stream %q has %d events, want %d", path, ingestionCtx.stats.Events, want)
+		}
+		if !ingestionCtx.Flush.Dirty() {
+			t.Errorf("stream %q should be dirty after a write", path)
+		}
+	}
+}
+
+func TestBatch_WriteToClosedStream(t *testing.T) {
+	pluginCtx, _ := newTestPluginContext(t)
+
+	batch := NewBatch(pluginCtx)
+	for i, path := range []string{"other", testPath, "other"} {
+		event := newTestLogEvent(0, i)
+		if err := batch.Add(path, "app", nil, &event, time.Time{}, 0); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+
+	// Closing a stream between Add and Write (e.g. at shutdown) fails the batch as transient
+	closed, _ := pluginCtx.Ingestion.get(testPath)
+	closed.Flush.Stop()
+	if err := closed.Finalize(pluginCtx); err != nil {
+		t.Fatalf("Finalize() error = %v", err)
+	}
+
+	written, err := batch.Write(time.Now())
+	if !IsTransient(err) || written != 1 {
+		t.Errorf("Write() = %d, %v, want 1 and a transient error", written, err)
+	}
+	other, _ := pluginCtx.Ingestion.get("other")
+	other.Flush.Stop()
+}
+
+func TestBatch_MoreStreamsThanMaxOpenStreams(t *testing.T) {
+	pluginCtx, store := newTestPluginContext(t)
+	pluginCtx.Eviction = &EvictionConfig{MaxOpenStreams: 1}
+
+	// Resolving "other" must not evict testPath, which the batch still writes to
+	batch := NewBatch(pluginCtx)
+	for i, path := range []string{testPath, "other", testPath} {
+		event := newTestLogEvent(0, i)
+		if err := batch.Add(path, "app", nil, &event, time.Time{}, 0); err != nil {
+			t.Fatalf("Add(%q) error = %v", path, err)
+		}
+	}
+	written, err := batch.Write(time.Now())
+	if err != nil || written != 3 {
+		t.Fatalf("Write() = %d, %v, want 3, nil", written, err)
+	}
+
+	// Releasing the batch evicts the least recently written stream to restore the cap
+	batch.Release()
+	streams := pluginCtx.Ingestion.Snapshot()
+	for _, ingestionCtx := range streams {
+		ingestionCtx.Flush.Stop()
+	}
+	if len(streams) != 1 {
+		t.Fatalf("got %d open streams after Release(), want 1", len(streams))
+	}
+	ingestionCtx, ok := streams[testPath]
+	if !ok {
+		t.Fatalf("stream %q should still be open", testPath)
+	}
+	if ingestionCtx.stats.Events != 2 || ingestionCtx.pinned() {
+		t.Errorf("stream %q has %d events (pinned %v), want 2 unpinned", testPath,
+			ingestionCtx.stats.Events, ingestionCtx.pinned())
+	}
+	if keys := store.Keys(); !slices.Equal(keys, []string{"other.0.clp.zst"}) {
+		t.Errorf("uploaded objects = %v, want the evicted stream's object", keys)
+	}
+}
+
+func TestBatch_NamesObjectsByFirstRecord(t *testing.T) {
+	pluginCtx, store := newTestPluginContext(t)
+	keyFormat, err := parseKeyFormat("$TAG[0]/$app/$STREAM.$INDEX.clp.zst")
+	if err != nil {
+		t.Fatalf("parseKeyFormat() error = %v", err)
+	}
+	tags, err := objmeta.ParseTags("app=$app")
+	if err != nil {
+		t.Fatalf("ParseTags() error = %v", err)
+	}
+	pluginCtx.KeyFormat = keyFormat
+	pluginCtx.Tags = tags
+	pluginCtx.Rotation = &RotationConfig{MaxAge: time.Hour}
+
+	write := func(tag, app string) {
+		t.Helper()
+		batch := NewBatch(pluginCtx)
+		event := newTestLogEvent(0, 0)
+		fields := map[string]any{"app": app}
+		if err := batch.Add(testPath, tag, fields, &event, time.Time{}, 0); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+		if _, err := batch.Write(time.Now()); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+
+	write("kube.api", "api")
+	write("kube.worker", "worker")
+	ingestionCtx, _ := pluginCtx.Ingestion.get(testPath)
+	defer ingestionCtx.Flush.Stop()
+	firstKey := "kube/api/" + testPath + ".0.clp.zst"
+	if got := ingestionCtx.manifest.RemoteKey; got != firstKey {
+		t.Errorf("RemoteKey = %q, want %q", got, firstKey)
+	}
+	manifest, err := readManifest(ingestionCtx.manifestPath)
+	if err != nil {
+		t.Fatalf("readManifest() error = %v", err)
+	}
+	if manifest.RemoteKey != ingestionCtx.manifest.RemoteKey {
+		t.Errorf("persisted RemoteKey = %q, want %q", manifest.RemoteKey,
+			ingestionCtx.manifest.RemoteKey)
+	}
+
+	// The next object is named by its own first record; tags use the first record as well
+	if err := ingestionCtx.RotateIfNeeded(pluginCtx, time.Now().Add(2*time.Hour)); err != nil {
+		t.Fatalf("RotateIfNeeded() error = %v", err)
+	}
+	object, ok := store.Get(firstKey)
+	if !ok {
+		t.Fatalf("rotated object not uploaded, got keys %v", store.Keys())
+	}
+	if object.Opts.Tags["app"] != "api" {
+		t.Errorf("tags = %v, want app=api", object.Opts.Tags)
+	}
+	write("kube.worker", "worker")
+	secondKey := "kube/worker/" + testPath + ".1.clp.zst"
+	if got := ingestionCtx.manifest.RemoteKey; got != secondKey {
+		t.Errorf("RemoteKey after rotation = %q, want %q", got, secondKey)
+	}
+}
@@ -1,16 +1,26 @@
 package internal
 
 import (
-	"log"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/fluent/fluent-bit-go/output"
 	"github.com/klauspost/compress/zstd"
 	"github.com/y-scope/clp-ffi-go/ir"
+
+	"github.com/y-scope/fluent-bit-clp/internal/admin"
+	"github.com/y-scope/fluent-bit-clp/internal/keytemplate"
+	"github.com/y-scope/fluent-bit-clp/internal/logging"
+	"github.com/y-scope/fluent-bit-clp/internal/metrics"
+	"github.com/y-scope/fluent-bit-clp/internal/objindex"
+	"github.com/y-scope/fluent-bit-clp/internal/objmeta"
+	"github.com/y-scope/fluent-bit-clp/internal/objstore"
 )
 
 // Default configuration values.
@@ -19,8 +29,30 @@ const (
 	defaultLogLevelKey = "level"
 	// defaultFlushDelta is the default time between flushes for all log levels.
 	defaultFlushDelta = 3 * time.Second
+	// defaultBufferDirName is the buffer directory created under the system temp directory when
+	// disk_buffer_path is not set.
+	defaultBufferDirName = "out_clp_s3_v2"
+	// defaultChecksum is the checksum algorithm of uploaded objects.
+	defaultChecksum = "crc32c"
+	// maxIndexBloomSize bounds index_bloom_size, since every open stream holds a Bloom filter.
+	maxIndexBloomSize = 16 << 20
 )
 
+// pluginName identifies the plugin in object metadata.
+const pluginName = "out_clp_s3_v2"
+
+// logLevelNames names the log levels, indexed by level (see the LogLevel constants of the plugin).
+// Used by storage_class_<level> options and the level counts of object metadata.
+var logLevelNames = []string{"trace", "debug", "info", "warn", "error", "fatal"}
+
+// logLevelName returns the name of a log level, or "" if the level is unknown.
+func logLevelName(level int) string {
+	if level < 0 || level >= len(logLevelNames) {
+		return ""
+	}
+	return logLevelNames[level]
+}
+
 // FlushConfigContext stores configuration for the dual-timer flush strategy.
 //
 // The flush strategy uses two timers per log stream:
@@ -45,6 +77,9 @@ type FlushConfigContext struct {
 	// softDeltas contains the soft flush delay for each log level.
 	// Soft timer resets on each log event, triggering upload after inactivity.
 	softDeltas []time.Duration
+
+	// retry is the retry policy for uploads that fail when a timer fires.
+	retry *RetryConfig
 }
 
 // flushContext manages the dual-timer flush strategy for a single log stream.
@@ -61,9 +96,28 @@ type flushContext struct {
 	SoftTimer *time.Timer
 	// softDelta tracks the current soft timer duration (minimum seen for this batch).
 	softDelta time.Duration
+	// softTimeout tracks when the soft timer will fire, reported by the admin API.
+	softTimeout time.Time
 
-	// userCallback is invoked when either timer fires, triggering S3 upload.
-	userCallback func()
+	// RetryTimer fires to retry a failed upload after a backoff delay.
+	RetryTimer *time.Timer
+	// retry is the retry policy for failed uploads. Nil disables retries.
+	retry *RetryConfig
+	// attempts counts consecutive failed uploads.
+	attempts int
+	// firstFailure is when the first of the consecutive failed uploads happened.
+	firstFailure time.Time
+	// retryAt tracks when the retry timer will fire, reported by the admin API.
+	retryAt time.Time
+	// dirty is set when a log event is written and cleared when an upload succeeds.
+	dirty bool
+
+	// userCallback is invoked when any timer fires, triggering S3 upload.
+	userCallback func() error
+	// path is the stream's path, labelling its timer fire metrics.
+	path string
+	// log is the stream's logger. Nil logs through the default logger.
+	log *logging.Logger
 
 	// Mutex protects all fields from concurrent access.
 	Mutex sync.Mutex
@@ -75,7 +129,7 @@ type flushContext struct {
 //
 //	Log Event → IR Writer → Zstd Writer → File
 type compressionContext struct {
-	// File is the temporary file storing compressed logs before S3 upload.
+	// File is the buffer file storing compressed logs before S3 upload.
 	File *os.File
 	// ZstdWriter compresses data using Zstandard algorithm.
 	ZstdWriter *zstd.Encoder
@@ -87,105 +141,451 @@ type compressionContext struct {
 //
 // Each unique log path (derived from Fluent Bit tag) has its own IngestionContext,
 // allowing independent compression and flush timing per stream.
+//
+// Thread-safety: Writes, syncs, rotation and finalization are serialized by the stream's mutex, so
+// an upload never captures a partially written Zstd block. Flush timer callbacks acquire the flush
+// context's Mutex before the stream's mutex; the stream's mutex is never held while acquiring the
+// flush context's Mutex.
 type IngestionContext struct {
 	// Compression holds the file and encoder resources for this stream.
 	Compression *compressionContext
 	// Flush manages the upload timing for this stream.
 	Flush *flushContext
-}
 
-// s3Context holds the S3 client and bucket configuration.
-type s3Context struct {
-	// Client is the configured AWS S3 client.
-	Client *s3.Client
-	// Bucket is the target S3 bucket for log uploads.
-	Bucket string
+	// mu serializes access to the compression pipeline, manifest and openedAt.
+	mu sync.Mutex
+	// closed is set once the stream is finalized; it must not be written to afterwards.
+	closed bool
+
+	// path is the stream path (Fluent Bit tag) the context was created for.
+	path string
+	// openedAt is when the current object was started, used by rotation policies.
+	openedAt time.Time
+
+	// manifest records the stream's tag, remote key and sync progress for crash recovery.
+	manifest *streamManifest
+	// manifestPath is where manifest is persisted, next to the buffer file.
+	manifestPath string
+
+	// lastWrite is when the stream was last written to, in Unix nanoseconds. It is atomic so
+	// eviction can compare streams without acquiring their mutexes.
+	lastWrite atomic.Int64
+	// pins counts the records queued for the stream by batches that have not been released yet.
+	// Pinned streams are not evicted to make room for other streams (see evictLeastRecentlyUsed).
+	pins atomic.Int32
+	// maxLevel is the most severe log level written to the current object, or -1 if none was
+	// observed. It selects the object's storage class (see StorageClassConfig).
+	maxLevel atomic.Int32
+	// stats describes the events written to the current object, stored as its metadata.
+	stats objmeta.Stats
+	// first is the first record written to the current object, which names it (see nameObject).
+	first firstRecord
+	// index collects the sidecar index of the current object. Nil if write_index is not set.
+	index *objindex.Builder
+	// log is the plugin's logger, adding the stream path to messages.
+	log *logging.Logger
 }
 
 // PluginContext is the top-level context for the out_clp_s3_v2 plugin.
 //
 // A single PluginContext is created during FLBPluginInit and shared across
 // all flush callbacks. It contains:
-//   - S3 configuration and client
+//   - Object store uploads are sent to
 //   - Map of ingestion contexts (one per log stream/tag)
 //   - Flush timing configuration
 type PluginContext struct {
-	// S3 holds the S3 client and bucket configuration.
-	S3 *s3Context
+	// Store is the destination of uploads.
+	Store objstore.ObjectStore
 	// Ingestion maps log paths to their ingestion contexts.
-	// Key is typically the Fluent Bit tag or file_path from log records.
-	Ingestion map[string]*IngestionContext
+	// Key is the rendered StreamKey, typically the Fluent Bit tag or file_path from log records.
+	Ingestion *IngestionRegistry
+	// StreamKey is the template rendering the path of the stream each record belongs to.
+	StreamKey *keytemplate.Template
+	// KeyFormat is the template rendering the S3 key of each object. Nil uses the stream path.
+	KeyFormat *keytemplate.Template
+	// Hostname is available to KeyFormat. Empty if it could not be retrieved.
+	Hostname string
+	// ID identifies the plugin instance in object metadata and as $ID. Empty if not configured.
+	ID string
+	// Tags are applied to uploaded objects. Empty if object_tags is not set.
+	Tags objmeta.Tags
 	// FlushConfig contains the dual-timer flush strategy configuration.
 	FlushConfig *FlushConfigContext
+	// BufferDir is the directory holding buffer files and their manifests. It persists across
+	// restarts so buffers left behind by a crash can be recovered.
+	BufferDir string
+	// Rotation contains the policies for starting a new object within a stream.
+	Rotation *RotationConfig
+	// SyncMode selects whether syncs upload the whole buffer file or only the bytes appended since
+	// the last sync (SyncModeFull, SyncModeSegments or SyncModeAppend).
+	SyncMode string
+	// DeadLetterPrefix is the key prefix chunks with malformed records are uploaded under. Such
+	// chunks are dropped without a copy if empty.
+	DeadLetterPrefix string
+	// Eviction contains the policies for closing streams that are no longer written to.
+	Eviction *EvictionConfig
+	// StorageClasses selects the storage class of objects by log level. Nil uses the store's
+	// default storage class.
+	StorageClasses *StorageClassConfig
+	// ChecksumAlgorithm is the checksum sent with uploaded objects (objstore.ChecksumCRC32C or
+	// objstore.ChecksumSHA256). Empty disables checksums.
+	ChecksumAlgorithm string
+	// VerifyUploads confirms each upload with a HeadObject request before its buffer is discarded.
+	VerifyUploads bool
+	// WriteIndex uploads a sidecar index next to each object (see objindex).
+	WriteIndex bool
+	// IndexBloomSize is the size of the Bloom filter of each index in bytes.
+	IndexBloomSize int
+	// Metrics serves the plugin's metrics over HTTP. Nil if metrics_listen is not set.
+	Metrics *metrics.Server
+	// Admin serves the admin API over HTTP. Nil if admin_listen is not set.
+	Admin *admin.Server
+	// Log is the logger of the plugin instance, adding its id (if configured) to messages.
+	Log *logging.Logger
+
+	// uploadsPaused is set while uploads are paused through the admin API.
+	uploadsPaused atomic.Bool
+	// janitor evicts idle streams and rotates objects of idle streams in the background. Nil if
+	// neither an idle timeout nor a time-based rotation policy is configured.
+	janitor *janitor
 }
 
 // NewPluginContext creates and initializes a new PluginContext from Fluent Bit configuration.
 //
 // This function:
-//  1. Creates an S3 client using AWS credentials from the environment
-//  2. Validates the target S3 bucket exists and is accessible
-//  3. Loads flush timing configuration from plugin settings
+//  1. Creates the logger of the plugin instance (see newLogger) and the object store of the
+//     destination; for S3, creates a client using AWS credentials from the environment and
+//     validates the target bucket is accessible
+//  2. Loads flush timing configuration from plugin settings
+//  3. Uploads buffers left behind by a previous crash (see RecoverBufferDir)
+//  4. Starts serving metrics, if metrics_listen is set, and the admin API, if admin_listen is set
+//  5. Starts the janitor evicting idle streams and rotating objects of idle streams, if
+//     idle_timeout, rotate_max_age or rotate_interval is set
 //
 // Configuration keys read from Fluent Bit:
-//   - log_bucket: Target S3 bucket name (required)
+//   - destination: "s3", "gcs", "azure" or "file" (default: "s3")
+//   - log_bucket: Target bucket (container for "azure") name (required unless "file")
+//   - azure_account_url, azure_connection_string: Azure credentials (see newObjectStore)
+//   - destination_path: Root directory of objects (required for "file")
+//   - sse, sse_kms_key_id, sse_bucket_key, sse_encryption_context, sse_customer_key,
+//     storage_class: Encryption and storage class of S3 objects (see s3Options)
+//   - storage_class_*: Storage class per log level (default: storage_class)
+//   - checksum: "crc32c", "sha256" or "none" (default: "crc32c")
+//   - verify_uploads: Confirm uploads with a HeadObject request (default: false)
+//   - write_index: Upload a sidecar index next to each object (default: false)
+//   - index_bloom_size: Size of the Bloom filter of each index (default: "64KB")
 //   - log_level_key: JSON key for log severity (default: "level")
+//   - stream_key: Template of the stream path, e.g. "$file_path" (default: "$TAG")
+//   - s3_key_format: Template of object keys, e.g. "logs/$STREAM.$INDEX.clp.zst" (default: the
+//     stream path)
+//   - id: Id of the plugin instance, stored in object metadata (default: none)
+//   - object_tags: Tags of objects, e.g. "team=logs,host=$HOSTNAME" (default: none)
+//   - disk_buffer_path: Directory for buffer files (default: <system temp>/out_clp_s3_v2)
+//   - rotate_max_size: Compressed object size that triggers rotation (default: disabled)
+//   - rotate_max_age: Object age that triggers rotation (default: disabled)
+//   - rotate_interval: Wall-clock boundary that triggers rotation, e.g. 1h (default: disabled)
+//   - sync_mode: "full", "segments" or "append" (default: "full")
+//   - dead_letter_prefix: Key prefix for chunks with malformed records (default: disabled)
+//   - idle_timeout: Time without records after which a stream is evicted (default: disabled)
+//   - max_open_streams: Open streams before the least recently written is evicted (default:
+//     unlimited)
 //   - flush_hard_delta_*: Hard timer durations per log level
 //   - flush_soft_delta_*: Soft timer durations per log level
+//   - retry_initial_backoff: Delay before retrying a failed upload (default: 1s)
+//   - retry_max_backoff: Maximum delay between retries (default: 5m)
+//   - retry_max_attempts: Consecutive failures before giving up (default: unlimited)
+//   - retry_max_age: Time spent retrying before giving up (default: unlimited)
+//   - metrics_listen: Address serving Prometheus metrics at /metrics, e.g. ":2021" (default:
+//     disabled)
+//   - admin_listen: Address serving the admin API, e.g. "127.0.0.1:2022" (default: disabled)
+//   - log_level: "off", "error", "warn", "info", "debug" or "trace" (default: "info")
+//   - log_format: "text" or "json" (default: "text")
+//   - log_repeat_interval: Interval in which a message is logged at most 5 times; 0 disables
+//     rate limiting (default: 1m)
 //
-// Returns an error if S3 client creation or bucket validation fails.
+// Returns an error if the logging options are invalid, if the destination cannot be reached, if
+// recovery fails, or if the metrics or admin address cannot be listened on.
 func NewPluginContext(plugin unsafe.Pointer) (*PluginContext, error) {
-	// Create and validate S3 client
-	client, err := S3CreateClient()
+	logger, err := newLogger(plugin)
 	if err != nil {
-		log.Printf("[error] Failed to create S3 client: %v", err)
+		logging.Default().Errorf("%v", err)
 		return nil, err
 	}
 
-	bucket := output.FLBPluginConfigKey(plugin, "log_bucket")
-	if err := S3ValidateLogBucket(client, bucket); err != nil {
-		log.Printf("[error] Failed to validate log bucket %q: %v", bucket, err)
+	// Create and validate the destination of uploads
+	store, err := newObjectStore(plugin, logger)
+	if err != nil {
+		logger.Errorf("Failed to create destination: %v", err)
 		return nil, err
 	}
-	log.Printf("[info] Logs are configured to be uploaded to s3://%s", bucket)
 
 	// Load log level key configuration
 	logLevelKey := getConfigWithDefault(plugin, "log_level_key", defaultLogLevelKey)
-	log.Printf("[info] Log level key is configured to: %q", logLevelKey)
+	logger.Infof("Log level key is configured to: %q", logLevelKey)
+
+	// Load the template mapping records to streams
+	streamKeyText := getConfigWithDefault(plugin, "stream_key", defaultStreamKey)
+	streamKey, err := parseStreamKey(streamKeyText)
+	if err != nil {
+		logger.Errorf("Invalid stream_key: %v", err)
+		return nil, err
+	}
+	logger.Infof("Stream key is configured to: %q", streamKeyText)
+
+	var keyFormat *keytemplate.Template
+	if keyFormatText := output.FLBPluginConfigKey(plugin, "s3_key_format"); keyFormatText != "" {
+		keyFormat, err = parseKeyFormat(keyFormatText)
+		if err != nil {
+			logger.Errorf("Invalid s3_key_format: %v", err)
+			return nil, err
+		}
+		logger.Infof("Object keys are configured to: %q", keyFormatText)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		logger.Warnf("Failed to get hostname for s3_key_format: %v", err)
+	}
+
+	tags, err := objmeta.ParseTags(output.FLBPluginConfigKey(plugin, "object_tags"))
+	if err != nil {
+		logger.Errorf("Invalid object_tags: %v", err)
+		return nil, err
+	}
 
 	// Load flush timing configuration for each log level
 	// Index order: 0=debug, 1=info, 2=warn, 3=error, 4=fatal
 	hardDeltas := []time.Duration{
-		getConfigDuration(plugin, "flush_hard_delta_debug", defaultFlushDelta),
-		getConfigDuration(plugin, "flush_hard_delta_info", defaultFlushDelta),
-		getConfigDuration(plugin, "flush_hard_delta_warn", defaultFlushDelta),
-		getConfigDuration(plugin, "flush_hard_delta_error", defaultFlushDelta),
-		getConfigDuration(plugin, "flush_hard_delta_fatal", defaultFlushDelta),
+		getConfigDuration(plugin, logger, "flush_hard_delta_debug", defaultFlushDelta),
+		getConfigDuration(plugin, logger, "flush_hard_delta_info", defaultFlushDelta),
+		getConfigDuration(plugin, logger, "flush_hard_delta_warn", defaultFlushDelta),
+		getConfigDuration(plugin, logger, "flush_hard_delta_error", defaultFlushDelta),
+		getConfigDuration(plugin, logger, "flush_hard_delta_fatal", defaultFlushDelta),
 	}
 	softDeltas := []time.Duration{
-		getConfigDuration(plugin, "flush_soft_delta_debug", defaultFlushDelta),
-		getConfigDuration(plugin, "flush_soft_delta_info", defaultFlushDelta),
-		getConfigDuration(plugin, "flush_soft_delta_warn", defaultFlushDelta),
-		getConfigDuration(plugin, "flush_soft_delta_error", defaultFlushDelta),
-		getConfigDuration(plugin, "flush_soft_delta_fatal", defaultFlushDelta),
+		getConfigDuration(plugin, logger, "flush_soft_delta_debug", defaultFlushDelta),
+		getConfigDuration(plugin, logger, "flush_soft_delta_info", defaultFlushDelta),
+		getConfigDuration(plugin, logger, "flush_soft_delta_warn", defaultFlushDelta),
+		getConfigDuration(plugin, logger, "flush_soft_delta_error", defaultFlushDelta),
+		getConfigDuration(plugin, logger, "flush_soft_delta_fatal", defaultFlushDelta),
 	}
 
-	return &PluginContext{
-		S3: &s3Context{
-			Client: client,
-			Bucket: bucket,
-		},
-		Ingestion: make(map[string]*IngestionContext),
+	retry := &RetryConfig{
+		InitialBackoff: getConfigDuration(
+			plugin,
+			logger,
+			"retry_initial_backoff",
+			defaultRetryInitialBackoff,
+		),
+		MaxBackoff:  getConfigDuration(plugin, logger, "retry_max_backoff", defaultRetryMaxBackoff),
+		MaxAttempts: getConfigInt(plugin, logger, "retry_max_attempts", 0),
+		MaxAge:      getConfigDuration(plugin, logger, "retry_max_age", 0),
+	}
+	logger.Infof("Failed uploads are retried with backoff %v to %v",
+		retry.InitialBackoff, retry.MaxBackoff)
+
+	bufferDir := getConfigWithDefault(
+		plugin,
+		"disk_buffer_path",
+		filepath.Join(os.TempDir(), defaultBufferDirName),
+	)
+	logger.Infof("Buffer files are stored in %q", bufferDir)
+
+	rotation := &RotationConfig{
+		MaxSize:  getConfigSize(plugin, logger, "rotate_max_size", 0),
+		MaxAge:   getConfigDuration(plugin, logger, "rotate_max_age", 0),
+		Interval: getConfigDuration(plugin, logger, "rotate_interval", 0),
+	}
+	if rotation.Enabled() {
+		logger.Infof("Objects rotate at size %d, age %v, interval %v",
+			rotation.MaxSize, rotation.MaxAge, rotation.Interval)
+	}
+
+	syncMode := getConfigWithDefault(plugin, "sync_mode", SyncModeFull)
+	switch syncMode {
+	case SyncModeFull, SyncModeSegments:
+	case SyncModeAppend:
+		if _, ok := store.(objstore.Appender); !ok {
+			err := fmt.Errorf("sync_mode %q is not supported by destination %s",
+				syncMode, store.URI(""))
+			logger.Errorf("%v", err)
+			return nil, err
+		}
+	default:
+		err := fmt.Errorf("invalid sync_mode %q: must be %q, %q or %q",
+			syncMode, SyncModeFull, SyncModeSegments, SyncModeAppend)
+		logger.Errorf("%v", err)
+		return nil, err
+	}
+	logger.Infof("Sync mode is configured to: %q", syncMode)
+
+	deadLetterPrefix := output.FLBPluginConfigKey(plugin, "dead_letter_prefix")
+	if deadLetterPrefix != "" {
+		logger.Infof("Chunks with malformed records are uploaded under %q", deadLetterPrefix)
+	}
+
+	eviction := &EvictionConfig{
+		IdleTimeout:    getConfigDuration(plugin, logger, "idle_timeout", 0),
+		MaxOpenStreams: getConfigInt(plugin, logger, "max_open_streams", 0),
+	}
+	if eviction.Enabled() {
+		logger.Infof("Streams are evicted after %v idle or above %d open streams",
+			eviction.IdleTimeout, eviction.MaxOpenStreams)
+	}
+	storageClasses, err := newStorageClassConfig(plugin)
+	if err != nil {
+		logger.Errorf("Invalid storage class: %v", err)
+		return nil, err
+	}
+	if storageClasses.Enabled() {
+		logger.Infof("Storage classes by log level are configured to: %q",
+			storageClasses.ByLevel)
+	}
+
+	checksumAlgorithm, err := objstore.ParseChecksumAlgorithm(
+		getConfigWithDefault(plugin, "checksum", defaultChecksum),
+	)
+	if err != nil {
+		logger.Errorf("Invalid checksum: %v", err)
+		return nil, err
+	}
+	verifyUploads := false
+	if rawValue := output.FLBPluginConfigKey(plugin, "verify_uploads"); rawValue != "" {
+		verifyUploads, err = strconv.ParseBool(rawValue)
+		if err != nil {
+			err = fmt.Errorf("invalid verify_uploads %q: %w", rawValue, err)
+			logger.Errorf("%v", err)
+			return nil, err
+		}
+	}
+	if checksumAlgorithm != "" || verifyUploads {
+		logger.Infof("Uploads are checksummed with %q, verified after upload: %v",
+			checksumAlgorithm, verifyUploads)
+	}
+
+	writeIndex := false
+	if rawValue := output.FLBPluginConfigKey(plugin, "write_index"); rawValue != "" {
+		writeIndex, err = strconv.ParseBool(rawValue)
+		if err != nil {
+			err = fmt.Errorf("invalid write_index %q: %w", rawValue, err)
+			logger.Errorf("%v", err)
+			return nil, err
+		}
+	}
+	indexBloomSize := getConfigSize(plugin, logger, "index_bloom_size", objindex.DefaultBloomSize)
+	if indexBloomSize <= 0 || indexBloomSize > maxIndexBloomSize {
+		err = fmt.Errorf("invalid index_bloom_size %d, must be in (0, %d]",
+			indexBloomSize, maxIndexBloomSize)
+		logger.Errorf("%v", err)
+		return nil, err
+	}
+	if writeIndex {
+		logger.Infof("Objects are indexed with a %d byte Bloom filter", indexBloomSize)
+	}
+
+	if keyFormat != nil && !keyFormat.UsesIndex() && (rotation.Enabled() || eviction.Enabled()) {
+		logger.Warnf("s3_key_format does not use $INDEX; objects of a stream may overwrite " +
+			"each other after rotation or eviction")
+	}
+
+	pluginCtx := &PluginContext{
+		Store:     store,
+		Ingestion: newIngestionRegistry(),
+		StreamKey: streamKey,
+		KeyFormat: keyFormat,
+		Hostname:  hostname,
+		ID:        output.FLBPluginConfigKey(plugin, "id"),
+		Tags:      tags,
 		FlushConfig: &FlushConfigContext{
 			LogLevelKey:     logLevelKey,
 			defaultLogLevel: 0, // Default to debug level
 			hardDeltas:      hardDeltas,
 			softDeltas:      softDeltas,
+			retry:           retry,
 		},
-	}, nil
+		BufferDir:         bufferDir,
+		Rotation:          rotation,
+		SyncMode:          syncMode,
+		DeadLetterPrefix:  deadLetterPrefix,
+		Eviction:          eviction,
+		StorageClasses:    storageClasses,
+		ChecksumAlgorithm: checksumAlgorithm,
+		VerifyUploads:     verifyUploads,
+		WriteIndex:        writeIndex,
+		IndexBloomSize:    int(indexBloomSize),
+		Log:               logger,
+	}
+
+	// Upload anything left behind by a previous crash before new buffers are created. Streams
+	// which fail to recover are logged and skipped.
+	if err := RecoverBufferDir(pluginCtx); err != nil {
+		logger.Errorf("Failed to recover buffer files: %v", err)
+		return nil, err
+	}
+
+	if metricsListen := output.FLBPluginConfigKey(plugin, "metrics_listen"); metricsListen != "" {
+		pluginCtx.Metrics, err = metrics.Serve(metricsListen)
+		if err != nil {
+			logger.Errorf("%v", err)
+			return nil, err
+		}
+	}
+
+	// Started after recovery so admin requests only see streams of this run
+	if adminListen := output.FLBPluginConfigKey(plugin, "admin_listen"); adminListen != "" {
+		pluginCtx.Admin, err = admin.Serve(adminListen, pluginCtx, logger)
+		if err != nil {
+			logger.Errorf("%v", err)
+			if pluginCtx.Metrics != nil {
+				_ = pluginCtx.Metrics.Close()
+			}
+			return nil, err
+		}
+	}
+
+	pluginCtx.startJanitor()
+	return pluginCtx, nil
+}
+
+// newLogger creates the logger of the plugin instance from log_level, log_format and
+// log_repeat_interval. The logger, without the instance's id, also becomes the default logger of
+// messages not tied to an instance.
+func newLogger(plugin unsafe.Pointer) (*logging.Logger, error) {
+	level, err := logging.ParseLevel(getConfigWithDefault(plugin, "log_level", "info"))
+	if err != nil {
+		return nil, err
+	}
+	format := getConfigWithDefault(plugin, "log_format", logging.FormatText)
+	if err := logging.ValidateFormat(format); err != nil {
+		return nil, err
+	}
+	repeatInterval := logging.DefaultRepeatInterval
+	if rawValue := output.FLBPluginConfigKey(plugin, "log_repeat_interval"); rawValue != "" {
+		repeatInterval, err = time.ParseDuration(rawValue)
+		if err != nil || repeatInterval < 0 {
+			return nil, fmt.Errorf("invalid log_repeat_interval %q", rawValue)
+		}
+	}
+
+	logger := logging.New(os.Stderr, logging.Config{
+		Level:          level,
+		Format:         format,
+		RepeatInterval: repeatInterval,
+	})
+	logging.SetDefault(logger)
+	if id := output.FLBPluginConfigKey(plugin, "id"); id != "" {
+		logger = logger.With("id", id)
+	}
+	return logger, nil
 }
 
 // getConfigDuration reads a duration configuration value with a default fallback.
-func getConfigDuration(plugin unsafe.Pointer, key string, defaultVal time.Duration) time.Duration {
+func getConfigDuration(
+	plugin unsafe.Pointer,
+	logger *logging.Logger,
+	key string,
+	defaultVal time.Duration,
+) time.Duration {
 	rawValue := output.FLBPluginConfigKey(plugin, key)
 	if rawValue == "" {
 		return defaultVal
@@ -193,13 +593,50 @@ func getConfigDuration(plugin unsafe.Pointer, key string, defaultVal time.Durati
 
 	duration, err := time.ParseDuration(rawValue)
 	if err != nil {
-		log.Printf("[warn] Failed to parse duration for %q (%q): %v; using default %v",
+		logger.Warnf("Failed to parse duration for %q (%q): %v; using default %v",
 			key, rawValue, err, defaultVal)
 		return defaultVal
 	}
 	return duration
 }
 
+// getConfigInt reads a non-negative integer configuration value with a default fallback.
+func getConfigInt(plugin unsafe.Pointer, logger *logging.Logger, key string, defaultVal int) int {
+	rawValue := output.FLBPluginConfigKey(plugin, key)
+	if rawValue == "" {
+		return defaultVal
+	}
+
+	value, err := strconv.Atoi(rawValue)
+	if err != nil || value < 0 {
+		logger.Warnf("Failed to parse non-negative integer for %q (%q); using default %v",
+			key, rawValue, defaultVal)
+		return defaultVal
+	}
+	return value
+}
+
+// getConfigSize reads a byte size configuration value (e.g. "64MB") with a default fallback.
+func getConfigSize(
+	plugin unsafe.Pointer,
+	logger *logging.Logger,
+	key string,
+	defaultVal int64,
+) int64 {
+	rawValue := output.FLBPluginConfigKey(plugin, key)
+	if rawValue == "" {
+		return defaultVal
+	}
+
+	size, err := parseSize(rawValue)
+	if err != nil {
+		logger.Warnf("Failed to parse size for %q (%q): %v; using default %v",
+			key, rawValue, err, defaultVal)
+		return defaultVal
+	}
+	return size
+}
+
 // getConfigWithDefault reads a string configuration value with a default fallback.
 func getConfigWithDefault(plugin unsafe.Pointer, key, defaultVal string) string {
 	val := output.FLBPluginConfigKey(plugin, key)
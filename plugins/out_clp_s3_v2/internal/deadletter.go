@@ -0,0 +1,31 @@
+package internal
+
+import (
+	"fmt"
+	"path"
+	"time"
+)
+
+// deadLetterContentType is the content type of dead-letter objects, which hold raw Fluent Bit
+// chunks.
+const deadLetterContentType = "application/msgpack"
+
+// DeadLetter uploads a Fluent Bit chunk containing records that could not be ingested to
+// "<dead_letter_prefix>/<tag>/<unix nanoseconds>.msgpack".
+//
+// The whole chunk is stored as received (Msgpack) since a malformed record may leave the rest of
+// the chunk undecodable. Records of the chunk that were ingested are included as well, so
+// replaying a dead-letter object duplicates them.
+//
+// Does nothing if no dead-letter prefix is configured.
+func DeadLetter(pluginCtx *PluginContext, tag string, chunk []byte, now time.Time) error {
+	if pluginCtx.DeadLetterPrefix == "" {
+		return nil
+	}
+
+	key := path.Join(pluginCtx.DeadLetterPrefix, tag, fmt.Sprintf("%d.msgpack", now.UnixNano()))
+	if err := pluginCtx.putBytes(key, chunk, deadLetterContentType); err != nil {
+		return fmt.Errorf("failed to upload dead-letter chunk: %w", err)
+	}
+	return nil
+}
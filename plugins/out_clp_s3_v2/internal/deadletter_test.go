@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDeadLetter(t *testing.T) {
+	pluginCtx, store := newTestPluginContext(t)
+	chunk := []byte{0x92, 0xc1}
+	now := time.Unix(1700000000, 42)
+
+	// Without a prefix, malformed chunks are dropped
+	if err := DeadLetter(pluginCtx, "app", chunk, now); err != nil {
+		t.Fatalf("DeadLetter() error = %v", err)
+	}
+	if keys := store.Keys(); len(keys) != 0 {
+		t.Fatalf("DeadLetter() without prefix uploaded %v", keys)
+	}
+
+	pluginCtx.DeadLetterPrefix = "dead-letter/"
+	if err := DeadLetter(pluginCtx, "kube.app", chunk, now); err != nil {
+		t.Fatalf("DeadLetter() error = %v", err)
+	}
+	key := "dead-letter/kube.app/1700000000000000042.msgpack"
+	object, ok := store.Get(key)
+	if !ok {
+		t.Fatalf("dead-letter object %q not uploaded, got keys %v", key, store.Keys())
+	}
+	if !bytes.Equal(object.Data, chunk) {
+		t.Errorf("dead-letter object = %x, want the chunk %x", object.Data, chunk)
+	}
+	if object.Opts.ContentType != deadLetterContentType {
+		t.Errorf("content type = %q, want %q", object.Opts.ContentType, deadLetterContentType)
+	}
+
+	store.FailPuts(errors.New("unavailable"))
+	if err := DeadLetter(pluginCtx, "kube.app", chunk, now.Add(time.Second)); err == nil {
+		t.Error("DeadLetter() error = nil, want upload error")
+	}
+}
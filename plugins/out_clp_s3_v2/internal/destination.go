@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"unsafe"
+
+	"github.com/fluent/fluent-bit-go/output"
+
+	"github.com/y-scope/fluent-bit-clp/internal/logging"
+	"github.com/y-scope/fluent-bit-clp/internal/objstore"
+)
+
+// newObjectStore creates the object store selected by the destination option.
+//
+// Configuration keys read from Fluent Bit:
+//   - destination: "s3", "gcs", "azure" or "file" (default: "s3")
+//   - log_bucket: Target bucket (container for "azure") name (required unless "file")
+//   - azure_account_url: Blob service URL, authenticated with Azure AD credentials
+//   - azure_connection_string: Connection string, used instead of azure_account_url
+//   - destination_path: Root directory of objects (required for "file")
+//   - Encryption and storage class of S3 objects (see s3Options)
+//
+// Returns an error if the destination is unknown, if it cannot be reached, or if options of
+// another destination are set.
+func newObjectStore(plugin unsafe.Pointer, logger *logging.Logger) (objstore.ObjectStore, error) {
+	destination := getConfigWithDefault(plugin, "destination", objstore.DestinationS3)
+	if destination != objstore.DestinationS3 {
+		if err := checkS3OnlyOptions(plugin, destination); err != nil {
+			return nil, err
+		}
+	}
+
+	switch destination {
+	case objstore.DestinationS3:
+		opts, err := s3Options(plugin)
+		if err != nil {
+			return nil, err
+		}
+		client, err := S3CreateClient()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create S3 client: %w", err)
+		}
+		bucket := output.FLBPluginConfigKey(plugin, "log_bucket")
+		if err := S3ValidateLogBucket(client, bucket); err != nil {
+			return nil, fmt.Errorf("failed to validate log bucket %q: %w", bucket, err)
+		}
+		logger.Infof("Logs are configured to be uploaded to s3://%s", bucket)
+		return objstore.NewS3Store(client, bucket, opts)
+	case objstore.DestinationGCS:
+		bucket := output.FLBPluginConfigKey(plugin, "log_bucket")
+		store, err := objstore.OpenGCSStore(context.TODO(), bucket)
+		if err != nil {
+			return nil, err
+		}
+		logger.Infof("Logs are configured to be uploaded to gs://%s", bucket)
+		return store, nil
+	case objstore.DestinationAzure:
+		store, err := objstore.OpenAzureStore(context.TODO(), objstore.AzureOptions{
+			ConnectionString: output.FLBPluginConfigKey(plugin, "azure_connection_string"),
+			AccountURL:       output.FLBPluginConfigKey(plugin, "azure_account_url"),
+			Container:        output.FLBPluginConfigKey(plugin, "log_bucket"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		logger.Infof("Logs are configured to be uploaded to %s", store.URI(""))
+		return store, nil
+	case objstore.DestinationFile:
+		root := output.FLBPluginConfigKey(plugin, "destination_path")
+		if root == "" {
+			return nil, fmt.Errorf("destination_path is required for destination %q",
+				objstore.DestinationFile)
+		}
+		store, err := objstore.NewFileStore(root)
+		if err != nil {
+			return nil, err
+		}
+		logger.Infof("Logs are configured to be written to %s", store.URI(""))
+		return store, nil
+	default:
+		return nil, fmt.Errorf("invalid destination %q: must be %q, %q, %q or %q",
+			destination,
+			objstore.DestinationS3,
+			objstore.DestinationGCS,
+			objstore.DestinationAzure,
+			objstore.DestinationFile,
+		)
+	}
+}
@@ -0,0 +1,23 @@
+package internal
+
+import (
+	"errors"
+	"syscall"
+)
+
+// ErrTransient marks failures that are expected to succeed when Fluent Bit retries the chunk, such
+// as a buffer file that could not be created.
+var ErrTransient = errors.New("transient failure")
+
+// errUploadsPaused is returned by syncs while uploads are paused through the admin API. The stream
+// stays dirty and is uploaded once uploads are resumed.
+var errUploadsPaused = errors.New("uploads are paused")
+
+// IsTransient reports whether err is expected to succeed when retried. Besides errors marked with
+// [ErrTransient], a full disk or exceeded disk quota is transient since space is freed as buffer
+// files are uploaded and removed.
+func IsTransient(err error) bool {
+	return errors.Is(err, ErrTransient) ||
+		errors.Is(err, syscall.ENOSPC) ||
+		errors.Is(err, syscall.EDQUOT)
+}
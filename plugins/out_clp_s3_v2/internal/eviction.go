@@ -0,0 +1,229 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Bounds of the interval at which the janitor checks streams.
+const (
+	// minJanitorInterval is the shortest interval at which the janitor checks streams.
+	minJanitorInterval = time.Second
+	// maxJanitorInterval is the longest interval at which the janitor checks streams.
+	maxJanitorInterval = time.Minute
+)
+
+// EvictionConfig stores the policies that close streams which are no longer written to.
+//
+// Every stream keeps a buffer file, its encoders and its flush timers open until it is evicted (or
+// the plugin exits), so tags that stop receiving records would otherwise accumulate forever. An
+// evicted stream is finalized exactly like a rotated object: its remaining data is uploaded, its
+// buffer file and manifest are removed and it is dropped from the registry. A record for the same
+// path later creates the stream anew, continuing in the object with the next sequence number.
+//
+// A zero value for a policy disables it; eviction is enabled if any policy is set.
+type EvictionConfig struct {
+	// IdleTimeout evicts a stream once no record has been written to it for this long.
+	IdleTimeout time.Duration
+	// MaxOpenStreams caps the number of open streams. When a new stream would exceed the cap, the
+	// least recently written stream is evicted first.
+	MaxOpenStreams int
+}
+
+// Enabled reports whether any eviction policy is set. A nil config disables eviction.
+func (c *EvictionConfig) Enabled() bool {
+	return c != nil && (c.IdleTimeout > 0 || c.MaxOpenStreams > 0)
+}
+
+// janitor periodically evicts streams that have been idle for longer than the idle timeout and
+// rotates objects that are due for age or interval rotation.
+//
+// Fluent Bit only calls the plugin when there are records to flush, so idle streams cannot be
+// detected, nor their objects rotated on time, from the flush path alone.
+type janitor struct {
+	// stop is closed to ask the janitor goroutine to exit.
+	stop chan struct{}
+	// done is closed once the janitor goroutine has exited.
+	done chan struct{}
+}
+
+// startJanitor starts the janitor if an idle timeout or a time-based rotation policy is
+// configured.
+//
+// Streams are checked every quarter of the shortest of the idle timeout, rotate_max_age and
+// rotate_interval, bounded to between once per second and once per minute. A stream is thus
+// evicted at most 25% later than its idle timeout, and an object rotated at most a minute late.
+func (ctx *PluginContext) startJanitor() {
+	evictIdle := ctx.Eviction != nil && ctx.Eviction.IdleTimeout > 0
+	rotate := ctx.Rotation.timeBased()
+	if !evictIdle && !rotate {
+		return
+	}
+
+	var shortest time.Duration
+	for _, policy := range []time.Duration{
+		ctx.idleTimeout(),
+		ctx.Rotation.maxAge(),
+		ctx.Rotation.interval(),
+	} {
+		if policy > 0 && (shortest == 0 || policy < shortest) {
+			shortest = policy
+		}
+	}
+	interval := min(max(shortest/4, minJanitorInterval), maxJanitorInterval)
+	j := &janitor{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	ctx.janitor = j
+
+	go func() {
+		defer close(j.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-j.stop:
+				return
+			case now := <-ticker.C:
+				if evictIdle {
+					ctx.evictIdleStreams(now)
+				}
+				if rotate {
+					ctx.rotateDueStreams(now)
+				}
+			}
+		}
+	}()
+}
+
+// StopJanitor stops the janitor and waits for an eviction or rotation in progress to complete.
+// Safe to call if the janitor was never started.
+func (ctx *PluginContext) StopJanitor() {
+	if ctx.janitor == nil {
+		return
+	}
+	close(ctx.janitor.stop)
+	<-ctx.janitor.done
+	ctx.janitor = nil
+}
+
+// evictIdleStreams evicts every stream that has not been written to since IdleTimeout before now,
+// except streams pinned by a batch in progress. Nothing is evicted while uploads are paused
+// through the admin API.
+func (ctx *PluginContext) evictIdleStreams(now time.Time) {
+	if ctx.UploadsPaused() {
+		return
+	}
+	for _, ingestionCtx := range ctx.Ingestion.Snapshot() {
+		idle := now.Sub(ingestionCtx.LastWrite())
+		if idle < ctx.Eviction.IdleTimeout {
+			continue
+		}
+		if evicted, _ := ctx.evict(ingestionCtx); evicted {
+			ingestionCtx.log.Infof("Evicted stream after %v without records",
+				idle.Truncate(time.Second))
+		}
+	}
+}
+
+// idleTimeout returns the idle timeout, or zero if idle streams are not evicted.
+func (ctx *PluginContext) idleTimeout() time.Duration {
+	if ctx.Eviction == nil {
+		return 0
+	}
+	return ctx.Eviction.IdleTimeout
+}
+
+// rotateDueStreams rotates the objects of streams which are due for rotation (see
+// RotateIfNeeded), so age and interval rotation also apply to streams that stopped receiving
+// records.
+func (ctx *PluginContext) rotateDueStreams(now time.Time) {
+	for _, ingestionCtx := range ctx.Ingestion.Snapshot() {
+		if err := ingestionCtx.RotateIfNeeded(ctx, now); err != nil {
+			ingestionCtx.log.Errorf("Failed to rotate stream: %v", err)
+		}
+	}
+}
+
+// evictLeastRecentlyUsed evicts the least recently written streams until room more streams fit
+// within MaxOpenStreams.
+//
+// Streams pinned by a batch in progress are not evicted, so a chunk with more streams than
+// MaxOpenStreams briefly exceeds the cap instead of evicting its own streams before writing to
+// them; the excess is evicted once the batch is released (see [Batch.Release]). Streams whose
+// failed uploads are being retried are not evicted either, since their final upload would most
+// likely fail too and leave their data on disk until the next startup.
+//
+// Returns an error marked with [ErrTransient] if a final upload fails, or if the cap cannot be
+// restored because streams are being retried, so the caller does not open another stream.
+//
+// The cap is soft: concurrent flushes for new paths may each evict a stream and then all open
+// their stream, briefly exceeding the cap. It is not enforced while uploads are paused.
+func (ctx *PluginContext) evictLeastRecentlyUsed(room int) error {
+	if ctx.Eviction == nil || ctx.Eviction.MaxOpenStreams <= 0 || ctx.UploadsPaused() {
+		return nil
+	}
+
+	streams := ctx.Ingestion.Snapshot()
+	excess := len(streams) + room - ctx.Eviction.MaxOpenStreams
+	if excess <= 0 {
+		return nil
+	}
+
+	victims := make([]*IngestionContext, 0, len(streams))
+	var retrying int
+	for _, ingestionCtx := range streams {
+		switch {
+		case ingestionCtx.pinned():
+		case ingestionCtx.Flush.Retrying():
+			retrying++
+		default:
+			victims = append(victims, ingestionCtx)
+		}
+	}
+	slices.SortFunc(victims, func(a, b *IngestionContext) int {
+		return a.LastWrite().Compare(b.LastWrite())
+	})
+	for _, victim := range victims {
+		if excess == 0 {
+			return nil
+		}
+		// The stream may have been pinned or removed since the snapshot
+		evicted, err := ctx.evict(victim)
+		if err != nil {
+			return fmt.Errorf("%w: failed to evict stream %q at max_open_streams=%d: %w",
+				ErrTransient, victim.path, ctx.Eviction.MaxOpenStreams, err)
+		}
+		if evicted {
+			victim.log.Infof("Evicted least recently written stream at max_open_streams=%d",
+				ctx.Eviction.MaxOpenStreams)
+			excess--
+		}
+	}
+	if excess > 0 && retrying > 0 {
+		return fmt.Errorf("%w: max_open_streams=%d reached while uploads of %d streams are "+
+			"being retried", ErrTransient, ctx.Eviction.MaxOpenStreams, retrying)
+	}
+	return nil
+}
+
+// evict closes a stream and uploads its remaining data. Returns false, leaving the stream open, if
+// it is pinned by a batch in progress or has already been unregistered.
+//
+// The stream is unregistered first so that new records for its path open a new stream rather
+// than being written to the closing one. If the final upload fails, the finalized buffer is left
+// for recovery on the next startup and the failure is returned; the stream is evicted either way.
+func (ctx *PluginContext) evict(ingestionCtx *IngestionContext) (bool, error) {
+	if !ctx.Ingestion.removeUnpinned(ingestionCtx.path, ingestionCtx) {
+		return false, nil
+	}
+	ingestionCtx.Flush.Stop()
+	if err := ingestionCtx.Finalize(ctx); err != nil {
+		ingestionCtx.log.Errorf("Failed to finalize evicted stream; it will be recovered on "+
+			"restart: %v", err)
+		return true, err
+	}
+	return true, nil
+}
@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEvictionConfig_Enabled(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *EvictionConfig
+		want   bool
+	}{
+		{"nil", nil, false},
+		{"zero", &EvictionConfig{}, false},
+		{"idle timeout", &EvictionConfig{IdleTimeout: time.Minute}, true},
+		{"max open streams", &EvictionConfig{MaxOpenStreams: 10}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.Enabled(); got != tt.want {
+				t.Errorf("Enabled() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPluginContext_EvictIdleStreams(t *testing.T) {
+	pluginCtx, store := newTestPluginContext(t)
+	pluginCtx.Eviction = &EvictionConfig{IdleTimeout: time.Minute}
+
+	idle, err := GetOrCreateIngestionContext(pluginCtx, "idle")
+	if err != nil {
+		t.Fatalf("GetOrCreateIngestionContext() error = %v", err)
+	}
+	active, err := GetOrCreateIngestionContext(pluginCtx, "active")
+	if err != nil {
+		t.Fatalf("GetOrCreateIngestionContext() error = %v", err)
+	}
+	if err := idle.WriteLogEvent(newTestLogEvent(0, 0), time.Time{}, 0); err != nil {
+		t.Fatalf("WriteLogEvent() error = %v", err)
+	}
+
+	now := time.Now()
+	idle.touch(now.Add(-2 * time.Minute))
+	active.touch(now)
+	pluginCtx.evictIdleStreams(now)
+
+	if _, exists := pluginCtx.Ingestion.get("idle"); exists {
+		t.Error("idle stream should be evicted")
+	}
+	if _, exists := pluginCtx.Ingestion.get("active"); !exists {
+		t.Error("active stream should not be evicted")
+	}
+	if object, _ := store.Get("idle.0.clp.zst"); len(object.Data) == 0 {
+		t.Error("evicted stream should be uploaded to its sequenced key")
+	}
+	if _, err := os.Stat(idle.Compression.File.Name()); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("evicted stream's buffer file should be removed, stat error = %v", err)
+	}
+
+	// A new record for the evicted path continues in the next object
+	reopened, err := GetOrCreateIngestionContext(pluginCtx, "idle")
+	if err != nil {
+		t.Fatalf("GetOrCreateIngestionContext() error = %v", err)
+	}
+	if reopened == idle {
+		t.Error("evicted stream should be replaced by a new stream")
+	}
+	if got, want := reopened.manifest.RemoteKey, "idle.1.clp.zst"; got != want {
+		t.Errorf("reopened stream key = %q, want %q", got, want)
+	}
+
+	for _, ingestionCtx := range pluginCtx.Ingestion.Snapshot() {
+		ingestionCtx.Flush.Stop()
+	}
+}
+
+func TestGetOrCreateIngestionContext_EvictsLeastRecentlyUsed(t *testing.T) {
+	pluginCtx, _ := newTestPluginContext(t)
+	pluginCtx.Eviction = &EvictionConfig{MaxOpenStreams: 2}
+
+	now := time.Now()
+	for i, path := range []string{"a", "b"} {
+		ingestionCtx, err := GetOrCreateIngestionContext(pluginCtx, path)
+		if err != nil {
+			t.Fatalf("GetOrCreateIngestionContext(%q) error = %v", path, err)
+		}
+		ingestionCtx.touch(now.Add(time.Duration(i-2) * time.Second))
+	}
+
+	// Retrieving an existing stream at the cap evicts nothing
+	if _, err := GetOrCreateIngestionContext(pluginCtx, "a"); err != nil {
+		t.Fatalf("GetOrCreateIngestionContext() error = %v", err)
+	}
+	if got := len(pluginCtx.Ingestion.Snapshot()); got != 2 {
+		t.Fatalf("got %d open streams, want 2", got)
+	}
+
+	// "a" was just retrieved, so "b" is now the least recently used
+	if _, err := GetOrCreateIngestionContext(pluginCtx, "c"); err != nil {
+		t.Fatalf("GetOrCreateIngestionContext() error = %v", err)
+	}
+	streams := pluginCtx.Ingestion.Snapshot()
+	if len(streams) != 2 {
+		t.Errorf("got %d open streams, want 2", len(streams))
+	}
+	if _, exists := streams["b"]; exists {
+		t.Error("least recently used stream should be evicted")
+	}
+
+	for _, ingestionCtx := range streams {
+		ingestionCtx.Flush.Stop()
+	}
+}
+
+func TestGetOrCreateIngestionContext_SkipsRetryingStreams(t *testing.T) {
+	pluginCtx, store := newTestPluginContext(t)
+	pluginCtx.Eviction = &EvictionConfig{MaxOpenStreams: 1}
+	pluginCtx.FlushConfig.retry = &RetryConfig{InitialBackoff: time.Hour, MaxBackoff: time.Hour}
+
+	failing, err := GetOrCreateIngestionContext(pluginCtx, "failing")
+	if err != nil {
+		t.Fatalf("GetOrCreateIngestionContext() error = %v", err)
+	}
+	defer failing.Flush.Stop()
+	store.FailPuts(errors.New("unavailable"))
+	if err := failing.Flush.UploadNow(); err == nil {
+		t.Fatal("UploadNow() error = nil, want error")
+	}
+	store.FailPuts(nil)
+
+	// The only open stream is being retried, so no stream is opened over the cap
+	if _, err := GetOrCreateIngestionContext(pluginCtx, "new"); !IsTransient(err) {
+		t.Fatalf("GetOrCreateIngestionContext() error = %v, want transient error", err)
+	}
+	streams := pluginCtx.Ingestion.Snapshot()
+	if _, exists := streams["failing"]; !exists || len(streams) != 1 {
+		t.Fatalf("open streams = %v, want only the retried stream", streams)
+	}
+
+	// Once the retry succeeds, the stream is evicted for the new one
+	if err := failing.Flush.UploadNow(); err != nil {
+		t.Fatalf("UploadNow() error = %v", err)
+	}
+	created, err := GetOrCreateIngestionContext(pluginCtx, "new")
+	if err != nil {
+		t.Fatalf("GetOrCreateIngestionContext() error = %v", err)
+	}
+	created.Flush.Stop()
+	if streams := pluginCtx.Ingestion.Snapshot(); len(streams) != 1 {
+		t.Errorf("got %d open streams, want 1", len(streams))
+	}
+}
+
+func TestPluginContext_StopJanitor(t *testing.T) {
+	pluginCtx, _ := newTestPluginContext(t)
+
+	// Safe without a janitor
+	pluginCtx.StopJanitor()
+
+	pluginCtx.Eviction = &EvictionConfig{IdleTimeout: time.Hour}
+	pluginCtx.startJanitor()
+	if pluginCtx.janitor == nil {
+		t.Fatal("janitor should start with an idle timeout")
+	}
+	pluginCtx.StopJanitor()
+	if pluginCtx.janitor != nil {
+		t.Error("janitor should be cleared once stopped")
+	}
+
+	pluginCtx.Eviction = nil
+	pluginCtx.Rotation = &RotationConfig{MaxSize: 1 << 20}
+	pluginCtx.startJanitor()
+	if pluginCtx.janitor != nil {
+		t.Error("janitor should not start with size rotation only")
+	}
+	pluginCtx.Rotation = &RotationConfig{Interval: time.Hour}
+	pluginCtx.startJanitor()
+	if pluginCtx.janitor == nil {
+		t.Fatal("janitor should start with interval rotation")
+	}
+	pluginCtx.StopJanitor()
+}
@@ -1,9 +1,13 @@
 package internal
 
 import (
-	"log"
+	"errors"
 	"math"
+	"math/rand/v2"
 	"time"
+
+	"github.com/y-scope/fluent-bit-clp/internal/logging"
+	"github.com/y-scope/fluent-bit-clp/internal/metrics"
 )
 
 /*
@@ -41,28 +45,97 @@ Higher severity logs (ERROR, FATAL) can have shorter deltas, meaning:
   - An ERROR log triggers faster sync of the ENTIRE log file
   - This ensures critical logs reach S3 quickly for investigation
   - Lower severity logs (DEBUG, INFO) can have longer deltas to reduce costs
+
+Retries
+
+Both timers are cleared when they fire, so a failed upload would otherwise only be retried once
+another log arrives and re-arms them; the last sync of an idle stream would never happen. Instead,
+a failed upload schedules a RETRY TIMER with exponential backoff and jitter. The stream stays
+"dirty" (holding data not yet synced) until an upload succeeds. If the retry policy gives up, the
+data remains in the buffer file and is uploaded by the next sync, on shutdown, or by recovery.
 */
 
+// Retry policy defaults.
+const (
+	// defaultRetryInitialBackoff is the delay before the first retry of a failed upload.
+	defaultRetryInitialBackoff = time.Second
+	// defaultRetryMaxBackoff caps the delay between retries.
+	defaultRetryMaxBackoff = 5 * time.Minute
+)
+
+// RetryConfig stores the retry policy for failed timer-driven uploads.
+//
+// The delay before retry n (starting at 1) is InitialBackoff * 2^(n-1), capped at MaxBackoff, with
+// jitter spreading it over [delay/2, delay) so streams that failed together do not retry together.
+type RetryConfig struct {
+	// InitialBackoff is the delay before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between retries.
+	MaxBackoff time.Duration
+	// MaxAttempts stops retrying after this many consecutive failures. Zero retries indefinitely.
+	MaxAttempts int
+	// MaxAge stops retrying once uploads have been failing for this long. Zero retries
+	// indefinitely.
+	MaxAge time.Duration
+}
+
+// backoff returns the jittered delay before the given retry attempt (starting at 1).
+func (c *RetryConfig) backoff(attempt int) time.Duration {
+	delay := c.MaxBackoff
+	// Shifting by 62 or more would overflow; the cap applies long before that.
+	if shift := attempt - 1; shift < 62 {
+		if d := c.InitialBackoff << shift; d > 0 && d < c.MaxBackoff {
+			delay = d
+		}
+	}
+	if delay <= 1 {
+		return delay
+	}
+
+	half := delay / 2
+	// #nosec G404 -- jitter does not need a cryptographically secure source
+	return half + time.Duration(rand.Int64N(int64(delay-half)))
+}
+
+// exhausted reports whether retrying should stop after attempts consecutive failures, the first
+// of which happened at firstFailure.
+func (c *RetryConfig) exhausted(attempts int, firstFailure, now time.Time) bool {
+	if c.MaxAttempts > 0 && attempts >= c.MaxAttempts {
+		return true
+	}
+	return c.MaxAge > 0 && now.Sub(firstFailure) >= c.MaxAge
+}
+
 // FlushManager defines the interface for updating flush timing based on log events.
 type FlushManager interface {
 	// Update recalculates flush timers based on a new log event's level and timestamp.
 	Update(level int, timestamp time.Time, flushConfig *FlushConfigContext)
 }
 
-// Callback is invoked when either the hard or soft timer fires.
+// Callback is invoked when the hard, soft or retry timer fires. It runs UploadNow, which logs and
+// retries failed uploads itself.
+func (m *flushContext) Callback() {
+	_ = m.UploadNow()
+}
+
+// UploadNow uploads the stream immediately, e.g. when a timer fires or on request of the admin API.
 //
 // This method:
 //  1. Acquires the mutex to prevent concurrent timer modifications
-//  2. Stops and clears both timers (prevents double-firing)
+//  2. Stops and clears all timers (prevents double-firing)
 //  3. Resets state for the next batch of logs
 //  4. Invokes the user callback (S3 upload)
+//  5. On success, marks the stream clean; on failure, schedules a retry (see retryLater)
 //
-// After Callback completes, the flushContext is ready for new log events.
-func (m *flushContext) Callback() {
+// While uploads are paused the user callback returns [errUploadsPaused]; the stream then stays
+// dirty without scheduling a retry, and is uploaded once uploads are resumed.
+//
+// After UploadNow completes, the flushContext is ready for new log events.
+func (m *flushContext) UploadNow() error {
 	m.Mutex.Lock()
 	defer m.Mutex.Unlock()
 
-	// Stop both timers to prevent double-firing
+	// Stop all timers to prevent double-firing
 	m.stopAndClearTimers()
 
 	// Reset state for next batch
@@ -70,7 +143,81 @@ func (m *flushContext) Callback() {
 	m.softDelta = time.Duration(math.MaxInt64)
 
 	// Trigger the upload
-	m.userCallback()
+	if err := m.userCallback(); err != nil {
+		if !errors.Is(err, errUploadsPaused) {
+			m.retryLater(err, time.Now())
+		}
+		return err
+	}
+
+	m.dirty = false
+	m.attempts = 0
+	m.firstFailure = time.Time{}
+	return nil
+}
+
+// fire returns the function run when the given timer fires, which counts the fire by timer
+// (hard, soft or retry) before invoking Callback.
+func (m *flushContext) fire(timer string) func() {
+	return func() {
+		metrics.FlushTimerFires.Inc(m.path, timer)
+		m.Callback()
+	}
+}
+
+// retryLater records a failed upload and schedules the retry timer, unless the retry policy is
+// exhausted. The stream stays dirty either way; the data is kept in the buffer file.
+func (m *flushContext) retryLater(err error, now time.Time) {
+	if m.attempts == 0 {
+		m.firstFailure = now
+	}
+	m.attempts++
+
+	if m.retry == nil || m.retry.exhausted(m.attempts, m.firstFailure, now) {
+		m.log.Errorf(
+			"Upload failed %d times since %v; giving up until new logs arrive or "+
+				"shutdown: %v",
+			m.attempts, m.firstFailure.Format(time.RFC3339), err,
+		)
+		m.attempts = 0
+		m.firstFailure = time.Time{}
+		return
+	}
+
+	delay := m.retry.backoff(m.attempts)
+	m.log.Warnf("Upload failed (attempt %d); retrying in %v: %v", m.attempts, delay, err)
+	replaceTimer(&m.RetryTimer, delay, m.fire(metrics.TimerRetry))
+	m.retryAt = now.Add(delay)
+}
+
+// Stop stops and clears all timers so no further uploads are triggered, e.g. before the stream
+// is finalized.
+func (m *flushContext) Stop() {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+	m.stopAndClearTimers()
+}
+
+// Dirty reports whether the stream holds data that has not been synced successfully.
+func (m *flushContext) Dirty() bool {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+	return m.dirty
+}
+
+// Retrying reports whether a failed upload is scheduled to be retried.
+func (m *flushContext) Retrying() bool {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+	return !m.retryAt.IsZero()
+}
+
+// Deadlines returns when the hard, soft and retry timers fire. Each is zero if the timer is not
+// scheduled.
+func (m *flushContext) Deadlines() (hard, soft, retry time.Time) {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+	return m.hardTimeout, m.softTimeout, m.retryAt
 }
 
 // Update adjusts the hard and soft timers based on a new log event.
@@ -92,6 +239,8 @@ func (m *flushContext) Update(level int, timestamp time.Time, flushConfig *Flush
 	m.Mutex.Lock()
 	defer m.Mutex.Unlock()
 
+	m.dirty = true
+
 	// Calculate and potentially update hard timer
 	hardDelta := getDeltaSafe(level, flushConfig.hardDeltas, flushConfig.defaultLogLevel, "hard")
 	nextHardTimeout := timestamp.Add(hardDelta)
@@ -100,7 +249,7 @@ func (m *flushContext) Update(level int, timestamp time.Time, flushConfig *Flush
 	// 1. No hard timeout is set yet (zero value), OR
 	// 2. New timeout is earlier than current (higher severity log arrived)
 	if m.hardTimeout.IsZero() || nextHardTimeout.Before(m.hardTimeout) {
-		replaceTimer(&m.HardTimer, time.Until(nextHardTimeout), m.Callback)
+		replaceTimer(&m.HardTimer, time.Until(nextHardTimeout), m.fire(metrics.TimerHard))
 		m.hardTimeout = nextHardTimeout
 	}
 
@@ -112,7 +261,8 @@ func (m *flushContext) Update(level int, timestamp time.Time, flushConfig *Flush
 
 	// Always reset soft timer on each event (inactivity detection)
 	nextSoftTimeout := timestamp.Add(m.softDelta)
-	replaceTimer(&m.SoftTimer, time.Until(nextSoftTimeout), m.Callback)
+	replaceTimer(&m.SoftTimer, time.Until(nextSoftTimeout), m.fire(metrics.TimerSoft))
+	m.softTimeout = nextSoftTimeout
 }
 
 // getDeltaSafe returns the flush delta for a log level, with fallback handling.
@@ -135,18 +285,21 @@ func getDeltaSafe(level int, deltas []time.Duration, defaultLevel int, label str
 		defaultDelta = deltas[defaultLevel]
 	}
 
-	log.Printf(
-		"[warn] No %s flush delta found for log level %v; defaulting to level %v (%v).",
+	logging.Default().Warnf(
+		"No %s flush delta found for log level %v; defaulting to level %v (%v).",
 		label, level, defaultLevel, defaultDelta,
 	)
 	return defaultDelta
 }
 
-// stopAndClearTimers stops both hard and soft timers and sets them to nil.
+// stopAndClearTimers stops the hard, soft and retry timers and sets them to nil.
 // Safe to call even if timers are already nil.
 func (m *flushContext) stopAndClearTimers() {
 	stopTimer(&m.HardTimer)
 	stopTimer(&m.SoftTimer)
+	stopTimer(&m.RetryTimer)
+	m.softTimeout = time.Time{}
+	m.retryAt = time.Time{}
 }
 
 // stopTimer safely stops a timer if it is not nil, then sets it to nil.
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"errors"
 	"sync"
 	"testing"
 	"time"
@@ -24,9 +25,10 @@ func TestFlushManager(t *testing.T) {
 	flushCtx := &flushContext{
 		HardTimer: time.NewTimer(0),
 		SoftTimer: time.NewTimer(0),
-		userCallback: func() {
+		userCallback: func() error {
 			t.Logf("flush occurred")
 			wg.Done()
+			return nil
 		},
 	}
 
@@ -206,10 +208,11 @@ func TestFlushContext_MultipleUpdates_PreservesEarlierHardTimeout(t *testing.T)
 	flushCtx := &flushContext{
 		HardTimer: time.NewTimer(0),
 		SoftTimer: time.NewTimer(0),
-		userCallback: func() {
+		userCallback: func() error {
 			mu.Lock()
 			callCount++
 			mu.Unlock()
+			return nil
 		},
 	}
 
@@ -242,8 +245,9 @@ func TestFlushContext_Update_SetsEarlierHardTimeout(t *testing.T) {
 	flushCtx := &flushContext{
 		HardTimer: time.NewTimer(0),
 		SoftTimer: time.NewTimer(0),
-		userCallback: func() {
+		userCallback: func() error {
 			// no-op
+			return nil
 		},
 	}
 
@@ -281,8 +285,9 @@ func TestFlushContext_Callback_ResetsState(t *testing.T) {
 	flushCtx := &flushContext{
 		HardTimer: time.NewTimer(time.Hour),
 		SoftTimer: time.NewTimer(time.Hour),
-		userCallback: func() {
+		userCallback: func() error {
 			callCount++
+			return nil
 		},
 		hardTimeout: time.Now().Add(time.Hour),
 		softDelta:   time.Minute,
@@ -303,3 +308,147 @@ func TestFlushContext_Callback_ResetsState(t *testing.T) {
 		t.Errorf("userCallback should have been called once, got %d", callCount)
 	}
 }
+
+func TestRetryConfig_Backoff(t *testing.T) {
+	retry := &RetryConfig{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{100, time.Second},
+	}
+
+	for _, tt := range tests {
+		for range 20 {
+			got := retry.backoff(tt.attempt)
+			if got < tt.max/2 || got >= tt.max {
+				t.Errorf("backoff(%d) = %v, want in [%v, %v)", tt.attempt, got, tt.max/2, tt.max)
+			}
+		}
+	}
+}
+
+func TestRetryConfig_Exhausted(t *testing.T) {
+	firstFailure := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		retry    RetryConfig
+		attempts int
+		now      time.Time
+		want     bool
+	}{
+		{"unlimited", RetryConfig{}, 1000, firstFailure.Add(24 * time.Hour), false},
+		{"below max attempts", RetryConfig{MaxAttempts: 3}, 2, firstFailure, false},
+		{"at max attempts", RetryConfig{MaxAttempts: 3}, 3, firstFailure, true},
+		{"below max age", RetryConfig{MaxAge: time.Hour}, 1, firstFailure.Add(time.Minute), false},
+		{"at max age", RetryConfig{MaxAge: time.Hour}, 1, firstFailure.Add(time.Hour), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.retry.exhausted(tt.attempts, firstFailure, tt.now); got != tt.want {
+				t.Errorf("exhausted() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlushContext_Callback_RetriesFailedUpload(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	succeeded := make(chan struct{})
+
+	flushCtx := newFlushContext("test", func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls < 3 {
+			return errors.New("upload failed")
+		}
+		close(succeeded)
+		return nil
+	}, &RetryConfig{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond})
+	flushCtx.Stop()
+
+	flushCtx.Mutex.Lock()
+	flushCtx.dirty = true
+	flushCtx.Mutex.Unlock()
+
+	// No timer is armed, so only the retry timer can trigger the later attempts
+	flushCtx.Callback()
+
+	select {
+	case <-succeeded:
+	case <-time.After(time.Second):
+		t.Fatal("failed upload was not retried until it succeeded")
+	}
+
+	// Wait for Callback to release the mutex after the successful upload
+	flushCtx.Mutex.Lock()
+	defer flushCtx.Mutex.Unlock()
+	if flushCtx.dirty {
+		t.Error("stream should be clean after a successful upload")
+	}
+	if flushCtx.attempts != 0 {
+		t.Errorf("attempts = %d after a successful upload, want 0", flushCtx.attempts)
+	}
+}
+
+func TestFlushContext_Callback_GivesUpWhenExhausted(t *testing.T) {
+	flushCtx := newFlushContext("test", func() error {
+		return errors.New("upload failed")
+	}, &RetryConfig{InitialBackoff: time.Hour, MaxBackoff: time.Hour, MaxAttempts: 2})
+	flushCtx.Stop()
+	flushCtx.dirty = true
+
+	flushCtx.Callback()
+	if flushCtx.RetryTimer == nil {
+		t.Fatal("retry timer should be armed after the first failure")
+	}
+
+	flushCtx.Callback()
+	if flushCtx.RetryTimer != nil {
+		t.Error("retry timer should not be armed once attempts are exhausted")
+	}
+	if !flushCtx.dirty {
+		t.Error("stream should stay dirty after giving up")
+	}
+}
+
+func TestFlushContext_UploadNow_PausedKeepsDirty(t *testing.T) {
+	flushConfig := &FlushConfigContext{
+		defaultLogLevel: 0,
+		hardDeltas:      []time.Duration{time.Hour},
+		softDeltas:      []time.Duration{time.Minute},
+	}
+	flushCtx := newFlushContext("test", func() error {
+		return errUploadsPaused
+	}, &RetryConfig{InitialBackoff: time.Hour, MaxBackoff: time.Hour})
+	flushCtx.Stop()
+
+	now := time.Now()
+	flushCtx.Update(0, now, flushConfig)
+	hard, soft, retry := flushCtx.Deadlines()
+	if !hard.Equal(now.Add(time.Hour)) || soft.IsZero() || !retry.IsZero() {
+		t.Errorf("Deadlines() = %v, %v, %v; want hard in 1h, a soft deadline and no retry",
+			hard, soft, retry)
+	}
+
+	if err := flushCtx.UploadNow(); !errors.Is(err, errUploadsPaused) {
+		t.Fatalf("UploadNow() = %v, want errUploadsPaused", err)
+	}
+	if !flushCtx.Dirty() {
+		t.Error("stream should stay dirty while uploads are paused")
+	}
+	if hard, soft, retry := flushCtx.Deadlines(); !hard.IsZero() || !soft.IsZero() ||
+		!retry.IsZero() {
+		t.Errorf("Deadlines() = %v, %v, %v after a paused upload; want no timers",
+			hard, soft, retry)
+	}
+}
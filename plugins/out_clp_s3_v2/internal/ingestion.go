@@ -2,128 +2,580 @@ package internal
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"time"
 
 	"github.com/klauspost/compress/zstd"
+	"github.com/y-scope/clp-ffi-go/ffi"
 	"github.com/y-scope/clp-ffi-go/ir"
-)
 
-// tempFilePattern is the pattern for creating temporary CLP IR files.
-// Files are created in the system temp directory with this pattern.
-const tempFilePattern = "clp-irv2-*.clp.zst"
+	"github.com/y-scope/fluent-bit-clp/internal/keytemplate"
+	"github.com/y-scope/fluent-bit-clp/internal/metrics"
+	"github.com/y-scope/fluent-bit-clp/internal/objindex"
+	"github.com/y-scope/fluent-bit-clp/internal/objmeta"
+	"github.com/y-scope/fluent-bit-clp/internal/objstore"
+)
 
 // GetOrCreateIngestionContext returns an existing IngestionContext for the given path,
 // or creates and registers a new one.
 //
 // Each unique log path (typically derived from the Fluent Bit tag) gets its own
 // IngestionContext, which includes:
-//   - A temporary file for buffering compressed logs
+//   - A buffer file (and manifest) in the buffer directory for compressed logs
 //   - A Zstd compression writer
 //   - An IR (Intermediate Representation) writer for CLP encoding
 //   - A flush context managing upload timing
 //
-// The created temp file is continuously synced to S3 based on the flush strategy.
+// The buffer file is continuously synced to S3 based on the flush strategy.
 // Multiple calls with the same path return the existing context.
+//
+// If max_open_streams is reached, the least recently written stream is evicted before a new one
+// is created. The returned stream is marked as written to, so it is not evicted as idle before the
+// caller writes to it.
+//
+// Creation failures (e.g. the buffer file cannot be created), and evictions that cannot restore
+// max_open_streams (see evictLeastRecentlyUsed), are marked with [ErrTransient].
+// Safe for concurrent use.
 func GetOrCreateIngestionContext(pluginCtx *PluginContext, path string) (*IngestionContext, error) {
-	// Return existing ingestion context if available
-	if ingestionContext, exists := pluginCtx.Ingestion[path]; exists {
-		return ingestionContext, nil
+	return getOrCreateIngestionContext(pluginCtx, path, false)
+}
+
+// getOrCreateIngestionContext implements GetOrCreateIngestionContext, pinning the returned stream
+// if pin is set (see [IngestionRegistry.acquire]).
+func getOrCreateIngestionContext(
+	pluginCtx *PluginContext,
+	path string,
+	pin bool,
+) (*IngestionContext, error) {
+	if _, exists := pluginCtx.Ingestion.get(path); !exists {
+		if err := pluginCtx.evictLeastRecentlyUsed(1); err != nil {
+			return nil, err
+		}
 	}
 
-	// Create new ingestion context for this path
-	ingestionCtx, err := createIngestionContext(pluginCtx, path)
+	create := func() (*IngestionContext, error) {
+		return createIngestionContext(pluginCtx, path)
+	}
+	lookup := pluginCtx.Ingestion.getOrCreate
+	if pin {
+		lookup = pluginCtx.Ingestion.acquire
+	}
+	ingestionCtx, err := lookup(path, create)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %w", ErrTransient, err)
 	}
-
-	pluginCtx.Ingestion[path] = ingestionCtx
+	ingestionCtx.touch(time.Now())
 	return ingestionCtx, nil
 }
 
 // createIngestionContext creates a new IngestionContext with all required resources.
 //
-// This function sets up the compression pipeline:
+// This function sets up the compression pipeline for the stream's first object:
 //
-//	Log Events → IR Writer → Zstd Writer → Temp File → S3
-//
-// Resources are cleaned up on error to prevent leaks.
+//	Log Events → IR Writer → Zstd Writer → Buffer File → S3
 func createIngestionContext(pluginCtx *PluginContext, path string) (*IngestionContext, error) {
-	// Create temp file for buffering compressed logs
-	tempFile, err := os.CreateTemp(os.TempDir(), tempFilePattern)
+	ingestionCtx := &IngestionContext{path: path, log: pluginCtx.Log.With("stream", path)}
+	if err := ingestionCtx.openObject(pluginCtx, time.Now()); err != nil {
+		return nil, err
+	}
+
+	// Create flush context with the upload callback
+	ingestionCtx.Flush = newFlushContext(path, func() error {
+		return ingestionCtx.sync(pluginCtx)
+	}, pluginCtx.FlushConfig.retry)
+	ingestionCtx.Flush.log = ingestionCtx.log
+
+	return ingestionCtx, nil
+}
+
+// openObject starts a new object for the stream, replacing the compression pipeline.
+//
+// Without rotation or eviction every object of a stream is synced to "<path>.clp.zst". With
+// either, each object gets the next sequence number and is synced to "<path>.<sequence>.clp.zst",
+// so a stream reopened after eviction never overwrites its earlier objects. If s3_key_format is
+// set, it names objects instead (see objectKey).
+//
+// The manifest is written before the buffer file is created so that any buffer file that exists
+// after a crash can be attributed to its stream. A buffer left behind by a failed recovery is
+// recovered first. Resources are cleaned up on error to prevent leaks.
+func (ctx *IngestionContext) openObject(pluginCtx *PluginContext, now time.Time) error {
+	sequence := 0
+	sequenced := pluginCtx.Rotation.Enabled() || pluginCtx.Eviction.Enabled()
+	if sequenced {
+		var err error
+		sequence, err = nextSequence(sequenceFilePath(pluginCtx.BufferDir, ctx.path))
+		if err != nil {
+			return err
+		}
+	}
+	remoteKey := pluginCtx.objectKey(ctx.path, sequence, sequenced, now, firstRecord{})
+
+	dataPath, manifestPath := bufferFilePaths(pluginCtx.BufferDir, ctx.path, sequence)
+	// A buffer whose recovery failed at startup still holds its manifest; it is recovered before
+	// its paths are reused.
+	if _, err := os.Stat(manifestPath); err == nil {
+		if err := recoverStream(pluginCtx, dataPath, manifestPath); err != nil {
+			return fmt.Errorf("failed to recover earlier buffer of stream: %w", err)
+		}
+	}
+	manifest := &streamManifest{
+		Tag:       ctx.path,
+		Sequence:  sequence,
+		RemoteKey: remoteKey,
+	}
+	if err := writeManifest(manifestPath, manifest); err != nil {
+		return err
+	}
+
+	// Create buffer file for compressed logs. O_EXCL guards against clobbering a buffer that
+	// recovery could not upload.
+	// #nosec G304 -- dataPath is derived from the plugin's own buffer directory
+	bufferFile, err := os.OpenFile(
+		dataPath,
+		os.O_RDWR|os.O_CREATE|os.O_EXCL,
+		bufferFilePermission,
+	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create temp file: %w", err)
+		_ = os.Remove(manifestPath)
+		return fmt.Errorf("failed to create buffer file: %w", err)
 	}
 
 	// Create Zstd compression writer
-	zstdWriter, err := zstd.NewWriter(tempFile)
+	zstdWriter, err := zstd.NewWriter(bufferFile)
 	if err != nil {
-		cleanupOnError(tempFile, nil)
-		return nil, fmt.Errorf("failed to create zstd writer: %w", err)
+		cleanupOnError(bufferFile, nil, manifestPath)
+		return fmt.Errorf("failed to create zstd writer: %w", err)
 	}
 
 	// Create CLP IR writer (FourByteEncoding is the standard encoding)
 	irWriter, err := ir.NewWriter[ir.FourByteEncoding](zstdWriter)
 	if err != nil {
-		cleanupOnError(tempFile, zstdWriter)
-		return nil, fmt.Errorf("failed to create IR writer: %w", err)
+		cleanupOnError(bufferFile, zstdWriter, manifestPath)
+		return fmt.Errorf("failed to create IR writer: %w", err)
 	}
 
-	// Create flush context with the upload callback
-	flushCtx := newFlushContext(pluginCtx, path, tempFile, zstdWriter)
+	ctx.Compression = &compressionContext{
+		File:       bufferFile,
+		ZstdWriter: zstdWriter,
+		IRWriter:   irWriter,
+	}
+	ctx.manifest = manifest
+	ctx.manifestPath = manifestPath
+	ctx.openedAt = now
+	ctx.first = firstRecord{}
+	ctx.maxLevel.Store(-1)
+	ctx.stats.Reset()
+	if pluginCtx.WriteIndex {
+		if ctx.index == nil {
+			ctx.index = objindex.NewBuilder(pluginCtx.IndexBloomSize)
+		} else {
+			ctx.index.Reset()
+		}
+	}
+	ctx.touch(now)
+	return nil
+}
+
+// RotateIfNeeded finalizes the stream's current object and starts a new one if any rotation
+// policy is due.
+//
+// The buffer file of the finalized object is deleted once its upload is confirmed. If the upload
+// fails, the finalized buffer is left for recovery on the next startup and the stream still moves
+// on to a new object, so the failed object never blocks ingestion.
+//
+// Objects are not rotated while uploads are paused through the admin API, nor before a record has
+// been written to them, so streams without records do not produce empty objects. Besides after
+// each Fluent Bit chunk, the janitor checks streams periodically (see startJanitor).
+//
+// Returns an error only if the new object cannot be opened. The stream is then closed and
+// unregistered, so the next record for its path creates it anew.
+func (ctx *IngestionContext) RotateIfNeeded(pluginCtx *PluginContext, now time.Time) error {
+	if !pluginCtx.Rotation.Enabled() || pluginCtx.UploadsPaused() {
+		return nil
+	}
+
+	closed, err := ctx.rotateIfNeeded(pluginCtx, now)
+	if closed {
+		// Stopped without holding the stream's mutex to respect the lock order
+		ctx.Flush.Stop()
+		pluginCtx.Ingestion.remove(ctx.path, ctx)
+	}
+	return err
+}
+
+// rotateIfNeeded implements RotateIfNeeded while holding the stream's mutex. Returns whether the
+// stream was closed because the new object could not be opened.
+func (ctx *IngestionContext) rotateIfNeeded(
+	pluginCtx *PluginContext,
+	now time.Time,
+) (bool, error) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if ctx.closed || ctx.stats.Events == 0 {
+		return false, nil
+	}
 
-	return &IngestionContext{
-		Compression: &compressionContext{
-			File:       tempFile,
-			ZstdWriter: zstdWriter,
-			IRWriter:   irWriter,
-		},
-		Flush: flushCtx,
-	}, nil
+	info, err := ctx.Compression.File.Stat()
+	if err != nil {
+		return false, fmt.Errorf("failed to stat buffer file: %w", err)
+	}
+	if !pluginCtx.Rotation.shouldRotate(info.Size(), ctx.openedAt, now) {
+		return false, nil
+	}
+
+	ctx.log.Infof("Rotating %q after %d bytes (opened %v)",
+		ctx.manifest.RemoteKey, info.Size(), ctx.openedAt.Format(time.RFC3339))
+	if err := ctx.finalize(pluginCtx); err != nil {
+		ctx.log.Errorf("Failed to finalize %q; it will be recovered on restart: %v",
+			ctx.manifest.RemoteKey, err)
+		// finalize may have failed before closing the file.
+		_ = ctx.Compression.File.Close()
+	}
+
+	if err := ctx.openObject(pluginCtx, now); err != nil {
+		ctx.closed = true
+		return true, err
+	}
+	return false, nil
 }
 
 // cleanupOnError closes and removes resources when ingestion context creation fails.
-func cleanupOnError(tempFile *os.File, zstdWriter *zstd.Encoder) {
+func cleanupOnError(bufferFile *os.File, zstdWriter *zstd.Encoder, manifestPath string) {
 	if zstdWriter != nil {
 		_ = zstdWriter.Close()
 	}
-	if tempFile != nil {
-		_ = tempFile.Close()
-		_ = os.Remove(tempFile.Name())
+	if bufferFile != nil {
+		_ = bufferFile.Close()
+		_ = os.Remove(bufferFile.Name())
 	}
+	_ = os.Remove(manifestPath)
 }
 
-// newFlushContext creates a flush context with the S3 upload callback.
+// newFlushContext creates a flush context for the stream at path with the given upload callback
+// and retry policy.
 //
-// The callback is invoked by the flush manager when either timer fires.
-// It flushes the Zstd buffer and uploads the temp file to S3.
-func newFlushContext(
-	pluginCtx *PluginContext,
-	path string,
-	tempFile *os.File,
-	zstdWriter *zstd.Encoder,
-) *flushContext {
+// The callback is invoked by the flush manager when any timer fires. If it returns an error, the
+// upload is retried according to the retry policy.
+func newFlushContext(path string, callback func() error, retry *RetryConfig) *flushContext {
 	return &flushContext{
 		// Initialize timers - they will be properly scheduled on first Update() call
-		HardTimer: time.NewTimer(0),
-		SoftTimer: time.NewTimer(0),
-		userCallback: func() {
-			// Flush any buffered data in the Zstd encoder
-			if err := zstdWriter.Flush(); err != nil {
-				log.Printf("[error] zstdWriter.Flush failed: %v", err)
-				return
-			}
-			// Upload the temp file to S3
-			remotePath := fmt.Sprintf("%s.clp.zst", path)
-			if err := S3Upload(
-				pluginCtx.S3.Client,
-				pluginCtx.S3.Bucket,
-				tempFile.Name(),
-				remotePath,
-			); err != nil {
-				log.Printf("[error] Failed to upload to S3: %v", err)
-			}
-		},
+		HardTimer:    time.NewTimer(0),
+		SoftTimer:    time.NewTimer(0),
+		retry:        retry,
+		userCallback: callback,
+		path:         path,
+	}
+}
+
+// WriteLogEvent encodes a log event into the stream's current object and counts it in the
+// object's statistics, which are uploaded as its metadata (see putOptions), and its index.
+//
+// Returns an error marked with [ErrTransient] if the stream has been closed (e.g. by a failed
+// rotation), so the record is retried on the stream's replacement.
+func (ctx *IngestionContext) WriteLogEvent(
+	event ffi.LogEvent,
+	timestamp time.Time,
+	level int,
+) error {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	return ctx.writeLogEvent(event, timestamp, level)
+}
+
+// writeRecord implements WriteLogEvent for a record of a [Batch]. If the record is the first of
+// the current object, its tag and fields name the object (see nameObject).
+func (ctx *IngestionContext) writeRecord(pluginCtx *PluginContext, record batchRecord) error {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if !ctx.closed && ctx.stats.Events == 0 {
+		if err := ctx.nameObject(pluginCtx, record.first); err != nil {
+			return err
+		}
+	}
+	return ctx.writeLogEvent(*record.event, record.timestamp, record.level)
+}
+
+// nameObject keeps the first record of the current object for object_tags and renders the
+// object's key again with it. The key is kept if the object has already been uploaded (e.g.
+// through the admin API), so an object never moves. The caller must hold the stream's mutex.
+func (ctx *IngestionContext) nameObject(pluginCtx *PluginContext, first firstRecord) error {
+	ctx.first = first
+	if pluginCtx.KeyFormat == nil || ctx.manifest.SyncedBytes > 0 || ctx.manifest.Segments > 0 {
+		return nil
+	}
+
+	sequenced := pluginCtx.Rotation.Enabled() || pluginCtx.Eviction.Enabled()
+	remoteKey := pluginCtx.objectKey(
+		ctx.path,
+		ctx.manifest.Sequence,
+		sequenced,
+		ctx.openedAt,
+		first,
+	)
+	if remoteKey == ctx.manifest.RemoteKey {
+		return nil
+	}
+	previousKey := ctx.manifest.RemoteKey
+	ctx.manifest.RemoteKey = remoteKey
+	if err := writeManifest(ctx.manifestPath, ctx.manifest); err != nil {
+		ctx.manifest.RemoteKey = previousKey
+		return err
+	}
+	return nil
+}
+
+// writeLogEvent implements WriteLogEvent. The caller must hold the stream's mutex.
+func (ctx *IngestionContext) writeLogEvent(
+	event ffi.LogEvent,
+	timestamp time.Time,
+	level int,
+) error {
+	if ctx.closed {
+		return fmt.Errorf("%w: stream %q is closed", ErrTransient, ctx.path)
+	}
+	n, err := ctx.Compression.IRWriter.WriteLogEvent(event)
+	metrics.IrBytes.Add(float64(n), ctx.path)
+	if err != nil {
+		return fmt.Errorf("failed to write log event: %w", err)
+	}
+	ctx.stats.Count(logLevelName(level))
+	ctx.stats.ExtendTimeRange(timestamp, timestamp)
+	if ctx.index != nil {
+		ctx.index.Add(event.UserKvPairs)
+	}
+	ctx.touch(time.Now())
+	return nil
+}
+
+// LastWrite returns when a log event was last written to the stream (or the stream was last
+// retrieved for writing). Safe to call without holding the stream's mutex.
+func (ctx *IngestionContext) LastWrite() time.Time {
+	return time.Unix(0, ctx.lastWrite.Load())
+}
+
+// pinned reports whether a batch holds the stream (see [IngestionRegistry.acquire]).
+func (ctx *IngestionContext) pinned() bool {
+	return ctx.pins.Load() > 0
+}
+
+// release unpins the stream once for a batch that no longer writes to it.
+func (ctx *IngestionContext) release() {
+	ctx.pins.Add(-1)
+}
+
+// touch records now as the stream's last write, used by idle and LRU eviction.
+func (ctx *IngestionContext) touch(now time.Time) {
+	ctx.lastWrite.Store(now.UnixNano())
+}
+
+// ObserveLevel records that a log event of the given level is written to the current object.
+// Safe to call without holding the stream's mutex.
+func (ctx *IngestionContext) ObserveLevel(level int) {
+	// #nosec G115 -- log levels are small constants
+	observed := int32(level)
+	for {
+		current := ctx.maxLevel.Load()
+		if observed <= current || ctx.maxLevel.CompareAndSwap(current, observed) {
+			return
+		}
+	}
+}
+
+// putOptions returns the options of the current object, selecting its storage class from the
+// most severe log level written to it. The object's metadata describes the events written so far,
+// and its tags are rendered from object_tags with the upload time and the object's first record.
+func (ctx *IngestionContext) putOptions(pluginCtx *PluginContext) objstore.PutOptions {
+	level := int(ctx.maxLevel.Load())
+	tags := pluginCtx.Tags.Render(keytemplate.Values{
+		Tag:        ctx.first.tag,
+		Stream:     ctx.path,
+		Record:     ctx.first.fields,
+		ID:         pluginCtx.ID,
+		Index:      ctx.manifest.Sequence,
+		Hostname:   pluginCtx.Hostname,
+		UploadTime: time.Now(),
+		EventStart: ctx.stats.Start,
+		EventEnd:   ctx.stats.End,
+	})
+	return objstore.PutOptions{
+		StorageClass: pluginCtx.StorageClasses.forLevel(level),
+		Metadata:     objmeta.Metadata(pluginCtx.objectSource(ctx.path), &ctx.stats),
+		Tags:         tags,
+	}
+}
+
+// uploadIndex uploads the sidecar index of the current object (or, in [SyncModeSegments], of the
+// object its segments make up) once the object is synced, if write_index is set. The caller must
+// hold the stream's mutex.
+//
+// An object without an up to date index is searched rather than skipped (a stale index records a
+// different object size), so failures are logged rather than returned.
+//
+// Parameters:
+//   - pluginCtx: Plugin context holding the object store
+//   - size: Size of the synced object in bytes
+func (ctx *IngestionContext) uploadIndex(pluginCtx *PluginContext, size int64) {
+	if ctx.index == nil {
+		return
+	}
+	key := ctx.manifest.RemoteKey
+	body, err := ctx.index.Marshal(key, size, &ctx.stats)
+	if err == nil {
+		err = pluginCtx.putBytes(key+objindex.KeySuffix, body, objindex.ContentType)
+	}
+	if err != nil {
+		ctx.log.Warnf("Failed to upload index of %q: %v", key, err)
+	}
+}
+
+// FlushBuffer writes data buffered in the Zstd encoder to the buffer file.
+//
+// Called after each Fluent Bit chunk so that everything accepted from Fluent Bit is on disk and
+// can be recovered after a crash, even if it has not been synced to S3 yet.
+func (ctx *IngestionContext) FlushBuffer() error {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if ctx.closed {
+		return nil
+	}
+	if err := ctx.Compression.ZstdWriter.Flush(); err != nil {
+		return fmt.Errorf("failed to flush zstd writer: %w", err)
+	}
+	return nil
+}
+
+// sync flushes the Zstd buffer and ships the buffer file to S3 according to the sync mode.
+//
+// In [SyncModeFull] the whole buffer file is uploaded to the object key. In [SyncModeSegments]
+// only the bytes appended since the last sync are uploaded (see syncSegment). In [SyncModeAppend]
+// those bytes are appended to the object itself. On success the manifest is updated with the
+// number of bytes synced.
+//
+// The stream's mutex is held for the whole sync, so no log event is written between flushing the
+// Zstd encoder and uploading the buffer file.
+//
+// Returns an error if the data could not be uploaded, so the flush manager can retry, or
+// [errUploadsPaused] while uploads are paused through the admin API.
+func (ctx *IngestionContext) sync(pluginCtx *PluginContext) error {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if ctx.closed {
+		// Finalize uploaded everything
+		return nil
+	}
+	if pluginCtx.UploadsPaused() {
+		return errUploadsPaused
+	}
+
+	// Flush any buffered data in the Zstd encoder
+	if err := ctx.Compression.ZstdWriter.Flush(); err != nil {
+		return fmt.Errorf("failed to flush zstd writer: %w", err)
+	}
+
+	info, err := ctx.Compression.File.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat buffer file: %w", err)
+	}
+
+	metrics.BufferBytes.Set(float64(info.Size()), ctx.path)
+
+	// Upload the buffer file (or its new bytes) to the object store
+	start := time.Now()
+	switch pluginCtx.SyncMode {
+	case SyncModeSegments:
+		err = ctx.syncSegment(pluginCtx, info.Size())
+	case SyncModeAppend:
+		err = ctx.syncAppend(pluginCtx, ctx.Compression.File.Name(), info.Size())
+	default:
+		err = pluginCtx.uploadFile(ctx.Compression.File.Name(), ctx.manifest.RemoteKey,
+			ctx.putOptions(pluginCtx))
+	}
+	metrics.ObserveUpload(ctx.path, start, err)
+	if err != nil {
+		return fmt.Errorf("failed to upload %q: %w", ctx.manifest.RemoteKey, err)
+	}
+	metrics.ZstdBytes.Add(float64(info.Size()-ctx.manifest.SyncedBytes), ctx.path)
+	ctx.uploadIndex(pluginCtx, info.Size())
+
+	ctx.manifest.SyncedBytes = info.Size()
+	if err := writeManifest(ctx.manifestPath, ctx.manifest); err != nil {
+		// The data is uploaded; a stale manifest only causes extra work during recovery.
+		ctx.log.Warnf("Failed to update manifest: %v", err)
+	}
+	return nil
+}
+
+// Finalize terminates the IR stream and Zstd frame, uploads the completed object, and removes the
+// buffer file and manifest. Segment objects uploaded in [SyncModeSegments] are deleted once the
+// completed object is stored.
+//
+// If the upload fails, the terminated buffer is kept (with its manifest marked finalized) so that
+// it is uploaded as-is by recovery on the next startup. The stream is closed afterwards, and
+// further writes fail.
+func (ctx *IngestionContext) Finalize(pluginCtx *PluginContext) error {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if ctx.closed {
+		return nil
+	}
+	ctx.closed = true
+	if err := ctx.finalize(pluginCtx); err != nil {
+		// finalize may have failed before closing the file.
+		_ = ctx.Compression.File.Close()
+		return err
+	}
+	return nil
+}
+
+// finalize implements Finalize for the current object. The caller must hold the stream's mutex.
+func (ctx *IngestionContext) finalize(pluginCtx *PluginContext) error {
+	compression := ctx.Compression
+	if err := compression.IRWriter.Close(); err != nil {
+		return fmt.Errorf("failed to close IR writer: %w", err)
+	}
+	if err := compression.ZstdWriter.Close(); err != nil {
+		return fmt.Errorf("failed to close zstd writer: %w", err)
+	}
+	if err := compression.File.Sync(); err != nil {
+		return fmt.Errorf("failed to sync buffer file: %w", err)
+	}
+
+	ctx.manifest.Finalized = true
+	if err := writeManifest(ctx.manifestPath, ctx.manifest); err != nil {
+		return err
 	}
+
+	dataPath := compression.File.Name()
+	if err := compression.File.Close(); err != nil {
+		return fmt.Errorf("failed to close buffer file: %w", err)
+	}
+
+	info, err := os.Stat(dataPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat buffer file: %w", err)
+	}
+	start := time.Now()
+	if pluginCtx.SyncMode == SyncModeAppend {
+		// Terminating the IR stream and Zstd frame only appended to the buffer file, so appending
+		// the remaining bytes completes the object.
+		err = ctx.syncAppend(pluginCtx, dataPath, info.Size())
+	} else {
+		err = pluginCtx.uploadFile(dataPath, ctx.manifest.RemoteKey, ctx.putOptions(pluginCtx))
+	}
+	metrics.ObserveUpload(ctx.path, start, err)
+	if err != nil {
+		return err
+	}
+	metrics.ZstdBytes.Add(float64(info.Size()-ctx.manifest.SyncedBytes), ctx.path)
+	metrics.CloseStream(ctx.path)
+	ctx.uploadIndex(pluginCtx, info.Size())
+
+	deleteSegments(pluginCtx, ctx.manifest)
+	return removeBufferFiles(dataPath, ctx.manifestPath)
 }
@@ -0,0 +1,437 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/y-scope/clp-ffi-go/ffi"
+
+	"github.com/y-scope/fluent-bit-clp/internal/objindex"
+	"github.com/y-scope/fluent-bit-clp/internal/objmeta"
+	"github.com/y-scope/fluent-bit-clp/internal/objstore"
+)
+
+const testPath = "app/server.log"
+
+// newTestPluginContext creates a plugin context uploading to an in-memory object store. Flush
+// timers are effectively disabled so tests control when syncs happen.
+func newTestPluginContext(t *testing.T) (*PluginContext, *objstore.MemoryStore) {
+	t.Helper()
+
+	store := objstore.NewMemoryStore()
+	pluginCtx := &PluginContext{
+		Store:     store,
+		Ingestion: newIngestionRegistry(),
+		FlushConfig: &FlushConfigContext{
+			hardDeltas: []time.Duration{time.Hour},
+			softDeltas: []time.Duration{time.Hour},
+		},
+		BufferDir: t.TempDir(),
+		SyncMode:  SyncModeFull,
+	}
+	return pluginCtx, store
+}
+
+// newTestLogEvent creates a log event written by the given writer.
+func newTestLogEvent(writer, i int) ffi.LogEvent {
+	event := ffi.NewLogEvent()
+	event.AutoKvPairs["timestamp"] = int64(i)
+	event.UserKvPairs = map[string]any{"writer": writer, "message": "hammering the stream"}
+	return *event
+}
+
+func TestIngestionContext_ConcurrentWritesAndSyncs(t *testing.T) {
+	pluginCtx, store := newTestPluginContext(t)
+	ingestionCtx, err := GetOrCreateIngestionContext(pluginCtx, testPath)
+	if err != nil {
+		t.Fatalf("GetOrCreateIngestionContext() error = %v", err)
+	}
+
+	// Simulate flush timers firing while records are written
+	done := make(chan struct{})
+	var syncer sync.WaitGroup
+	syncer.Add(1)
+	go func() {
+		defer syncer.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				ingestionCtx.Flush.Callback()
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	const writers = 4
+	const eventsPerWriter = 200
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range eventsPerWriter {
+				stream, err := GetOrCreateIngestionContext(pluginCtx, testPath)
+				if err != nil {
+					t.Errorf("GetOrCreateIngestionContext() error = %v", err)
+					return
+				}
+				if err := stream.WriteLogEvent(newTestLogEvent(w, i), time.Time{}, 0); err != nil {
+					t.Errorf("WriteLogEvent() error = %v", err)
+					return
+				}
+				stream.Flush.Update(0, time.Now(), pluginCtx.FlushConfig)
+				if i%10 == 0 {
+					if err := stream.FlushBuffer(); err != nil {
+						t.Errorf("FlushBuffer() error = %v", err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	syncer.Wait()
+
+	ingestionCtx.Flush.Stop()
+	if err := ingestionCtx.Finalize(pluginCtx); err != nil {
+		t.Fatalf("Finalize() error = %v", err)
+	}
+
+	object, _ := store.Get(testPath + ".clp.zst")
+	if puts := store.Puts(); puts < 2 {
+		t.Errorf("got %d uploads, want syncs during writes and a final upload", puts)
+	}
+
+	// A sync capturing a partially written block would corrupt the stream
+	zstdReader, err := zstd.NewReader(bytes.NewReader(object.Data))
+	if err != nil {
+		t.Fatalf("Failed to create zstd reader: %v", err)
+	}
+	defer zstdReader.Close()
+	decoded, err := io.ReadAll(zstdReader)
+	if err != nil {
+		t.Fatalf("finalized object is not a complete zstd stream: %v", err)
+	}
+	if len(decoded) == 0 || decoded[len(decoded)-1] != irEndOfStream {
+		t.Error("finalized object should end with the IR end-of-stream tag")
+	}
+}
+
+func TestIngestionContext_WriteAfterFinalize(t *testing.T) {
+	pluginCtx, _ := newTestPluginContext(t)
+	ingestionCtx, err := GetOrCreateIngestionContext(pluginCtx, testPath)
+	if err != nil {
+		t.Fatalf("GetOrCreateIngestionContext() error = %v", err)
+	}
+
+	ingestionCtx.Flush.Stop()
+	if err := ingestionCtx.Finalize(pluginCtx); err != nil {
+		t.Fatalf("Finalize() error = %v", err)
+	}
+
+	err = ingestionCtx.WriteLogEvent(newTestLogEvent(0, 0), time.Time{}, 0)
+	if !IsTransient(err) {
+		t.Errorf("WriteLogEvent() after Finalize error = %v, want transient error", err)
+	}
+	if err := ingestionCtx.sync(pluginCtx); err != nil {
+		t.Errorf("sync() after Finalize error = %v, want nil", err)
+	}
+}
+
+func TestIngestionContext_SyncSegments(t *testing.T) {
+	pluginCtx, store := newTestPluginContext(t)
+	pluginCtx.SyncMode = SyncModeSegments
+	ingestionCtx, err := GetOrCreateIngestionContext(pluginCtx, testPath)
+	if err != nil {
+		t.Fatalf("GetOrCreateIngestionContext() error = %v", err)
+	}
+	ingestionCtx.Flush.Stop()
+
+	remoteKey := testPath + ".clp.zst"
+	for i := range 2 {
+		if err := ingestionCtx.WriteLogEvent(newTestLogEvent(0, i), time.Time{}, 0); err != nil {
+			t.Fatalf("WriteLogEvent() error = %v", err)
+		}
+		if err := ingestionCtx.sync(pluginCtx); err != nil {
+			t.Fatalf("sync() error = %v", err)
+		}
+	}
+
+	want := []string{
+		remoteKey + indexKeySuffix,
+		segmentKey(remoteKey, 0),
+		segmentKey(remoteKey, 1),
+	}
+	if got := store.Keys(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Keys() after syncs = %v, want %v", got, want)
+	}
+	index, _ := store.Get(remoteKey + indexKeySuffix)
+	if index.Opts.ContentType != indexContentType {
+		t.Errorf("index content type = %q, want %q", index.Opts.ContentType, indexContentType)
+	}
+
+	// A failed upload leaves the synced state untouched so the next sync retries it
+	store.FailPuts(errors.New("unavailable"))
+	if err := ingestionCtx.WriteLogEvent(newTestLogEvent(0, 2), time.Time{}, 0); err != nil {
+		t.Fatalf("WriteLogEvent() error = %v", err)
+	}
+	if err := ingestionCtx.sync(pluginCtx); err == nil {
+		t.Error("sync() error = nil, want upload error")
+	}
+	store.FailPuts(nil)
+
+	if err := ingestionCtx.Finalize(pluginCtx); err != nil {
+		t.Fatalf("Finalize() error = %v", err)
+	}
+	if got := store.Keys(); !reflect.DeepEqual(got, []string{remoteKey}) {
+		t.Errorf("Keys() after Finalize = %v, want only %q", got, remoteKey)
+	}
+}
+
+func TestIngestionContext_SyncAppend(t *testing.T) {
+	pluginCtx, store := newTestPluginContext(t)
+	pluginCtx.SyncMode = SyncModeAppend
+	ingestionCtx, err := GetOrCreateIngestionContext(pluginCtx, testPath)
+	if err != nil {
+		t.Fatalf("GetOrCreateIngestionContext() error = %v", err)
+	}
+	ingestionCtx.Flush.Stop()
+
+	remoteKey := testPath + ".clp.zst"
+	dataPath := ingestionCtx.Compression.File.Name()
+	for i := range 2 {
+		if err := ingestionCtx.WriteLogEvent(newTestLogEvent(0, i), time.Time{}, 0); err != nil {
+			t.Fatalf("WriteLogEvent() error = %v", err)
+		}
+		if err := ingestionCtx.sync(pluginCtx); err != nil {
+			t.Fatalf("sync() error = %v", err)
+		}
+
+		// The object mirrors the buffer file after every sync
+		buffer, err := os.ReadFile(dataPath)
+		if err != nil {
+			t.Fatalf("Failed to read buffer file: %v", err)
+		}
+		if object, _ := store.Get(remoteKey); !bytes.Equal(object.Data, buffer) {
+			t.Errorf("sync %d: object has %d bytes, want buffer file (%d bytes)",
+				i, len(object.Data), len(buffer))
+		}
+	}
+
+	if err := ingestionCtx.Finalize(pluginCtx); err != nil {
+		t.Fatalf("Finalize() error = %v", err)
+	}
+	object, _ := store.Get(remoteKey)
+	zstdReader, err := zstd.NewReader(bytes.NewReader(object.Data))
+	if err != nil {
+		t.Fatalf("Failed to create zstd reader: %v", err)
+	}
+	defer zstdReader.Close()
+	decoded, err := io.ReadAll(zstdReader)
+	if err != nil {
+		t.Fatalf("finalized object is not a complete zstd stream: %v", err)
+	}
+	if len(decoded) == 0 || decoded[len(decoded)-1] != irEndOfStream {
+		t.Error("finalized object should end with the IR end-of-stream tag")
+	}
+}
+
+func TestIngestionContext_StorageClassByLevel(t *testing.T) {
+	pluginCtx, store := newTestPluginContext(t)
+	pluginCtx.StorageClasses = &StorageClassConfig{
+		ByLevel: []string{"DEEP_ARCHIVE", "GLACIER_IR", "STANDARD_IA", "", "", ""},
+	}
+	ingestionCtx, err := GetOrCreateIngestionContext(pluginCtx, testPath)
+	if err != nil {
+		t.Fatalf("GetOrCreateIngestionContext() error = %v", err)
+	}
+	ingestionCtx.Flush.Stop()
+
+	// The object's storage class follows the most severe level written to it so far
+	tests := []struct {
+		level int
+		want  string
+	}{
+		{1, "GLACIER_IR"},
+		{0, "GLACIER_IR"},
+		{2, "STANDARD_IA"},
+		{4, ""},
+		{1, ""},
+	}
+	remoteKey := testPath + ".clp.zst"
+	for i, tt := range tests {
+		ingestionCtx.ObserveLevel(tt.level)
+		if err := ingestionCtx.WriteLogEvent(newTestLogEvent(0, i), time.Time{}, 0); err != nil {
+			t.Fatalf("WriteLogEvent() error = %v", err)
+		}
+		if err := ingestionCtx.sync(pluginCtx); err != nil {
+			t.Fatalf("sync() error = %v", err)
+		}
+		object, _ := store.Get(remoteKey)
+		if object.Opts.StorageClass != tt.want {
+			t.Errorf("after level %d: StorageClass = %q, want %q",
+				tt.level, object.Opts.StorageClass, tt.want)
+		}
+	}
+
+	if err := ingestionCtx.Finalize(pluginCtx); err != nil {
+		t.Fatalf("Finalize() error = %v", err)
+	}
+}
+
+func TestIngestionContext_SyncChecksum(t *testing.T) {
+	pluginCtx, store := newTestPluginContext(t)
+	pluginCtx.ChecksumAlgorithm = objstore.ChecksumCRC32C
+	pluginCtx.VerifyUploads = true
+	ingestionCtx, err := GetOrCreateIngestionContext(pluginCtx, testPath)
+	if err != nil {
+		t.Fatalf("GetOrCreateIngestionContext() error = %v", err)
+	}
+	ingestionCtx.Flush.Stop()
+
+	if err := ingestionCtx.WriteLogEvent(newTestLogEvent(0, 0), time.Time{}, 0); err != nil {
+		t.Fatalf("WriteLogEvent() error = %v", err)
+	}
+	if err := ingestionCtx.sync(pluginCtx); err != nil {
+		t.Fatalf("sync() error = %v", err)
+	}
+
+	remoteKey := testPath + ".clp.zst"
+	object, _ := store.Get(remoteKey)
+	want, err := objstore.ComputeChecksum(objstore.ChecksumCRC32C, bytes.NewReader(object.Data))
+	if err != nil {
+		t.Fatalf("ComputeChecksum() error = %v", err)
+	}
+	if object.Opts.Checksum != want ||
+		object.Opts.Metadata[objstore.MetadataChecksum] != want.Value {
+		t.Errorf("synced object checksum = %+v, metadata %v, want %+v",
+			object.Opts.Checksum, object.Opts.Metadata, want)
+	}
+
+	if err := ingestionCtx.Finalize(pluginCtx); err != nil {
+		t.Fatalf("Finalize() error = %v", err)
+	}
+}
+
+func TestIngestionContext_SyncMetadata(t *testing.T) {
+	pluginCtx, store := newTestPluginContext(t)
+	pluginCtx.ID = "abc123"
+	tags, err := objmeta.ParseTags("team=logs,stream=$STREAM")
+	if err != nil {
+		t.Fatalf("ParseTags() error = %v", err)
+	}
+	pluginCtx.Tags = tags
+	ingestionCtx, err := GetOrCreateIngestionContext(pluginCtx, testPath)
+	if err != nil {
+		t.Fatalf("GetOrCreateIngestionContext() error = %v", err)
+	}
+	ingestionCtx.Flush.Stop()
+
+	early := time.Date(2024, 1, 15, 9, 0, 0, 0, time.UTC)
+	for i, level := range []int{4, 2, 4} {
+		timestamp := early.Add(time.Duration(2-i) * time.Minute)
+		if err := ingestionCtx.WriteLogEvent(newTestLogEvent(0, i), timestamp, level); err != nil {
+			t.Fatalf("WriteLogEvent() error = %v", err)
+		}
+	}
+	if err := ingestionCtx.sync(pluginCtx); err != nil {
+		t.Fatalf("sync() error = %v", err)
+	}
+
+	object, _ := store.Get(testPath + ".clp.zst")
+	wantMetadata := map[string]string{
+		objmeta.MetadataEventCount:  "3",
+		objmeta.MetadataEventStart:  "2024-01-15T09:00:00Z",
+		objmeta.MetadataEventEnd:    "2024-01-15T09:02:00Z",
+		objmeta.MetadataLevelCounts: "error=2,info=1",
+		objmeta.MetadataInstanceId:  "abc123",
+		objmeta.MetadataPlugin:      pluginName + "/" + objmeta.PluginVersion(),
+	}
+	for key, want := range wantMetadata {
+		if got := object.Opts.Metadata[key]; got != want {
+			t.Errorf("synced object metadata %s = %q, want %q", key, got, want)
+		}
+	}
+	wantTags := map[string]string{"team": "logs", "stream": testPath}
+	if !reflect.DeepEqual(object.Opts.Tags, wantTags) {
+		t.Errorf("synced object tags = %v, want %v", object.Opts.Tags, wantTags)
+	}
+
+	if err := ingestionCtx.Finalize(pluginCtx); err != nil {
+		t.Fatalf("Finalize() error = %v", err)
+	}
+}
+
+func TestIngestionContext_SyncIndex(t *testing.T) {
+	pluginCtx, store := newTestPluginContext(t)
+	pluginCtx.WriteIndex = true
+	pluginCtx.IndexBloomSize = objindex.DefaultBloomSize
+	ingestionCtx, err := GetOrCreateIngestionContext(pluginCtx, testPath)
+	if err != nil {
+		t.Fatalf("GetOrCreateIngestionContext() error = %v", err)
+	}
+	ingestionCtx.Flush.Stop()
+
+	event := newTestLogEvent(0, 0)
+	event.UserKvPairs["request_id"] = "req-4f2a"
+	if err := ingestionCtx.WriteLogEvent(event, time.Time{}, 0); err != nil {
+		t.Fatalf("WriteLogEvent() error = %v", err)
+	}
+
+	remoteKey := testPath + ".clp.zst"
+	checkIndex := func(name string) {
+		t.Helper()
+		object, _ := store.Get(remoteKey)
+		indexObject, ok := store.Get(remoteKey + objindex.KeySuffix)
+		if !ok {
+			t.Fatalf("%s: index of %s was not uploaded", name, remoteKey)
+		}
+		index, err := objindex.Parse(indexObject.Data)
+		if err != nil {
+			t.Fatalf("%s: Parse() error = %v", name, err)
+		}
+		if index.ObjectSize != int64(len(object.Data)) || index.EventCount != 1 {
+			t.Errorf("%s: index size %d, %d events, want %d bytes and 1 event",
+				name, index.ObjectSize, index.EventCount, len(object.Data))
+		}
+		if !index.MayContain("req-4f2a") || !index.HasKey("request_id") {
+			t.Errorf("%s: index does not hold the written request_id", name)
+		}
+	}
+
+	if err := ingestionCtx.sync(pluginCtx); err != nil {
+		t.Fatalf("sync() error = %v", err)
+	}
+	checkIndex("sync")
+	if err := ingestionCtx.Finalize(pluginCtx); err != nil {
+		t.Fatalf("Finalize() error = %v", err)
+	}
+	checkIndex("Finalize")
+}
+
+func TestStorageClassConfig_ForLevel(t *testing.T) {
+	var disabled *StorageClassConfig
+	if disabled.Enabled() || disabled.forLevel(1) != "" {
+		t.Error("nil config should be disabled and use the default storage class")
+	}
+
+	config := &StorageClassConfig{ByLevel: []string{"", "GLACIER_IR"}}
+	if !config.Enabled() {
+		t.Error("Enabled() = false, want true")
+	}
+	for level, want := range map[int]string{-1: "", 0: "", 1: "GLACIER_IR", 5: ""} {
+		if got := config.forLevel(level); got != want {
+			t.Errorf("forLevel(%d) = %q, want %q", level, got, want)
+		}
+	}
+}
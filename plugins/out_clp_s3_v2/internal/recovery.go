@@ -0,0 +1,296 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/y-scope/fluent-bit-clp/internal/logging"
+	"github.com/y-scope/fluent-bit-clp/internal/metrics"
+	"github.com/y-scope/fluent-bit-clp/internal/objindex"
+	"github.com/y-scope/fluent-bit-clp/internal/objmeta"
+	"github.com/y-scope/fluent-bit-clp/internal/objstore"
+)
+
+// Buffer file naming.
+const (
+	// bufferFileSuffix is appended to the escaped stream path to name its buffer file.
+	bufferFileSuffix = ".clp.zst"
+	// manifestFileSuffix is appended to the escaped stream path to name its manifest.
+	manifestFileSuffix = ".manifest.json"
+	// recoveredFileSuffix is appended to a buffer file path while it is being finalized.
+	recoveredFileSuffix = ".recovered"
+	// tempFileSuffix is appended to a manifest path while it is being rewritten.
+	tempFileSuffix = ".tmp"
+)
+
+// Buffer directory permissions.
+const (
+	// bufferDirPermission is the permission mode for the buffer directory.
+	bufferDirPermission = 0o750
+	// bufferFilePermission is the permission mode for buffer and manifest files.
+	bufferFilePermission = 0o600
+)
+
+// irEndOfStream is the CLP IR end-of-stream tag. [ir.Writer.Close] appends it when a stream is
+// closed gracefully; recovered streams never reached that point, so it is appended manually.
+const irEndOfStream byte = 0x00
+
+// streamManifest records which stream a buffer file belongs to. It is persisted next to the buffer
+// file so that a buffer left behind by a crash can be uploaded to the right key on startup.
+type streamManifest struct {
+	// Tag is the Fluent Bit tag (or stream path) the buffer was created for.
+	Tag string `json:"tag"`
+	// Sequence is the object sequence number within the stream (always 0 without rotation).
+	Sequence int `json:"sequence"`
+	// RemoteKey is the S3 object key the buffer is synced to.
+	RemoteKey string `json:"remote_key"`
+	// SyncedBytes is the size of the buffer file at the last successful upload.
+	SyncedBytes int64 `json:"synced_bytes"`
+	// Segments is the number of segment objects uploaded in [SyncModeSegments].
+	Segments int `json:"segments"`
+	// Finalized is set once the IR stream and Zstd frame have been terminated.
+	Finalized bool `json:"finalized"`
+}
+
+// bufferFilePaths returns the buffer file and manifest paths for one object of a stream.
+//
+// The stream path is escaped so that tags containing path separators map to a single,
+// deterministic file name inside the buffer directory. The object sequence number is part of the
+// name so a finalized buffer awaiting recovery never collides with the stream's next object.
+func bufferFilePaths(bufferDir, path string, sequence int) (string, string) {
+	name := fmt.Sprintf("%s.%d", url.PathEscape(path), sequence)
+	return filepath.Join(bufferDir, name+bufferFileSuffix),
+		filepath.Join(bufferDir, name+manifestFileSuffix)
+}
+
+// sequenceFilePath returns the path of the file persisting a stream's next object sequence number.
+func sequenceFilePath(bufferDir, path string) string {
+	return filepath.Join(bufferDir, url.PathEscape(path)+sequenceFileSuffix)
+}
+
+// writeManifest atomically replaces the manifest at manifestPath.
+//
+// The manifest is written to a temporary file and renamed into place so a crash mid-write never
+// leaves a truncated manifest behind.
+func writeManifest(manifestPath string, manifest *streamManifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest %q: %w", manifestPath, err)
+	}
+
+	tempPath := manifestPath + tempFileSuffix
+	if err := os.WriteFile(tempPath, data, bufferFilePermission); err != nil {
+		return fmt.Errorf("failed to write manifest %q: %w", tempPath, err)
+	}
+	if err := os.Rename(tempPath, manifestPath); err != nil {
+		return fmt.Errorf("failed to rename manifest %q: %w", tempPath, err)
+	}
+	return nil
+}
+
+// readManifest loads the manifest at manifestPath.
+func readManifest(manifestPath string) (*streamManifest, error) {
+	// #nosec G304 -- manifestPath is listed from the plugin's own buffer directory
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest %q: %w", manifestPath, err)
+	}
+
+	var manifest streamManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %q: %w", manifestPath, err)
+	}
+	return &manifest, nil
+}
+
+// RecoverBufferDir uploads buffers left behind by a previous execution and removes them.
+//
+// Each manifest in the buffer directory identifies a stream that was not closed gracefully. For
+// every such stream this function:
+//  1. Finishes the IR stream and Zstd frame (see finalizeBuffer)
+//  2. Uploads the result to the key recorded in the manifest
+//  3. Deletes any segment objects uploaded in [SyncModeSegments]
+//  4. Removes the buffer file and its manifest
+//
+// Buffers are only removed after a successful upload. A stream whose recovery fails (e.g. a corrupt
+// manifest or an unreachable store) is logged and its files are left in place, so it is retried
+// when the stream's buffer is next opened (see openObject) or on the next startup; the remaining
+// streams are still recovered.
+func RecoverBufferDir(pluginCtx *PluginContext) error {
+	bufferDir := pluginCtx.BufferDir
+	if err := os.MkdirAll(bufferDir, bufferDirPermission); err != nil {
+		return fmt.Errorf("failed to create buffer directory %q: %w", bufferDir, err)
+	}
+
+	entries, err := os.ReadDir(bufferDir)
+	if err != nil {
+		return fmt.Errorf("failed to read buffer directory %q: %w", bufferDir, err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, manifestFileSuffix) {
+			continue
+		}
+
+		escapedPath := strings.TrimSuffix(name, manifestFileSuffix)
+		dataPath := filepath.Join(bufferDir, escapedPath+bufferFileSuffix)
+		manifestPath := filepath.Join(bufferDir, name)
+		if err := recoverStream(pluginCtx, dataPath, manifestPath); err != nil {
+			pluginCtx.Log.With("buffer", escapedPath).Errorf("Failed to recover buffer: %v", err)
+		}
+	}
+	return nil
+}
+
+// recoverStream uploads and removes a single buffer left behind by a previous execution.
+func recoverStream(pluginCtx *PluginContext, dataPath, manifestPath string) error {
+	manifest, err := readManifest(manifestPath)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(dataPath)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && info.Size() == 0) {
+		// Crashed before anything was buffered; nothing to upload.
+		pluginCtx.Log.With("stream", manifest.Tag).Infof("Removing empty buffer")
+		if err := removeBufferFiles(dataPath, manifestPath); err != nil {
+			return err
+		}
+		metrics.RecoveredBuffers.Inc(manifest.Tag, metrics.ResultEmpty)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat buffer %q: %w", dataPath, err)
+	}
+
+	err = recoverBuffer(pluginCtx, manifest, info.Size(), dataPath, manifestPath)
+	metrics.ObserveRecovery(manifest.Tag, err)
+	return err
+}
+
+// recoverBuffer uploads and removes a non-empty buffer left behind by a previous execution,
+// finishing its IR stream and Zstd frame first unless it was finalized.
+func recoverBuffer(
+	pluginCtx *PluginContext,
+	manifest *streamManifest,
+	size int64,
+	dataPath string,
+	manifestPath string,
+) error {
+	uploadPath := dataPath
+	if !manifest.Finalized {
+		uploadPath = dataPath + recoveredFileSuffix
+		if err := finalizeBuffer(dataPath, uploadPath); err != nil {
+			return fmt.Errorf("failed to finalize buffer %q: %w", dataPath, err)
+		}
+	}
+
+	pluginCtx.Log.With("stream", manifest.Tag).Infof(
+		"Recovered buffer (%d bytes, %d previously synced)", size, manifest.SyncedBytes)
+
+	// The events written to the buffer are unknown, so the object gets the default storage class
+	// and its metadata only describes its source.
+	metadata := objmeta.Metadata(pluginCtx.objectSource(manifest.Tag), nil)
+	opts := objstore.PutOptions{Metadata: metadata}
+	start := time.Now()
+	err := pluginCtx.uploadFile(uploadPath, manifest.RemoteKey, opts)
+	metrics.ObserveUpload(manifest.Tag, start, err)
+	if err != nil {
+		return fmt.Errorf("failed to upload recovered buffer for %q: %w", manifest.Tag, err)
+	}
+
+	deleteSegments(pluginCtx, manifest)
+	deleteStaleIndex(pluginCtx, manifest)
+
+	if uploadPath != dataPath {
+		if err := os.Remove(uploadPath); err != nil {
+			return fmt.Errorf("failed to remove %q: %w", uploadPath, err)
+		}
+	}
+	return removeBufferFiles(dataPath, manifestPath)
+}
+
+// deleteStaleIndex removes the sidecar index of a recovered object, which describes an earlier
+// sync of the object. Readers ignore an index whose object size differs, so failures are only
+// logged.
+func deleteStaleIndex(pluginCtx *PluginContext, manifest *streamManifest) {
+	if !pluginCtx.WriteIndex {
+		return
+	}
+	key := manifest.RemoteKey + objindex.KeySuffix
+	if err := pluginCtx.deleteObjects([]string{key}); err != nil {
+		pluginCtx.Log.Warnf("Failed to delete stale index of %q: %v", manifest.RemoteKey, err)
+	}
+}
+
+// finalizeBuffer rewrites a buffer file left behind by a crash as a complete CLP IR stream.
+//
+// A crashed buffer ends inside an unterminated Zstd frame (and possibly a partially written
+// block), and its IR stream is missing the end-of-stream tag. Every block that can be decoded is
+// copied into a new, terminated Zstd frame and the IR end-of-stream tag is appended. Data after the
+// first undecodable block was never synced and cannot be recovered.
+func finalizeBuffer(dataPath, finalPath string) error {
+	// #nosec G304 -- dataPath is listed from the plugin's own buffer directory
+	src, err := os.Open(dataPath)
+	if err != nil {
+		return fmt.Errorf("failed to open %q: %w", dataPath, err)
+	}
+	defer src.Close()
+
+	// #nosec G304 -- finalPath is derived from the plugin's own buffer directory
+	dst, err := os.OpenFile(finalPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, bufferFilePermission)
+	if err != nil {
+		return fmt.Errorf("failed to create %q: %w", finalPath, err)
+	}
+	defer dst.Close()
+
+	zstdReader, err := zstd.NewReader(src, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return fmt.Errorf("failed to create zstd reader: %w", err)
+	}
+	defer zstdReader.Close()
+
+	zstdWriter, err := zstd.NewWriter(dst)
+	if err != nil {
+		return fmt.Errorf("failed to create zstd writer: %w", err)
+	}
+
+	// The copy is expected to stop with an error at the end of the unterminated frame.
+	n, err := io.Copy(zstdWriter, zstdReader)
+	if err != nil {
+		logging.Default().Infof("Buffer %q is truncated after %d bytes of IR: %v", dataPath, n, err)
+	}
+
+	if _, err := zstdWriter.Write([]byte{irEndOfStream}); err != nil {
+		_ = zstdWriter.Close()
+		return fmt.Errorf("failed to terminate IR stream: %w", err)
+	}
+	if err := zstdWriter.Close(); err != nil {
+		return fmt.Errorf("failed to close zstd frame: %w", err)
+	}
+	return dst.Sync()
+}
+
+// removeBufferFiles removes a stream's buffer file and manifest.
+//
+// A missing buffer file is not an error since the manifest is written before the buffer file is
+// created.
+func removeBufferFiles(dataPath, manifestPath string) error {
+	if err := os.Remove(dataPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove buffer %q: %w", dataPath, err)
+	}
+	if err := os.Remove(manifestPath); err != nil {
+		return fmt.Errorf("failed to remove manifest %q: %w", manifestPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestBufferFilePaths_EscapesSeparators(t *testing.T) {
+	dataPath, manifestPath := bufferFilePaths("/buffers", "app/server.log", 3)
+
+	if filepath.Dir(dataPath) != "/buffers" {
+		t.Errorf("buffer file %q should be directly inside the buffer directory", dataPath)
+	}
+	if filepath.Dir(manifestPath) != "/buffers" {
+		t.Errorf("manifest %q should be directly inside the buffer directory", manifestPath)
+	}
+	if filepath.Base(dataPath) != "app%2Fserver.log.3"+bufferFileSuffix {
+		t.Errorf("unexpected buffer file name %q", filepath.Base(dataPath))
+	}
+}
+
+func TestManifest_RoundTrip(t *testing.T) {
+	manifestPath := filepath.Join(t.TempDir(), "tag"+manifestFileSuffix)
+	want := streamManifest{
+		Tag:         "tag",
+		Sequence:    1,
+		RemoteKey:   "tag.1.clp.zst",
+		SyncedBytes: 42,
+	}
+
+	if err := writeManifest(manifestPath, &want); err != nil {
+		t.Fatalf("writeManifest() error = %v", err)
+	}
+	got, err := readManifest(manifestPath)
+	if err != nil {
+		t.Fatalf("readManifest() error = %v", err)
+	}
+	if *got != want {
+		t.Errorf("readManifest() = %+v, want %+v", *got, want)
+	}
+	if _, err := os.Stat(manifestPath + tempFileSuffix); !os.IsNotExist(err) {
+		t.Error("temporary manifest should have been renamed")
+	}
+}
+
+func TestFinalizeBuffer_TruncatedFrame(t *testing.T) {
+	dir := t.TempDir()
+	dataPath := filepath.Join(dir, "tag"+bufferFileSuffix)
+	finalPath := dataPath + recoveredFileSuffix
+	payload := bytes.Repeat([]byte("synced IR bytes "), 64)
+
+	// Simulate a crash: the frame is flushed but never closed.
+	f, err := os.Create(dataPath)
+	if err != nil {
+		t.Fatalf("Failed to create buffer file: %v", err)
+	}
+	zstdWriter, err := zstd.NewWriter(f)
+	if err != nil {
+		t.Fatalf("Failed to create zstd writer: %v", err)
+	}
+	if _, err := zstdWriter.Write(payload); err != nil {
+		t.Fatalf("Failed to write payload: %v", err)
+	}
+	if err := zstdWriter.Flush(); err != nil {
+		t.Fatalf("Failed to flush zstd writer: %v", err)
+	}
+	f.Close()
+
+	if err := finalizeBuffer(dataPath, finalPath); err != nil {
+		t.Fatalf("finalizeBuffer() error = %v", err)
+	}
+
+	recovered, err := os.Open(finalPath)
+	if err != nil {
+		t.Fatalf("Failed to open finalized buffer: %v", err)
+	}
+	defer recovered.Close()
+
+	zstdReader, err := zstd.NewReader(recovered)
+	if err != nil {
+		t.Fatalf("Failed to create zstd reader: %v", err)
+	}
+	defer zstdReader.Close()
+
+	decoded, err := io.ReadAll(zstdReader)
+	if err != nil {
+		t.Fatalf("finalized buffer should be a complete zstd frame: %v", err)
+	}
+	want := append(append([]byte{}, payload...), irEndOfStream)
+	if !bytes.Equal(decoded, want) {
+		t.Errorf("finalized buffer has %d bytes, want %d", len(decoded), len(want))
+	}
+}
+
+func TestRemoveBufferFiles_MissingBufferFile(t *testing.T) {
+	dir := t.TempDir()
+	dataPath := filepath.Join(dir, "tag"+bufferFileSuffix)
+	manifestPath := filepath.Join(dir, "tag"+manifestFileSuffix)
+
+	if err := os.WriteFile(manifestPath, []byte("{}"), bufferFilePermission); err != nil {
+		t.Fatalf("Failed to create manifest: %v", err)
+	}
+
+	if err := removeBufferFiles(dataPath, manifestPath); err != nil {
+		t.Errorf("removeBufferFiles() error = %v, want nil", err)
+	}
+	if _, err := os.Stat(manifestPath); !os.IsNotExist(err) {
+		t.Error("manifest should have been removed")
+	}
+}
+
+// writeTestBuffer leaves a finalized buffer and its manifest in the buffer directory, as if the
+// plugin had crashed after terminating it.
+func writeTestBuffer(t *testing.T, bufferDir string, manifest *streamManifest) (string, string) {
+	t.Helper()
+
+	dataPath, manifestPath := bufferFilePaths(bufferDir, manifest.Tag, manifest.Sequence)
+	if err := writeManifest(manifestPath, manifest); err != nil {
+		t.Fatalf("writeManifest() error = %v", err)
+	}
+	if err := os.WriteFile(dataPath, []byte("finalized"), bufferFilePermission); err != nil {
+		t.Fatalf("Failed to create buffer file: %v", err)
+	}
+	return dataPath, manifestPath
+}
+
+func TestRecoverBufferDir_SkipsFailedStreams(t *testing.T) {
+	pluginCtx, store := newTestPluginContext(t)
+	writeTestBuffer(t, pluginCtx.BufferDir, &streamManifest{
+		Tag:       "good",
+		RemoteKey: "good.clp.zst",
+		Finalized: true,
+	})
+	corruptPath := filepath.Join(pluginCtx.BufferDir, "corrupt.0"+manifestFileSuffix)
+	if err := os.WriteFile(corruptPath, []byte("{"), bufferFilePermission); err != nil {
+		t.Fatalf("Failed to create manifest: %v", err)
+	}
+
+	if err := RecoverBufferDir(pluginCtx); err != nil {
+		t.Fatalf("RecoverBufferDir() error = %v, want nil", err)
+	}
+	if _, ok := store.Get("good.clp.zst"); !ok {
+		t.Error("buffer after the corrupt manifest should have been recovered")
+	}
+	if _, err := os.Stat(corruptPath); err != nil {
+		t.Errorf("corrupt manifest should have been left in place: %v", err)
+	}
+}
+
+func TestRecoverBufferDir_RetriedWhenStreamReopens(t *testing.T) {
+	pluginCtx, store := newTestPluginContext(t)
+	dataPath, manifestPath := writeTestBuffer(t, pluginCtx.BufferDir, &streamManifest{
+		Tag:       testPath,
+		RemoteKey: "crashed.clp.zst",
+		Finalized: true,
+	})
+
+	store.FailPuts(errors.New("store unreachable"))
+	if err := RecoverBufferDir(pluginCtx); err != nil {
+		t.Fatalf("RecoverBufferDir() error = %v, want nil", err)
+	}
+	if _, err := os.Stat(dataPath); err != nil {
+		t.Fatalf("buffer should have been left in place after a failed upload: %v", err)
+	}
+	if _, err := GetOrCreateIngestionContext(pluginCtx, testPath); err == nil {
+		t.Fatal("GetOrCreateIngestionContext() should fail until the earlier buffer is uploaded")
+	}
+	if _, err := os.Stat(dataPath); err != nil {
+		t.Fatalf("failed retry should have left the earlier buffer in place: %v", err)
+	}
+
+	store.FailPuts(nil)
+	ingestionCtx, err := GetOrCreateIngestionContext(pluginCtx, testPath)
+	if err != nil {
+		t.Fatalf("GetOrCreateIngestionContext() error = %v", err)
+	}
+	defer ingestionCtx.Finalize(pluginCtx)
+	if object, ok := store.Get("crashed.clp.zst"); !ok || string(object.Data) != "finalized" {
+		t.Errorf("earlier buffer should have been recovered before reusing its path")
+	}
+	if ingestionCtx.manifestPath != manifestPath ||
+		ingestionCtx.manifest.RemoteKey == "crashed.clp.zst" {
+		t.Errorf("stream should have opened a new object at the same path")
+	}
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"maps"
+	"sync"
+
+	"github.com/y-scope/fluent-bit-clp/internal/metrics"
+)
+
+// IngestionRegistry maps stream paths to their ingestion contexts.
+//
+// Fluent Bit may call FLBPluginFlushCtx from several worker goroutines while flush timers fire on
+// their own goroutines, so the map is guarded by a read-write mutex. Streams are created under the
+// write lock so concurrent flushes for a new path never create it twice.
+type IngestionRegistry struct {
+	mu      sync.RWMutex
+	streams map[string]*IngestionContext
+}
+
+// newIngestionRegistry creates an empty registry.
+func newIngestionRegistry() *IngestionRegistry {
+	return &IngestionRegistry{streams: make(map[string]*IngestionContext)}
+}
+
+// get returns the stream registered for path, if any.
+func (r *IngestionRegistry) get(path string) (*IngestionContext, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ingestionCtx, exists := r.streams[path]
+	return ingestionCtx, exists
+}
+
+// getOrCreate returns the stream registered for path, calling create and registering its result
+// if there is none.
+func (r *IngestionRegistry) getOrCreate(
+	path string,
+	create func() (*IngestionContext, error),
+) (*IngestionContext, error) {
+	return r.lookup(path, create, false)
+}
+
+// acquire is like getOrCreate, but also pins the returned stream so that it is not evicted to make
+// room for other streams until it is released (see [IngestionContext.release]).
+func (r *IngestionRegistry) acquire(
+	path string,
+	create func() (*IngestionContext, error),
+) (*IngestionContext, error) {
+	return r.lookup(path, create, true)
+}
+
+// lookup implements getOrCreate and acquire. Streams are pinned while a lock is held, so a stream
+// is never pinned once removeUnpinned has unregistered it.
+func (r *IngestionRegistry) lookup(
+	path string,
+	create func() (*IngestionContext, error),
+	pin bool,
+) (*IngestionContext, error) {
+	r.mu.RLock()
+	ingestionCtx, exists := r.streams[path]
+	if exists && pin {
+		ingestionCtx.pins.Add(1)
+	}
+	r.mu.RUnlock()
+	if exists {
+		return ingestionCtx, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Another goroutine may have created the stream while the lock was released
+	ingestionCtx, exists = r.streams[path]
+	if !exists {
+		var err error
+		ingestionCtx, err = create()
+		if err != nil {
+			return nil, err
+		}
+		r.streams[path] = ingestionCtx
+		metrics.OpenStreams.Add(1)
+	}
+	if pin {
+		ingestionCtx.pins.Add(1)
+	}
+	return ingestionCtx, nil
+}
+
+// remove unregisters the stream at path, provided it is still ingestionCtx. A stream that has
+// already been replaced by a newer context for the same path is left untouched.
+func (r *IngestionRegistry) remove(path string, ingestionCtx *IngestionContext) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.removeLocked(path, ingestionCtx)
+}
+
+// removeUnpinned is like remove, but leaves the stream registered if it is pinned. Returns whether
+// the stream was unregistered.
+func (r *IngestionRegistry) removeUnpinned(path string, ingestionCtx *IngestionContext) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if ingestionCtx.pinned() {
+		return false
+	}
+	return r.removeLocked(path, ingestionCtx)
+}
+
+// removeLocked implements remove. The caller must hold the write lock.
+func (r *IngestionRegistry) removeLocked(path string, ingestionCtx *IngestionContext) bool {
+	if r.streams[path] != ingestionCtx {
+		return false
+	}
+	delete(r.streams, path)
+	metrics.OpenStreams.Add(-1)
+	metrics.CloseStream(path)
+	return true
+}
+
+// Snapshot returns a copy of the registered streams keyed by path. Streams may be added to or
+// removed from the registry while the copy is iterated.
+func (r *IngestionRegistry) Snapshot() map[string]*IngestionContext {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return maps.Clone(r.streams)
+}
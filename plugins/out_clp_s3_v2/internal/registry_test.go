@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestIngestionRegistry_GetOrCreate_CreatesOnce(t *testing.T) {
+	registry := newIngestionRegistry()
+	var creates atomic.Int32
+	create := func() (*IngestionContext, error) {
+		creates.Add(1)
+		return &IngestionContext{path: "tag"}, nil
+	}
+
+	const goroutines = 32
+	results := make([]*IngestionContext, goroutines)
+	var wg sync.WaitGroup
+	for i := range goroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ingestionCtx, err := registry.getOrCreate("tag", create)
+			if err != nil {
+				t.Errorf("getOrCreate() error = %v", err)
+			}
+			results[i] = ingestionCtx
+		}()
+	}
+	wg.Wait()
+
+	if got := creates.Load(); got != 1 {
+		t.Errorf("create called %d times, want 1", got)
+	}
+	for _, ingestionCtx := range results {
+		if ingestionCtx != results[0] {
+			t.Fatal("getOrCreate() returned different contexts for the same path")
+		}
+	}
+}
+
+func TestIngestionRegistry_Remove_IgnoresReplacedStream(t *testing.T) {
+	registry := newIngestionRegistry()
+	stale := &IngestionContext{path: "tag"}
+	current := &IngestionContext{path: "tag"}
+	registry.streams["tag"] = current
+
+	registry.remove("tag", stale)
+	if registry.Snapshot()["tag"] != current {
+		t.Error("remove() should not unregister a newer context for the same path")
+	}
+
+	registry.remove("tag", current)
+	if _, exists := registry.Snapshot()["tag"]; exists {
+		t.Error("remove() should unregister the context")
+	}
+}
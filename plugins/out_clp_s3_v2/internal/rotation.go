@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sequenceFileSuffix is appended to the escaped stream path to name the file persisting the next
+// unused object sequence number.
+const sequenceFileSuffix = ".sequence"
+
+// sizeUnits maps the suffixes accepted by parseSize to their multipliers.
+var sizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	// Longer suffixes first so "MB" is not matched as "B".
+	{"KB", 1 << 10},
+	{"MB", 1 << 20},
+	{"GB", 1 << 30},
+	{"K", 1 << 10},
+	{"M", 1 << 20},
+	{"G", 1 << 30},
+	{"B", 1},
+}
+
+// RotationConfig stores the policies that close a stream's current object and start a new one.
+//
+// Without rotation a stream is synced to a single object for its whole lifetime, so the buffer
+// file (and every re-upload of it) grows without bound. With rotation, each object is finalized
+// (IR stream and Zstd frame terminated) and uploaded one last time, its buffer file is deleted, and
+// the stream continues in a new object with the next sequence number.
+//
+// A zero value for a policy disables it; rotation is enabled if any policy is set.
+type RotationConfig struct {
+	// MaxSize rotates once the compressed buffer file reaches this many bytes.
+	MaxSize int64
+	// MaxAge rotates once an object has been open for this long.
+	MaxAge time.Duration
+	// Interval rotates when the wall clock crosses a multiple of this duration (in UTC), e.g. 1h
+	// rotates on the hour and 24h at midnight.
+	Interval time.Duration
+}
+
+// Enabled reports whether any rotation policy is set. A nil config disables rotation.
+func (c *RotationConfig) Enabled() bool {
+	return c != nil && (c.MaxSize > 0 || c.MaxAge > 0 || c.Interval > 0)
+}
+
+// timeBased reports whether an age or interval policy is set. These policies can become due while
+// a stream receives no records, so the janitor checks them as well.
+func (c *RotationConfig) timeBased() bool {
+	return c.maxAge() > 0 || c.interval() > 0
+}
+
+// maxAge returns MaxAge, or zero for a nil config.
+func (c *RotationConfig) maxAge() time.Duration {
+	if c == nil {
+		return 0
+	}
+	return c.MaxAge
+}
+
+// interval returns Interval, or zero for a nil config.
+func (c *RotationConfig) interval() time.Duration {
+	if c == nil {
+		return 0
+	}
+	return c.Interval
+}
+
+// shouldRotate reports whether an object of the given size, opened at openedAt, is due for
+// rotation at now.
+func (c *RotationConfig) shouldRotate(size int64, openedAt, now time.Time) bool {
+	if c.MaxSize > 0 && size >= c.MaxSize {
+		return true
+	}
+	if c.MaxAge > 0 && now.Sub(openedAt) >= c.MaxAge {
+		return true
+	}
+	if c.Interval > 0 && now.Truncate(c.Interval).After(openedAt.Truncate(c.Interval)) {
+		return true
+	}
+	return false
+}
+
+// nextSequence returns the next unused object sequence number for a stream and persists the one
+// after it.
+//
+// The counter is persisted in the buffer directory so that objects created after a restart never
+// overwrite objects uploaded (or recovered) by a previous execution.
+func nextSequence(sequencePath string) (int, error) {
+	sequence := 0
+
+	// #nosec G304 -- sequencePath is derived from the plugin's own buffer directory
+	data, err := os.ReadFile(sequencePath)
+	switch {
+	case err == nil:
+		sequence, err = strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse sequence file %q: %w", sequencePath, err)
+		}
+	case errors.Is(err, os.ErrNotExist):
+		// First object for this stream.
+	default:
+		return 0, fmt.Errorf("failed to read sequence file %q: %w", sequencePath, err)
+	}
+
+	tempPath := sequencePath + tempFileSuffix
+	next := []byte(strconv.Itoa(sequence + 1))
+	if err := os.WriteFile(tempPath, next, bufferFilePermission); err != nil {
+		return 0, fmt.Errorf("failed to write sequence file %q: %w", tempPath, err)
+	}
+	if err := os.Rename(tempPath, sequencePath); err != nil {
+		return 0, fmt.Errorf("failed to rename sequence file %q: %w", tempPath, err)
+	}
+	return sequence, nil
+}
+
+// parseSize parses a byte size such as "512", "64KB", "256M" or "1GB". Suffixes are
+// case-insensitive and use binary multiples.
+func parseSize(rawValue string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(rawValue))
+	multiplier := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", rawValue, err)
+	}
+	if size < 0 {
+		return 0, fmt.Errorf("invalid size %q: must not be negative", rawValue)
+	}
+	return size * multiplier, nil
+}
@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotationConfig_Enabled(t *testing.T) {
+	var nilConfig *RotationConfig
+	if nilConfig.Enabled() {
+		t.Error("nil config should disable rotation")
+	}
+	if (&RotationConfig{}).Enabled() {
+		t.Error("zero config should disable rotation")
+	}
+	if !(&RotationConfig{MaxAge: time.Hour}).Enabled() {
+		t.Error("config with max age should enable rotation")
+	}
+}
+
+func TestRotationConfig_ShouldRotate(t *testing.T) {
+	openedAt := time.Date(2024, 1, 15, 10, 30, 0, 0, time.UTC)
+	hour := RotationConfig{MaxAge: time.Hour}
+	hourly := RotationConfig{Interval: time.Hour}
+
+	tests := []struct {
+		name   string
+		config RotationConfig
+		size   int64
+		now    time.Time
+		want   bool
+	}{
+		{"below max size", RotationConfig{MaxSize: 100}, 99, openedAt, false},
+		{"at max size", RotationConfig{MaxSize: 100}, 100, openedAt, true},
+		{"below max age", hour, 0, openedAt.Add(59 * time.Minute), false},
+		{"at max age", hour, 0, openedAt.Add(time.Hour), true},
+		{"same hour", hourly, 0, openedAt.Add(29 * time.Minute), false},
+		{"next hour", hourly, 0, openedAt.Add(30 * time.Minute), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.shouldRotate(tt.size, openedAt, tt.now); got != tt.want {
+				t.Errorf("shouldRotate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextSequence_PersistsAcrossCalls(t *testing.T) {
+	sequencePath := filepath.Join(t.TempDir(), "tag"+sequenceFileSuffix)
+
+	for want := range 3 {
+		got, err := nextSequence(sequencePath)
+		if err != nil {
+			t.Fatalf("nextSequence() error = %v", err)
+		}
+		if got != want {
+			t.Errorf("nextSequence() = %d, want %d", got, want)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    int64
+		wantErr bool
+	}{
+		{"512", 512, false},
+		{"64KB", 64 << 10, false},
+		{"256M", 256 << 20, false},
+		{"1gb", 1 << 30, false},
+		{"10 MB", 10 << 20, false},
+		{"-1", 0, true},
+		{"big", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := parseSize(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSize(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseSize(%q) = %d, want %d", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPluginContext_RotateDueStreams(t *testing.T) {
+	pluginCtx, store := newTestPluginContext(t)
+	pluginCtx.Rotation = &RotationConfig{MaxAge: time.Hour}
+	ingestionCtx, err := GetOrCreateIngestionContext(pluginCtx, testPath)
+	if err != nil {
+		t.Fatalf("GetOrCreateIngestionContext() error = %v", err)
+	}
+	defer ingestionCtx.Flush.Stop()
+	if err := ingestionCtx.WriteLogEvent(newTestLogEvent(0, 0), time.Time{}, 0); err != nil {
+		t.Fatalf("WriteLogEvent() error = %v", err)
+	}
+	if err := ingestionCtx.FlushBuffer(); err != nil {
+		t.Fatalf("FlushBuffer() error = %v", err)
+	}
+
+	// No further records arrive, so only the janitor can rotate the object.
+	now := time.Now()
+	pluginCtx.rotateDueStreams(now.Add(30 * time.Minute))
+	if puts := store.Puts(); puts != 0 {
+		t.Fatalf("got %d uploads before the object is due, want 0", puts)
+	}
+	pluginCtx.rotateDueStreams(now.Add(2 * time.Hour))
+	if _, ok := store.Get(testPath + ".0.clp.zst"); !ok {
+		t.Fatalf("object due for rotation should have been uploaded, got keys %v", store.Keys())
+	}
+	if ingestionCtx.manifest.Sequence != 1 {
+		t.Errorf("stream should continue in object 1, got %d", ingestionCtx.manifest.Sequence)
+	}
+
+	// The new object holds no records, so it is not rotated however old it gets.
+	pluginCtx.rotateDueStreams(now.Add(4 * time.Hour))
+	if keys := store.Keys(); len(keys) != 1 {
+		t.Errorf("empty object should not be rotated, got keys %v", keys)
+	}
+}
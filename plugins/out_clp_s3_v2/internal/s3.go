@@ -15,7 +15,7 @@
 //
 // # Key Components
 //
-//   - PluginContext: Top-level context holding S3 client and ingestion contexts
+//   - PluginContext: Top-level context holding the object store and ingestion contexts
 //   - IngestionContext: Per-stream context with compression and flush management
 //   - FlushConfigContext: Configuration for the dual-timer flush strategy
 package internal
@@ -24,7 +24,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
 	"os"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -112,38 +111,3 @@ func S3ValidateLogBucket(s3Client *s3.Client, logBucket string) error {
 	}
 	return nil
 }
-
-// S3Upload uploads a local file to S3.
-//
-// Parameters:
-//   - s3Client: Configured S3 client
-//   - bucket: Target S3 bucket name
-//   - localPath: Path to the local file to upload
-//   - remotePath: S3 object key (path within the bucket)
-//
-// The file is uploaded using a single PutObject request. For large files,
-// consider using multipart upload (not implemented in this version).
-func S3Upload(s3Client *s3.Client, bucket, localPath, remotePath string) error {
-	// #nosec G304 -- localPath is from trusted internal temp file creation
-	file, err := os.Open(localPath)
-	if err != nil {
-		return fmt.Errorf("failed to open file %q: %w", localPath, err)
-	}
-	defer func() {
-		if cerr := file.Close(); cerr != nil {
-			log.Printf("[warn] Failed to close file %q: %v", localPath, cerr)
-		}
-	}()
-
-	_, err = s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(remotePath),
-		Body:   file,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to upload %s to s3://%s/%s: %w",
-			localPath, bucket, remotePath, err)
-	}
-	log.Printf("[info] Uploaded %s to s3://%s/%s", localPath, bucket, remotePath)
-	return nil
-}
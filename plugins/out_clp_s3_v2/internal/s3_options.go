@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"unsafe"
+
+	"github.com/fluent/fluent-bit-go/output"
+
+	"github.com/y-scope/fluent-bit-clp/internal/objstore"
+)
+
+// s3OnlyOptions are the configuration keys only supported by the S3 destination, besides the
+// storage_class_<level> keys.
+var s3OnlyOptions = []string{
+	"sse",
+	"sse_kms_key_id",
+	"sse_bucket_key",
+	"sse_encryption_context",
+	"sse_customer_key",
+	"storage_class",
+}
+
+// StorageClassConfig selects the storage class of each object from the most severe log level
+// written to it, so objects holding only verbose logs can go straight to a colder class.
+type StorageClassConfig struct {
+	// ByLevel holds the storage class of each log level, indexed by level. Empty entries use the
+	// store's default storage class.
+	ByLevel []string
+}
+
+// Enabled returns true if any log level has its own storage class. Safe to call on a nil config.
+func (c *StorageClassConfig) Enabled() bool {
+	if c == nil {
+		return false
+	}
+	for _, class := range c.ByLevel {
+		if class != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// forLevel returns the storage class of objects whose most severe log level is level, or "" to
+// use the store's default. Safe to call on a nil config.
+func (c *StorageClassConfig) forLevel(level int) string {
+	if c == nil || level < 0 || level >= len(c.ByLevel) {
+		return ""
+	}
+	return c.ByLevel[level]
+}
+
+// s3Options reads the encryption and storage class options of uploaded S3 objects.
+//
+// Configuration keys read from Fluent Bit:
+//   - sse: Server-side encryption, "AES256" or "aws:kms" (default: bucket default)
+//   - sse_kms_key_id: KMS key of "aws:kms" encryption (default: AWS managed key)
+//   - sse_bucket_key: Whether "aws:kms" encryption uses an S3 Bucket Key (default: false)
+//   - sse_encryption_context: JSON object of "aws:kms" encryption context (default: none)
+//   - sse_customer_key: Base64 encoded 256-bit key for SSE-C (default: none)
+//   - storage_class: Storage class of objects, e.g. "STANDARD_IA" (default: bucket default)
+//
+// Returns an error if an option cannot be parsed or the combination is invalid.
+func s3Options(plugin unsafe.Pointer) (objstore.S3Options, error) {
+	opts := objstore.S3Options{
+		ServerSideEncryption: output.FLBPluginConfigKey(plugin, "sse"),
+		KMSKeyID:             output.FLBPluginConfigKey(plugin, "sse_kms_key_id"),
+		CustomerKey:          output.FLBPluginConfigKey(plugin, "sse_customer_key"),
+		StorageClass:         output.FLBPluginConfigKey(plugin, "storage_class"),
+	}
+
+	if rawValue := output.FLBPluginConfigKey(plugin, "sse_bucket_key"); rawValue != "" {
+		bucketKey, err := strconv.ParseBool(rawValue)
+		if err != nil {
+			return objstore.S3Options{}, fmt.Errorf("invalid sse_bucket_key %q: %w", rawValue, err)
+		}
+		opts.BucketKeyEnabled = bucketKey
+	}
+
+	if rawValue := output.FLBPluginConfigKey(plugin, "sse_encryption_context"); rawValue != "" {
+		if err := json.Unmarshal([]byte(rawValue), &opts.EncryptionContext); err != nil {
+			return objstore.S3Options{}, fmt.Errorf(
+				"invalid sse_encryption_context, expected JSON object of strings: %w", err)
+		}
+	}
+
+	if err := opts.Validate(); err != nil {
+		return objstore.S3Options{}, fmt.Errorf("invalid encryption or storage class: %w", err)
+	}
+	return opts, nil
+}
+
+// newStorageClassConfig reads the storage_class_<level> options, e.g. storage_class_debug.
+//
+// Returns an error if a storage class is not an S3 storage class.
+func newStorageClassConfig(plugin unsafe.Pointer) (*StorageClassConfig, error) {
+	config := &StorageClassConfig{ByLevel: make([]string, len(logLevelNames))}
+	var errs []error
+	for level, name := range logLevelNames {
+		key := "storage_class_" + name
+		class := output.FLBPluginConfigKey(plugin, key)
+		if class != "" && !objstore.IsS3StorageClass(class) {
+			errs = append(errs, fmt.Errorf("invalid %s: unknown storage class %q", key, class))
+		}
+		config.ByLevel[level] = class
+	}
+	return config, errors.Join(errs...)
+}
+
+// checkS3OnlyOptions returns an error if options only supported by the S3 destination are set
+// for another destination.
+func checkS3OnlyOptions(plugin unsafe.Pointer, destination string) error {
+	keys := append([]string{}, s3OnlyOptions...)
+	for _, name := range logLevelNames {
+		keys = append(keys, "storage_class_"+name)
+	}
+	for _, key := range keys {
+		if output.FLBPluginConfigKey(plugin, key) != "" {
+			return fmt.Errorf("%s is only supported by destination %q, not %q",
+				key, objstore.DestinationS3, destination)
+		}
+	}
+	return nil
+}
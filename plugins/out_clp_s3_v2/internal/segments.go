@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Sync modes select how a stream's buffer file is shipped to the object store when a flush timer
+// fires.
+const (
+	// SyncModeFull re-uploads the entire buffer file to the object key on every sync.
+	SyncModeFull = "full"
+	// SyncModeSegments uploads only the bytes appended since the last sync as numbered segment
+	// objects. The complete object is uploaded once, when it is finalized.
+	SyncModeSegments = "segments"
+	// SyncModeAppend appends the bytes written since the last sync to the object itself, so the
+	// object always holds the synced prefix of the buffer file. Requires a destination supporting
+	// appends (see [objstore.Appender]).
+	SyncModeAppend = "append"
+)
+
+// Segment object naming.
+const (
+	// segmentKeyFormat names segment n of an object: "<key>.segments/<n>".
+	segmentKeyFormat = "%s.segments/%06d"
+	// indexKeySuffix is appended to an object key to name its segment index.
+	indexKeySuffix = ".index.json"
+	// indexContentType is the content type of segment index objects.
+	indexContentType = "application/json"
+)
+
+// segmentIndex describes the segments uploaded so far for an object that has not been finalized.
+//
+// Concatenating segments 0 to SegmentCount-1 in order yields the first SyncedBytes bytes of the
+// object: a (not yet terminated) Zstd compressed CLP IR stream.
+type segmentIndex struct {
+	// Object is the key the complete object is uploaded to once finalized.
+	Object string `json:"object"`
+	// SegmentKeyFormat is the printf format of segment keys, taking the object key and segment
+	// number.
+	SegmentKeyFormat string `json:"segment_key_format"`
+	// SegmentCount is the number of segments uploaded.
+	SegmentCount int `json:"segment_count"`
+	// SyncedBytes is the combined size of all segments.
+	SyncedBytes int64 `json:"synced_bytes"`
+}
+
+// segmentKey returns the key of segment n of the object at remoteKey.
+func segmentKey(remoteKey string, n int) string {
+	return fmt.Sprintf(segmentKeyFormat, remoteKey, n)
+}
+
+// syncSegment uploads the bytes appended to the buffer file since the last sync as the next
+// segment, then updates the object's segment index.
+//
+// Upload cost is proportional to the new data rather than to the size of the whole buffer file,
+// so frequent syncs of large streams stay cheap.
+//
+// Parameters:
+//   - pluginCtx: Plugin context holding the object store
+//   - size: Size of the buffer file after the Zstd writer was flushed
+func (ctx *IngestionContext) syncSegment(pluginCtx *PluginContext, size int64) error {
+	manifest := ctx.manifest
+	length := size - manifest.SyncedBytes
+	if length <= 0 {
+		// Nothing was appended since the last sync.
+		return nil
+	}
+
+	key := segmentKey(manifest.RemoteKey, manifest.Segments)
+	err := pluginCtx.uploadFileRange(
+		ctx.Compression.File.Name(),
+		manifest.SyncedBytes,
+		length,
+		key,
+		ctx.putOptions(pluginCtx),
+	)
+	if err != nil {
+		return err
+	}
+
+	index := segmentIndex{
+		Object:           manifest.RemoteKey,
+		SegmentKeyFormat: segmentKeyFormat,
+		SegmentCount:     manifest.Segments + 1,
+		SyncedBytes:      size,
+	}
+	body, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("failed to marshal segment index: %w", err)
+	}
+	err = pluginCtx.putBytes(manifest.RemoteKey+indexKeySuffix, body, indexContentType)
+	if err != nil {
+		return err
+	}
+
+	manifest.Segments = index.SegmentCount
+	return nil
+}
+
+// syncAppend appends the bytes written to the buffer file since the last sync to the object.
+//
+// Parameters:
+//   - pluginCtx: Plugin context holding the object store
+//   - dataPath: Path of the buffer file
+//   - size: Size of the buffer file after the Zstd writer was flushed
+func (ctx *IngestionContext) syncAppend(
+	pluginCtx *PluginContext,
+	dataPath string,
+	size int64,
+) error {
+	length := size - ctx.manifest.SyncedBytes
+	if length <= 0 {
+		// Nothing was appended since the last sync.
+		return nil
+	}
+	return pluginCtx.appendFileRange(dataPath, ctx.manifest.SyncedBytes, length,
+		ctx.manifest.RemoteKey, ctx.putOptions(pluginCtx))
+}
+
+// deleteSegments removes the segments and segment index of an object once the complete object has
+// been uploaded. Failures are logged rather than returned since the complete object is already
+// safely stored.
+func deleteSegments(pluginCtx *PluginContext, manifest *streamManifest) {
+	if manifest.Segments == 0 {
+		return
+	}
+
+	keys := make([]string, 0, manifest.Segments+1)
+	for n := range manifest.Segments {
+		keys = append(keys, segmentKey(manifest.RemoteKey, n))
+	}
+	keys = append(keys, manifest.RemoteKey+indexKeySuffix)
+
+	if err := pluginCtx.deleteObjects(keys); err != nil {
+		pluginCtx.Log.Warnf("Failed to delete segments of %q: %v", manifest.RemoteKey, err)
+	}
+}
@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/y-scope/fluent-bit-clp/internal/objstore"
+)
+
+// newTestSegmentStream creates a stream syncing in [SyncModeSegments] whose flush timers are
+// stopped, so tests control when syncs happen.
+func newTestSegmentStream(
+	t *testing.T,
+) (*PluginContext, *objstore.MemoryStore, *IngestionContext) {
+	t.Helper()
+
+	pluginCtx, store := newTestPluginContext(t)
+	pluginCtx.SyncMode = SyncModeSegments
+	ingestionCtx, err := GetOrCreateIngestionContext(pluginCtx, testPath)
+	if err != nil {
+		t.Fatalf("GetOrCreateIngestionContext() error = %v", err)
+	}
+	ingestionCtx.Flush.Stop()
+	return pluginCtx, store, ingestionCtx
+}
+
+func TestSyncSegment_IndexAndNumbering(t *testing.T) {
+	pluginCtx, store, ingestionCtx := newTestSegmentStream(t)
+	remoteKey := ingestionCtx.manifest.RemoteKey
+
+	for i := range 3 {
+		if err := ingestionCtx.WriteLogEvent(newTestLogEvent(0, i), time.Time{}, 0); err != nil {
+			t.Fatalf("WriteLogEvent() error = %v", err)
+		}
+		if err := ingestionCtx.sync(pluginCtx); err != nil {
+			t.Fatalf("sync() error = %v", err)
+		}
+	}
+
+	// A sync without new bytes uploads nothing
+	puts := store.Puts()
+	if err := ingestionCtx.sync(pluginCtx); err != nil {
+		t.Fatalf("sync() error = %v", err)
+	}
+	if store.Puts() != puts {
+		t.Errorf("sync() without new bytes uploaded %d objects", store.Puts()-puts)
+	}
+
+	object, ok := store.Get(remoteKey + indexKeySuffix)
+	if !ok {
+		t.Fatalf("segment index %q not uploaded, got keys %v", remoteKey+indexKeySuffix,
+			store.Keys())
+	}
+	var index segmentIndex
+	if err := json.Unmarshal(object.Data, &index); err != nil {
+		t.Fatalf("Failed to parse segment index: %v", err)
+	}
+	buffer, err := os.ReadFile(ingestionCtx.Compression.File.Name())
+	if err != nil {
+		t.Fatalf("Failed to read buffer file: %v", err)
+	}
+	want := segmentIndex{
+		Object:           remoteKey,
+		SegmentKeyFormat: segmentKeyFormat,
+		SegmentCount:     3,
+		SyncedBytes:      int64(len(buffer)),
+	}
+	if index != want {
+		t.Errorf("segment index = %+v, want %+v", index, want)
+	}
+
+	// Concatenating the segments in order yields the synced prefix of the buffer file
+	var concatenated []byte
+	for n := range index.SegmentCount {
+		segment, ok := store.Get(segmentKey(remoteKey, n))
+		if !ok {
+			t.Fatalf("segment %d not uploaded", n)
+		}
+		if len(segment.Data) == 0 {
+			t.Errorf("segment %d is empty", n)
+		}
+		concatenated = append(concatenated, segment.Data...)
+	}
+	if !bytes.Equal(concatenated, buffer[:index.SyncedBytes]) {
+		t.Errorf("segments hold %d bytes, want the %d synced bytes of the buffer file",
+			len(concatenated), index.SyncedBytes)
+	}
+
+	// Segment numbering is persisted so recovery knows which segments to delete
+	manifest, err := readManifest(ingestionCtx.manifestPath)
+	if err != nil {
+		t.Fatalf("readManifest() error = %v", err)
+	}
+	if manifest.Segments != 3 || manifest.SyncedBytes != index.SyncedBytes {
+		t.Errorf("manifest = %+v, want 3 segments and %d synced bytes", *manifest,
+			index.SyncedBytes)
+	}
+
+	if err := ingestionCtx.Finalize(pluginCtx); err != nil {
+		t.Fatalf("Finalize() error = %v", err)
+	}
+	if got := store.Keys(); !reflect.DeepEqual(got, []string{remoteKey}) {
+		t.Errorf("Keys() after Finalize = %v, want only %q", got, remoteKey)
+	}
+}
+
+func TestSyncSegment_NumberingRestartsAfterRotation(t *testing.T) {
+	pluginCtx, store, ingestionCtx := newTestSegmentStream(t)
+	pluginCtx.Rotation = &RotationConfig{MaxAge: time.Hour}
+
+	if err := ingestionCtx.WriteLogEvent(newTestLogEvent(0, 0), time.Time{}, 0); err != nil {
+		t.Fatalf("WriteLogEvent() error = %v", err)
+	}
+	if err := ingestionCtx.sync(pluginCtx); err != nil {
+		t.Fatalf("sync() error = %v", err)
+	}
+	firstKey := ingestionCtx.manifest.RemoteKey
+	if err := ingestionCtx.RotateIfNeeded(pluginCtx, time.Now().Add(2*time.Hour)); err != nil {
+		t.Fatalf("RotateIfNeeded() error = %v", err)
+	}
+
+	secondKey := ingestionCtx.manifest.RemoteKey
+	if secondKey == firstKey || ingestionCtx.manifest.Segments != 0 {
+		t.Fatalf("rotated stream should start a new object without segments, got %+v",
+			*ingestionCtx.manifest)
+	}
+	if err := ingestionCtx.WriteLogEvent(newTestLogEvent(0, 1), time.Time{}, 0); err != nil {
+		t.Fatalf("WriteLogEvent() error = %v", err)
+	}
+	if err := ingestionCtx.sync(pluginCtx); err != nil {
+		t.Fatalf("sync() error = %v", err)
+	}
+	if _, ok := store.Get(segmentKey(secondKey, 0)); !ok {
+		t.Errorf("first segment of the new object should be numbered 0, got keys %v",
+			store.Keys())
+	}
+	if _, ok := store.Get(segmentKey(firstKey, 0)); ok {
+		t.Error("segments of the rotated object should have been deleted")
+	}
+}
+
+func TestRecoverBufferDir_DeletesSegments(t *testing.T) {
+	pluginCtx, store := newTestPluginContext(t)
+	remoteKey := "crashed.clp.zst"
+	for _, key := range []string{
+		segmentKey(remoteKey, 0),
+		segmentKey(remoteKey, 1),
+		remoteKey + indexKeySuffix,
+	} {
+		if err := pluginCtx.putBytes(key, []byte("synced"), indexContentType); err != nil {
+			t.Fatalf("putBytes() error = %v", err)
+		}
+	}
+	writeTestBuffer(t, pluginCtx.BufferDir, &streamManifest{
+		Tag:       "crashed",
+		RemoteKey: remoteKey,
+		Segments:  2,
+		Finalized: true,
+	})
+
+	if err := RecoverBufferDir(pluginCtx); err != nil {
+		t.Fatalf("RecoverBufferDir() error = %v", err)
+	}
+	if got := store.Keys(); !reflect.DeepEqual(got, []string{remoteKey}) {
+		t.Errorf("Keys() after recovery = %v, want only the recovered object %q", got, remoteKey)
+	}
+}
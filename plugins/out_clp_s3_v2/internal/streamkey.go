@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/y-scope/fluent-bit-clp/internal/keytemplate"
+	"github.com/y-scope/fluent-bit-clp/internal/objmeta"
+)
+
+// Stream key defaults.
+const (
+	// defaultStreamKey keys streams by Fluent Bit tag.
+	defaultStreamKey = "$TAG"
+	// unknownStreamPath is used for records whose stream key and tag are both empty once
+	// sanitized.
+	unknownStreamPath = "unknown"
+)
+
+// parseStreamKey parses the stream_key option. The key is rendered for each record before its
+// stream is known, so it cannot reference the stream, its objects or their times.
+func parseStreamKey(text string) (*keytemplate.Template, error) {
+	streamKey, err := keytemplate.Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	err = streamKey.Reject(
+		keytemplate.StreamPlaceholder,
+		keytemplate.IndexPlaceholder,
+		keytemplate.UploadTimePlaceholder,
+		keytemplate.EventStartPlaceholder,
+		keytemplate.EventEndPlaceholder,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return streamKey, nil
+}
+
+// parseKeyFormat parses the s3_key_format option. An object's key is fixed once its first event is
+// written (see objectKey), so it cannot reference the time range of the object's events.
+func parseKeyFormat(text string) (*keytemplate.Template, error) {
+	keyFormat, err := keytemplate.Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	err = keyFormat.Reject(keytemplate.EventStartPlaceholder, keytemplate.EventEndPlaceholder)
+	if err != nil {
+		return nil, err
+	}
+	return keyFormat, nil
+}
+
+// StreamPath returns the path of the stream a record belongs to by rendering the stream_key
+// template with the record's tag and fields, the id option and the hostname.
+//
+// The rendered key is sanitized (see [keytemplate.Sanitize]) since it names both the stream's S3
+// object and its buffer file. Records for which the key renders empty, e.g. because the field it
+// references is missing, fall back to the stream of their tag.
+func (ctx *PluginContext) StreamPath(tag string, record map[string]any) string {
+	rendered := ctx.StreamKey.Render(keytemplate.Values{
+		Tag:      tag,
+		Record:   record,
+		ID:       ctx.ID,
+		Hostname: ctx.Hostname,
+	})
+	if path := keytemplate.Sanitize(rendered); path != "" {
+		return path
+	}
+	if path := keytemplate.Sanitize(tag); path != "" {
+		return path
+	}
+	return unknownStreamPath
+}
+
+// objectKey returns the S3 key of a stream's object.
+//
+// Without s3_key_format, objects are named "<path>.clp.zst", or "<path>.<sequence>.clp.zst" if
+// objects are sequenced (see openObject). With s3_key_format, the template is rendered with the
+// stream path as $STREAM, the sequence number as $INDEX, the id option as $ID, the time the
+// object is opened as $UPLOAD_TIME, and the tag and fields of the object's first record. The key
+// is rendered again once the first record is written (see nameObject) and is fixed from then on
+// since every sync overwrites it.
+func (ctx *PluginContext) objectKey(
+	path string,
+	sequence int,
+	sequenced bool,
+	openedAt time.Time,
+	first firstRecord,
+) string {
+	if ctx.KeyFormat == nil {
+		if sequenced {
+			return fmt.Sprintf("%s.%d.clp.zst", path, sequence)
+		}
+		return fmt.Sprintf("%s.clp.zst", path)
+	}
+	return ctx.KeyFormat.Render(keytemplate.Values{
+		Tag:        first.tag,
+		Stream:     path,
+		Record:     first.fields,
+		ID:         ctx.ID,
+		Index:      sequence,
+		Hostname:   ctx.Hostname,
+		UploadTime: openedAt,
+	})
+}
+
+// firstRecord is the tag and fields of the first record written to an object, available to
+// s3_key_format and object_tags.
+type firstRecord struct {
+	tag string
+	// fields is nil unless s3_key_format or object_tags reference record fields (see
+	// UsesRecordFields).
+	fields map[string]any
+}
+
+// UsesRecordFields reports whether s3_key_format or object_tags reference record fields, which
+// must then be kept for the first record of each object.
+func (ctx *PluginContext) UsesRecordFields() bool {
+	return (ctx.KeyFormat != nil && ctx.KeyFormat.UsesRecord()) || ctx.Tags.UsesRecord()
+}
+
+// objectSource returns the source recorded in the metadata of a stream's objects.
+func (ctx *PluginContext) objectSource(path string) objmeta.Source {
+	return objmeta.Source{
+		Tag:        path,
+		InstanceId: ctx.ID,
+		Hostname:   ctx.Hostname,
+		Plugin:     pluginName,
+	}
+}
@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/y-scope/fluent-bit-clp/internal/keytemplate"
+)
+
+func TestPluginContext_StreamPath(t *testing.T) {
+	tests := []struct {
+		name      string
+		streamKey string
+		tag       string
+		record    map[string]any
+		want      string
+	}{
+		{"tag", defaultStreamKey, "app.server", nil, "app.server"},
+		{
+			"file path",
+			"$file_path",
+			"tail.0",
+			map[string]any{"file_path": "/logs/app/server.log"},
+			"logs/app/server.log",
+		},
+		{
+			"tag and file path",
+			"$TAG[0]/$file_path",
+			"tail.0",
+			map[string]any{"file_path": "/logs/app/server.log"},
+			"tail/logs/app/server.log",
+		},
+		{
+			"unsafe file path",
+			"$file_path",
+			"tail.0",
+			map[string]any{"file_path": "/logs/../my app.log"},
+			"logs/_/my_app.log",
+		},
+		{"missing field falls back to tag", "$file_path", "tail.0", map[string]any{}, "tail.0"},
+		{"empty tag", "$file_path", "/", nil, unknownStreamPath},
+		{"id and hostname", "$ID/$HOSTNAME/$TAG", "app", nil, "fluent-1/node-1/app"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			streamKey, err := parseStreamKey(tt.streamKey)
+			if err != nil {
+				t.Fatalf("parseStreamKey(%q) error = %v", tt.streamKey, err)
+			}
+			pluginCtx := &PluginContext{StreamKey: streamKey, ID: "fluent-1", Hostname: "node-1"}
+			if got := pluginCtx.StreamPath(tt.tag, tt.record); got != tt.want {
+				t.Errorf("StreamPath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPluginContext_ObjectKey(t *testing.T) {
+	now := time.Date(2024, 1, 15, 10, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		keyFormat string
+		sequenced bool
+		first     firstRecord
+		want      string
+	}{
+		{"default", "", false, firstRecord{}, "app/server.log.clp.zst"},
+		{"default sequenced", "", true, firstRecord{}, "app/server.log.4.clp.zst"},
+		{
+			"template",
+			"logs/dt=$UPLOAD_TIME[%Y-%m-%d]/$HOSTNAME/$STREAM.$INDEX.clp.zst",
+			true,
+			firstRecord{},
+			"logs/dt=2024-01-15/node-1/app/server.log.4.clp.zst",
+		},
+		{
+			"first record",
+			"$kubernetes['namespace_name']/$TAG[1]/$STREAM.clp.zst",
+			false,
+			firstRecord{
+				tag: "kube.api",
+				fields: map[string]any{
+					"kubernetes": map[string]any{"namespace_name": "prod"},
+				},
+			},
+			"prod/api/app/server.log.clp.zst",
+		},
+		{
+			"before first record",
+			"$kubernetes['namespace_name']/$TAG[1]/$STREAM.clp.zst",
+			false,
+			firstRecord{},
+			"//app/server.log.clp.zst",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pluginCtx := &PluginContext{Hostname: "node-1"}
+			if tt.keyFormat != "" {
+				keyFormat, err := parseKeyFormat(tt.keyFormat)
+				if err != nil {
+					t.Fatalf("parseKeyFormat(%q) error = %v", tt.keyFormat, err)
+				}
+				pluginCtx.KeyFormat = keyFormat
+			}
+			got := pluginCtx.objectKey("app/server.log", 4, tt.sequenced, now, tt.first)
+			if got != tt.want {
+				t.Errorf("objectKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseKeys_RejectsUnsupportedPlaceholders(t *testing.T) {
+	tests := []struct {
+		name  string
+		parse func(string) (*keytemplate.Template, error)
+		text  string
+	}{
+		{"stream key stream", parseStreamKey, "$STREAM"},
+		{"stream key index", parseStreamKey, "$TAG.$INDEX"},
+		{"stream key upload time", parseStreamKey, "$UPLOAD_TIME[%Y]/$TAG"},
+		{"stream key event start", parseStreamKey, "$EVENT_START[%Y]/$TAG"},
+		{"key format event start", parseKeyFormat, "$EVENT_START[%Y]/$STREAM.clp.zst"},
+		{"key format event end", parseKeyFormat, "$STREAM.$EVENT_END.clp.zst"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.parse(tt.text); err == nil {
+				t.Errorf("parsing %q: error = nil, want error", tt.text)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/y-scope/fluent-bit-clp/internal/objstore"
+)
+
+// uploadFile uploads a local file to the plugin's object store.
+//
+// Parameters:
+//   - localPath: Path to the local file to upload
+//   - key: Object key
+//   - opts: Options of the object, e.g. its storage class
+//
+// The file is uploaded as a whole. To avoid re-uploading large files on every sync, see
+// [SyncModeSegments].
+func (ctx *PluginContext) uploadFile(localPath, key string, opts objstore.PutOptions) error {
+	err := objstore.PutFile(context.TODO(), ctx.Store, localPath, key, ctx.integrityOptions(opts))
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", localPath, err)
+	}
+	ctx.Log.Infof("Uploaded %s to %s", localPath, ctx.Store.URI(key))
+	return nil
+}
+
+// uploadFileRange uploads a byte range of a local file to the plugin's object store as its own
+// object.
+//
+// Parameters:
+//   - localPath: Path to the local file to upload from
+//   - offset: Offset of the first byte to upload
+//   - length: Number of bytes to upload
+//   - key: Object key
+//   - opts: Options of the object, e.g. its storage class
+func (ctx *PluginContext) uploadFileRange(
+	localPath string,
+	offset, length int64,
+	key string,
+	opts objstore.PutOptions,
+) error {
+	err := objstore.PutFileRange(
+		context.TODO(),
+		ctx.Store,
+		localPath,
+		offset,
+		length,
+		key,
+		ctx.integrityOptions(opts),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to upload bytes [%d, %d) of %s: %w",
+			offset, offset+length, localPath, err)
+	}
+	ctx.Log.Infof("Uploaded %d bytes of %s to %s", length, localPath, ctx.Store.URI(key))
+	return nil
+}
+
+// appendFileRange appends a byte range of a local file to an object in the plugin's object store.
+//
+// Parameters:
+//   - localPath: Path to the local file to append from
+//   - offset: Offset of the first byte to append, which is also the object's current size
+//   - length: Number of bytes to append
+//   - key: Object key
+//   - opts: Options of the object, applied when it is created
+//
+// Returns an error if the object store does not support appends (see [objstore.Appender]).
+func (ctx *PluginContext) appendFileRange(
+	localPath string,
+	offset, length int64,
+	key string,
+	opts objstore.PutOptions,
+) error {
+	appender, ok := ctx.Store.(objstore.Appender)
+	if !ok {
+		return fmt.Errorf("destination %s does not support appends", ctx.Store.URI(""))
+	}
+	err := objstore.AppendFileRange(
+		context.TODO(),
+		appender,
+		localPath,
+		offset,
+		length,
+		key,
+		ctx.integrityOptions(opts),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to append bytes [%d, %d) of %s: %w",
+			offset, offset+length, localPath, err)
+	}
+	ctx.Log.Infof("Appended %d bytes of %s to %s", length, localPath, ctx.Store.URI(key))
+	return nil
+}
+
+// putBytes uploads an in-memory payload to the plugin's object store.
+//
+// Parameters:
+//   - key: Object key
+//   - body: Object contents
+//   - contentType: MIME type of the object
+func (ctx *PluginContext) putBytes(key string, body []byte, contentType string) error {
+	return objstore.PutSeeker(
+		context.TODO(),
+		ctx.Store,
+		key,
+		bytes.NewReader(body),
+		int64(len(body)),
+		ctx.integrityOptions(objstore.PutOptions{ContentType: contentType}),
+	)
+}
+
+// integrityOptions adds the configured checksum and verification to the options of an object.
+// Uploads return once the store accepted the data against its checksum and, if verify_uploads is
+// set, the object is confirmed with a HeadObject request, so buffers are only discarded after.
+func (ctx *PluginContext) integrityOptions(opts objstore.PutOptions) objstore.PutOptions {
+	opts.Checksum = objstore.Checksum{Algorithm: ctx.ChecksumAlgorithm}
+	opts.Verify = ctx.VerifyUploads
+	return opts
+}
+
+// deleteObjects removes objects from the plugin's object store.
+func (ctx *PluginContext) deleteObjects(keys []string) error {
+	return ctx.Store.Delete(context.TODO(), keys)
+}
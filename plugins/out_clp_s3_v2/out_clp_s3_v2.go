@@ -30,8 +30,9 @@ import (
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
-	"log"
+	"maps"
 	"time"
 	"unsafe"
 
@@ -39,6 +40,8 @@ import (
 	"github.com/y-scope/clp-ffi-go/ffi"
 
 	"github.com/y-scope/fluent-bit-clp/internal/decoder"
+	"github.com/y-scope/fluent-bit-clp/internal/logging"
+	"github.com/y-scope/fluent-bit-clp/internal/metrics"
 	"github.com/y-scope/fluent-bit-clp/plugins/out_clp_s3_v2/internal"
 )
 
@@ -119,7 +122,8 @@ func FLBPluginRegister(def unsafe.Pointer) int {
 // This function:
 //  1. Creates the plugin context (S3 client, configuration)
 //  2. Validates S3 bucket access
-//  3. Associates the context with this plugin instance
+//  3. Uploads buffers left behind by a previous crash
+//  4. Associates the context with this plugin instance
 //
 // Configuration is read from the Fluent Bit configuration file.
 // Returns FLB_ERROR if initialization fails.
@@ -128,7 +132,7 @@ func FLBPluginRegister(def unsafe.Pointer) int {
 func FLBPluginInit(plugin unsafe.Pointer) int {
 	outCtx, err := internal.NewPluginContext(plugin)
 	if err != nil {
-		log.Printf("[error] Failed to initialize plugin: %s.", err)
+		logging.Default().Errorf("Failed to initialize plugin: %s.", err)
 		return output.FLB_ERROR
 	}
 
@@ -143,17 +147,20 @@ func FLBPluginInit(plugin unsafe.Pointer) int {
 // Fluent Bit buffers log records and periodically flushes them to output plugins.
 // Each call receives a batch of Msgpack-encoded records that this function:
 //  1. Decodes from Msgpack format
-//  2. Extracts timestamp, log level, and file path
+//  2. Extracts timestamp, log level, and file path, and resolves the record's stream
 //  3. Writes to the CLP IR compression pipeline
 //  4. Updates flush timers based on log severity
 //
+// Streams are resolved for the whole batch before any record is written (see [internal.Batch]).
+//
 // Parameters (provided by Fluent Bit):
 //   - ctx: Plugin context pointer (contains our PluginContext)
 //   - data: Pointer to Msgpack-encoded log records
 //   - length: Size of the data buffer in bytes
 //   - tag: Fluent Bit tag string for this batch
 //
-// Returns FLB_OK on success, FLB_ERROR on failure.
+// Returns the status of chunkStatus. Batches with malformed records are uploaded under
+// dead_letter_prefix (if configured) instead of vanishing.
 //
 //export FLBPluginFlushCtx
 func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int {
@@ -164,34 +171,98 @@ func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int
 
 	flushConfig := pluginCtx.FlushConfig
 	tagStr := C.GoString(tag)
+	logger := pluginCtx.Log.With("tag", tagStr)
 
 	// Create Msgpack decoder for this batch
 	dec := decoder.New(data, int(length))
 
-	// Process each record in the batch
+	// Decode every record of the batch and resolve its stream before anything is written
+	batch := internal.NewBatch(pluginCtx)
+	defer batch.Release()
+	var malformed int
 	for {
-		flbTimestamp, jsonRecord, err := decoder.GetRecord(dec)
+		flbTimestamp, metadata, jsonRecord, err := decoder.GetRecord(dec)
+		if errors.Is(err, io.EOF) {
+			break // End of batch
+		}
 		if err != nil {
-			if !errors.Is(err, io.EOF) {
-				log.Printf("[error] decoder.GetRecord error: %v", err)
-			}
-			break // End of batch or error
+			// The rest of the batch cannot be decoded
+			logger.Errorf("decoder.GetRecord error: %v", err)
+			malformed++
+			break
 		}
 
-		processRecord(pluginCtx, tagStr, flushConfig, flbTimestamp, jsonRecord)
+		err = addRecord(
+			pluginCtx,
+			batch,
+			logger,
+			tagStr,
+			flushConfig,
+			flbTimestamp,
+			metadata,
+			jsonRecord,
+		)
+		if errors.Is(err, errMalformedRecord) {
+			logger.Errorf("Dropping malformed record: %v", err)
+			malformed++
+			continue
+		}
+		if err != nil {
+			logger.Warnf("Retrying batch before any record was written: %v", err)
+			return chunkStatus(malformed, err)
+		}
 	}
 
-	return output.FLB_OK
+	now := time.Now()
+	written, err := batch.Write(now)
+	metrics.RecordsDecoded.Add(float64(written), tagStr)
+	metrics.DecodeFailures.Add(float64(malformed), tagStr)
+
+	status := chunkStatus(malformed, err)
+	switch {
+	case status == output.FLB_RETRY:
+		logger.Warnf("Retrying batch after %d records were written: %v", written, err)
+	case err != nil:
+		logger.Errorf("Dropping batch after %d records were written: %v", written, err)
+	}
+	if status == output.FLB_ERROR && malformed > 0 {
+		logger.Errorf("Batch has %d malformed records (%d written)", malformed, written)
+		chunk := C.GoBytes(data, length)
+		if err := internal.DeadLetter(pluginCtx, tagStr, chunk, now); err != nil {
+			logger.Errorf("Failed to store malformed batch: %v", err)
+		}
+	}
+	return status
+}
+
+// chunkStatus maps the outcome of a batch to the status returned to Fluent Bit.
+//
+// Returns:
+//   - FLB_RETRY if err is transient (e.g. disk full, buffer file creation), so the whole batch is
+//     retried
+//   - FLB_ERROR if err is any other failure to write, or the batch has malformed records
+//   - FLB_OK if every record was written
+func chunkStatus(malformed int, err error) int {
+	switch {
+	case err != nil && internal.IsTransient(err):
+		return output.FLB_RETRY
+	case err != nil, malformed > 0:
+		return output.FLB_ERROR
+	default:
+		return output.FLB_OK
+	}
 }
 
 // FLBPluginExitCtx is called during graceful shutdown.
 //
-// This function ensures all buffered logs are uploaded before the plugin exits:
-//  1. Stops all flush timers to prevent concurrent operations
-//  2. Triggers a final flush for each ingestion context
+// This function ensures all buffered logs are uploaded before the plugin exits, even if uploads
+// are paused through the admin API:
+//  1. Stops serving the admin API and all flush timers to prevent concurrent operations
+//  2. Finalizes each ingestion context (terminates the stream, uploads, removes buffers)
+//  3. Stops serving metrics
 //
-// Note: This is only called for graceful shutdown. Crash scenarios may lose
-// buffered data (logs are in temp files, not yet uploaded).
+// Note: This is only called for graceful shutdown. After a crash, buffer files and their
+// manifests remain in the buffer directory and are uploaded on the next startup.
 //
 //export FLBPluginExitCtx
 func FLBPluginExitCtx(ctx unsafe.Pointer) int {
@@ -200,28 +271,31 @@ func FLBPluginExitCtx(ctx unsafe.Pointer) int {
 		return output.FLB_ERROR
 	}
 
+	// Stop admin requests and evicting idle streams so they are finalized only once, below
+	pluginCtx.CloseAdmin()
+	pluginCtx.StopJanitor()
+
 	// Flush all ingestion contexts
-	for path, ingestionCtx := range pluginCtx.Ingestion {
-		flushCtx := ingestionCtx.Flush
-
-		// Stop timers to prevent concurrent flush during shutdown
-		flushCtx.Mutex.Lock()
-		if flushCtx.HardTimer != nil {
-			flushCtx.HardTimer.Stop()
-			flushCtx.HardTimer = nil
-		}
-		if flushCtx.SoftTimer != nil {
-			flushCtx.SoftTimer.Stop()
-			flushCtx.SoftTimer = nil
-		}
-		flushCtx.Mutex.Unlock()
+	for path, ingestionCtx := range pluginCtx.Ingestion.Snapshot() {
+		// Stop timers (including pending retries) to prevent concurrent flush during shutdown
+		ingestionCtx.Flush.Stop()
 
 		// Trigger final upload
-		log.Printf("[info] Graceful shutdown: flushing logs for %q", path)
-		flushCtx.Callback()
+		pluginCtx.Log.Infof("Graceful shutdown: flushing logs for %q (unsynced data: %v)",
+			path, ingestionCtx.Flush.Dirty())
+		if err := ingestionCtx.Finalize(pluginCtx); err != nil {
+			pluginCtx.Log.Errorf("Failed to finalize %q; it will be recovered on restart: %v",
+				path, err)
+		}
+	}
+
+	if pluginCtx.Metrics != nil {
+		if err := pluginCtx.Metrics.Close(); err != nil {
+			pluginCtx.Log.Warnf("%v", err)
+		}
 	}
 
-	log.Println("[info] Plugin shutdown complete.")
+	pluginCtx.Log.Infof("Plugin shutdown complete.")
 	return output.FLB_OK
 }
 
@@ -230,49 +304,58 @@ func getPluginContext(ctx unsafe.Pointer) (*internal.PluginContext, bool) {
 	p := output.FLBPluginGetContext(ctx)
 	pluginCtx, ok := p.(*internal.PluginContext)
 	if !ok {
-		log.Println("[error] Could not read context.")
+		logging.Default().Errorf("Could not read context.")
 	}
 	return pluginCtx, ok
 }
 
-// processRecord handles a single decoded log record.
+// errMalformedRecord marks records that cannot be ingested however often they are retried.
+var errMalformedRecord = errors.New("malformed record")
+
+// addRecord handles a single decoded log record.
 //
 // Processing steps:
 //  1. Parse timestamp from Fluent Bit format
 //  2. Unmarshal JSON record to extract fields
-//  3. Get or create ingestion context for this stream
-//  4. Build CLP log event with auto/user KV separation
-//  5. Write to IR compression pipeline
-//  6. Update flush timers based on log level
-func processRecord(
+//  3. Build CLP log event with auto/user KV separation
+//  4. Extract the log level, which selects the object's storage class and flush timers
+//  5. Queue the event in the batch with the record's tag and fields, which name the object if the
+//     event is its first, getting or creating the ingestion context for the record's stream (see
+//     StreamPath)
+//
+// Returns an error marked with errMalformedRecord if the record cannot be unmarshalled. Any other
+// error satisfies [internal.IsTransient] and may succeed on retry.
+func addRecord(
 	pluginCtx *internal.PluginContext,
+	batch *internal.Batch,
+	logger *logging.Logger,
 	tagStr string,
 	flushConfig *internal.FlushConfigContext,
 	flbTimestamp any,
+	metadata map[string]any,
 	jsonRecord []byte,
-) {
-	timestamp := parseTimestamp(flbTimestamp)
+) error {
+	timestamp := parseTimestamp(flbTimestamp, logger)
 
-	userKvPairs, ok := unmarshalRecord(jsonRecord)
-	if !ok {
-		return
+	userKvPairs, err := unmarshalRecord(jsonRecord)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errMalformedRecord, err)
 	}
 
-	ingestionCtx, err := internal.GetOrCreateIngestionContext(pluginCtx, tagStr)
-	if err != nil || ingestionCtx == nil {
-		log.Printf("[error] Failed to get or create ingestion context for tag %s: %v", tagStr, err)
-		return
+	// The stream path and log level are read before file_path is moved to the auto KV pairs. The
+	// fields are copied for s3_key_format and object_tags for the same reason.
+	streamPath := pluginCtx.StreamPath(tagStr, userKvPairs)
+	level := extractLogLevel(userKvPairs, flushConfig, logger)
+	var fields map[string]any
+	if pluginCtx.UsesRecordFields() {
+		fields = maps.Clone(userKvPairs)
 	}
+	event := buildLogEvent(timestamp, metadata, userKvPairs)
 
-	event := buildLogEvent(timestamp, userKvPairs)
-
-	if !writeLogEvent(ingestionCtx, event) {
-		return
+	if err := batch.Add(streamPath, tagStr, fields, event, timestamp, level); err != nil {
+		return fmt.Errorf("failed to get or create ingestion context: %w", err)
 	}
-
-	// Update flush timers based on log severity
-	level := extractLogLevel(userKvPairs, flushConfig)
-	ingestionCtx.Flush.Update(level, timestamp, flushConfig)
+	return nil
 }
 
 // parseTimestamp converts Fluent Bit's timestamp format to Go's time.Time.
@@ -282,42 +365,51 @@ func processRecord(
 //   - uint64: Unix timestamp in milliseconds
 //
 // Falls back to current time if format is unrecognized.
-func parseTimestamp(flbTimestamp any) time.Time {
+func parseTimestamp(flbTimestamp any, logger *logging.Logger) time.Time {
 	switch t := flbTimestamp.(type) {
 	case decoder.FlbTime:
 		return t.Time
 	case uint64:
 		return time.UnixMilli(int64(t))
 	default:
-		log.Printf("[warn] Invalid time type (%T), defaulting to now.", t)
+		logger.Warnf("Invalid time type (%T), defaulting to now.", t)
 		return time.Now()
 	}
 }
 
 // unmarshalRecord decodes JSON record bytes into a map.
-func unmarshalRecord(jsonRecord []byte) (map[string]any, bool) {
+func unmarshalRecord(jsonRecord []byte) (map[string]any, error) {
 	var userKvPairs map[string]any
 	if err := json.Unmarshal(jsonRecord, &userKvPairs); err != nil {
-		log.Printf("[error] Failed to unmarshal JSON record %q: %v", string(jsonRecord), err)
-		return nil, false
+		return nil, fmt.Errorf("failed to unmarshal JSON record %q: %w", string(jsonRecord), err)
 	}
-	return userKvPairs, true
+	return userKvPairs, nil
 }
 
 // buildLogEvent creates a CLP log event from the parsed record.
 //
 // CLP IR format distinguishes between:
-//   - Auto KV pairs: System-generated metadata (timestamp, file_path)
+//   - Auto KV pairs: System-generated metadata (timestamp, file_path, metadata)
 //   - User KV pairs: Application-provided log fields
 //
 // The file_path field is extracted from user data and moved to auto KV
-// since it's typically used for log routing/organization.
-func buildLogEvent(timestamp time.Time, userKvPairs map[string]any) *ffi.LogEvent {
+// since it's typically used for log routing/organization. Fluent Bit event metadata (e.g.
+// OpenTelemetry attributes) is kept under the metadata auto KV pair when present.
+func buildLogEvent(
+	timestamp time.Time,
+	metadata map[string]any,
+	userKvPairs map[string]any,
+) *ffi.LogEvent {
 	event := ffi.NewLogEvent()
 
 	// Add timestamp as auto-generated metadata
 	event.AutoKvPairs["timestamp"] = timestamp.UnixMilli()
 
+	// Add Fluent Bit event metadata, which lives outside the record body
+	if metadata != nil {
+		event.AutoKvPairs[decoder.MetadataKey] = metadata
+	}
+
 	// Extract and move file_path to auto KV pairs
 	filePath, exists := userKvPairs[filePathKey]
 	if exists {
@@ -332,15 +424,6 @@ func buildLogEvent(timestamp time.Time, userKvPairs map[string]any) *ffi.LogEven
 	return event
 }
 
-// writeLogEvent writes a log event to the compression pipeline.
-func writeLogEvent(ingestionCtx *internal.IngestionContext, event *ffi.LogEvent) bool {
-	if _, err := ingestionCtx.Compression.IRWriter.WriteLogEvent(*event); err != nil {
-		log.Printf("[error] Failed to write log event: %v", err)
-		return false
-	}
-	return true
-}
-
 // extractLogLevel extracts the log severity level from record fields.
 //
 // Looks for the configured log level key (default: "level") and maps
@@ -350,7 +433,11 @@ func writeLogEvent(ingestionCtx *internal.IngestionContext, event *ffi.LogEvent)
 //   - Log level key is not found
 //   - Log level value is not a string
 //   - Log level string is not in logLevelMap
-func extractLogLevel(userKvPairs map[string]any, flushConfig *internal.FlushConfigContext) int {
+func extractLogLevel(
+	userKvPairs map[string]any,
+	flushConfig *internal.FlushConfigContext,
+	logger *logging.Logger,
+) int {
 	level := LogLevelInfo // Default to info
 
 	lvl, found := userKvPairs[flushConfig.LogLevelKey]
@@ -361,13 +448,13 @@ func extractLogLevel(userKvPairs map[string]any, flushConfig *internal.FlushConf
 
 	lvlStr, ok := lvl.(string)
 	if !ok {
-		log.Printf("[warn] LogLevel is not a string (got %T), defaulting to info.", lvl)
+		logger.Warnf("LogLevel is not a string (got %T), defaulting to info.", lvl)
 		return level
 	}
 
 	mapped, ok := logLevelMap[lvlStr]
 	if !ok {
-		log.Printf("[warn] Unknown log level %q, defaulting to info.", lvlStr)
+		logger.Warnf("Unknown log level %q, defaulting to info.", lvlStr)
 		return level
 	}
 
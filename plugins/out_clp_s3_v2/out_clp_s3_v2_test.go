@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"github.com/fluent/fluent-bit-go/output"
+
+	"github.com/y-scope/fluent-bit-clp/plugins/out_clp_s3_v2/internal"
+)
+
+func TestChunkStatus(t *testing.T) {
+	tests := []struct {
+		name      string
+		malformed int
+		err       error
+		want      int
+	}{
+		{"all written", 0, nil, output.FLB_OK},
+		{"malformed records", 2, nil, output.FLB_ERROR},
+		{
+			"stream creation failed",
+			0,
+			fmt.Errorf("%w: no buffer", internal.ErrTransient),
+			output.FLB_RETRY,
+		},
+		{
+			"disk full",
+			0,
+			fmt.Errorf("failed to write log event: %w", syscall.ENOSPC),
+			output.FLB_RETRY,
+		},
+		{"transient with malformed records", 1, syscall.EDQUOT, output.FLB_RETRY},
+		{"write failed", 0, errors.New("input/output error"), output.FLB_ERROR},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := chunkStatus(tt.malformed, tt.err); got != tt.want {
+				t.Errorf("chunkStatus(%d, %v) = %d, want %d", tt.malformed, tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddRecord_Malformed(t *testing.T) {
+	err := addRecord(nil, nil, nil, "app", nil, uint64(0), nil, []byte("{"))
+	if !errors.Is(err, errMalformedRecord) {
+		t.Errorf("addRecord() error = %v, want %v", err, errMalformedRecord)
+	}
+}